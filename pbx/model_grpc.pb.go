@@ -148,6 +148,10 @@ type PluginClient interface {
 	// and forward it to the client session.
 	// ServerCtrl.code equals to 0 instructs the server to continue with default processing of the client message.
 	FireHose(ctx context.Context, in *ClientReq, opts ...grpc.CallOption) (*ServerResp, error)
+	// This plugin method is called by Tinode server for {data}, {pres} and {info} messages broadcast by a topic,
+	// once per message before it's delivered to subscribers. The returned ServerResp.status instructs the server to deliver
+	// the message unchanged (CONTINUE), not deliver it (DROP), or deliver ServerResp.srvmsg instead (REPLACE).
+	FireHoseOut(ctx context.Context, in *ServerReq, opts ...grpc.CallOption) (*ServerResp, error)
 	// An alteranative user and topic discovery mechanism.
 	// A search request issued on a 'fnd' topic. This method is called to generate an alternative result set.
 	Find(ctx context.Context, in *SearchQuery, opts ...grpc.CallOption) (*SearchFound, error)
@@ -178,6 +182,15 @@ func (c *pluginClient) FireHose(ctx context.Context, in *ClientReq, opts ...grpc
 	return out, nil
 }
 
+func (c *pluginClient) FireHoseOut(ctx context.Context, in *ServerReq, opts ...grpc.CallOption) (*ServerResp, error) {
+	out := new(ServerResp)
+	err := c.cc.Invoke(ctx, "/pbx.Plugin/FireHoseOut", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *pluginClient) Find(ctx context.Context, in *SearchQuery, opts ...grpc.CallOption) (*SearchFound, error) {
 	out := new(SearchFound)
 	err := c.cc.Invoke(ctx, "/pbx.Plugin/Find", in, out, opts...)
@@ -233,6 +246,10 @@ type PluginServer interface {
 	// and forward it to the client session.
 	// ServerCtrl.code equals to 0 instructs the server to continue with default processing of the client message.
 	FireHose(context.Context, *ClientReq) (*ServerResp, error)
+	// This plugin method is called by Tinode server for {data}, {pres} and {info} messages broadcast by a topic,
+	// once per message before it's delivered to subscribers. The returned ServerResp.status instructs the server to deliver
+	// the message unchanged (CONTINUE), not deliver it (DROP), or deliver ServerResp.srvmsg instead (REPLACE).
+	FireHoseOut(context.Context, *ServerReq) (*ServerResp, error)
 	// An alteranative user and topic discovery mechanism.
 	// A search request issued on a 'fnd' topic. This method is called to generate an alternative result set.
 	Find(context.Context, *SearchQuery) (*SearchFound, error)
@@ -254,6 +271,9 @@ type UnimplementedPluginServer struct {
 func (UnimplementedPluginServer) FireHose(context.Context, *ClientReq) (*ServerResp, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method FireHose not implemented")
 }
+func (UnimplementedPluginServer) FireHoseOut(context.Context, *ServerReq) (*ServerResp, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FireHoseOut not implemented")
+}
 func (UnimplementedPluginServer) Find(context.Context, *SearchQuery) (*SearchFound, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Find not implemented")
 }
@@ -300,6 +320,24 @@ func _Plugin_FireHose_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Plugin_FireHoseOut_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServerReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PluginServer).FireHoseOut(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pbx.Plugin/FireHoseOut",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PluginServer).FireHoseOut(ctx, req.(*ServerReq))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Plugin_Find_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(SearchQuery)
 	if err := dec(in); err != nil {
@@ -401,6 +439,10 @@ var Plugin_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "FireHose",
 			Handler:    _Plugin_FireHose_Handler,
 		},
+		{
+			MethodName: "FireHoseOut",
+			Handler:    _Plugin_FireHoseOut_Handler,
+		},
 		{
 			MethodName: "Find",
 			Handler:    _Plugin_Find_Handler,
@@ -425,3 +467,135 @@ var Plugin_ServiceDesc = grpc.ServiceDesc{
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "model.proto",
 }
+
+// FederationClient is the client API for Federation service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FederationClient interface {
+	// Deliver {data}, {info} or {pres} from a user of the calling server to a user of this server.
+	// The 'topic' is the ID of the recipient at this server, 'from_user_id' or 'src' is the ID of the sender
+	// at the calling server. The response is a {ctrl} message.
+	Relay(ctx context.Context, in *ServerMsg, opts ...grpc.CallOption) (*ServerMsg, error)
+	// Fetch description of a user of this server. ClientMsg.get.topic is the ID of the user.
+	// The response is a {meta} message with the public part of the description.
+	GetUser(ctx context.Context, in *ClientMsg, opts ...grpc.CallOption) (*ServerMsg, error)
+}
+
+type federationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFederationClient(cc grpc.ClientConnInterface) FederationClient {
+	return &federationClient{cc}
+}
+
+func (c *federationClient) Relay(ctx context.Context, in *ServerMsg, opts ...grpc.CallOption) (*ServerMsg, error) {
+	out := new(ServerMsg)
+	err := c.cc.Invoke(ctx, "/pbx.Federation/Relay", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *federationClient) GetUser(ctx context.Context, in *ClientMsg, opts ...grpc.CallOption) (*ServerMsg, error) {
+	out := new(ServerMsg)
+	err := c.cc.Invoke(ctx, "/pbx.Federation/GetUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FederationServer is the server API for Federation service.
+// All implementations must embed UnimplementedFederationServer
+// for forward compatibility
+type FederationServer interface {
+	// Deliver {data}, {info} or {pres} from a user of the calling server to a user of this server.
+	// The 'topic' is the ID of the recipient at this server, 'from_user_id' or 'src' is the ID of the sender
+	// at the calling server. The response is a {ctrl} message.
+	Relay(context.Context, *ServerMsg) (*ServerMsg, error)
+	// Fetch description of a user of this server. ClientMsg.get.topic is the ID of the user.
+	// The response is a {meta} message with the public part of the description.
+	GetUser(context.Context, *ClientMsg) (*ServerMsg, error)
+	mustEmbedUnimplementedFederationServer()
+}
+
+// UnimplementedFederationServer must be embedded to have forward compatible implementations.
+type UnimplementedFederationServer struct {
+}
+
+func (UnimplementedFederationServer) Relay(context.Context, *ServerMsg) (*ServerMsg, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Relay not implemented")
+}
+func (UnimplementedFederationServer) GetUser(context.Context, *ClientMsg) (*ServerMsg, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedFederationServer) mustEmbedUnimplementedFederationServer() {}
+
+// UnsafeFederationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FederationServer will
+// result in compilation errors.
+type UnsafeFederationServer interface {
+	mustEmbedUnimplementedFederationServer()
+}
+
+func RegisterFederationServer(s grpc.ServiceRegistrar, srv FederationServer) {
+	s.RegisterService(&Federation_ServiceDesc, srv)
+}
+
+func _Federation_Relay_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ServerMsg)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FederationServer).Relay(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pbx.Federation/Relay",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FederationServer).Relay(ctx, req.(*ServerMsg))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Federation_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClientMsg)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FederationServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pbx.Federation/GetUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FederationServer).GetUser(ctx, req.(*ClientMsg))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Federation_ServiceDesc is the grpc.ServiceDesc for Federation service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Federation_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pbx.Federation",
+	HandlerType: (*FederationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Relay",
+			Handler:    _Federation_Relay_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _Federation_GetUser_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "model.proto",
+}
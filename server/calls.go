@@ -360,7 +360,7 @@ func (t *Topic) handleCallEvent(msg *ClientComMessage) {
 			originatorUid, originator := t.getCallOriginator()
 			// Hangup may come from either the originating session or
 			// any callee user session.
-			if asUid == originatorUid && originator.sid != msg.sess.sid {
+			if asUid == originatorUid && (originator == nil || originator.sid != msg.sess.sid) {
 				return
 			}
 		default:
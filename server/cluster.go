@@ -4,7 +4,6 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"errors"
-	"net"
 	"net/rpc"
 	"sort"
 	"sync"
@@ -44,7 +43,8 @@ const (
 	ProxyReqBroadcast              // {pub}, {note}
 	ProxyReqBgSession
 	ProxyReqMeUserAgent
-	ProxyReqCall // Used in video call proxy sessions for routing call events.
+	ProxyReqCall    // Used in video call proxy sessions for routing call events.
+	ProxyReqMigrate // {sub} of a session moved to the new topic master after rehashing.
 )
 
 type clusterNodeConfig struct {
@@ -57,6 +57,19 @@ type clusterConfig struct {
 	Nodes []clusterNodeConfig `json:"nodes"`
 	// Name of this cluster node
 	ThisName string `json:"self"`
+	// TCP address of this node if the node is not listed in Nodes and joins the cluster at runtime.
+	Addr string `json:"addr"`
+	// Discovery of cluster members for joining the cluster at runtime. Dynamic membership
+	// is disabled if discovery is not configured.
+	Discovery *clusterDiscoveryConfig `json:"discovery"`
+	// TLS for connections between nodes.
+	TLS *clusterTLSConfig `json:"tls"`
+	// Shared secret for authenticating connections between nodes.
+	Secret string `json:"secret"`
+	// Move topics to their new nodes without disconnecting subscribers when the cluster is rehashed.
+	TopicHandoff bool `json:"topic_handoff"`
+	// Delivery of calls between nodes. Full mesh of RPC connections if not configured.
+	Transport *clusterTransportConfig `json:"transport"`
 	// Deprecated: this field is no longer used.
 	NumProxyEventGoRoutines int `json:"-"`
 	// Failover configuration
@@ -68,13 +81,17 @@ type ClusterNode struct {
 	lock sync.Mutex
 
 	// RPC endpoint
-	endpoint *rpc.Client
+	endpoint clusterEndpoint
 	// True if the endpoint is believed to be connected
 	connected bool
 	// True if a go routine is trying to reconnect the node
 	reconnecting bool
 	// TCP address in the form host:port
 	address string
+	// Delivery of calls to the node.
+	transport clusterTransport
+	// Cluster which the node is a member of.
+	cluster *Cluster
 	// Name of the node
 	name string
 	// Fingerprint of the node: unique value which changes when the node restarts.
@@ -82,6 +99,8 @@ type ClusterNode struct {
 
 	// A number of times this node has failed in a row
 	failCount int
+	// The node is draining before shutdown and must not host topics.
+	draining bool
 
 	// Channel for shutting down the runner; buffered, 1.
 	done chan bool
@@ -99,6 +118,10 @@ type ClusterNode struct {
 
 func (n *ClusterNode) asyncRpcLoop() {
 	for call := range n.rpcDone {
+		if call == nil {
+			// Stop
+			return
+		}
 		n.handleRpcResponse(call)
 	}
 }
@@ -112,6 +135,10 @@ func (n *ClusterNode) p2mSenderLoop() {
 
 		if err := n.proxyToMaster(req); err != nil {
 			logs.Warn.Println("p2mSenderLoop: call failed", n.name, err)
+			if req.ReqType == ProxyReqMigrate {
+				// The new master may not know yet that it owns the topic.
+				globals.cluster.retryMigration(req)
+			}
 		}
 	}
 }
@@ -190,6 +217,9 @@ type ClusterReq struct {
 	Sess *ClusterSess
 	// True when the topic proxy is gone.
 	Gone bool
+
+	// Number of times the request was resent to the master; not sent over the wire.
+	attempts int
 }
 
 // ClusterRoute is intra-cluster routing request message.
@@ -255,13 +285,17 @@ func (n *ClusterNode) reconnect() {
 
 	count := 0
 	for {
-		// Attempt to reconnect right away
-		if conn, err := net.DialTimeout("tcp", n.address, clusterNetworkTimeout); err == nil {
+		// Attempt to reconnect right away. The address may change when the node rejoins the cluster.
+		n.lock.Lock()
+		address := n.address
+		n.lock.Unlock()
+		endpoint, err := n.transport.dial(n.name, address)
+		if err == nil {
 			if reconnTicker != nil {
 				reconnTicker.Stop()
 			}
 			n.lock.Lock()
-			n.endpoint = rpc.NewClient(conn)
+			n.endpoint = endpoint
 			n.connected = true
 			n.reconnecting = false
 			n.lock.Unlock()
@@ -271,12 +305,13 @@ func (n *ClusterNode) reconnect() {
 			var unused bool
 			n.call("Cluster.Ping",
 				&ClusterPing{
-					Node:        globals.cluster.thisNodeName,
-					Fingerprint: globals.cluster.fingerprint,
+					Node:        n.cluster.thisNodeName,
+					Fingerprint: n.cluster.fingerprint,
 				},
 				&unused)
 			return
 		} else if count == 0 {
+			logs.Warn.Println("cluster: failed to connect to", n.name, err)
 			reconnTicker = time.NewTicker(clusterDefaultReconnectTime)
 		}
 
@@ -302,12 +337,23 @@ func (n *ClusterNode) reconnect() {
 	}
 }
 
-func (n *ClusterNode) call(proc string, req, resp any) error {
+// connectedEndpoint returns the endpoint of the node or nil if the node is not connected.
+func (n *ClusterNode) connectedEndpoint() clusterEndpoint {
+	n.lock.Lock()
+	defer n.lock.Unlock()
 	if !n.connected {
+		return nil
+	}
+	return n.endpoint
+}
+
+func (n *ClusterNode) call(proc string, req, resp any) error {
+	endpoint := n.connectedEndpoint()
+	if endpoint == nil {
 		return errors.New("cluster: node '" + n.name + "' not connected")
 	}
 
-	if err := n.endpoint.Call(proc, req, resp); err != nil {
+	if err := endpoint.Call(proc, req, resp); err != nil {
 		logs.Warn.Println("cluster: call failed", n.name, err)
 
 		n.lock.Lock()
@@ -343,7 +389,8 @@ func (n *ClusterNode) callAsync(proc string, req, resp any, done chan *rpc.Call)
 		logs.Err.Panic("cluster: RPC done channel is unbuffered")
 	}
 
-	if !n.connected {
+	endpoint := n.connectedEndpoint()
+	if endpoint == nil {
 		call := &rpc.Call{
 			ServiceMethod: proc,
 			Args:          req,
@@ -373,7 +420,7 @@ func (n *ClusterNode) callAsync(proc string, req, resp any, done chan *rpc.Call)
 		responseChan = n.rpcDone
 	}
 
-	call := n.endpoint.Go(proc, req, resp, responseChan)
+	call := endpoint.Go(proc, req, resp, responseChan)
 
 	return call
 }
@@ -419,6 +466,20 @@ func (n *ClusterNode) route(msg *ClusterRoute) error {
 type Cluster struct {
 	// Cluster nodes with RPC endpoints (excluding current node).
 	nodes map[string]*ClusterNode
+	// Guards nodes and members: nodes can join and leave at runtime.
+	nodesLock sync.RWMutex
+	// All members of the cluster including the current node.
+	members map[string]ClusterMember
+	// Version of the membership list, incremented by the leader on every change.
+	membersVersion int64
+	// Election term of the leader which produced the membership list. Lists are ordered by (term, version).
+	membersTerm int
+	// Names of nodes listed in the config. These nodes are permanent members of the cluster.
+	staticNodes map[string]bool
+	// Dynamic membership parameters. Could be nil if dynamic membership is not enabled.
+	discovery *clusterDiscovery
+	// Snowflake worker ID of the local node.
+	workerId int
 	// Name of the local node
 	thisNodeName string
 	// Fingerprint of the local node
@@ -426,11 +487,24 @@ type Cluster struct {
 
 	// Resolved address to listed on
 	listenOn string
-
-	// Socket for inbound connections
-	inbound *net.TCPListener
-	// Ring hash for mapping topic names to nodes
-	ring *rh.Ring
+	// Authentication of connections between nodes; nil if not configured.
+	security *clusterSecurity
+	// Delivery of calls between nodes.
+	transport clusterTransport
+
+	// Topics are handed off to new master nodes on rehashing instead of being shut down.
+	topicHandoff bool
+	// State of topics received from their previous master nodes before the topics were loaded.
+	handoffLock sync.Mutex
+	handoffs    map[string]*ClusterTopicState
+	// Ring hash before the most recent rehashing and the time of rehashing; guarded by handoffLock.
+	prevRing   *rh.Ring
+	rehashedAt time.Time
+
+	// Ring hash for mapping topic names to nodes. It's replaced on rehashing by the failover
+	// runner while other goroutines use it; read it with hashRing().
+	ringLock sync.RWMutex
+	ring     *rh.Ring
 
 	// Failover parameters. Could be nil if failover is not enabled
 	fo *clusterFailover
@@ -457,7 +531,7 @@ func (n *ClusterNode) stopMultiplexingSession(msess *Session) {
 func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 	*rejected = false
 
-	node := c.nodes[msg.Node]
+	node := c.node(msg.Node)
 	if node == nil {
 		logs.Warn.Println("cluster TopicMaster: request from an unknown node", msg.Node)
 		return nil
@@ -492,12 +566,20 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 		return nil
 	}
 
-	if msg.Signature != c.ring.Signature() {
+	if msg.Signature != c.hashRing().Signature() {
 		logs.Warn.Println("cluster TopicMaster: session signature mismatch", msg.RcptTo)
 		*rejected = true
 		return nil
 	}
 
+	if msg.ReqType == ProxyReqMigrate {
+		if t := globals.hub.topicGet(msg.RcptTo); t != nil && t.isProxy {
+			// The topic has not moved to this node yet. The proxy will retry.
+			*rejected = true
+			return nil
+		}
+	}
+
 	// Create a new multiplexing session if needed.
 	if msess == nil {
 		// If the session is not found, create it.
@@ -535,10 +617,11 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 	if msg.CliMsg != nil {
 		msg.CliMsg.sess = sess
 		msg.CliMsg.init = true
+		msg.CliMsg.migrating = msg.ReqType == ProxyReqMigrate
 	}
 
 	switch msg.ReqType {
-	case ProxyReqJoin:
+	case ProxyReqJoin, ProxyReqMigrate:
 		select {
 		case globals.hub.join <- msg.CliMsg:
 		default:
@@ -601,7 +684,7 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 }
 
 // TopicProxy is a gRPC endpoint at topic proxy which receives topic master responses.
-func (Cluster) TopicProxy(msg *ClusterResp, unused *bool) error {
+func (*Cluster) TopicProxy(msg *ClusterResp, unused *bool) error {
 	// This cluster member received a response from the topic master to be forwarded to the topic.
 	// Find appropriate topic, send the message to it.
 	if t := globals.hub.topicGet(msg.RcptTo); t != nil {
@@ -627,7 +710,7 @@ func (c *Cluster) Route(msg *ClusterRoute, rejected *bool) error {
 	}
 
 	*rejected = false
-	if msg.Signature != c.ring.Signature() {
+	if msg.Signature != c.hashRing().Signature() {
 		logError("cluster Route: session signature mismatch")
 		return nil
 	}
@@ -661,24 +744,36 @@ func (c *Cluster) UserCacheUpdate(msg *UserCacheReq, rejected *bool) error {
 		}
 	}
 
-	usersRequestFromCluster(msg)
+	if msg.PushRcpt != nil {
+		// Global notification preferences are applied by the node which owns the users.
+		// RPC calls are served in separate goroutines: wait for preferences which are not cached.
+		applyUserNotifyPrefs(msg.PushRcpt, true)
+	}
+
+	if !usersRequestFromCluster(msg) {
+		// The sender keeps unread count increments and resends them when rejected.
+		logs.Warn.Println("cluster: users cache queue is full, request rejected from", msg.Node)
+		*rejected = true
+	}
 	return nil
 }
 
 // Ping is a gRPC endpoint which receives ping requests from peer nodes.Used to detect node restarts.
 func (c *Cluster) Ping(ping *ClusterPing, unused *bool) error {
-	node := c.nodes[ping.Node]
+	node := c.node(ping.Node)
 	if node == nil {
 		logs.Warn.Println("cluster Ping from unknown node", ping.Node)
 		return nil
 	}
 
-	if node.fingerprint == 0 {
-		// This is the first connection to remote node.
-		node.fingerprint = ping.Fingerprint
-	} else if node.fingerprint != ping.Fingerprint {
+	// Pings from the node could be served concurrently.
+	node.lock.Lock()
+	prev := node.fingerprint
+	node.fingerprint = ping.Fingerprint
+	node.lock.Unlock()
+
+	if prev != 0 && prev != ping.Fingerprint {
 		// Remote node restarted.
-		node.fingerprint = ping.Fingerprint
 		c.invalidateProxySubs(ping.Node)
 		c.gcProxySessionsForNode(ping.Node)
 	}
@@ -729,18 +824,21 @@ func (c *Cluster) routeUserReq(req *UserCacheReq) error {
 	} else if req.Gone {
 		// Message that the user is deleted is sent to all nodes.
 		r := &UserCacheReq{Node: c.thisNodeName, UserIdList: req.UserIdList, Gone: true}
-		for _, n := range c.nodes {
+		for _, n := range c.nodeList() {
 			reqByNode[n.name] = r
 		}
 	}
 
 	if len(reqByNode) > 0 {
 		for nodeName, r := range reqByNode {
-			n := c.nodes[nodeName]
+			n := c.node(nodeName)
+			if n == nil {
+				return errors.New("attempt to update user at a departed node")
+			}
 			var rejected bool
 			err := n.call("Cluster.UserCacheUpdate", r, &rejected)
 			if rejected {
-				err = errors.New("master node out of sync")
+				err = errors.New("cluster: user cache update rejected by node '" + nodeName + "'")
 			}
 			if err != nil {
 				return err
@@ -758,21 +856,21 @@ func (c *Cluster) routeUserReq(req *UserCacheReq) error {
 	var rejected bool
 	err := n.call("Cluster.UserCacheUpdate", req, &rejected)
 	if rejected {
-		err = errors.New("master node out of sync")
+		err = errors.New("cluster: user cache update rejected by node '" + n.name + "'")
 	}
 	return err
 }
 
 // Given topic name, find appropriate cluster node to route message to.
 func (c *Cluster) nodeForTopic(topic string) *ClusterNode {
-	key := c.ring.Get(topic)
+	key := c.hashRing().Get(topic)
 	if key == c.thisNodeName {
 		logs.Err.Println("cluster: request to route to self")
 		// Do not route to self
 		return nil
 	}
 
-	node := c.nodes[key]
+	node := c.node(key)
 	if node == nil {
 		logs.Warn.Println("cluster: no node for topic", topic, key)
 	}
@@ -785,7 +883,7 @@ func (c *Cluster) isRemoteTopic(topic string) bool {
 		// Cluster not initialized, all topics are local
 		return false
 	}
-	return c.ring.Get(topic) != c.thisNodeName
+	return c.hashRing().Get(topic) != c.thisNodeName
 }
 
 // genLocalTopicName is just like genTopicName(), but the generated name belongs to the current cluster node.
@@ -796,8 +894,13 @@ func (c *Cluster) genLocalTopicName() string {
 		return topic
 	}
 
+	if !c.hashRing().Has(c.thisNodeName) {
+		// The node is draining: the topic will be hosted elsewhere.
+		return topic
+	}
+
 	// TODO: if cluster is large it may become too inefficient.
-	for c.ring.Get(topic) != c.thisNodeName {
+	for c.hashRing().Get(topic) != c.thisNodeName {
 		topic = genTopicName()
 	}
 	return topic
@@ -811,8 +914,13 @@ func (c *Cluster) isPartitioned() bool {
 		return false
 	}
 
+	if atomic.LoadInt32(&c.fo.partitioned) != 0 {
+		// This node cannot reach the majority of the cluster.
+		return true
+	}
+
 	c.fo.activeNodesLock.RLock()
-	result := (len(c.nodes)+1)/2 >= len(c.fo.activeNodes)
+	result := (c.nodeCount()+1)/2 >= len(c.fo.activeNodes)
 	c.fo.activeNodesLock.RUnlock()
 
 	return result
@@ -821,7 +929,7 @@ func (c *Cluster) isPartitioned() bool {
 func (c *Cluster) makeClusterReq(reqType ProxyReqType, msg *ClientComMessage, topic string, sess *Session) *ClusterReq {
 	req := &ClusterReq{
 		Node:        c.thisNodeName,
-		Signature:   c.ring.Signature(),
+		Signature:   c.hashRing().Signature(),
 		Fingerprint: c.fingerprint,
 		ReqType:     reqType,
 		RcptTo:      topic,
@@ -895,7 +1003,7 @@ func (c *Cluster) routeToTopicIntraCluster(topic string, msg *ServerComMessage,
 
 	route := &ClusterRoute{
 		Node:        c.thisNodeName,
-		Signature:   c.ring.Signature(),
+		Signature:   c.hashRing().Signature(),
 		Fingerprint: c.fingerprint,
 		SrvMsg:      msg,
 	}
@@ -939,6 +1047,10 @@ func clusterInit(configString json.RawMessage, self *string) int {
 	statsRegisterInt("TotalClusterNodes")
 	// Number of nodes currently believed to be up.
 	statsRegisterInt("LiveClusterNodes")
+	// 1 if this node is in a minority partition and rejects requests, 0 otherwise
+	statsRegisterInt("ClusterPartitioned")
+	// Current leader election term
+	statsRegisterInt("ClusterTerm")
 
 	// This is a standalone server, not initializing
 	if len(configString) == 0 {
@@ -972,46 +1084,164 @@ func clusterInit(configString json.RawMessage, self *string) int {
 		logs.Warn.Println("Cluster config: field num_proxy_event_goroutines is deprecated.")
 	}
 
-	globals.cluster = &Cluster{
+	c := &Cluster{
 		thisNodeName:    thisName,
 		fingerprint:     time.Now().Unix(),
 		nodes:           make(map[string]*ClusterNode),
+		members:         make(map[string]ClusterMember),
+		staticNodes:     make(map[string]bool),
+		topicHandoff:    config.TopicHandoff,
+		handoffs:        make(map[string]*ClusterTopicState),
 		proxyEventQueue: concurrency.NewGoRoutinePool(len(config.Nodes) * 5),
 	}
 
+	busTransport := config.Transport != nil && config.Transport.Type == clusterTransportRedis
+	if busTransport {
+		// Address of a node on the bus is its name.
+		for i := range config.Nodes {
+			config.Nodes[i].Addr = config.Nodes[i].Name
+		}
+		config.Addr = thisName
+		if config.Discovery == nil && config.Failover != nil && config.Failover.Enabled {
+			// Nodes are discovered by their heartbeats on the bus.
+			config.Discovery = &clusterDiscoveryConfig{Type: "bus"}
+		}
+	}
+
 	var nodeNames []string
 	for _, host := range config.Nodes {
 		nodeNames = append(nodeNames, host.Name)
+		c.staticNodes[host.Name] = true
+	}
+	// Worker IDs of static nodes are determined by the order of node names.
+	sort.Strings(nodeNames)
+	for _, host := range config.Nodes {
+		c.members[host.Name] = ClusterMember{
+			Name:     host.Name,
+			Addr:     host.Addr,
+			WorkerId: sort.SearchStrings(nodeNames, host.Name) + 1,
+		}
+	}
+
+	var err error
+	if c.security, err = newClusterSecurity(config.TLS, config.Secret); err != nil {
+		logs.Err.Fatal("Cluster: ", err)
+	}
+
+	var bus *clusterBus
+	switch {
+	case busTransport:
+		if config.TLS != nil && config.TLS.Enabled {
+			logs.Warn.Println("Cluster: TLS certificates are not used with Redis transport, enable Redis TLS instead")
+		}
+		if bus, err = newClusterBus(config.Transport.Redis, thisName, c.security); err != nil {
+			logs.Err.Fatal("Cluster: failed to connect to Redis: ", err)
+		}
+		c.transport = bus
+	case config.Transport == nil || config.Transport.Type == "" || config.Transport.Type == clusterTransportRPC:
+		// The address to listen on is known later.
+		c.transport = &clusterRPC{security: c.security}
+	default:
+		logs.Err.Fatal("Cluster: unknown transport '" + config.Transport.Type + "'")
+	}
+
+	if config.Discovery != nil {
+		if config.Failover == nil || !config.Failover.Enabled {
+			logs.Err.Fatal("Cluster: dynamic membership requires failover to be enabled")
+		}
+		if (config.Discovery.Type == "bus") != busTransport {
+			logs.Err.Fatal("Cluster: discovery 'bus' must be used with Redis transport")
+		}
+		if c.discovery, err = newClusterDiscovery(config.Discovery, config.Nodes); err != nil {
+			logs.Err.Fatal("Cluster: ", err)
+		}
+		if bus != nil {
+			c.discovery.peers = bus.alivePeers
+		}
+	}
 
-		if host.Name == thisName {
-			globals.cluster.listenOn = host.Addr
-			// Don't create a cluster member for this local instance
-			continue
+	if self, ok := c.members[thisName]; ok {
+		c.listenOn = self.Addr
+		c.workerId = self.WorkerId
+	} else if c.discovery != nil {
+		// This node is not in the config: get the list of members and the worker ID from the leader.
+		if config.Addr == "" {
+			logs.Err.Fatal("Cluster: address of node '" + thisName + "' is not specified")
+		}
+		c.listenOn = config.Addr
+		resp, err := c.join(clusterJoinTimeout)
+		if err != nil {
+			logs.Err.Fatal("Cluster: failed to join: ", err)
 		}
+		c.setMembers(resp.Members, resp.Term, resp.Version)
+		logs.Info.Printf("Cluster: node '%s' joined the cluster as worker %d", thisName, c.workerId)
+	} else {
+		logs.Err.Fatal("Cluster: node '" + thisName + "' is not listed in the config")
+	}
+
+	if rpcTransport, ok := c.transport.(*clusterRPC); ok {
+		rpcTransport.listenOn = c.listenOn
+	}
 
-		globals.cluster.nodes[host.Name] = &ClusterNode{
-			address: host.Addr,
-			name:    host.Name,
-			done:    make(chan bool, 1),
-			msess:   make(map[string]struct{}),
+	for _, member := range c.members {
+		if member.Name != thisName {
+			c.nodes[member.Name] = c.newNode(member.Name, member.Addr)
 		}
 	}
 
-	if len(globals.cluster.nodes) == 0 {
+	if len(c.nodes) == 0 {
 		// Cluster needs at least two nodes.
 		logs.Err.Fatal("Cluster: invalid cluster size: 1")
 	}
 
-	if !globals.cluster.failoverInit(config.Failover) {
-		globals.cluster.rehash(nil)
+	globals.cluster = c
+	if !c.failoverInit(config.Failover) {
+		c.rehash(nil)
 	}
 
-	sort.Strings(nodeNames)
-	workerId := sort.SearchStrings(nodeNames, thisName) + 1
+	statsSet("TotalClusterNodes", int64(len(c.nodes)+1))
+
+	return c.workerId
+}
+
+// newNode creates a fully initialized node which can be safely published in c.nodes.
+// The caller must hold c.nodesLock or call it before the cluster is started.
+func (c *Cluster) newNode(name, addr string) *ClusterNode {
+	return &ClusterNode{
+		address:   addr,
+		name:      name,
+		transport: c.transport,
+		cluster:   c,
+		done:      make(chan bool, 1),
+		msess:     make(map[string]struct{}),
+		rpcDone:   make(chan *rpc.Call, max(len(c.members), 2)*clusterRpcCompletionBuffer),
+		p2mSender: make(chan *ClusterReq, clusterProxyToMasterBuffer),
+	}
+}
+
+// node returns the cluster node with the given name or nil if there is no such node.
+func (c *Cluster) node(name string) *ClusterNode {
+	c.nodesLock.RLock()
+	defer c.nodesLock.RUnlock()
+	return c.nodes[name]
+}
 
-	statsSet("TotalClusterNodes", int64(len(globals.cluster.nodes)+1))
+// nodeList returns a snapshot of the current list of remote nodes.
+func (c *Cluster) nodeList() []*ClusterNode {
+	c.nodesLock.RLock()
+	defer c.nodesLock.RUnlock()
+	nodes := make([]*ClusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
 
-	return workerId
+// nodeCount returns the number of remote nodes.
+func (c *Cluster) nodeCount() int {
+	c.nodesLock.RLock()
+	defer c.nodesLock.RUnlock()
+	return len(c.nodes)
 }
 
 // Proxied session is being closed at the Master node.
@@ -1023,45 +1253,56 @@ func (sess *Session) closeRPC() {
 
 // Start accepting connections.
 func (c *Cluster) start() {
-	addr, err := net.ResolveTCPAddr("tcp", c.listenOn)
-	if err != nil {
+	if err := c.transport.listen(c); err != nil {
 		logs.Err.Fatal(err)
 	}
 
-	c.inbound, err = net.ListenTCP("tcp", addr)
-
-	if err != nil {
-		logs.Err.Fatal(err)
-	}
-
-	for _, n := range c.nodes {
-		go n.reconnect()
-		n.rpcDone = make(chan *rpc.Call, len(c.nodes)*clusterRpcCompletionBuffer)
-		n.p2mSender = make(chan *ClusterReq, clusterProxyToMasterBuffer)
-		go n.asyncRpcLoop()
-		go n.p2mSenderLoop()
+	for _, n := range c.nodeList() {
+		c.startNode(n)
 	}
 
 	if c.fo != nil {
 		go c.run()
 	}
 
-	err = rpc.Register(c)
-	if err != nil {
-		logs.Err.Fatal(err)
+	if c.discovery != nil {
+		c.discovery.stop = c.discovery.run(c.discoveryChanged)
 	}
 
-	go rpc.Accept(c.inbound)
-
-	logs.Info.Printf("Cluster of %d nodes initialized, node '%s' is listening on [%s]", len(globals.cluster.nodes)+1,
+	logs.Info.Printf("Cluster of %d nodes initialized, node '%s' is listening on [%s]", c.nodeCount()+1,
 		globals.cluster.thisNodeName, c.listenOn)
 }
 
+// startNode starts communication with the remote node.
+func (c *Cluster) startNode(n *ClusterNode) {
+	go n.reconnect()
+	go n.asyncRpcLoop()
+	go n.p2mSenderLoop()
+}
+
+// isKnownPeer checks if the node with the given name is allowed to connect.
+func (c *Cluster) isKnownPeer(name string) bool {
+	// With dynamic membership any node with a valid certificate may connect in order to join the cluster.
+	return c.discovery != nil || c.node(name) != nil
+}
+
 func (c *Cluster) shutdown() {
 	if globals.cluster == nil {
 		return
 	}
-	for _, n := range c.nodes {
+
+	if c.discovery != nil {
+		if c.discovery.stop != nil {
+			c.discovery.stop <- true
+		}
+		if !c.staticNodes[c.thisNodeName] {
+			// Node joined at runtime: remove it from the cluster and release the worker ID.
+			c.leave()
+		}
+	}
+
+	nodes := c.nodeList()
+	for _, n := range nodes {
 		close(n.rpcDone)
 		close(n.p2mSender)
 	}
@@ -1069,13 +1310,13 @@ func (c *Cluster) shutdown() {
 	globals.cluster.proxyEventQueue.Stop()
 	globals.cluster = nil
 
-	c.inbound.Close()
+	c.transport.close()
 
 	if c.fo != nil {
 		c.fo.done <- true
 	}
 
-	for _, n := range c.nodes {
+	for _, n := range nodes {
 		n.done <- true
 	}
 
@@ -1090,7 +1331,7 @@ func (c *Cluster) rehash(nodes []string) []string {
 	var ringKeys []string
 
 	if nodes == nil {
-		for _, node := range c.nodes {
+		for _, node := range c.nodeList() {
 			ringKeys = append(ringKeys, node.name)
 		}
 		ringKeys = append(ringKeys, c.thisNodeName)
@@ -1099,16 +1340,31 @@ func (c *Cluster) rehash(nodes []string) []string {
 	}
 	ring.Add(ringKeys...)
 
+	c.ringLock.Lock()
+	if c.ring != nil {
+		c.handoffLock.Lock()
+		c.prevRing = c.ring
+		c.rehashedAt = time.Now()
+		c.handoffLock.Unlock()
+	}
 	c.ring = ring
+	c.ringLock.Unlock()
 
 	return ringKeys
 }
 
+// hashRing returns the current ring hash.
+func (c *Cluster) hashRing() *rh.Ring {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	return c.ring
+}
+
 // invalidateProxySubs iterates over sessions proxied on this node and for each session
 // sends "{pres term}" informing that the topic subscription (attachment) was lost:
 // - Called immediately after Cluster.rehash() for all relocated topics (forNode == "").
 // - Called for topics hosted at a specific node when a node restart is detected.
-// TODO: consider resubscribing to topics instead of forcing sessions to resubscribe.
+// With topic handoff enabled, sessions of relocated topics are resubscribed instead.
 func (c *Cluster) invalidateProxySubs(forNode string) {
 	sessions := make(map[*Session][]string)
 	globals.hub.topics.Range(func(_, v any) bool {
@@ -1118,7 +1374,7 @@ func (c *Cluster) invalidateProxySubs(forNode string) {
 			return true
 		}
 		if forNode == "" {
-			if topic.masterNode == c.ring.Get(topic.name) {
+			if topic.masterNode == c.hashRing().Get(topic.name) {
 				// The topic hasn't moved. Continue.
 				return true
 			}
@@ -1143,8 +1399,8 @@ func (c *Cluster) invalidateProxySubs(forNode string) {
 // The session is orphaned when the origin node is gone.
 func (c *Cluster) gcProxySessions(activeNodes []string) {
 	allNodes := []string{c.thisNodeName}
-	for name := range c.nodes {
-		allNodes = append(allNodes, name)
+	for _, n := range c.nodeList() {
+		allNodes = append(allNodes, n.name)
 	}
 	_, failedNodes, _ := stringSliceDelta(allNodes, activeNodes)
 	for _, node := range failedNodes {
@@ -1156,7 +1412,10 @@ func (c *Cluster) gcProxySessions(activeNodes []string) {
 // gcProxySessionsForNode terminates orphaned proxy sessions at a master node for the given node.
 // For example, a remote node is restarted or the cluster is rehashed without the node.
 func (c *Cluster) gcProxySessionsForNode(node string) {
-	n := c.nodes[node]
+	n := c.node(node)
+	if n == nil {
+		return
+	}
 	n.lock.Lock()
 	msess := n.msess
 	n.msess = make(map[string]struct{})
@@ -1198,7 +1457,8 @@ func (sess *Session) clusterWriteLoop(forTopic string) {
 				srvMsg.AsUser = srvMsg.sess.uid.UserId()
 
 				switch srvMsg.sess.proxyReq {
-				case ProxyReqJoin, ProxyReqLeave, ProxyReqMeta, ProxyReqBgSession, ProxyReqMeUserAgent, ProxyReqCall:
+				case ProxyReqJoin, ProxyReqLeave, ProxyReqMeta, ProxyReqBgSession, ProxyReqMeUserAgent, ProxyReqCall,
+					ProxyReqMigrate:
 				// Do nothing
 				case ProxyReqBroadcast, ProxyReqNone:
 					if srvMsg.Data != nil || srvMsg.Pres != nil || srvMsg.Info != nil {
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/redis"
+)
+
+// Cluster transport over Redis pub/sub. Each node subscribes to its own channel and receives
+// calls and replies to its calls there. Nodes periodically announce themselves on the shared
+// heartbeat channel. Nodes which are not heard from are considered unreachable, nodes which
+// joined the cluster at runtime are removed from the cluster by the leader when they stop
+// sending heartbeats. The address of a node on the bus is the name of the node.
+//
+// If the shared secret is configured, messages are signed with it. The signature covers the channel
+// and the whole encoded message including the name of the sender and the time the message was sent.
+// Messages older than clusterBusMessageTTL and messages which are not newer than the last message
+// from the same sender are rejected, so a captured message cannot be replayed. Redis connections can
+// be encrypted with TLS, cluster TLS certificates are not used.
+
+const (
+	// Default prefix of names of Redis channels.
+	clusterBusDefaultPrefix = "tinode"
+	// Default interval between heartbeats.
+	clusterBusDefaultHeartbeat = 500 * time.Millisecond
+	// A node is considered unreachable when this many heartbeats are missed.
+	clusterBusHeartbeatsMissed = 3
+	// Default time without heartbeats before the node which joined at runtime is removed from the cluster.
+	clusterBusDefaultMemberTTL = time.Minute
+	// Timeout of a call to another node.
+	clusterBusCallTimeout = clusterNetworkTimeout
+	// Messages sent longer than this ago (or this far in the future) are rejected.
+	clusterBusMessageTTL = 10 * clusterNetworkTimeout
+)
+
+type clusterRedisConfig struct {
+	// Address of the Redis server in the form host:port.
+	Addr string `json:"addr"`
+	// Password for authenticating with the Redis server.
+	Password string `json:"password"`
+	// Connect to Redis over TLS.
+	TLS bool `json:"tls"`
+	// Prefix of names of Redis channels used by the cluster.
+	Prefix string `json:"prefix"`
+	// Time in milliseconds between heartbeats.
+	Heartbeat int `json:"heartbeat"`
+	// Time in seconds without heartbeats before a node which joined at runtime is removed from the cluster.
+	MemberTTL int `json:"member_ttl"`
+}
+
+// ClusterBusMessage is a call, a reply to a call or a heartbeat sent through the bus.
+type ClusterBusMessage struct {
+	// Name of the sending node
+	From string
+	// Time when the message was sent, Unix nanoseconds; strictly increasing for each sender
+	Sent int64
+	// ID of the call assigned by the caller
+	ID uint64
+	// Name of the called method; empty in replies
+	Proc string
+	// Gob-encoded arguments of the call or the reply
+	Body []byte
+	// Error returned by the called method
+	Error string
+}
+
+// clusterBus delivers calls between nodes through Redis pub/sub.
+type clusterBus struct {
+	self      string
+	prefix    string
+	opts      *redis.Options
+	heartbeat time.Duration
+	memberTTL time.Duration
+	// Shared secret for signing messages; nil if not configured.
+	security *clusterSecurity
+	started  time.Time
+
+	// Connection for publishing messages. The subscribed connection cannot publish.
+	pubLock sync.Mutex
+	pub     *redis.Conn
+	// Send time of the last published message.
+	sent int64
+
+	lock sync.Mutex
+	// Receiver of calls; nil until the cluster starts listening.
+	rcvr *Cluster
+	// The subscribed connection.
+	sub *redis.Conn
+	// ID of the last call made by this node.
+	seq uint64
+	// Calls waiting for replies.
+	pending map[uint64]*clusterBusCall
+	// Time of the last heartbeat from each node.
+	peers map[string]time.Time
+	// Send time of the last accepted message from each node.
+	received map[string]int64
+
+	done chan bool
+}
+
+// clusterBusCall is a call waiting for a reply.
+type clusterBusCall struct {
+	call  *rpc.Call
+	ep    *clusterBusEndpoint
+	timer *time.Timer
+}
+
+// clusterBusEndpoint makes calls to one node.
+type clusterBusEndpoint struct {
+	bus  *clusterBus
+	node string
+}
+
+// newClusterBus connects to the bus and starts sending heartbeats.
+func newClusterBus(conf *clusterRedisConfig, self string, security *clusterSecurity) (*clusterBus, error) {
+	if conf == nil || conf.Addr == "" {
+		return nil, errors.New("redis address is not specified")
+	}
+
+	t := &clusterBus{
+		self:      self,
+		prefix:    clusterBusDefaultPrefix,
+		opts:      &redis.Options{Addr: conf.Addr, Password: conf.Password, Timeout: clusterNetworkTimeout},
+		heartbeat: clusterBusDefaultHeartbeat,
+		memberTTL: clusterBusDefaultMemberTTL,
+		started:   time.Now(),
+		pending:   make(map[uint64]*clusterBusCall),
+		peers:     make(map[string]time.Time),
+		received:  make(map[string]int64),
+		done:      make(chan bool),
+	}
+	if security != nil && security.secret != nil {
+		t.security = security
+	}
+	if conf.TLS {
+		host := conf.Addr
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		t.opts.TLS = &tls.Config{ServerName: host}
+	}
+	if conf.Prefix != "" {
+		t.prefix = conf.Prefix
+	}
+	if conf.Heartbeat > 0 {
+		t.heartbeat = time.Duration(conf.Heartbeat) * time.Millisecond
+	}
+	if conf.MemberTTL > 0 {
+		t.memberTTL = time.Duration(conf.MemberTTL) * time.Second
+	}
+
+	// Fail early if the bus is not available.
+	sub, err := t.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go t.receiveLoop(sub)
+	go t.heartbeatLoop()
+
+	return t, nil
+}
+
+func (t *clusterBus) nodeChannel(name string) string {
+	return t.prefix + ".node." + name
+}
+
+func (t *clusterBus) heartbeatChannel() string {
+	return t.prefix + ".heartbeat"
+}
+
+// subscribe opens the connection for receiving messages addressed to this node and heartbeats.
+func (t *clusterBus) subscribe() (*redis.Conn, error) {
+	sub, err := redis.Dial(t.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = sub.Subscribe(t.nodeChannel(t.self), t.heartbeatChannel()); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	t.lock.Lock()
+	t.sub = sub
+	t.lock.Unlock()
+	return sub, nil
+}
+
+// receiveLoop reads messages from the subscribed connection and resubscribes when the connection is lost.
+func (t *clusterBus) receiveLoop(sub *redis.Conn) {
+	for {
+		for {
+			msg, err := sub.Receive()
+			if err != nil {
+				select {
+				case <-t.done:
+					return
+				default:
+				}
+				logs.Warn.Println("cluster: bus connection lost", err)
+				sub.Close()
+				break
+			}
+			t.handleMessage(msg)
+		}
+
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-time.After(clusterDefaultReconnectTime):
+			}
+			var err error
+			if sub, err = t.subscribe(); err == nil {
+				logs.Info.Println("cluster: bus connection restored")
+				break
+			}
+		}
+	}
+}
+
+func (t *clusterBus) heartbeatLoop() {
+	ticker := time.NewTicker(t.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.publish(t.heartbeatChannel(), &ClusterBusMessage{From: t.self}); err != nil {
+				logs.Warn.Println("cluster: failed to send heartbeat", err)
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// publish signs and sends the message to the channel.
+func (t *clusterBus) publish(channel string, msg *ClusterBusMessage) error {
+	// Messages are published one at a time, so send times of the messages are ordered
+	// the same way as the messages are received by other nodes.
+	t.pubLock.Lock()
+	defer t.pubLock.Unlock()
+
+	msg.Sent = time.Now().UnixNano()
+	if msg.Sent <= t.sent {
+		// The clock went back or did not advance.
+		msg.Sent = t.sent + 1
+	}
+	t.sent = msg.Sent
+
+	var buf bytes.Buffer
+	if t.security != nil {
+		// Placeholder for the signature.
+		buf.Write(make([]byte, sha256.Size))
+	}
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if t.security != nil {
+		copy(data, t.security.mac("bus", []byte(channel), data[sha256.Size:]))
+	}
+
+	var err error
+	// Retry once on a new connection: the old one could have been closed by the server.
+	for attempt := 0; attempt < 2; attempt++ {
+		if t.pub == nil {
+			if t.pub, err = redis.Dial(t.opts); err != nil {
+				return err
+			}
+		}
+		if err = t.pub.Publish(channel, data); err == nil {
+			return nil
+		}
+		if _, ok := err.(redis.Error); ok {
+			return err
+		}
+		t.pub.Close()
+		t.pub = nil
+	}
+	return err
+}
+
+// handleMessage verifies and dispatches the received message.
+func (t *clusterBus) handleMessage(raw *redis.Message) {
+	data := raw.Payload
+	if t.security != nil {
+		if len(data) < sha256.Size || !hmac.Equal(data[:sha256.Size], t.security.mac("bus", []byte(raw.Channel), data[sha256.Size:])) {
+			logs.Warn.Println("cluster: bus message with invalid signature", raw.Channel)
+			return
+		}
+		data = data[sha256.Size:]
+	}
+	var msg ClusterBusMessage
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		logs.Warn.Println("cluster: malformed bus message", raw.Channel, err)
+		return
+	}
+	if err := t.checkFresh(&msg); err != nil {
+		logs.Warn.Println("cluster: bus message rejected", raw.Channel, msg.From, err)
+		return
+	}
+
+	switch {
+	case raw.Channel == t.heartbeatChannel():
+		if msg.From == t.self {
+			return
+		}
+		t.lock.Lock()
+		_, known := t.peers[msg.From]
+		t.peers[msg.From] = time.Now()
+		t.lock.Unlock()
+		if !known {
+			logs.Info.Printf("cluster: node '%s' is on the bus", msg.From)
+		}
+	case msg.Proc != "":
+		go t.serve(&msg)
+	default:
+		t.complete(&msg)
+	}
+}
+
+// checkFresh rejects messages which were sent too long ago and messages which are not newer than
+// the last accepted message from the same sender, i.e. duplicates and replays.
+func (t *clusterBus) checkFresh(msg *ClusterBusMessage) error {
+	age := time.Since(time.Unix(0, msg.Sent))
+	if age > clusterBusMessageTTL || age < -clusterBusMessageTTL {
+		return errors.New("stale message")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if msg.Sent <= t.received[msg.From] {
+		return errors.New("duplicate message")
+	}
+	t.received[msg.From] = msg.Sent
+	return nil
+}
+
+// serve makes the call to the method of the cluster and sends the reply to the caller.
+func (t *clusterBus) serve(msg *ClusterBusMessage) {
+	resp := &ClusterBusMessage{From: t.self, ID: msg.ID}
+	if body, err := t.invoke(msg.From, msg.Proc, msg.Body); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Body = body
+	}
+	if err := t.publish(t.nodeChannel(msg.From), resp); err != nil {
+		logs.Warn.Println("cluster: failed to reply to", msg.From, msg.Proc, err)
+	}
+}
+
+// invoke calls the method of the cluster.
+func (t *clusterBus) invoke(from, proc string, body []byte) ([]byte, error) {
+	t.lock.Lock()
+	rcvr := t.rcvr
+	t.lock.Unlock()
+	if rcvr == nil {
+		return nil, errors.New("cluster: node is not ready")
+	}
+	return invokeClusterMethod(rcvr, from, proc, body)
+}
+
+// invokeClusterMethod calls the method of the cluster with gob-encoded arguments in the same way
+// as net/rpc does. The call must be made on behalf of the sender. Returns the gob-encoded reply.
+func invokeClusterMethod(rcvr *Cluster, from, proc string, body []byte) ([]byte, error) {
+	name := strings.TrimPrefix(proc, "Cluster.")
+	method := reflect.ValueOf(rcvr).MethodByName(name)
+	if name == proc || !method.IsValid() {
+		return nil, errors.New("cluster: unknown method " + proc)
+	}
+	mtype := method.Type()
+	if mtype.NumIn() != 2 || mtype.NumOut() != 1 ||
+		mtype.In(0).Kind() != reflect.Pointer || mtype.In(1).Kind() != reflect.Pointer ||
+		mtype.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return nil, errors.New("cluster: method " + proc + " cannot be called remotely")
+	}
+
+	args := reflect.New(mtype.In(0).Elem())
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(args.Interface()); err != nil {
+		return nil, err
+	}
+	if err := checkRequestSender(args.Interface(), []string{from}); err != nil {
+		return nil, err
+	}
+	reply := reflect.New(mtype.In(1).Elem())
+	if errVal := method.Call([]reflect.Value{args, reply})[0]; !errVal.IsNil() {
+		return nil, errVal.Interface().(error)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(reply.Interface()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// complete delivers the reply to the waiting call.
+func (t *clusterBus) complete(msg *ClusterBusMessage) {
+	t.lock.Lock()
+	pc := t.pending[msg.ID]
+	delete(t.pending, msg.ID)
+	t.lock.Unlock()
+	if pc == nil {
+		// Timed out or cancelled.
+		return
+	}
+	pc.timer.Stop()
+
+	call := pc.call
+	if msg.Error != "" {
+		call.Error = rpc.ServerError(msg.Error)
+	} else if err := gob.NewDecoder(bytes.NewReader(msg.Body)).Decode(call.Reply); err != nil {
+		call.Error = err
+	}
+	call.Done <- call
+}
+
+// fail completes the pending call with an error.
+func (t *clusterBus) fail(id uint64, err error) {
+	t.lock.Lock()
+	pc := t.pending[id]
+	delete(t.pending, id)
+	t.lock.Unlock()
+	if pc == nil {
+		return
+	}
+	pc.timer.Stop()
+	pc.call.Error = err
+	pc.call.Done <- pc.call
+}
+
+// isAlive checks if heartbeats are received from the node.
+func (t *clusterBus) isAlive(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return time.Since(t.peers[name]) < t.heartbeat*clusterBusHeartbeatsMissed
+}
+
+// alivePeers returns names of nodes which send heartbeats.
+func (t *clusterBus) alivePeers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var names []string
+	for name, seen := range t.peers {
+		if time.Since(seen) < t.heartbeat*clusterBusHeartbeatsMissed {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isExpired checks if no heartbeats were received from the node for too long.
+func (t *clusterBus) isExpired(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seen := t.peers[name]
+	if seen.Before(t.started) {
+		seen = t.started
+	}
+	return time.Since(seen) > t.memberTTL
+}
+
+func (t *clusterBus) listen(c *Cluster) error {
+	t.lock.Lock()
+	t.rcvr = c
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *clusterBus) dial(name, addr string) (clusterEndpoint, error) {
+	if name == "" {
+		// Address on the bus is the name of the node.
+		name = addr
+	}
+	if !t.isAlive(name) {
+		return nil, errors.New("cluster: no heartbeats from node '" + name + "'")
+	}
+	return &clusterBusEndpoint{bus: t, node: name}, nil
+}
+
+func (t *clusterBus) close() {
+	close(t.done)
+	t.lock.Lock()
+	if t.sub != nil {
+		t.sub.Close()
+	}
+	t.lock.Unlock()
+	t.pubLock.Lock()
+	if t.pub != nil {
+		t.pub.Close()
+		t.pub = nil
+	}
+	t.pubLock.Unlock()
+}
+
+// Go sends the call to the node. The call completes when the reply is received or the call times out.
+func (ep *clusterBusEndpoint) Go(serviceMethod string, args any, reply any, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+
+	t := ep.bus
+	if !t.isAlive(ep.node) {
+		call.Error = errors.New("cluster: no heartbeats from node '" + ep.node + "'")
+		done <- call
+		return call
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		call.Error = err
+		done <- call
+		return call
+	}
+
+	t.lock.Lock()
+	t.seq++
+	id := t.seq
+	t.pending[id] = &clusterBusCall{
+		call: call,
+		ep:   ep,
+		timer: time.AfterFunc(clusterBusCallTimeout, func() {
+			t.fail(id, errors.New("cluster: call timed out"))
+		}),
+	}
+	t.lock.Unlock()
+
+	if err := t.publish(t.nodeChannel(ep.node), &ClusterBusMessage{
+		From: t.self,
+		ID:   id,
+		Proc: serviceMethod,
+		Body: buf.Bytes(),
+	}); err != nil {
+		t.fail(id, err)
+	}
+	return call
+}
+
+// Call sends the call to the node and waits for the reply.
+func (ep *clusterBusEndpoint) Call(serviceMethod string, args any, reply any) error {
+	call := <-ep.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done
+	return call.Error
+}
+
+// Close cancels calls to the node which are waiting for replies.
+func (ep *clusterBusEndpoint) Close() error {
+	t := ep.bus
+	var ids []uint64
+	t.lock.Lock()
+	for id, pc := range t.pending {
+		if pc.ep == ep {
+			ids = append(ids, id)
+		}
+	}
+	t.lock.Unlock()
+	for _, id := range ids {
+		t.fail(id, rpc.ErrShutdown)
+	}
+	return nil
+}
+
+// expireBusMembers removes nodes which joined the cluster at runtime and stopped sending heartbeats.
+// Called by the leader.
+func (c *Cluster) expireBusMembers() {
+	bus, ok := c.transport.(*clusterBus)
+	if !ok || c.discovery == nil {
+		return
+	}
+	for _, node := range c.nodeList() {
+		if !c.staticNodes[node.name] && bus.isExpired(node.name) {
+			logs.Info.Printf("cluster: no heartbeats from node '%s', removing it from the cluster", node.name)
+			if _, err := c.memberLeave(&ClusterLeaveRequest{Node: node.name}); err != nil {
+				logs.Warn.Println("cluster: failed to remove node", node.name, err)
+			}
+		}
+	}
+}
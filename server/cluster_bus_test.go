@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/redis"
+)
+
+func gobEncode(t *testing.T, val any) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(val); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestClusterBusInvoke(t *testing.T) {
+	bus := &clusterBus{self: "one"}
+	if _, err := bus.invoke("two", "Cluster.Ping", nil); err == nil {
+		t.Error("call served before listening")
+	}
+
+	c := newTestLeader()
+	c.discovery = nil
+	bus.listen(c)
+
+	if _, err := bus.invoke("two", "Cluster.Ping", gobEncode(t, &ClusterPing{Node: "two", Fingerprint: 5})); err != nil {
+		t.Fatal(err)
+	}
+	if fp := c.node("two").fingerprint; fp != 5 {
+		t.Errorf("expected fingerprint 5, got %d", fp)
+	}
+	// Calls on behalf of another node are rejected.
+	if _, err := bus.invoke("three", "Cluster.Ping", gobEncode(t, &ClusterPing{Node: "two", Fingerprint: 6})); err == nil {
+		t.Error("call on behalf of another node must be rejected")
+	}
+
+	// Methods which are not exported or not callable remotely.
+	for _, proc := range []string{"Cluster.node", "Cluster.NoSuchMethod", "Ping"} {
+		if _, err := bus.invoke("two", proc, nil); err == nil {
+			t.Errorf("%s must not be callable", proc)
+		}
+	}
+
+	// Errors returned by the method are passed to the caller.
+	if _, err := bus.invoke("four", "Cluster.Join", gobEncode(t, &ClusterJoinRequest{Node: "four"})); err == nil ||
+		err.Error() != "cluster: dynamic membership is disabled" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClusterBusReplay(t *testing.T) {
+	security, err := newClusterSecurity(nil, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := &clusterBus{
+		self:     "one",
+		prefix:   clusterBusDefaultPrefix,
+		security: security,
+		peers:    make(map[string]time.Time),
+		received: make(map[string]int64),
+	}
+	channel := bus.heartbeatChannel()
+	signed := func(msg *ClusterBusMessage) *redis.Message {
+		data := append(make([]byte, sha256.Size), gobEncode(t, msg)...)
+		copy(data, security.mac("bus", []byte(channel), data[sha256.Size:]))
+		return &redis.Message{Channel: channel, Payload: data}
+	}
+	heard := func(name string) bool {
+		defer func() { delete(bus.peers, name) }()
+		_, ok := bus.peers[name]
+		return ok
+	}
+
+	now := time.Now().UnixNano()
+	fresh := signed(&ClusterBusMessage{From: "two", Sent: now})
+	bus.handleMessage(fresh)
+	if !heard("two") {
+		t.Fatal("fresh heartbeat was not accepted")
+	}
+	// Replayed message.
+	bus.handleMessage(fresh)
+	if heard("two") {
+		t.Error("duplicate heartbeat was accepted")
+	}
+	// Older message from the same sender.
+	bus.handleMessage(signed(&ClusterBusMessage{From: "two", Sent: now - 1}))
+	if heard("two") {
+		t.Error("out of order heartbeat was accepted")
+	}
+	// Stale message from another sender.
+	bus.handleMessage(signed(&ClusterBusMessage{From: "three", Sent: now - int64(2*clusterBusMessageTTL)}))
+	if heard("three") {
+		t.Error("stale heartbeat was accepted")
+	}
+	// The sender and the send time are signed.
+	tampered := signed(&ClusterBusMessage{From: "three", Sent: now})
+	tampered.Payload = append(tampered.Payload[:sha256.Size:sha256.Size], gobEncode(t, &ClusterBusMessage{From: "four", Sent: now})...)
+	bus.handleMessage(tampered)
+	if heard("four") {
+		t.Error("tampered heartbeat was accepted")
+	}
+	bus.handleMessage(signed(&ClusterBusMessage{From: "two", Sent: now + 1}))
+	if !heard("two") {
+		t.Error("newer heartbeat was not accepted")
+	}
+}
+
+// TestClusterBusRedis runs against a real server at the address from REDIS_TEST_ADDR, e.g. localhost:6379.
+func TestClusterBusRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+
+	security, err := newClusterSecurity(nil, "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &clusterRedisConfig{Addr: addr, Password: os.Getenv("REDIS_TEST_PASSWORD"), Prefix: "tinode-test", Heartbeat: 50}
+
+	one, err := newClusterBus(conf, "one", security)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer one.close()
+	two, err := newClusterBus(conf, "two", security)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer two.close()
+
+	c := newTestLeader()
+	c.discovery = nil
+	one.listen(c)
+
+	for deadline := time.Now().Add(time.Second); !two.isAlive("one"); {
+		if time.Now().After(deadline) {
+			t.Fatal("no heartbeats from node 'one'")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ep, err := two.dial("", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unused bool
+	if err = ep.Call("Cluster.Ping", &ClusterPing{Node: "two", Fingerprint: 7}, &unused); err != nil {
+		t.Fatal(err)
+	}
+	if fp := c.node("two").fingerprint; fp != 7 {
+		t.Errorf("expected fingerprint 7, got %d", fp)
+	}
+
+	var resp ClusterJoinResponse
+	if err = ep.Call("Cluster.Join", &ClusterJoinRequest{Node: "four", Addr: "four"}, &resp); err == nil {
+		t.Error("expected error from the node without dynamic membership")
+	}
+
+	if _, err = two.dial("three", ""); err == nil {
+		t.Error("dialed node which sends no heartbeats")
+	}
+}
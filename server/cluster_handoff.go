@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Handoff of topics between nodes when the cluster is rehashed. The old master topic stops
+// saving messages, processes already queued requests, sends its in-memory state to the new master
+// and subscribes its sessions to the topic at the new location. The new master queues requests
+// until the state arrives. Proxy topics subscribe their sessions to the new master. Clients are
+// not notified unless the subscription cannot be moved.
+
+const (
+	// Topic state received before the topic is loaded is discarded after this time.
+	clusterHandoffTTL = time.Minute
+	// Time after rehashing during which a moved topic waits for the state from its previous master
+	// before processing requests.
+	clusterHandoffWait = 5 * time.Second
+	// Delay between attempts to subscribe a moved session at the new master.
+	clusterMigrateRetryDelay = 250 * time.Millisecond
+	// Number of attempts to subscribe a moved session at the new master. Rings of nodes
+	// are updated at slightly different times, the new master may reject early requests.
+	clusterMigrateRetries = 8
+)
+
+// ClusterTopicUser is the state of a topic subscriber.
+type ClusterTopicUser struct {
+	Uid    types.Uid
+	RecvID int
+	ReadID int
+}
+
+// ClusterCallParty is a participant of a video call.
+type ClusterCallParty struct {
+	// Session ID of the call party.
+	Sid string
+	// Node which hosts the session.
+	Node string
+	// ID of the user.
+	Uid types.Uid
+	// The party initiated the call.
+	IsOriginator bool
+}
+
+// ClusterCallState is a video call which is being established or in progress.
+type ClusterCallState struct {
+	Seq         int
+	Content     any
+	ContentMime any
+	AcceptedAt  time.Time
+	Parties     []ClusterCallParty
+}
+
+// ClusterTopicState is in-memory state of a topic sent by the old master to the new master.
+type ClusterTopicState struct {
+	// Node which sent the state.
+	Node string
+	// Name of the topic.
+	Topic string
+	// IDs of the last message and the last deletion.
+	LastID int
+	DelID  int
+	// Per-subscriber data.
+	Users []ClusterTopicUser
+	// Last published user agent, 'me' topic only.
+	UserAgent string
+	// Video call, p2p topics only.
+	Call *ClusterCallState
+
+	// Time when the state was received.
+	received time.Time
+}
+
+// TopicHandoff is an RPC endpoint which receives the state of a topic from its previous master.
+func (c *Cluster) TopicHandoff(state *ClusterTopicState, unused *bool) error {
+	if !c.isHandoffSender(state.Topic, state.Node) {
+		logs.Warn.Println("cluster: topic handoff rejected - sender is not the previous master", state.Topic, state.Node)
+		return errors.New("cluster: topic handoff from a node which is not the previous master")
+	}
+
+	state.received = time.Now()
+	if t := globals.hub.topicGet(state.Topic); t != nil && t.handoff != nil {
+		select {
+		case t.handoff <- state:
+		default:
+			logs.Warn.Println("cluster: topic handoff dropped - queue full", state.Topic, state.Node)
+		}
+		return nil
+	}
+
+	// The topic is not loaded yet. Keep the state until it's loaded.
+	c.handoffLock.Lock()
+	for name, s := range c.handoffs {
+		if time.Since(s.received) > clusterHandoffTTL {
+			delete(c.handoffs, name)
+		}
+	}
+	c.handoffs[state.Topic] = state
+	c.handoffLock.Unlock()
+	return nil
+}
+
+// isHandoffSender checks if the node was the master of the topic before the cluster was rehashed.
+// The sender may also be the master in the current ring if this node has not rehashed yet.
+func (c *Cluster) isHandoffSender(topic, node string) bool {
+	if node == c.thisNodeName || c.node(node) == nil {
+		return false
+	}
+	if c.hashRing().Get(topic) == node {
+		return true
+	}
+	c.handoffLock.Lock()
+	defer c.handoffLock.Unlock()
+	return c.prevRing != nil && c.prevRing.Get(topic) == node
+}
+
+// takeHandoff returns and forgets the state of the topic received from its previous master.
+func (c *Cluster) takeHandoff(topic string) *ClusterTopicState {
+	if c == nil {
+		return nil
+	}
+	c.handoffLock.Lock()
+	defer c.handoffLock.Unlock()
+
+	state := c.handoffs[topic]
+	delete(c.handoffs, topic)
+	if state == nil || time.Since(state.received) > clusterHandoffTTL {
+		return nil
+	}
+	return state
+}
+
+// handoffWait returns how long the topic which has just been loaded should wait for its state from
+// the previous master. Returns 0 if the topic has not moved recently or the previous master is gone.
+func (c *Cluster) handoffWait(topic string) time.Duration {
+	if c == nil || !c.topicHandoff {
+		return 0
+	}
+	c.handoffLock.Lock()
+	defer c.handoffLock.Unlock()
+
+	if c.prevRing == nil {
+		return 0
+	}
+	wait := clusterHandoffWait - time.Since(c.rehashedAt)
+	if wait <= 0 {
+		return 0
+	}
+	if prev := c.prevRing.Get(topic); prev == c.thisNodeName || c.node(prev) == nil {
+		return 0
+	}
+	return wait
+}
+
+// sendTopicHandoff sends the state of the topic to its new master. Does not wait for delivery:
+// the new master stops waiting for the state after a timeout.
+func (c *Cluster) sendTopicHandoff(state *ClusterTopicState) error {
+	n := c.nodeForTopic(state.Topic)
+	if n == nil {
+		return errors.New("node for topic not found")
+	}
+	var unused bool
+	if call := n.callAsync("Cluster.TopicHandoff", state, &unused, nil); call.Error != nil {
+		return call.Error
+	}
+	return nil
+}
+
+// forwardPub sends {pub} received by the old master while the topic was moving to the new master.
+func (c *Cluster) forwardPub(topic string, msg *ClientComMessage) error {
+	n := c.nodeForTopic(topic)
+	if n == nil {
+		return errors.New("node for topic not found")
+	}
+	req := c.makeClusterReq(ProxyReqBroadcast, msg, topic, msg.sess)
+	if sess := msg.sess; sess != nil && sess.isProxy() {
+		// The message came from a proxy topic: the new master replies to the node of the proxy directly.
+		if sess.multi == nil || sess.multi.clnode == nil || sess.multi.clnode.name == n.name {
+			return errors.New("proxy node is unknown or is the new master")
+		}
+		req.Node = sess.multi.clnode.name
+	}
+	return n.proxyToMasterAsync(req)
+}
+
+// retryMigration resends the request to subscribe a moved session to the new master after a delay.
+// The client is told that the subscription is lost when all attempts fail.
+func (c *Cluster) retryMigration(req *ClusterReq) {
+	req.attempts++
+	if req.attempts >= clusterMigrateRetries {
+		c.abortMigration(req)
+		return
+	}
+	time.AfterFunc(clusterMigrateRetryDelay, func() {
+		n := c.nodeForTopic(req.RcptTo)
+		if n == nil {
+			c.abortMigration(req)
+			return
+		}
+		req.Signature = c.hashRing().Signature()
+		if err := n.proxyToMasterAsync(req); err != nil {
+			c.abortMigration(req)
+		}
+	})
+}
+
+// abortMigration tells the client that the session could not be subscribed at the new master.
+func (c *Cluster) abortMigration(req *ClusterReq) {
+	logs.Warn.Println("cluster: failed to move session to the new master", req.RcptTo, req.Sess.Sid)
+	if sess := globals.sessionStore.Get(req.Sess.Sid); sess != nil {
+		sess.presTermDirect([]string{req.CliMsg.Original})
+	}
+}
+
+// abortMigration tells the client that the subscription was lost because the session could not
+// be moved to the new master. Proxy sessions are handled by the proxy topic.
+func abortMigration(msg *ClientComMessage) {
+	if msg.migrating && !msg.sess.isProxy() {
+		msg.sess.presTermDirect([]string{msg.Original})
+	}
+}
+
+// migrate hands off the master topic to its new node: processes queued requests,
+// sends the state of the topic to the new master and moves the sessions.
+func (t *Topic) migrate() {
+	// Process requests which were queued before the topic was unregistered. Messages are
+	// no longer saved: the new master may be assigning the same IDs already. They are forwarded
+	// to the new master instead.
+	for done := false; !done; {
+		select {
+		case msg := <-t.reg:
+			t.registerSession(msg)
+		case msg := <-t.unreg:
+			t.unregisterSession(msg)
+		case msg := <-t.clientMsg:
+			t.handleClientMsg(msg)
+		case msg := <-t.serverMsg:
+			t.handleServerMsg(msg)
+		case meta := <-t.meta:
+			t.handleMeta(meta)
+		default:
+			done = true
+		}
+	}
+	t.markDeleted()
+
+	if err := globals.cluster.sendTopicHandoff(t.handoffState()); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to hand off to the new master - %s", t.name, err)
+	}
+
+	t.migrateSessions()
+
+	// Sessions are moving to the new master ahead of the messages.
+	for _, msg := range t.migratingPubs {
+		if err := globals.cluster.forwardPub(t.name, msg); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to forward message to the new master - %s", t.name, err)
+			msg.sess.queueOut(ErrLocked(msg.Id, t.original(types.ParseUserId(msg.AsUser)), msg.Timestamp))
+		}
+	}
+	t.migratingPubs = nil
+}
+
+// handoffState collects the in-memory state of the topic.
+func (t *Topic) handoffState() *ClusterTopicState {
+	state := &ClusterTopicState{
+		Node:      globals.cluster.thisNodeName,
+		Topic:     t.name,
+		LastID:    t.lastID,
+		DelID:     t.delID,
+		UserAgent: t.userAgent,
+	}
+	for uid, pud := range t.perUser {
+		state.Users = append(state.Users, ClusterTopicUser{Uid: uid, RecvID: pud.recvID, ReadID: pud.readID})
+	}
+
+	if call := t.currentCall; call != nil {
+		state.Call = &ClusterCallState{
+			Seq:         call.seq,
+			Content:     call.content,
+			ContentMime: call.contentMime,
+			AcceptedAt:  call.acceptedAt,
+		}
+		for sid, p := range call.parties {
+			node := globals.cluster.thisNodeName
+			if p.sess != nil && p.sess.isProxy() && p.sess.multi != nil && p.sess.multi.clnode != nil {
+				node = p.sess.multi.clnode.name
+			}
+			state.Call.Parties = append(state.Call.Parties, ClusterCallParty{
+				Sid:          sid,
+				Node:         node,
+				Uid:          p.uid,
+				IsOriginator: p.isOriginator,
+			})
+		}
+	}
+	return state
+}
+
+// applyHandoff merges the state received from the previous master into the topic.
+func (t *Topic) applyHandoff(state *ClusterTopicState) {
+	// Messages could have been sent after the topic was loaded from the database.
+	t.lastID = max(t.lastID, state.LastID)
+	t.delID = max(t.delID, state.DelID)
+
+	for _, u := range state.Users {
+		if pud, ok := t.perUser[u.Uid]; ok {
+			pud.recvID = max(pud.recvID, u.RecvID)
+			pud.readID = max(pud.readID, u.ReadID)
+			t.perUser[u.Uid] = pud
+		}
+	}
+
+	if t.cat == types.TopicCatMe && state.UserAgent != "" {
+		t.userAgent = state.UserAgent
+	}
+
+	if state.Call == nil || t.cat != types.TopicCatP2P || t.currentCall != nil {
+		return
+	}
+	t.currentCall = &videoCall{
+		parties:     make(map[string]callPartyData),
+		seq:         state.Call.Seq,
+		content:     state.Call.Content,
+		contentMime: state.Call.ContentMime,
+		acceptedAt:  state.Call.AcceptedAt,
+	}
+	for _, p := range state.Call.Parties {
+		// Session could be nil if it has not moved here yet. It's restored when the session joins the topic.
+		t.currentCall.parties[p.Sid] = callPartyData{
+			uid:          p.Uid,
+			isOriginator: p.IsOriginator,
+			sess:         handoffCallSession(t.name, p),
+		}
+	}
+	if len(t.currentCall.parties) < 2 {
+		// The call is not established yet. Give the other side time to accept it.
+		t.callEstablishmentTimer.Reset(time.Duration(globals.callEstablishmentTimeout) * time.Second)
+	}
+}
+
+// handoffCallSession finds the session of the call party moved to this node.
+func handoffCallSession(topic string, p ClusterCallParty) *Session {
+	if p.Node == globals.cluster.thisNodeName {
+		return globals.sessionStore.Get(p.Sid)
+	}
+	// The session is proxied through the multiplexing session of its node.
+	msess := globals.sessionStore.Get(topic + "-" + p.Node)
+	if msess == nil {
+		return nil
+	}
+	return &Session{
+		proto:    PROXY,
+		multi:    msess,
+		sid:      p.Sid,
+		uid:      p.Uid,
+		proxyReq: ProxyReqCall,
+	}
+}
+
+// restoreCallParty links the session moved to this node to the video call.
+func (t *Topic) restoreCallParty(sess *Session) {
+	if t.currentCall == nil {
+		return
+	}
+	if p, ok := t.currentCall.parties[sess.sid]; ok && p.sess == nil {
+		p.sess = callPartySession(sess)
+		t.currentCall.parties[sess.sid] = p
+	}
+}
+
+// migrateSessions subscribes sessions attached to the topic to the topic at its new master.
+// The sessions are removed from the topic. Multiplexing sessions remain attached: proxy topics
+// at other nodes move their sessions on their own.
+func (t *Topic) migrateSessions() {
+	now := types.TimeNow()
+	for s, pssd := range t.sessions {
+		if s.isMultiplex() || atomic.LoadInt32(&s.terminating) > 0 {
+			continue
+		}
+		delete(t.sessions, s)
+		// Unlink the topic right away: asynchronous detaching may arrive after the new subscription.
+		s.delSub(t.name)
+
+		original := topicNameForUser(t.name, pssd.uid, pssd.isChanSub)
+		msg := &ClientComMessage{
+			Sub:       &MsgClientSub{Topic: original},
+			Original:  original,
+			RcptTo:    t.name,
+			AsUser:    pssd.uid.UserId(),
+			AuthLvl:   int(s.authLvl),
+			Timestamp: now,
+			sess:      s,
+			init:      true,
+			migrating: true,
+		}
+		if s.inflightReqs != nil {
+			s.inflightReqs.Add(1)
+		}
+		select {
+		case globals.hub.join <- msg:
+		default:
+			if s.inflightReqs != nil {
+				s.inflightReqs.Done()
+			}
+			logs.Err.Println("topic: hub.join queue full, failed to move session", t.name, s.sid)
+			s.presTermDirect([]string{original})
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"net/http"
+	"testing"
+	"time"
+
+	rh "github.com/tinode/chat/server/ringhash"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestTopicHandoff(t *testing.T) {
+	globals.cluster = &Cluster{thisNodeName: "two"}
+	globals.sessionStore = &SessionStore{lru: list.New(), sessCache: make(map[string]*Session)}
+	defer func() {
+		globals.cluster = nil
+		globals.sessionStore = nil
+	}()
+
+	caller, callee := types.Uid(1), types.Uid(2)
+	// Callee's session is proxied from node "one".
+	msess := &Session{proto: MULTIPLEX, sid: "p2pTest-one", clnode: &ClusterNode{name: "one"}}
+	old := &Topic{
+		name:   "p2pTest",
+		cat:    types.TopicCatP2P,
+		lastID: 10,
+		perUser: map[types.Uid]perUserData{
+			caller: {recvID: 9, readID: 8},
+			callee: {recvID: 10, readID: 10},
+		},
+		currentCall: &videoCall{
+			parties: map[string]callPartyData{
+				"sid1": {uid: caller, isOriginator: true, sess: &Session{sid: "sid1", uid: caller}},
+				"sid2": {uid: callee, sess: &Session{proto: PROXY, multi: msess, sid: "sid2", uid: callee}},
+			},
+			seq:        10,
+			content:    "call",
+			acceptedAt: time.Now().Round(0),
+		},
+	}
+
+	// The state must survive the trip over the wire.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(old.handoffState()); err != nil {
+		t.Fatal(err)
+	}
+	state := &ClusterTopicState{}
+	if err := gob.NewDecoder(&buf).Decode(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The topic is now hosted by node "one" where callee's session is local.
+	globals.cluster.thisNodeName = "one"
+	calleeSess := &Session{sid: "sid2", uid: callee}
+	globals.sessionStore.sessCache["sid2"] = calleeSess
+
+	topic := &Topic{
+		name:   "p2pTest",
+		cat:    types.TopicCatP2P,
+		lastID: 9,
+		perUser: map[types.Uid]perUserData{
+			caller: {recvID: 7, readID: 7},
+			callee: {recvID: 10, readID: 9},
+		},
+		callEstablishmentTimer: time.NewTimer(time.Hour),
+	}
+	topic.callEstablishmentTimer.Stop()
+	topic.applyHandoff(state)
+
+	if topic.lastID != 10 {
+		t.Errorf("expected lastID 10, got %d", topic.lastID)
+	}
+	if pud := topic.perUser[caller]; pud.recvID != 9 || pud.readID != 8 {
+		t.Errorf("unexpected caller state %+v", pud)
+	}
+	if pud := topic.perUser[callee]; pud.recvID != 10 || pud.readID != 10 {
+		t.Errorf("unexpected callee state %+v", pud)
+	}
+
+	call := topic.currentCall
+	if call == nil || call.seq != 10 || call.content != "call" || !call.acceptedAt.Equal(old.currentCall.acceptedAt) {
+		t.Fatalf("call not restored %+v", call)
+	}
+	if p := call.parties["sid2"]; p.sess != calleeSess || p.uid != callee || p.isOriginator {
+		t.Errorf("unexpected callee party %+v", p)
+	}
+	// Caller's session is proxied from node "two" and has not moved yet.
+	if p := call.parties["sid1"]; p.sess != nil || !p.isOriginator {
+		t.Errorf("unexpected caller party %+v", p)
+	}
+
+	callerSess := &Session{proto: PROXY, multi: &Session{proto: MULTIPLEX, sid: "p2pTest-two"}, sid: "sid1", uid: caller}
+	topic.restoreCallParty(callerSess)
+	if p := call.parties["sid1"]; p.sess == nil || p.sess.sid != "sid1" || p.sess.proxyReq != ProxyReqCall {
+		t.Errorf("caller session not restored %+v", p.sess)
+	}
+}
+
+func TestTopicHandoffWait(t *testing.T) {
+	c := &Cluster{thisNodeName: "two", topicHandoff: true, nodes: map[string]*ClusterNode{"one": {name: "one"}}}
+	c.prevRing = rh.New(clusterHashReplicas, nil)
+	c.prevRing.Add("one")
+	c.rehashedAt = time.Now()
+
+	if wait := c.handoffWait("grpTest"); wait <= 0 || wait > clusterHandoffWait {
+		t.Errorf("topic moved from another node must wait, got %v", wait)
+	}
+
+	// The previous master is gone.
+	delete(c.nodes, "one")
+	if c.handoffWait("grpTest") != 0 {
+		t.Error("topic must not wait for a node which left the cluster")
+	}
+	c.nodes["one"] = &ClusterNode{name: "one"}
+
+	// The topic was hosted by this node.
+	c.thisNodeName = "one"
+	if c.handoffWait("grpTest") != 0 {
+		t.Error("topic which has not moved must not wait")
+	}
+	c.thisNodeName = "two"
+
+	c.rehashedAt = time.Now().Add(-clusterHandoffWait)
+	if c.handoffWait("grpTest") != 0 {
+		t.Error("topic loaded long after rehashing must not wait")
+	}
+
+	c.topicHandoff = false
+	c.rehashedAt = time.Now()
+	if c.handoffWait("grpTest") != 0 {
+		t.Error("topic must not wait when handoff is disabled")
+	}
+}
+
+func TestTopicMigratingForwardsMessages(t *testing.T) {
+	c := newTestLeader()
+	c.rehash(nil)
+	globals.cluster = c
+	defer func() { globals.cluster = nil }()
+
+	// Find a topic which moved to node "two".
+	var name string
+	for i := 0; name == ""; i++ {
+		if n := "grp" + types.Uid(i+1).String(); c.hashRing().Get(n) == "two" {
+			name = n
+		}
+	}
+	topic := &Topic{name: name, xoriginal: name, cat: types.TopicCatGrp}
+	topic.markMigrating()
+
+	pub := func(sess *Session) *ClientComMessage {
+		return &ClientComMessage{
+			Pub:      &MsgClientPub{Topic: name, Content: "hello"},
+			Id:       "1",
+			Original: name,
+			RcptTo:   name,
+			AsUser:   types.Uid(1).UserId(),
+			sess:     sess,
+		}
+	}
+
+	// Messages are queued while the topic is migrating.
+	local := &Session{sid: "local", send: make(chan any, 1)}
+	topic.handlePubBroadcast(pub(local))
+	proxied := &Session{proto: PROXY, sid: "proxied", multi: &Session{proto: MULTIPLEX, clnode: c.nodes["three"]}}
+	topic.handlePubBroadcast(pub(proxied))
+	if len(local.send) != 0 || len(topic.migratingPubs) != 2 {
+		t.Fatal("messages must be queued for forwarding", len(topic.migratingPubs))
+	}
+
+	// Queued messages are forwarded to the new master.
+	for _, msg := range topic.migratingPubs {
+		if err := c.forwardPub(name, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := c.nodes["two"]
+	if req := <-n.p2mSender; req.ReqType != ProxyReqBroadcast || req.Node != "one" || req.Sess.Sid != "local" {
+		t.Errorf("unexpected request for local session %+v", req)
+	}
+	// The new master replies to the node of the proxy topic.
+	if req := <-n.p2mSender; req.Node != "three" || req.Sess.Sid != "proxied" {
+		t.Errorf("unexpected request for proxied session %+v", req)
+	}
+
+	// Proxy topic at the new master: the message cannot be forwarded.
+	proxied.multi.clnode = n
+	if err := c.forwardPub(name, pub(proxied)); err == nil {
+		t.Error("message from the new master must not be forwarded back to it")
+	}
+
+	// The topic is gone after migration.
+	topic.markDeleted()
+	topic.handlePubBroadcast(pub(local))
+	if resp, ok := (<-local.send).(*ServerComMessage); !ok || resp.Ctrl == nil || resp.Ctrl.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %+v", resp)
+	}
+}
+
+func TestTopicHandoffSender(t *testing.T) {
+	c := newTestLeader()
+	c.thisNodeName = "two"
+	delete(c.nodes, "two")
+	c.nodes["one"] = c.newNode("one", "127.0.0.1:0")
+	c.ring = rh.New(clusterHashReplicas, nil)
+	c.ring.Add("two", "three")
+	c.prevRing = rh.New(clusterHashReplicas, nil)
+	c.prevRing.Add("one")
+
+	// Find a topic which moved to this node.
+	var name string
+	for i := 0; name == ""; i++ {
+		if n := "grp" + types.Uid(i+1).String(); c.ring.Get(n) == "two" {
+			name = n
+		}
+	}
+
+	if !c.isHandoffSender(name, "one") {
+		t.Error("previous master must be accepted")
+	}
+	if c.isHandoffSender(name, "three") {
+		t.Error("node which was not the master must be rejected")
+	}
+	var unused bool
+	if err := c.TopicHandoff(&ClusterTopicState{Node: "three", Topic: name}, &unused); err == nil {
+		t.Error("state from a node which was not the master must be rejected")
+	}
+
+	// This node has not rehashed yet: the sender is the master in the current ring.
+	c.prevRing = nil
+	c.ring = rh.New(clusterHashReplicas, nil)
+	c.ring.Add("one")
+	if !c.isHandoffSender("grpTest", "one") {
+		t.Error("current master must be accepted")
+	}
+	if c.isHandoffSender("grpTest", "four") {
+		t.Error("unknown node must be rejected")
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"math/rand"
 	"net/rpc"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tinode/chat/server/logs"
@@ -14,6 +17,11 @@ import (
 // times, the leader node annouces it dead and initiates rehashing: it regenerates ring hash with
 // only live nodes and communicates the new list of nodes to followers. They in turn do their
 // rehashing using the new list. When the dead node is revived, rehashing happens again.
+//
+// Like in Raft, a node votes at most once per term and the term and the vote could be persisted
+// to survive restarts. The leader acts only while it can reach the majority of the cluster: a leader
+// cut off from the majority steps down without rehashing. A node which cannot reach the majority
+// considers itself partitioned and rejects client requests until it hears from a leader again.
 
 // Failover config.
 type clusterFailover struct {
@@ -21,6 +29,17 @@ type clusterFailover struct {
 	leader string
 	// Current election term
 	term int
+	// Leader and term are changed by the failover runner only, under this lock.
+	// Other goroutines must read them with stateLock held, e.g. using currentState().
+	stateLock sync.RWMutex
+	// Candidate this node voted for in the current term
+	votedFor string
+	// File for persisting the term and the vote; could be empty
+	stateFile string
+	// Number of consecutive health check rounds in which the leader could not reach the majority
+	noQuorum int
+	// 1 if this node cannot reach the majority of the cluster, 0 otherwise
+	partitioned int32
 	// Hearbeat interval
 	heartBeat time.Duration
 	// Vote timeout: the number of missed heartbeats before a new election is initiated.
@@ -36,6 +55,9 @@ type clusterFailover struct {
 	healthCheck chan *ClusterHealth
 	// Channel for processing election votes.
 	electionVote chan *ClusterVote
+	// Channels for processing requests to join or leave the cluster.
+	memberJoin  chan *clusterJoin
+	memberLeave chan *clusterLeave
 	// Channel for stopping the failover runner.
 	done chan bool
 }
@@ -49,6 +71,14 @@ type clusterFailoverConfig struct {
 	VoteAfter int `json:"vote_after"`
 	// Number of failures before a node is considered dead
 	NodeFailAfter int `json:"node_fail_after"`
+	// File for persisting the election term and the vote between restarts
+	StateFile string `json:"state_file"`
+}
+
+// clusterElectionState is the state of the leader election persisted between restarts.
+type clusterElectionState struct {
+	Term     int    `json:"term"`
+	VotedFor string `json:"voted_for"`
 }
 
 // ClusterHealth is content of a leader's health check of a follower node.
@@ -61,6 +91,12 @@ type ClusterHealth struct {
 	Signature string
 	// Names of nodes currently active in the cluster
 	Nodes []string
+	// Names of live nodes which are draining before shutdown. They are not in the ring hash.
+	Draining []string
+	// All members of the cluster, including inactive.
+	Members []ClusterMember
+	// Version of the membership list.
+	Version int64
 }
 
 // ClusterVoteRequest is a request from a leader candidate to a node to vote for the candidate.
@@ -89,15 +125,16 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 	if config == nil || !config.Enabled {
 		return false
 	}
-	if len(c.nodes) < 2 {
-		logs.Err.Printf("cluster: failover disabled; need at least 3 nodes, got %d", len(c.nodes)+1)
+	nodes := c.nodeList()
+	if len(nodes) < 2 {
+		logs.Err.Printf("cluster: failover disabled; need at least 3 nodes, got %d", len(nodes)+1)
 		return false
 	}
 
 	// Generate ring hash on the assumption that all nodes are alive and well.
 	// This minimizes rehashing during normal operations.
 	var activeNodes []string
-	for _, node := range c.nodes {
+	for _, node := range nodes {
 		activeNodes = append(activeNodes, node.name)
 	}
 	activeNodes = append(activeNodes, c.thisNodeName)
@@ -114,8 +151,15 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 		voteTimeout:        config.VoteAfter,
 		nodeFailCountLimit: config.NodeFailAfter,
 		healthCheck:        make(chan *ClusterHealth, config.VoteAfter),
-		electionVote:       make(chan *ClusterVote, len(c.nodes)),
+		electionVote:       make(chan *ClusterVote, len(nodes)),
+		memberJoin:         make(chan *clusterJoin, 1),
+		memberLeave:        make(chan *clusterLeave, 1),
 		done:               make(chan bool, 1),
+		stateFile:          config.StateFile,
+	}
+
+	if err := c.loadElectionState(); err != nil {
+		logs.Err.Fatal("cluster: failed to load election state: ", err)
 	}
 
 	logs.Info.Println("cluster: failover mode enabled")
@@ -124,15 +168,115 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 }
 
 // Health is called by the leader node to assert leadership and check status
-// of the followers.
-func (c *Cluster) Health(health *ClusterHealth, unused *bool) error {
+// of the followers. The follower responds if it's draining.
+func (c *Cluster) Health(health *ClusterHealth, draining *bool) error {
 	select {
 	case c.fo.healthCheck <- health:
 	default:
 	}
+	*draining = globals.drain.isActive()
+	return nil
+}
+
+// loadElectionState restores the term and the vote persisted before the restart.
+func (c *Cluster) loadElectionState() error {
+	if c.fo.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.fo.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state clusterElectionState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	c.fo.setState(state.Term, c.fo.leader)
+	c.fo.votedFor = state.VotedFor
+	statsSet("ClusterTerm", int64(c.fo.term))
 	return nil
 }
 
+// saveElectionState persists the term and the vote. Must be called before the vote is sent.
+func (c *Cluster) saveElectionState() {
+	statsSet("ClusterTerm", int64(c.fo.term))
+	if c.fo.stateFile == "" {
+		return
+	}
+	data, _ := json.Marshal(&clusterElectionState{Term: c.fo.term, VotedFor: c.fo.votedFor})
+	// Write to a temporary file first to avoid corrupting the state on crash.
+	tmp := c.fo.stateFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err == nil {
+		_, err = file.Write(data)
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.fo.stateFile)
+	}
+	if err != nil {
+		logs.Err.Println("cluster: failed to save election state", err)
+	}
+}
+
+// setState changes the term and the leader.
+func (fo *clusterFailover) setState(term int, leader string) {
+	fo.stateLock.Lock()
+	fo.term = term
+	fo.leader = leader
+	fo.stateLock.Unlock()
+}
+
+// setLeader changes the leader in the current term.
+func (fo *clusterFailover) setLeader(leader string) {
+	fo.stateLock.Lock()
+	fo.leader = leader
+	fo.stateLock.Unlock()
+}
+
+// currentState returns the term and the leader. Safe to call from any goroutine.
+func (fo *clusterFailover) currentState() (int, string) {
+	fo.stateLock.RLock()
+	defer fo.stateLock.RUnlock()
+	return fo.term, fo.leader
+}
+
+// setTerm advances the term learned from another node. The vote is reset in the new term.
+func (c *Cluster) setTerm(term int) {
+	c.fo.setState(term, c.fo.leader)
+	c.fo.votedFor = ""
+	c.saveElectionState()
+}
+
+// hasQuorum checks if the given number of nodes including this one is the majority of the cluster.
+func (c *Cluster) hasQuorum(count int) bool {
+	return count >= (c.nodeCount()+1)>>1+1
+}
+
+// setPartitioned marks this node as being cut off from the majority of the cluster or reconnected to it.
+func (c *Cluster) setPartitioned(partitioned bool) {
+	var val int32
+	if partitioned {
+		val = 1
+	}
+	if atomic.SwapInt32(&c.fo.partitioned, val) != val {
+		if partitioned {
+			logs.Warn.Println("cluster: node is cut off from the majority of the cluster")
+		} else {
+			logs.Info.Println("cluster: node is connected to the majority of the cluster")
+		}
+		statsSet("ClusterPartitioned", int64(val))
+	}
+}
+
 // Vote processes request for a vote from a candidate.
 func (c *Cluster) Vote(vreq *ClusterVoteRequest, response *ClusterVoteResponse) error {
 	respChan := make(chan ClusterVoteResponse, 1)
@@ -151,17 +295,49 @@ func (c *Cluster) Vote(vreq *ClusterVoteRequest, response *ClusterVoteResponse)
 func (c *Cluster) sendHealthChecks() {
 	rehash := false
 
-	for _, node := range c.nodes {
-		unused := false
+	nodes := c.nodeList()
+	members, version := c.memberList()
+	drainingNodes := c.drainingNodes()
+	// Outcomes of health checks: nil if the node failed to respond, otherwise the draining flag.
+	results := make([]*bool, len(nodes))
+	// Number of nodes which responded, including this one.
+	responded := 1
+	for i, node := range nodes {
+		draining := false
 		err := node.call("Cluster.Health",
 			&ClusterHealth{
 				Leader:    c.thisNodeName,
 				Term:      c.fo.term,
-				Signature: c.ring.Signature(),
+				Signature: c.hashRing().Signature(),
 				Nodes:     c.fo.activeNodes,
-			}, &unused)
+				Draining:  drainingNodes,
+				Members:   members,
+				Version:   version,
+			}, &draining)
+		if err == nil {
+			results[i] = &draining
+			responded++
+		}
+	}
+
+	if !c.hasQuorum(responded) {
+		// The leader cannot tell failed nodes from being cut off from them. Do not count failures
+		// and do not rehash: the majority of the cluster may be alive and electing another leader.
+		c.fo.noQuorum++
+		if c.fo.noQuorum >= c.fo.voteTimeout {
+			logs.Warn.Printf("cluster: leader reached %d of %d nodes, stepping down", responded, len(nodes)+1)
+			c.fo.setLeader("")
+			c.fo.noQuorum = 0
+			statsSet("ClusterLeader", 0)
+			c.setPartitioned(true)
+		}
+		return
+	}
+	c.fo.noQuorum = 0
+	c.setPartitioned(false)
 
-		if err != nil {
+	for i, node := range nodes {
+		if results[i] == nil {
 			node.failCount++
 			if node.failCount == c.fo.nodeFailCountLimit {
 				// Node failed too many times
@@ -173,45 +349,90 @@ func (c *Cluster) sendHealthChecks() {
 				rehash = true
 			}
 			node.failCount = 0
+			if node.draining != *results[i] {
+				// Draining nodes are removed from the ring hash.
+				node.draining = *results[i]
+				rehash = true
+			}
+		}
+	}
+
+	// The leader itself is draining and must be removed from the ring hash.
+	if globals.drain.isActive() && c.hashRing().Has(c.thisNodeName) {
+		rehash = true
+	}
+
+	c.expireBusMembers()
+
+	// Nodes which left the cluster must be removed from the ring hash.
+	for _, name := range c.fo.activeNodes {
+		if name != c.thisNodeName && c.node(name) == nil {
+			rehash = true
+			break
 		}
 	}
 
 	if rehash {
-		activeNodes := []string{c.thisNodeName}
-		for _, node := range c.nodes {
-			if node.failCount < c.fo.nodeFailCountLimit {
-				activeNodes = append(activeNodes, node.name)
-			}
+		c.failoverRehash()
+	}
+}
+
+// failoverRehash recalculates the ring hash using live nodes only.
+func (c *Cluster) failoverRehash() {
+	var activeNodes []string
+	if !globals.drain.isActive() {
+		activeNodes = append(activeNodes, c.thisNodeName)
+	}
+	for _, node := range c.nodeList() {
+		if node.failCount < c.fo.nodeFailCountLimit && !node.draining {
+			activeNodes = append(activeNodes, node.name)
 		}
-		c.fo.activeNodesLock.Lock()
-		c.fo.activeNodes = activeNodes
-		c.fo.activeNodesLock.Unlock()
-		c.rehash(activeNodes)
+	}
+	c.fo.activeNodesLock.Lock()
+	c.fo.activeNodes = activeNodes
+	c.fo.activeNodesLock.Unlock()
+	c.rehash(activeNodes)
+	if !c.topicHandoff {
 		c.invalidateProxySubs("")
-		c.gcProxySessions(activeNodes)
+	}
+	// Draining nodes are still serving their clients.
+	c.gcProxySessions(append(activeNodes, c.drainingNodes()...))
+
+	logs.Info.Println("cluster: initiating failover rehash for nodes", activeNodes)
+	globals.hub.rehash <- true
+}
 
-		logs.Info.Println("cluster: initiating failover rehash for nodes", activeNodes)
-		globals.hub.rehash <- true
+// drainingNodes returns names of live nodes which are draining, including the current node.
+func (c *Cluster) drainingNodes() []string {
+	var draining []string
+	if globals.drain.isActive() {
+		draining = append(draining, c.thisNodeName)
 	}
+	for _, node := range c.nodeList() {
+		if node.draining && node.failCount < c.fo.nodeFailCountLimit {
+			draining = append(draining, node.name)
+		}
+	}
+	return draining
 }
 
 func (c *Cluster) electLeader() {
 	// Increment the term (voting for myself in this term) and clear the leader
-	c.fo.term++
-	c.fo.leader = ""
+	c.fo.setState(c.fo.term+1, "")
+	c.fo.votedFor = c.thisNodeName
+	c.saveElectionState()
 
 	// Make sure the current node does not report itself as a leader.
 	statsSet("ClusterLeader", 0)
 
 	logs.Info.Println("cluster: leading new election for term", c.fo.term)
 
-	nodeCount := len(c.nodes)
-	// Number of votes needed to elect the leader
-	expectVotes := (nodeCount+1)>>1 + 1
+	nodes := c.nodeList()
+	nodeCount := len(nodes)
 	done := make(chan *rpc.Call, nodeCount)
 
 	// Send async requests for votes to other nodes
-	for _, node := range c.nodes {
+	for _, node := range nodes {
 		response := ClusterVoteResponse{}
 		node.callAsync("Cluster.Vote",
 			&ClusterVoteRequest{
@@ -222,22 +443,29 @@ func (c *Cluster) electLeader() {
 
 	// Number of votes received (1 vote for self)
 	voteCount := 1
+	// Number of nodes which responded, including this one.
+	responded := 1
+	// The vote was abandoned because another node is in a later term.
+	abandoned := false
 	timeout := time.NewTimer(c.fo.heartBeat>>1 + c.fo.heartBeat)
 	// Wait for one of the following
 	// 1. More than half of the nodes voting in favor
 	// 2. All nodes responded.
 	// 3. Timeout.
-	for i := 0; i < nodeCount && voteCount < expectVotes; {
+	for i := 0; i < nodeCount && !c.hasQuorum(voteCount); {
 		select {
 		case call := <-done:
 			if call.Error == nil {
+				responded++
 				if call.Reply.(*ClusterVoteResponse).Result {
 					// Vote in my favor
 					voteCount++
-				} else if c.fo.term < call.Reply.(*ClusterVoteResponse).Term {
+				} else if term := call.Reply.(*ClusterVoteResponse).Term; c.fo.term < term {
 					// Vote against me. Abandon vote: this node's term is behind the cluster
+					c.setTerm(term)
 					i = nodeCount
 					voteCount = 0
+					abandoned = true
 				}
 			}
 
@@ -248,11 +476,17 @@ func (c *Cluster) electLeader() {
 		}
 	}
 
-	if voteCount >= expectVotes {
+	if c.hasQuorum(voteCount) {
 		// Current node elected as the leader.
-		c.fo.leader = c.thisNodeName
+		c.fo.setLeader(c.thisNodeName)
+		c.fo.noQuorum = 0
+		c.setPartitioned(false)
 		statsSet("ClusterLeader", 1)
 		logs.Info.Printf("'%s' elected self as a new leader", c.thisNodeName)
+	} else if !abandoned && !c.hasQuorum(responded) {
+		// Lost the election because the majority of the cluster is unreachable rather than
+		// because of a split vote or a later term elsewhere.
+		c.setPartitioned(true)
 	}
 }
 
@@ -277,7 +511,7 @@ func (c *Cluster) run() {
 				// The counter will be reset to zero when a health check is received.
 				missed++
 				if missed >= c.fo.voteTimeout {
-					// Leader is gone, initiate election of a new leader.
+					// Leader is gone. The election tells if this node is cut off from the majority.
 					missed = 0
 					c.electLeader()
 				}
@@ -292,8 +526,8 @@ func (c *Cluster) run() {
 			}
 
 			if health.Term > c.fo.term {
-				c.fo.term = health.Term
-				c.fo.leader = health.Leader
+				c.setTerm(health.Term)
+				c.fo.setLeader(health.Leader)
 				logs.Info.Printf("cluster: leader '%s' elected", c.fo.leader)
 			} else if health.Leader != c.fo.leader {
 				if c.fo.leader != "" {
@@ -303,20 +537,29 @@ func (c *Cluster) run() {
 				} else {
 					logs.Info.Printf("cluster: leader set to '%s'", health.Leader)
 				}
-				c.fo.leader = health.Leader
+				c.fo.setLeader(health.Leader)
 			}
 
 			// This is a health check from a leader, consequently this node is not the leader.
 			statsSet("ClusterLeader", 0)
+			// The leader which reaches the majority sends health checks.
+			c.setPartitioned(false)
 
 			missed = 0
-			if health.Signature != c.ring.Signature() {
+			if health.Members != nil && c.membersNewer(health.Term, health.Version) {
+				// Membership has changed: connect to new nodes, disconnect from departed nodes.
+				c.applyMembers(health.Members, health.Term, health.Version)
+			}
+			if health.Signature != c.hashRing().Signature() {
 				if rehashSkipped {
 					logs.Info.Println("cluster: rehashing at a request of",
-						health.Leader, health.Nodes, health.Signature, c.ring.Signature())
+						health.Leader, health.Nodes, health.Signature, c.hashRing().Signature())
 					c.rehash(health.Nodes)
-					c.invalidateProxySubs("")
-					c.gcProxySessions(health.Nodes)
+					if !c.topicHandoff {
+						// Proxied sessions are moved to the new masters by the hub otherwise.
+						c.invalidateProxySubs("")
+					}
+					c.gcProxySessions(append(health.Nodes, health.Draining...))
 					rehashSkipped = false
 
 					globals.hub.rehash <- true
@@ -330,16 +573,27 @@ func (c *Cluster) run() {
 				// This is a new election. This node has not voted yet. Vote for the requestor and
 				// clear the current leader.
 				logs.Info.Printf("Voting YES for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
-				c.fo.term = vreq.req.Term
-				c.fo.leader = ""
+				c.fo.setState(vreq.req.Term, "")
+				c.fo.votedFor = vreq.req.Node
+				// The vote must survive the restart: the node must not vote twice in the same term.
+				c.saveElectionState()
 				// Election means these is no leader yet.
 				statsSet("ClusterLeader", 0)
 				vreq.resp <- ClusterVoteResponse{Result: true, Term: c.fo.term}
+			} else if c.fo.term == vreq.req.Term && c.fo.votedFor == vreq.req.Node {
+				// Repeated request from the candidate this node has voted for.
+				vreq.resp <- ClusterVoteResponse{Result: true, Term: c.fo.term}
 			} else {
 				// This node has voted already or stale election, reject.
 				logs.Info.Printf("Voting NO for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
 				vreq.resp <- ClusterVoteResponse{Result: false, Term: c.fo.term}
 			}
+		case join := <-c.fo.memberJoin:
+			resp, err := c.memberJoin(join.req)
+			join.resp <- clusterMembershipResult{join: resp, err: err}
+		case leave := <-c.fo.memberLeave:
+			resp, err := c.memberLeave(leave.req)
+			leave.resp <- clusterMembershipResult{leave: resp, err: err}
 		case <-c.fo.done:
 			return
 		}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net/rpc"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClusterNetwork connects in-process cluster nodes and simulates network partitions.
+type testClusterNetwork struct {
+	lock  sync.Mutex
+	nodes map[string]*Cluster
+	// Nodes which cannot reach each other.
+	cut map[[2]string]bool
+}
+
+func (tn *testClusterNetwork) reachable(from, to string) bool {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+	return tn.nodes[to] != nil && !tn.cut[[2]string{from, to}]
+}
+
+// partition cuts links between the groups of nodes.
+func (tn *testClusterNetwork) partition(groups ...[]string) {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+	tn.cut = make(map[[2]string]bool)
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					tn.cut[[2]string{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+func (tn *testClusterNetwork) heal() {
+	tn.partition()
+}
+
+// testClusterTransport delivers calls to the nodes of the test network.
+type testClusterTransport struct {
+	net  *testClusterNetwork
+	self string
+}
+
+func (t *testClusterTransport) listen(c *Cluster) error {
+	t.net.lock.Lock()
+	t.net.nodes[t.self] = c
+	t.net.lock.Unlock()
+	return nil
+}
+
+func (t *testClusterTransport) dial(name, addr string) (clusterEndpoint, error) {
+	if !t.net.reachable(t.self, name) {
+		return nil, errors.New("unreachable")
+	}
+	return &testClusterEndpoint{t: t, node: name}, nil
+}
+
+func (t *testClusterTransport) close() {}
+
+type testClusterEndpoint struct {
+	t    *testClusterTransport
+	node string
+}
+
+func (ep *testClusterEndpoint) invoke(serviceMethod string, args any, reply any) error {
+	if !ep.t.net.reachable(ep.t.self, ep.node) || !ep.t.net.reachable(ep.node, ep.t.self) {
+		return errors.New("unreachable")
+	}
+	ep.t.net.lock.Lock()
+	rcvr := ep.t.net.nodes[ep.node]
+	ep.t.net.lock.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return err
+	}
+	resp, err := invokeClusterMethod(rcvr, ep.t.self, serviceMethod, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(resp)).Decode(reply)
+}
+
+func (ep *testClusterEndpoint) Go(serviceMethod string, args any, reply any, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	go func() {
+		call.Error = ep.invoke(serviceMethod, args, reply)
+		done <- call
+	}()
+	return call
+}
+
+func (ep *testClusterEndpoint) Call(serviceMethod string, args any, reply any) error {
+	return ep.invoke(serviceMethod, args, reply)
+}
+
+func (ep *testClusterEndpoint) Close() error {
+	return nil
+}
+
+func startTestCluster(t *testing.T, names []string, stateDir string) (*testClusterNetwork, map[string]*Cluster) {
+	tn := &testClusterNetwork{nodes: make(map[string]*Cluster)}
+	clusters := make(map[string]*Cluster)
+	for _, name := range names {
+		c := &Cluster{
+			thisNodeName: name,
+			fingerprint:  1,
+			nodes:        make(map[string]*ClusterNode),
+			members:      make(map[string]ClusterMember),
+			staticNodes:  make(map[string]bool),
+			topicHandoff: true,
+			handoffs:     make(map[string]*ClusterTopicState),
+			transport:    &testClusterTransport{net: tn, self: name},
+		}
+		for i, other := range names {
+			c.members[other] = ClusterMember{Name: other, Addr: other, WorkerId: i + 1}
+			c.staticNodes[other] = true
+			if other != name {
+				c.nodes[other] = c.newNode(other, other)
+			}
+		}
+		conf := &clusterFailoverConfig{Enabled: true, Heartbeat: 20, VoteAfter: 4, NodeFailAfter: 4}
+		if stateDir != "" {
+			conf.StateFile = filepath.Join(stateDir, name+".json")
+		}
+		if !c.failoverInit(conf) {
+			t.Fatal("failover not enabled")
+		}
+		c.transport.listen(c)
+		clusters[name] = c
+	}
+	// Nodes introduce themselves on connection as the global cluster. It does not affect the election.
+	globals.cluster = clusters[names[0]]
+	for _, c := range clusters {
+		for _, n := range c.nodeList() {
+			c.startNode(n)
+		}
+		go c.run()
+	}
+	return tn, clusters
+}
+
+func stopTestCluster(clusters map[string]*Cluster) {
+	for _, c := range clusters {
+		// The second signal is accepted only after the runner has received the first one and stopped.
+		c.fo.done <- true
+		c.fo.done <- true
+		for _, n := range c.nodeList() {
+			n.done <- true
+			n.p2mSender <- nil
+		}
+	}
+	globals.cluster = nil
+}
+
+// waitFor polls the condition until it's met or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); !cond(); {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// startTestHub installs the hub which accepts rehash notifications. Returns the function
+// which removes the hub.
+func startTestHub() func() {
+	rehash := make(chan bool)
+	globals.hub = &Hub{topics: &sync.Map{}, rehash: rehash}
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-rehash:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		globals.hub = nil
+	}
+}
+
+// leaders returns names of nodes which consider themselves leaders.
+func leaders(clusters map[string]*Cluster, names ...string) []string {
+	var result []string
+	for _, name := range names {
+		if _, leader := clusters[name].fo.currentState(); leader == name {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestClusterPartition(t *testing.T) {
+	defer startTestHub()()
+
+	names := []string{"one", "two", "three", "four", "five"}
+	tn, clusters := startTestCluster(t, names, t.TempDir())
+	defer stopTestCluster(clusters)
+
+	if !waitFor(5*time.Second, func() bool { return len(leaders(clusters, names...)) == 1 }) {
+		t.Fatal("leader not elected")
+	}
+	oldLeader := leaders(clusters, names...)[0]
+	oldTerm, _ := clusters[oldLeader].fo.currentState()
+
+	// Cut the leader and one follower off from the majority.
+	minority := []string{oldLeader}
+	var majority []string
+	for _, name := range names {
+		if name == oldLeader {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, name)
+		} else {
+			majority = append(majority, name)
+		}
+	}
+	tn.partition(minority, majority)
+
+	if !waitFor(5*time.Second, func() bool {
+		l := leaders(clusters, majority...)
+		return len(l) == 1 && len(leaders(clusters, minority...)) == 0
+	}) {
+		t.Fatal("majority did not elect a new leader or the old leader did not step down",
+			leaders(clusters, names...))
+	}
+	newLeader := leaders(clusters, majority...)[0]
+	if newTerm, _ := clusters[newLeader].fo.currentState(); newTerm <= oldTerm {
+		t.Errorf("new leader term %d is not greater than %d", newTerm, oldTerm)
+	}
+
+	if !waitFor(5*time.Second, func() bool {
+		for _, name := range minority {
+			if !clusters[name].isPartitioned() {
+				return false
+			}
+		}
+		for _, name := range majority {
+			if atomic.LoadInt32(&clusters[name].fo.partitioned) != 0 {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("partition state not detected")
+	}
+
+	// The majority excludes the minority from the ring hash, the minority keeps the ring as is.
+	if !waitFor(5*time.Second, func() bool {
+		for _, name := range majority {
+			for _, other := range minority {
+				if clusters[name].hashRing().Has(other) {
+					return false
+				}
+			}
+		}
+		return true
+	}) {
+		t.Error("majority did not rehash", leaders(clusters, names...))
+	}
+	for _, name := range minority {
+		if c := clusters[name]; !c.hashRing().Has(name) || !c.hashRing().Has(newLeader) {
+			t.Errorf("minority node '%s' must not rehash", name)
+		}
+	}
+
+	// After the partition heals, all nodes follow one leader and nobody is partitioned.
+	tn.heal()
+	if !waitFor(10*time.Second, func() bool {
+		l := leaders(clusters, names...)
+		if len(l) != 1 {
+			return false
+		}
+		for _, name := range names {
+			c := clusters[name]
+			if _, leader := c.fo.currentState(); leader != l[0] || c.isPartitioned() || !c.hashRing().Has(name) {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("cluster did not recover", leaders(clusters, names...))
+	}
+}
+
+func TestClusterElectionPartitioned(t *testing.T) {
+	defer startTestHub()()
+
+	names := []string{"one", "two", "three"}
+	tn, clusters := startTestCluster(t, names, "")
+	defer stopTestCluster(clusters)
+
+	// Stop the runner of the first node to run its elections directly.
+	one := clusters["one"]
+	one.fo.done <- true
+	defer func() { go one.run() }()
+
+	if !waitFor(5*time.Second, func() bool { return len(leaders(clusters, "two", "three")) == 1 }) {
+		t.Fatal("leader not elected")
+	}
+
+	// Losing the election to the reachable majority does not mean being partitioned.
+	one.fo.setState(0, "")
+	one.electLeader()
+	if one.isPartitioned() {
+		t.Error("node which reached the majority is marked partitioned")
+	}
+
+	tn.partition([]string{"one"}, []string{"two", "three"})
+	defer tn.heal()
+	one.electLeader()
+	if !one.isPartitioned() {
+		t.Error("node which cannot reach the majority is not marked partitioned")
+	}
+}
+
+func TestClusterVoteOncePerTerm(t *testing.T) {
+	dir := t.TempDir()
+	c := &Cluster{
+		thisNodeName: "one",
+		fo:           &clusterFailover{stateFile: filepath.Join(dir, "state.json")},
+		nodes:        map[string]*ClusterNode{"two": {name: "two"}, "three": {name: "three"}},
+	}
+	c.fo.term = 5
+	c.fo.votedFor = "two"
+	c.saveElectionState()
+
+	// Restart.
+	restarted := &Cluster{thisNodeName: "one", fo: &clusterFailover{stateFile: c.fo.stateFile}}
+	if err := restarted.loadElectionState(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.fo.term != 5 || restarted.fo.votedFor != "two" {
+		t.Errorf("state not restored: term %d, vote '%s'", restarted.fo.term, restarted.fo.votedFor)
+	}
+
+	c.setTerm(6)
+	if c.fo.votedFor != "" {
+		t.Error("vote must be reset in a new term")
+	}
+
+	if c.hasQuorum(1) || !c.hasQuorum(2) {
+		t.Error("quorum of 3 nodes is 2")
+	}
+}
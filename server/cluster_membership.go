@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Cluster methods related to dynamic membership. A node which is not listed in the config
+// finds existing members of the cluster through discovery and asks the leader to join.
+// The leader allocates a snowflake worker ID to the node and distributes the updated list
+// of members to followers with health checks. The new node is added to the ring hash once it
+// responds to health checks. When the node shuts down, it asks the leader to remove it from
+// the cluster. The worker ID of the removed node becomes available for allocation.
+
+const (
+	// Time to wait for the leader to accept the node into the cluster.
+	clusterJoinTimeout = 30 * time.Second
+	// Timeout before repeating the join request.
+	clusterJoinRetryTime = time.Second
+	// Default interval between checks of discovery sources for changes.
+	clusterDefaultDiscoveryInterval = 30 * time.Second
+	// Maximum value of a snowflake worker ID.
+	clusterMaxWorkerId = 1023
+)
+
+type clusterDiscoveryConfig struct {
+	// Source of addresses of cluster nodes: "static", "dns", "file" or "bus".
+	Type string `json:"type"`
+	// Addresses of existing cluster nodes in the form host:port for "static" discovery.
+	Seeds []string `json:"seeds"`
+	// Name to query for DNS SRV records for "dns" discovery, e.g. "_tinode._tcp.example.com".
+	Srv string `json:"srv"`
+	// Path to file with addresses of cluster nodes, one per line, for "file" discovery.
+	File string `json:"file"`
+	// Interval in seconds between checks of DNS records or the file for changes.
+	Interval int `json:"interval"`
+}
+
+// ClusterMember is a description of a cluster node.
+type ClusterMember struct {
+	// Name of the node
+	Name string
+	// TCP address of the node in the form host:port
+	Addr string
+	// Snowflake worker ID allocated to the node
+	WorkerId int
+}
+
+// ClusterJoinRequest is a request from a node to join the cluster.
+type ClusterJoinRequest struct {
+	// Name of the node which wants to join
+	Node string
+	// TCP address of the node
+	Addr string
+	// Worker ID of the node if the node is rejoining the cluster, 0 otherwise
+	WorkerId int
+}
+
+// ClusterJoinResponse is a response to a request to join the cluster.
+type ClusterJoinResponse struct {
+	// Name and address of the leader if the request was sent to a follower.
+	// The request must be repeated at the leader.
+	Leader     string
+	LeaderAddr string
+
+	// Worker ID allocated to the node
+	WorkerId int
+	// All members of the cluster, including the new node
+	Members []ClusterMember
+	// Election term of the leader and the version of the membership list
+	Term    int
+	Version int64
+}
+
+// ClusterLeaveRequest is a request from a node to leave the cluster.
+type ClusterLeaveRequest struct {
+	// Name of the node which is leaving
+	Node string
+}
+
+// ClusterLeaveResponse is a response to a request to leave the cluster.
+type ClusterLeaveResponse struct {
+	// Name of the leader if the request was sent to a follower.
+	Leader string
+}
+
+// clusterMembershipResult is an outcome of processing a join or leave request.
+type clusterMembershipResult struct {
+	join  *ClusterJoinResponse
+	leave *ClusterLeaveResponse
+	err   error
+}
+
+// clusterJoin is a request to join the cluster and a response channel.
+type clusterJoin struct {
+	req  *ClusterJoinRequest
+	resp chan clusterMembershipResult
+}
+
+// clusterLeave is a request to leave the cluster and a response channel.
+type clusterLeave struct {
+	req  *ClusterLeaveRequest
+	resp chan clusterMembershipResult
+}
+
+// Join processes a request from a node to join the cluster.
+func (c *Cluster) Join(req *ClusterJoinRequest, resp *ClusterJoinResponse) error {
+	if c.fo == nil || c.discovery == nil {
+		return errors.New("cluster: dynamic membership is disabled")
+	}
+
+	result := make(chan clusterMembershipResult, 1)
+	c.fo.memberJoin <- &clusterJoin{req: req, resp: result}
+	res := <-result
+	if res.err != nil {
+		return res.err
+	}
+	*resp = *res.join
+	return nil
+}
+
+// Leave processes a request from a node to leave the cluster.
+func (c *Cluster) Leave(req *ClusterLeaveRequest, resp *ClusterLeaveResponse) error {
+	if c.fo == nil || c.discovery == nil {
+		return errors.New("cluster: dynamic membership is disabled")
+	}
+
+	result := make(chan clusterMembershipResult, 1)
+	c.fo.memberLeave <- &clusterLeave{req: req, resp: result}
+	res := <-result
+	if res.err != nil {
+		return res.err
+	}
+	*resp = *res.leave
+	return nil
+}
+
+// leaderAddr returns name and address of the current leader.
+func (c *Cluster) leaderAddr() (string, string, error) {
+	_, leader := c.fo.currentState()
+	if leader == "" {
+		return "", "", errors.New("cluster: leader is not elected")
+	}
+	c.nodesLock.RLock()
+	addr := c.members[leader].Addr
+	c.nodesLock.RUnlock()
+	return leader, addr, nil
+}
+
+// memberJoin adds the node to the cluster. Called by the failover runner.
+func (c *Cluster) memberJoin(req *ClusterJoinRequest) (*ClusterJoinResponse, error) {
+	if c.fo.leader != c.thisNodeName {
+		leader, addr, err := c.leaderAddr()
+		if err != nil {
+			return nil, err
+		}
+		return &ClusterJoinResponse{Leader: leader, LeaderAddr: addr}, nil
+	}
+
+	if req.Node == "" || req.Addr == "" {
+		return nil, errors.New("cluster: invalid join request")
+	}
+	if req.Node == c.thisNodeName || c.staticNodes[req.Node] {
+		return nil, errors.New("cluster: node name '" + req.Node + "' is reserved")
+	}
+
+	c.nodesLock.Lock()
+	member, known := c.members[req.Node]
+	node := c.nodes[req.Node]
+	if known && member.Addr != req.Addr && node != nil && node.failCount < c.fo.nodeFailCountLimit {
+		c.nodesLock.Unlock()
+		return nil, errors.New("cluster: node '" + req.Node + "' is active at " + member.Addr)
+	}
+
+	workerId := member.WorkerId
+	if req.WorkerId != 0 {
+		// The node is rejoining the cluster. It must keep the worker ID: its UID generator is already initialized.
+		if owner := workerIdOwner(c.members, req.WorkerId); owner != "" && owner != req.Node {
+			c.nodesLock.Unlock()
+			return nil, errors.New("cluster: worker ID " + strconv.Itoa(req.WorkerId) + " is used by '" + owner + "'")
+		}
+		workerId = req.WorkerId
+	} else if workerId == 0 {
+		if workerId = allocWorkerId(c.members); workerId == 0 {
+			c.nodesLock.Unlock()
+			return nil, errors.New("cluster: no worker IDs available")
+		}
+	}
+
+	c.members[req.Node] = ClusterMember{Name: req.Node, Addr: req.Addr, WorkerId: workerId}
+	c.membersTerm = c.fo.term
+	c.membersVersion++
+
+	var added *ClusterNode
+	if node == nil {
+		added = c.newNode(req.Node, req.Addr)
+		// The node does not accept connections yet. It will be added to the ring hash
+		// once it responds to health checks.
+		added.failCount = c.fo.nodeFailCountLimit
+		c.nodes[req.Node] = added
+	} else {
+		node.lock.Lock()
+		node.address = req.Addr
+		node.lock.Unlock()
+	}
+	c.nodesLock.Unlock()
+
+	if added != nil {
+		c.startNode(added)
+	}
+	statsSet("TotalClusterNodes", int64(c.nodeCount()+1))
+
+	logs.Info.Printf("cluster: node '%s' [%s] joined as worker %d", req.Node, req.Addr, workerId)
+
+	members, version := c.memberList()
+	return &ClusterJoinResponse{WorkerId: workerId, Members: members, Term: c.fo.term, Version: version}, nil
+}
+
+// memberLeave removes the node from the cluster. Called by the failover runner.
+func (c *Cluster) memberLeave(req *ClusterLeaveRequest) (*ClusterLeaveResponse, error) {
+	if c.fo.leader != c.thisNodeName {
+		leader, _, err := c.leaderAddr()
+		if err != nil {
+			return nil, err
+		}
+		return &ClusterLeaveResponse{Leader: leader}, nil
+	}
+
+	if c.staticNodes[req.Node] {
+		return nil, errors.New("cluster: node '" + req.Node + "' is listed in the config and cannot leave")
+	}
+
+	c.nodesLock.Lock()
+	if _, ok := c.members[req.Node]; !ok {
+		c.nodesLock.Unlock()
+		return &ClusterLeaveResponse{}, nil
+	}
+	delete(c.members, req.Node)
+	c.membersTerm = c.fo.term
+	c.membersVersion++
+	node := c.nodes[req.Node]
+	c.nodesLock.Unlock()
+
+	logs.Info.Printf("cluster: node '%s' left the cluster", req.Node)
+
+	if req.Node == c.thisNodeName {
+		// The leader itself is leaving: let followers know before shutting down.
+		// The new leader will exclude this node from the ring hash.
+		c.sendHealthChecks()
+	} else if node != nil {
+		// The ring hash is updated with the next round of health checks.
+		c.removeNode(node)
+		statsSet("TotalClusterNodes", int64(c.nodeCount()+1))
+	}
+
+	return &ClusterLeaveResponse{}, nil
+}
+
+// membersNewer checks if the membership list produced by the leader of the given term supersedes
+// the current list. A leader of a newer term overrides lists of previous leaders regardless of version.
+func (c *Cluster) membersNewer(term int, version int64) bool {
+	c.nodesLock.RLock()
+	defer c.nodesLock.RUnlock()
+	return term > c.membersTerm || (term == c.membersTerm && version > c.membersVersion)
+}
+
+// applyMembers replaces the list of cluster members with the one received from the leader.
+// Called by the failover runner.
+func (c *Cluster) applyMembers(members []ClusterMember, term int, version int64) {
+	var added, removed []*ClusterNode
+
+	c.nodesLock.Lock()
+	c.members = make(map[string]ClusterMember, len(members))
+	for _, member := range members {
+		c.members[member.Name] = member
+		if member.Name == c.thisNodeName {
+			continue
+		}
+		if n := c.nodes[member.Name]; n == nil {
+			n = c.newNode(member.Name, member.Addr)
+			c.nodes[member.Name] = n
+			added = append(added, n)
+		} else {
+			n.lock.Lock()
+			n.address = member.Addr
+			n.lock.Unlock()
+		}
+	}
+	for name, n := range c.nodes {
+		if _, ok := c.members[name]; !ok {
+			removed = append(removed, n)
+		}
+	}
+	_, isMember := c.members[c.thisNodeName]
+	c.membersTerm = term
+	c.membersVersion = version
+	c.nodesLock.Unlock()
+
+	for _, n := range added {
+		logs.Info.Printf("cluster: node '%s' [%s] joined", n.name, n.address)
+		c.startNode(n)
+	}
+	for _, n := range removed {
+		logs.Info.Printf("cluster: node '%s' left", n.name)
+		c.removeNode(n)
+	}
+	statsSet("TotalClusterNodes", int64(c.nodeCount()+1))
+
+	if !isMember {
+		if c.discovery == nil || c.staticNodes[c.thisNodeName] {
+			logs.Err.Printf("cluster: node '%s' is missing from the list of members of the leader", c.thisNodeName)
+		} else {
+			// The leader has lost track of this node, e.g. all other nodes were restarted.
+			go c.rejoin()
+		}
+	}
+}
+
+// discoveryChanged feeds changes found by discovery into cluster membership: the node rejoins the cluster
+// if the leader lost track of it, unreachable nodes which are no longer discovered are removed from the cluster.
+// Called by the discovery watcher. Returns departed addresses which no longer need to be tracked.
+func (c *Cluster) discoveryChanged(added, departed []string) []string {
+	if len(added) > 0 {
+		logs.Info.Println("cluster: discovered nodes", added)
+		c.nodesLock.RLock()
+		_, isMember := c.members[c.thisNodeName]
+		c.nodesLock.RUnlock()
+		if !isMember && !c.staticNodes[c.thisNodeName] {
+			go c.rejoin()
+		}
+	}
+
+	names, settled := c.departedMembers(departed)
+	for _, name := range names {
+		// Only the leader removes nodes, followers receive a redirect which is ignored.
+		result := make(chan clusterMembershipResult, 1)
+		c.fo.memberLeave <- &clusterLeave{req: &ClusterLeaveRequest{Node: name}, resp: result}
+		if res := <-result; res.err != nil {
+			logs.Warn.Println("cluster: failed to remove node which is no longer discovered", name, res.err)
+		} else if res.leave.Leader == "" {
+			logs.Info.Printf("cluster: node '%s' is no longer discovered, removed from the cluster", name)
+		}
+	}
+	return settled
+}
+
+// departedMembers finds members at the departed addresses which should be removed from the cluster.
+// Nodes which are still connected are kept: they leave on shutdown or are removed once they stop responding.
+// Returns names of members to remove and departed addresses which do not belong to any removable member.
+func (c *Cluster) departedMembers(departed []string) ([]string, []string) {
+	c.nodesLock.RLock()
+	byAddr := make(map[string]string, len(c.members))
+	for name, member := range c.members {
+		byAddr[member.Addr] = name
+	}
+	c.nodesLock.RUnlock()
+
+	var names, settled []string
+	for _, addr := range departed {
+		name, ok := byAddr[addr]
+		if !ok || name == c.thisNodeName || c.staticNodes[name] {
+			settled = append(settled, addr)
+			continue
+		}
+		if n := c.node(name); n != nil {
+			n.lock.Lock()
+			connected := n.connected
+			n.lock.Unlock()
+			if connected {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	return names, settled
+}
+
+// removeNode disconnects from the node which left the cluster.
+func (c *Cluster) removeNode(n *ClusterNode) {
+	c.gcProxySessionsForNode(n.name)
+	c.invalidateProxySubs(n.name)
+
+	c.nodesLock.Lock()
+	delete(c.nodes, n.name)
+	c.nodesLock.Unlock()
+
+	// Channels are not closed: requests may still be in flight. Replies which arrive after
+	// the loops have stopped are discarded.
+	go func() {
+		n.p2mSender <- nil
+		n.rpcDone <- nil
+	}()
+	n.lock.Lock()
+	if n.connected {
+		n.endpoint.Close()
+		n.connected = false
+		statsInc("LiveClusterNodes", -1)
+	}
+	n.lock.Unlock()
+	select {
+	case n.done <- true:
+	default:
+	}
+}
+
+// setMembers initializes the list of cluster members.
+func (c *Cluster) setMembers(members []ClusterMember, term int, version int64) {
+	c.nodesLock.Lock()
+	c.members = make(map[string]ClusterMember, len(members))
+	for _, member := range members {
+		c.members[member.Name] = member
+	}
+	c.membersTerm = term
+	c.membersVersion = version
+	c.nodesLock.Unlock()
+}
+
+// memberList returns the list of cluster members sorted by name and the version of the list.
+func (c *Cluster) memberList() ([]ClusterMember, int64) {
+	c.nodesLock.RLock()
+	members := make([]ClusterMember, 0, len(c.members))
+	for _, member := range c.members {
+		members = append(members, member)
+	}
+	version := c.membersVersion
+	c.nodesLock.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, version
+}
+
+// join asks the leader to accept this node into the cluster. Nodes to send the request to
+// are obtained through discovery. Requests are repeated until accepted or the timeout expires.
+func (c *Cluster) join(timeout time.Duration) (*ClusterJoinResponse, error) {
+	req := &ClusterJoinRequest{Node: c.thisNodeName, Addr: c.listenOn, WorkerId: c.workerId}
+	deadline := time.Now().Add(timeout)
+	for {
+		seeds, err := c.discovery.resolve()
+		if err != nil {
+			logs.Warn.Println("cluster: discovery failed", err)
+		}
+		for _, addr := range seeds {
+			if addr == c.listenOn {
+				continue
+			}
+			resp, err := c.joinAt(addr, req)
+			if err != nil {
+				logs.Warn.Println("cluster: join request failed", addr, err)
+				continue
+			}
+			if c.workerId != 0 && resp.WorkerId != c.workerId {
+				return nil, errors.New("cluster: leader allocated a different worker ID " + strconv.Itoa(resp.WorkerId))
+			}
+			c.workerId = resp.WorkerId
+			return resp, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("cluster: join request not accepted")
+		}
+		time.Sleep(clusterJoinRetryTime)
+	}
+}
+
+// rejoin repeats the request to join the cluster when the leader lost track of this node.
+func (c *Cluster) rejoin() {
+	if !atomic.CompareAndSwapInt32(&c.discovery.rejoining, 0, 1) {
+		// Already rejoining.
+		return
+	}
+	defer atomic.StoreInt32(&c.discovery.rejoining, 0)
+
+	if _, err := c.join(clusterJoinTimeout); err != nil {
+		logs.Err.Println("cluster: failed to rejoin", err)
+		return
+	}
+	logs.Info.Printf("cluster: node '%s' rejoined the cluster", c.thisNodeName)
+}
+
+// leave asks the leader to remove this node from the cluster.
+func (c *Cluster) leave() {
+	req := &ClusterLeaveRequest{Node: c.thisNodeName}
+	result := make(chan clusterMembershipResult, 1)
+	c.fo.memberLeave <- &clusterLeave{req: req, resp: result}
+	res := <-result
+
+	err := res.err
+	if err == nil && res.leave.Leader != "" {
+		// This node is a follower: forward the request to the leader.
+		var resp ClusterLeaveResponse
+		if n := c.node(res.leave.Leader); n != nil {
+			err = n.call("Cluster.Leave", req, &resp)
+		} else {
+			err = errors.New("cluster: leader '" + res.leave.Leader + "' not found")
+		}
+	}
+
+	if err != nil {
+		logs.Warn.Println("cluster: failed to leave the cluster", err)
+	} else {
+		logs.Info.Printf("cluster: node '%s' left the cluster", c.thisNodeName)
+	}
+}
+
+// joinAt sends the join request to the node at the given address. If the node is
+// a follower, the request is repeated at the leader.
+func (c *Cluster) joinAt(addr string, req *ClusterJoinRequest) (*ClusterJoinResponse, error) {
+	for redirects := 0; redirects < 2; redirects++ {
+		var resp ClusterJoinResponse
+		if err := c.callAddr(addr, "Cluster.Join", req, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Leader == "" {
+			return &resp, nil
+		}
+		addr = resp.LeaderAddr
+	}
+	return nil, errors.New("cluster: leader changed")
+}
+
+// allocWorkerId returns the smallest worker ID not used by any of the members or 0 if all IDs are taken.
+func allocWorkerId(members map[string]ClusterMember) int {
+	used := make(map[int]bool, len(members))
+	for _, member := range members {
+		used[member.WorkerId] = true
+	}
+	for id := 1; id <= clusterMaxWorkerId; id++ {
+		if !used[id] {
+			return id
+		}
+	}
+	return 0
+}
+
+// workerIdOwner returns the name of the member which uses the given worker ID.
+func workerIdOwner(members map[string]ClusterMember, workerId int) string {
+	for _, member := range members {
+		if member.WorkerId == workerId {
+			return member.Name
+		}
+	}
+	return ""
+}
+
+// clusterDiscovery finds addresses of existing cluster nodes.
+type clusterDiscovery struct {
+	conf     *clusterDiscoveryConfig
+	interval time.Duration
+	// Addresses of nodes listed in the config.
+	static []string
+
+	lock sync.Mutex
+	// Most recently discovered addresses.
+	seeds []string
+	// Addresses found by the most recent check for changes.
+	known map[string]bool
+	// Addresses which disappeared from the discovery source and may still belong to cluster members.
+	departed map[string]bool
+	// Modification time of the file with addresses when it was last read.
+	modTime time.Time
+	// Names of nodes sending heartbeats for "bus" discovery.
+	peers func() []string
+
+	// Set to 1 while the node is rejoining the cluster.
+	rejoining int32
+	// Channel for stopping the watcher.
+	stop chan<- bool
+}
+
+func newClusterDiscovery(conf *clusterDiscoveryConfig, nodes []clusterNodeConfig) (*clusterDiscovery, error) {
+	switch conf.Type {
+	case "static":
+		if len(conf.Seeds) == 0 && len(nodes) == 0 {
+			return nil, errors.New("discovery: no seed nodes")
+		}
+	case "dns":
+		if conf.Srv == "" {
+			return nil, errors.New("discovery: missing SRV name")
+		}
+	case "file":
+		if conf.File == "" {
+			return nil, errors.New("discovery: missing file name")
+		}
+	case "bus":
+		// Nodes are discovered by their heartbeats on the message bus.
+	default:
+		return nil, errors.New("discovery: unknown type '" + conf.Type + "'")
+	}
+
+	d := &clusterDiscovery{conf: conf, interval: clusterDefaultDiscoveryInterval}
+	if conf.Interval > 0 {
+		d.interval = time.Duration(conf.Interval) * time.Second
+	}
+	for _, node := range nodes {
+		d.static = append(d.static, node.Addr)
+	}
+	return d, nil
+}
+
+// resolve returns addresses of known cluster nodes. If the source is not available,
+// the most recently discovered addresses are returned along with the error.
+func (d *clusterDiscovery) resolve() ([]string, error) {
+	var found []string
+	var err error
+	switch d.conf.Type {
+	case "static":
+		found = d.conf.Seeds
+	case "dns":
+		found, err = lookupSrvSeeds(d.conf.Srv)
+	case "file":
+		found, err = d.readFile()
+	case "bus":
+		if d.peers != nil {
+			found = d.peers()
+		}
+	}
+
+	d.lock.Lock()
+	if err == nil {
+		d.seeds = found
+	} else {
+		found = d.seeds
+	}
+	d.lock.Unlock()
+
+	seeds := make([]string, 0, len(d.static)+len(found))
+	seen := make(map[string]bool)
+	for _, addr := range append(d.static, found...) {
+		if !seen[addr] {
+			seen[addr] = true
+			seeds = append(seeds, addr)
+		}
+	}
+	return seeds, err
+}
+
+// readFile reads the file with addresses if it has changed since the last read.
+func (d *clusterDiscovery) readFile() ([]string, error) {
+	info, err := os.Stat(d.conf.File)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	unchanged := info.ModTime().Equal(d.modTime)
+	seeds := d.seeds
+	d.lock.Unlock()
+	if unchanged {
+		return seeds, nil
+	}
+
+	file, err := os.Open(d.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if seeds, err = parseSeedList(file); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	d.modTime = info.ModTime()
+	d.lock.Unlock()
+	return seeds, nil
+}
+
+// parseSeedList reads addresses in the form host:port, one per line. Lines starting with '#' are comments.
+func parseSeedList(r io.Reader) ([]string, error) {
+	var seeds []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
+
+// lookupSrvSeeds returns addresses of nodes from DNS SRV records.
+func lookupSrvSeeds(name string) ([]string, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var seeds []string
+	for _, addr := range addrs {
+		seeds = append(seeds, net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port))))
+	}
+	return seeds, nil
+}
+
+// update resolves addresses of nodes and compares them with the result of the previous call.
+// Returns newly discovered addresses and all departed addresses which are not forgotten yet.
+func (d *clusterDiscovery) update() ([]string, []string, error) {
+	seeds, err := d.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.departed == nil {
+		d.departed = make(map[string]bool)
+	}
+	current := make(map[string]bool, len(seeds))
+	var added []string
+	for _, addr := range seeds {
+		current[addr] = true
+		if !d.known[addr] {
+			added = append(added, addr)
+		}
+		delete(d.departed, addr)
+	}
+	for addr := range d.known {
+		if !current[addr] {
+			d.departed[addr] = true
+		}
+	}
+	d.known = current
+
+	departed := make([]string, 0, len(d.departed))
+	for addr := range d.departed {
+		departed = append(departed, addr)
+	}
+	sort.Strings(departed)
+	return added, departed, nil
+}
+
+// forget stops tracking the departed addresses.
+func (d *clusterDiscovery) forget(addrs []string) {
+	d.lock.Lock()
+	for _, addr := range addrs {
+		delete(d.departed, addr)
+	}
+	d.lock.Unlock()
+}
+
+// run periodically checks the discovery source for changes and reports them to the cluster.
+// The callback returns departed addresses which no longer need to be tracked.
+func (d *clusterDiscovery) run(changed func(added, departed []string) []string) chan<- bool {
+	stop := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				added, departed, err := d.update()
+				if err != nil {
+					logs.Warn.Println("cluster: discovery failed", err)
+					continue
+				}
+				if len(added) > 0 || len(departed) > 0 {
+					d.forget(changed(added, departed))
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
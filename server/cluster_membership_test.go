@@ -0,0 +1,235 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLeader() *Cluster {
+	c := &Cluster{
+		thisNodeName: "one",
+		nodes:        make(map[string]*ClusterNode),
+		members:      make(map[string]ClusterMember),
+		staticNodes:  map[string]bool{"one": true, "two": true, "three": true},
+		discovery:    &clusterDiscovery{conf: &clusterDiscoveryConfig{Type: "static"}},
+		transport:    &clusterRPC{},
+		fo: &clusterFailover{
+			leader:             "one",
+			nodeFailCountLimit: 3,
+		},
+	}
+	for i, name := range []string{"one", "two", "three"} {
+		c.members[name] = ClusterMember{Name: name, Addr: "127.0.0.1:0", WorkerId: i + 1}
+		if name != c.thisNodeName {
+			c.nodes[name] = c.newNode(name, "127.0.0.1:0")
+		}
+	}
+	return c
+}
+
+func TestClusterMemberJoinLeave(t *testing.T) {
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() { globals.hub = nil }()
+
+	c := newTestLeader()
+
+	resp, err := c.memberJoin(&ClusterJoinRequest{Node: "four", Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.WorkerId != 4 || len(resp.Members) != 4 || resp.Version != 1 {
+		t.Errorf("unexpected join response %+v", resp)
+	}
+	if n := c.node("four"); n == nil || n.failCount != c.fo.nodeFailCountLimit {
+		t.Error("new node must be added as inactive")
+	}
+
+	// Restarted node keeps its worker ID.
+	if resp, err = c.memberJoin(&ClusterJoinRequest{Node: "four", Addr: "127.0.0.1:0"}); err != nil || resp.WorkerId != 4 {
+		t.Errorf("expected worker ID 4 after restart, got %+v %v", resp, err)
+	}
+
+	// Static nodes don't join.
+	if _, err = c.memberJoin(&ClusterJoinRequest{Node: "two", Addr: "127.0.0.1:0"}); err == nil {
+		t.Error("static node name must be rejected")
+	}
+	// Worker ID of a rejoining node is taken by another node.
+	if _, err = c.memberJoin(&ClusterJoinRequest{Node: "five", Addr: "127.0.0.1:0", WorkerId: 2}); err == nil {
+		t.Error("worker ID in use must be rejected")
+	}
+
+	if _, err = c.memberLeave(&ClusterLeaveRequest{Node: "four"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.node("four") != nil {
+		t.Error("departed node must be removed")
+	}
+	if _, err = c.memberLeave(&ClusterLeaveRequest{Node: "three"}); err == nil {
+		t.Error("static node must not leave")
+	}
+
+	// Worker ID of the departed node is reused.
+	if resp, err = c.memberJoin(&ClusterJoinRequest{Node: "five", Addr: "127.0.0.1:0"}); err != nil || resp.WorkerId != 4 {
+		t.Errorf("expected worker ID 4 to be reused, got %+v %v", resp, err)
+	}
+
+	// Follower redirects to the leader.
+	c.fo.leader = "two"
+	if resp, err = c.memberJoin(&ClusterJoinRequest{Node: "six", Addr: "127.0.0.1:0"}); err != nil || resp.Leader != "two" {
+		t.Errorf("expected redirect to the leader, got %+v %v", resp, err)
+	}
+}
+
+func TestClusterRemoveNodeStopsLoops(t *testing.T) {
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() { globals.hub = nil }()
+
+	c := newTestLeader()
+	n := c.nodes["two"]
+	// The node is ready for use as soon as it's created.
+	if n.rpcDone == nil || n.p2mSender == nil {
+		t.Fatal("node must be initialized before it's published")
+	}
+
+	rpcStopped, p2mStopped := make(chan bool), make(chan bool)
+	go func() {
+		n.asyncRpcLoop()
+		close(rpcStopped)
+	}()
+	go func() {
+		n.p2mSenderLoop()
+		close(p2mStopped)
+	}()
+
+	c.removeNode(n)
+	for _, stopped := range []chan bool{rpcStopped, p2mStopped} {
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("node loops must stop when the node is removed")
+		}
+	}
+}
+
+func TestClusterDiscoveryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes")
+	if err := os.WriteFile(path, []byte("# seed nodes\nnode1:12001\n\nnode2:12002\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newClusterDiscovery(&clusterDiscoveryConfig{Type: "file", File: path},
+		[]clusterNodeConfig{{Name: "one", Addr: "node1:12001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds, err := d.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seeds, []string{"node1:12001", "node2:12002"}) {
+		t.Errorf("unexpected seeds %v", seeds)
+	}
+
+	// Changes to the file are picked up.
+	if err = os.WriteFile(path, []byte("node3:12003\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if seeds, _ = d.resolve(); !reflect.DeepEqual(seeds, []string{"node1:12001", "node3:12003"}) {
+		t.Errorf("unexpected seeds after update %v", seeds)
+	}
+
+	// Invalid file keeps the last known seeds.
+	if err = os.WriteFile(path, []byte("node4\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(path, future, future)
+	if seeds, err = d.resolve(); err == nil || !reflect.DeepEqual(seeds, []string{"node1:12001", "node3:12003"}) {
+		t.Errorf("expected error and last known seeds, got %v %v", seeds, err)
+	}
+
+	if _, err = parseSeedList(strings.NewReader("host:1\nbad address\n")); err == nil {
+		t.Error("expected error for invalid address")
+	}
+	if _, err = newClusterDiscovery(&clusterDiscoveryConfig{Type: "consul"}, nil); err == nil {
+		t.Error("expected error for unknown discovery type")
+	}
+}
+
+func TestClusterMembersVersion(t *testing.T) {
+	c := newTestLeader()
+	c.setMembers(nil, 2, 5)
+
+	if c.membersNewer(2, 4) || c.membersNewer(2, 5) || c.membersNewer(1, 9) {
+		t.Error("older membership list must be rejected")
+	}
+	if !c.membersNewer(2, 6) {
+		t.Error("newer version must be accepted")
+	}
+	if !c.membersNewer(3, 1) {
+		t.Error("list of a leader of a newer term must be accepted")
+	}
+}
+
+func TestClusterDiscoveryChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes")
+	writeSeeds := func(data string, at time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, at, at)
+	}
+	writeSeeds("node4:12004\nnode5:12005\n", time.Now())
+
+	d, err := newClusterDiscovery(&clusterDiscoveryConfig{Type: "file", File: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, departed, err := d.update()
+	if err != nil || !reflect.DeepEqual(added, []string{"node4:12004", "node5:12005"}) || len(departed) != 0 {
+		t.Fatalf("unexpected initial update %v %v %v", added, departed, err)
+	}
+
+	writeSeeds("node5:12005\nnode6:12006\n", time.Now().Add(time.Minute))
+	added, departed, _ = d.update()
+	if !reflect.DeepEqual(added, []string{"node6:12006"}) || !reflect.DeepEqual(departed, []string{"node4:12004"}) {
+		t.Fatalf("unexpected update %v %v", added, departed)
+	}
+
+	c := newTestLeader()
+	c.members["four"] = ClusterMember{Name: "four", Addr: "node4:12004", WorkerId: 4}
+	c.nodes["four"] = c.newNode("four", "node4:12004")
+	c.nodes["four"].connected = true
+
+	// Connected node is not removed, the address is still tracked.
+	names, settled := c.departedMembers(departed)
+	if len(names) != 0 || len(settled) != 0 {
+		t.Errorf("connected node must be kept %v %v", names, settled)
+	}
+	d.forget(settled)
+	if _, departed, _ = d.update(); !reflect.DeepEqual(departed, []string{"node4:12004"}) {
+		t.Errorf("departed address must be tracked %v", departed)
+	}
+
+	c.nodes["four"].connected = false
+	if names, _ = c.departedMembers(departed); !reflect.DeepEqual(names, []string{"four"}) {
+		t.Errorf("unreachable departed node must be removed %v", names)
+	}
+
+	// Address which does not belong to any member is forgotten.
+	delete(c.members, "four")
+	names, settled = c.departedMembers(departed)
+	d.forget(settled)
+	if _, departed, _ = d.update(); len(names) != 0 || len(departed) != 0 {
+		t.Errorf("departed address must be forgotten %v %v", names, departed)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Authentication and encryption of connections between cluster nodes. With TLS enabled, nodes
+// present certificates issued by the cluster CA to each other. The certificate of a node must
+// contain the name of the node as the Common Name or as a DNS Subject Alternative Name.
+// Alternatively or in addition, nodes authenticate each other with a challenge-response handshake
+// using a shared secret. Without TLS the handshake does not protect traffic from eavesdropping
+// or tampering and should be used on trusted networks only.
+
+const (
+	// Length of the random challenge in the shared secret handshake.
+	clusterNonceLength = 32
+	// Minimum length of the shared secret.
+	clusterMinSecretLength = 16
+)
+
+type clusterTLSConfig struct {
+	// TLS is enabled for connections between nodes.
+	Enabled bool `json:"enabled"`
+	// Certificate and private key of this node.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Certificate of the CA which issued certificates of cluster nodes.
+	CAFile string `json:"ca_file"`
+}
+
+// clusterSecurity authenticates connections between cluster nodes.
+type clusterSecurity struct {
+	// TLS configs for outbound and inbound connections; nil if TLS is disabled.
+	clientTLS *tls.Config
+	serverTLS *tls.Config
+	// CA which issued node certificates.
+	ca *x509.CertPool
+	// Shared secret; nil if the handshake is disabled.
+	secret []byte
+}
+
+// newClusterSecurity creates security settings for connections between nodes.
+// Returns nil if neither TLS nor the shared secret is configured.
+func newClusterSecurity(conf *clusterTLSConfig, secret string) (*clusterSecurity, error) {
+	if (conf == nil || !conf.Enabled) && secret == "" {
+		return nil, nil
+	}
+
+	s := &clusterSecurity{}
+	if secret != "" {
+		if len(secret) < clusterMinSecretLength {
+			return nil, errors.New("cluster: shared secret is too short")
+		}
+		s.secret = []byte(secret)
+	}
+
+	if conf != nil && conf.Enabled {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.ca = x509.NewCertPool()
+		if !s.ca.AppendCertsFromPEM(pem) {
+			return nil, errors.New("cluster: no certificates found in " + conf.CAFile)
+		}
+
+		s.serverTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAnyClientCert,
+			MinVersion:   tls.VersionTLS12,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return s.verifyPeer(rawCerts, "")
+			},
+		}
+		s.clientTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			// Certificates are verified by VerifyPeerCertificate against the cluster CA and the node name.
+			InsecureSkipVerify: true,
+		}
+	}
+
+	return s, nil
+}
+
+// verifyPeer checks that the peer certificate is issued by the cluster CA and, if the name
+// is not empty, that the certificate belongs to the node with the given name.
+func (s *clusterSecurity) verifyPeer(rawCerts [][]byte, name string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("cluster: peer certificate missing")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         s.ca,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+
+	if name != "" && !certHasName(certs[0], name) {
+		return errors.New("cluster: certificate does not belong to node '" + name + "'")
+	}
+	return nil
+}
+
+// certHasName checks if the certificate is issued to the node with the given name.
+func certHasName(cert *x509.Certificate, name string) bool {
+	if cert.Subject.CommonName == name {
+		return true
+	}
+	for _, dnsName := range cert.DNSNames {
+		if dnsName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the cluster node at the given address. If name is not empty, the peer
+// must present the certificate of the node with this name.
+func (s *clusterSecurity) dial(name, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, clusterNetworkTimeout)
+	if err != nil || s == nil {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(clusterNetworkTimeout))
+	if s.clientTLS != nil {
+		conf := s.clientTLS.Clone()
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return s.verifyPeer(rawCerts, name)
+		}
+		tlsConn := tls.Client(conn, conf)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if s.secret != nil {
+		if err = s.handshakeClient(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// accept authenticates the inbound connection. The isKnown callback checks if the node
+// which presented the certificate is allowed to connect. Returns the names of the node from its
+// certificate or nil if the name of the node is not authenticated.
+func (s *clusterSecurity) accept(conn net.Conn, isKnown func(name string) bool) (net.Conn, []string, error) {
+	if s == nil {
+		return conn, nil, nil
+	}
+
+	var names []string
+	conn.SetDeadline(time.Now().Add(clusterNetworkTimeout))
+	if s.serverTLS != nil {
+		tlsConn := tls.Server(conn, s.serverTLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		// The certificate chain is already verified by the handshake.
+		cert := tlsConn.ConnectionState().PeerCertificates[0]
+		names = append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		known := false
+		for _, name := range names {
+			known = known || isKnown(name)
+		}
+		if !known {
+			return nil, nil, errors.New("cluster: certificate of unknown node '" + cert.Subject.CommonName + "'")
+		}
+		conn = tlsConn
+	}
+	if s.secret != nil {
+		if err := s.handshakeServer(conn); err != nil {
+			return nil, nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, names, nil
+}
+
+// clusterRequestSender returns the name of the node which claims to send the request
+// or an empty string if the request does not name the sender.
+func clusterRequestSender(args any) string {
+	switch req := args.(type) {
+	case *ClusterReq:
+		return req.Node
+	case *ClusterRoute:
+		return req.Node
+	case *UserCacheReq:
+		return req.Node
+	case *ClusterPing:
+		return req.Node
+	case *ClusterTopicState:
+		return req.Node
+	case *ClusterHealth:
+		return req.Leader
+	case *ClusterVoteRequest:
+		return req.Node
+	case *ClusterJoinRequest:
+		return req.Node
+	case *ClusterLeaveRequest:
+		return req.Node
+	}
+	return ""
+}
+
+// checkRequestSender verifies that the request is sent on behalf of the node with one of the given names.
+func checkRequestSender(args any, names []string) error {
+	sender := clusterRequestSender(args)
+	if sender == "" {
+		return nil
+	}
+	for _, name := range names {
+		if name == sender {
+			return nil
+		}
+	}
+	return errors.New("cluster: request on behalf of node '" + sender + "' sent by another node")
+}
+
+// The shared secret handshake: the client sends a random challenge, the server responds with
+// its own challenge and a MAC of both, then the client responds with a MAC of both. Finally,
+// the server confirms successful authentication of the client with a single byte.
+
+func (s *clusterSecurity) handshakeClient(conn net.Conn) error {
+	clientNonce := make([]byte, clusterNonceLength)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(clientNonce); err != nil {
+		return err
+	}
+
+	buf := make([]byte, clusterNonceLength+sha256.Size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	serverNonce, serverMac := buf[:clusterNonceLength], buf[clusterNonceLength:]
+	if !hmac.Equal(serverMac, s.mac("server", clientNonce, serverNonce)) {
+		return errors.New("cluster: peer failed to authenticate")
+	}
+
+	if _, err := conn.Write(s.mac("client", serverNonce, clientNonce)); err != nil {
+		return err
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return errors.New("cluster: authentication rejected by peer")
+	}
+	return nil
+}
+
+func (s *clusterSecurity) handshakeServer(conn net.Conn) error {
+	clientNonce := make([]byte, clusterNonceLength)
+	if _, err := io.ReadFull(conn, clientNonce); err != nil {
+		return err
+	}
+
+	serverNonce := make([]byte, clusterNonceLength)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(serverNonce, s.mac("server", clientNonce, serverNonce)...)); err != nil {
+		return err
+	}
+
+	clientMac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, clientMac); err != nil {
+		return err
+	}
+	if !hmac.Equal(clientMac, s.mac("client", serverNonce, clientNonce)) {
+		return errors.New("cluster: peer failed to authenticate")
+	}
+
+	_, err := conn.Write([]byte{1})
+	return err
+}
+
+// mac calculates HMAC-SHA256 of the label and two challenges using the shared secret.
+func (s *clusterSecurity) mac(label string, first, second []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(label))
+	mac.Write(first)
+	mac.Write(second)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert issues a certificate for the given name and writes it and its key to dir.
+// Issues a self-signed CA certificate if the parent is nil.
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// testClusterConnect dials the listener using the client settings and returns errors of both sides.
+func testClusterConnect(t *testing.T, client, server *clusterSecurity, name string, known func(string) bool) (error, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_, _, err = server.accept(conn, known)
+			conn.Close()
+		}
+		serverErr <- err
+	}()
+
+	conn, clientErr := client.dial(name, ln.Addr().String())
+	if conn != nil {
+		// Wait for the server to finish the handshake before closing the connection.
+		err := <-serverErr
+		conn.Close()
+		return clientErr, err
+	}
+	return clientErr, <-serverErr
+}
+
+func TestClusterSecuritySecret(t *testing.T) {
+	if _, err := newClusterSecurity(nil, "short"); err == nil {
+		t.Error("short secret must be rejected")
+	}
+
+	one, _ := newClusterSecurity(nil, "0123456789abcdef")
+	two, _ := newClusterSecurity(nil, "0123456789abcdef")
+	other, _ := newClusterSecurity(nil, "fedcba9876543210")
+
+	if clientErr, serverErr := testClusterConnect(t, one, two, "two", nil); clientErr != nil || serverErr != nil {
+		t.Error("expected successful handshake, got", clientErr, serverErr)
+	}
+	if clientErr, serverErr := testClusterConnect(t, other, two, "two", nil); clientErr == nil || serverErr == nil {
+		t.Error("handshake with a wrong secret must fail")
+	}
+}
+
+func TestClusterSecurityTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "one", ca, caKey)
+	writeTestCert(t, dir, "two", ca, caKey)
+	rogueCA, rogueKey := writeTestCert(t, dir, "rogue-ca", nil, nil)
+	writeTestCert(t, dir, "rogue", rogueCA, rogueKey)
+
+	security := func(name string) *clusterSecurity {
+		s, err := newClusterSecurity(&clusterTLSConfig{
+			Enabled:  true,
+			CertFile: filepath.Join(dir, name+".crt"),
+			KeyFile:  filepath.Join(dir, name+".key"),
+			CAFile:   filepath.Join(dir, "ca.crt"),
+		}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	one, two, rogue := security("one"), security("two"), security("rogue")
+	known := func(name string) bool { return name == "one" || name == "two" }
+
+	if clientErr, serverErr := testClusterConnect(t, one, two, "two", known); clientErr != nil || serverErr != nil {
+		t.Error("expected successful connection, got", clientErr, serverErr)
+	}
+	// Certificate of a different node.
+	if clientErr, _ := testClusterConnect(t, one, two, "three", known); clientErr == nil {
+		t.Error("certificate of a wrong node must be rejected")
+	}
+	// Certificate issued by a different CA.
+	if _, serverErr := testClusterConnect(t, rogue, two, "two", known); serverErr == nil {
+		t.Error("certificate of a different CA must be rejected")
+	}
+	// Node is not a member of the cluster.
+	if _, serverErr := testClusterConnect(t, one, two, "two", func(string) bool { return false }); serverErr == nil {
+		t.Error("unknown node must be rejected")
+	}
+}
+
+func TestClusterPeerCodec(t *testing.T) {
+	c := newTestLeader()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Cluster", c); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go srv.ServeCodec(newClusterPeerCodec(serverConn, []string{"two", "two.example.com"}))
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	var unused bool
+	if err := client.Call("Cluster.Ping", &ClusterPing{Node: "two", Fingerprint: 5}, &unused); err != nil {
+		t.Fatal(err)
+	}
+	if fp := c.node("two").fingerprint; fp != 5 {
+		t.Errorf("expected fingerprint 5, got %d", fp)
+	}
+
+	// Requests on behalf of another node are rejected, the connection remains usable.
+	if err := client.Call("Cluster.Ping", &ClusterPing{Node: "three", Fingerprint: 6}, &unused); err == nil {
+		t.Error("ping on behalf of another node must be rejected")
+	}
+	if err := client.Call("Cluster.Vote", &ClusterVoteRequest{Node: "three", Term: 1}, &ClusterVoteResponse{}); err == nil {
+		t.Error("vote on behalf of another node must be rejected")
+	}
+	if fp := c.node("three").fingerprint; fp != 0 {
+		t.Error("rejected request must not be processed")
+	}
+	if err := client.Call("Cluster.Ping", &ClusterPing{Node: "two", Fingerprint: 5}, &unused); err != nil {
+		t.Error("connection must remain usable", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/rpc"
+	"sort"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Cluster-wide status: the node which received the status request collects the state
+// of other nodes and merges it with its own.
+
+// debugClusterNode is the state of a remote node as seen by this node.
+type debugClusterNode struct {
+	Name      string `json:"name"`
+	Address   string `json:"address,omitempty"`
+	Connected bool   `json:"connected"`
+	// Number of failed health checks in a row, maintained by the leader.
+	FailCount int  `json:"fail_count,omitempty"`
+	Draining  bool `json:"draining,omitempty"`
+	// Number of async call completions waiting to be processed.
+	RpcQueue int `json:"rpc_queue"`
+	// Number of proxy to master requests waiting to be sent.
+	P2mQueue int `json:"p2m_queue"`
+	// Number of multiplexing sessions of the node.
+	Multiplex int `json:"multiplex,omitempty"`
+}
+
+// debugCluster is the state of the cluster as seen by this node.
+type debugCluster struct {
+	Leader string `json:"leader,omitempty"`
+	Term   int    `json:"term,omitempty"`
+	// Signature of the ring hash.
+	Signature string `json:"signature,omitempty"`
+	// Nodes in the ring hash.
+	Ring []string `json:"ring,omitempty"`
+	// Node which hosts the topic from the filter.
+	TopicMaster string             `json:"topic_master,omitempty"`
+	Nodes       []debugClusterNode `json:"nodes,omitempty"`
+}
+
+// debugClusterDump is the state of all cluster nodes.
+type debugClusterDump struct {
+	Timestamp time.Time    `json:"ts"`
+	Nodes     []*debugDump `json:"nodes"`
+	// Nodes which failed to respond.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// ClusterStatusRequest is a request for the state of a node.
+type ClusterStatusRequest struct {
+	// Limit the state to the user and/or the topic.
+	User  string
+	Topic string
+}
+
+// ClusterStatusResponse is the state of a node.
+type ClusterStatusResponse struct {
+	Status *debugDump
+}
+
+// Status returns the state of this node.
+func (c *Cluster) Status(req *ClusterStatusRequest, resp *ClusterStatusResponse) error {
+	resp.Status = localStatus(&debugFilter{User: req.User, Topic: req.Topic})
+	return nil
+}
+
+// status returns the state of the cluster as seen by this node.
+func (c *Cluster) status(filter *debugFilter) *debugCluster {
+	result := &debugCluster{Signature: c.hashRing().Signature()}
+	if c.fo != nil {
+		result.Term, result.Leader = c.fo.currentState()
+		c.fo.activeNodesLock.RLock()
+		result.Ring = append(result.Ring, c.fo.activeNodes...)
+		c.fo.activeNodesLock.RUnlock()
+	} else {
+		for _, n := range c.nodeList() {
+			result.Ring = append(result.Ring, n.name)
+		}
+		result.Ring = append(result.Ring, c.thisNodeName)
+	}
+	sort.Strings(result.Ring)
+	if filter.Topic != "" {
+		result.TopicMaster = c.hashRing().Get(filter.Topic)
+	}
+
+	for _, n := range c.nodeList() {
+		n.lock.Lock()
+		result.Nodes = append(result.Nodes, debugClusterNode{
+			Name:      n.name,
+			Address:   n.address,
+			Connected: n.connected,
+			FailCount: n.failCount,
+			Draining:  n.draining,
+			RpcQueue:  len(n.rpcDone),
+			P2mQueue:  len(n.p2mSender),
+			Multiplex: len(n.msess),
+		})
+		n.lock.Unlock()
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool { return result.Nodes[i].Name < result.Nodes[j].Name })
+	return result
+}
+
+// clusterStatus collects the state of all cluster nodes.
+func (c *Cluster) clusterStatus(filter *debugFilter) *debugClusterDump {
+	result := &debugClusterDump{
+		Timestamp: types.TimeNow(),
+		Nodes:     []*debugDump{localStatus(filter)},
+	}
+
+	nodes := c.nodeList()
+	done := make(chan *rpc.Call, len(nodes))
+	calls := make(map[*rpc.Call]string, len(nodes))
+	for _, n := range nodes {
+		call := n.callAsync("Cluster.Status",
+			&ClusterStatusRequest{User: filter.User, Topic: filter.Topic},
+			&ClusterStatusResponse{}, done)
+		calls[call] = n.name
+	}
+
+	timeout := time.NewTimer(clusterNetworkTimeout)
+	defer timeout.Stop()
+	for pending := len(calls); pending > 0; pending-- {
+		select {
+		case call := <-done:
+			name := calls[call]
+			delete(calls, call)
+			if call.Error != nil {
+				result.addError(name, call.Error.Error())
+			} else {
+				result.Nodes = append(result.Nodes, call.Reply.(*ClusterStatusResponse).Status)
+			}
+		case <-timeout.C:
+			for _, name := range calls {
+				result.addError(name, "timed out")
+			}
+			pending = 0
+		}
+	}
+
+	sort.Slice(result.Nodes, func(i, j int) bool { return result.Nodes[i].Node < result.Nodes[j].Node })
+	return result
+}
+
+func (d *debugClusterDump) addError(node, err string) {
+	if d.Errors == nil {
+		d.Errors = make(map[string]string)
+	}
+	d.Errors[node] = err
+}
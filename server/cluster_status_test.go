@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestDebugFilter(t *testing.T) {
+	sess := &debugSession{Uid: "AbCdEf123456", Subs: []string{"grpOne", "usrAbCdEf123456"}}
+	topic := &debugTopic{Topic: "grpOne", PerUser: []string{"AbCdEf123456", "XyZ123456789"}}
+
+	testCases := []struct {
+		filter  debugFilter
+		session bool
+		topic   bool
+	}{
+		{debugFilter{}, true, true},
+		{debugFilter{User: "AbCdEf123456"}, true, true},
+		{debugFilter{User: "XyZ123456789"}, false, true},
+		{debugFilter{Topic: "grpOne"}, true, true},
+		{debugFilter{Topic: "grpTwo"}, false, false},
+		{debugFilter{User: "AbCdEf123456", Topic: "grpTwo"}, false, false},
+	}
+	for i, tc := range testCases {
+		if got := tc.filter.matchSession(sess); got != tc.session {
+			t.Errorf("%d: session match expected %t, got %t", i, tc.session, got)
+		}
+		if got := tc.filter.matchTopic(topic); got != tc.topic {
+			t.Errorf("%d: topic match expected %t, got %t", i, tc.topic, got)
+		}
+	}
+}
+
+func TestClusterStatusEncoding(t *testing.T) {
+	resp := &ClusterStatusResponse{Status: &debugDump{
+		Node:     "one",
+		Sessions: []debugSession{{Uid: "AbCdEf123456", Sid: "sid1", Subs: []string{"grpOne"}}},
+		Topics:   []debugTopic{{Topic: "grpOne", Master: "two", IsProxy: true}},
+		Cluster: &debugCluster{
+			Leader: "two",
+			Term:   3,
+			Ring:   []string{"one", "two"},
+			Nodes:  []debugClusterNode{{Name: "two", Connected: true, RpcQueue: 1}},
+		},
+	}}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err != nil {
+		t.Fatal(err)
+	}
+	var got ClusterStatusResponse
+	if err := gob.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	status := got.Status
+	if status == nil || status.Node != "one" || len(status.Sessions) != 1 || status.Sessions[0].Sid != "sid1" ||
+		len(status.Topics) != 1 || status.Topics[0].Master != "two" ||
+		status.Cluster == nil || status.Cluster.Term != 3 || status.Cluster.Nodes[0].RpcQueue != 1 {
+		t.Errorf("status not preserved %+v", status)
+	}
+}
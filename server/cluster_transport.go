@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Delivery of calls between cluster nodes. The default transport is a full mesh of net/rpc
+// connections between nodes. Alternatively, nodes exchange calls through a message bus.
+
+const (
+	clusterTransportRPC   = "rpc"
+	clusterTransportRedis = "redis"
+)
+
+type clusterTransportConfig struct {
+	// Type of the transport: "rpc" (default) or "redis".
+	Type string `json:"type"`
+	// Configuration of the Redis message bus.
+	Redis *clusterRedisConfig `json:"redis"`
+}
+
+// clusterEndpoint makes calls to a remote node. Implemented by *rpc.Client.
+type clusterEndpoint interface {
+	Call(serviceMethod string, args any, reply any) error
+	Go(serviceMethod string, args any, reply any, done chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+// clusterTransport delivers calls between cluster nodes.
+type clusterTransport interface {
+	// listen starts serving calls from other nodes to the methods of the cluster.
+	listen(c *Cluster) error
+	// dial creates an endpoint for calls to the node with the given name and address.
+	// The name could be empty if it's not known.
+	dial(name, addr string) (clusterEndpoint, error)
+	// close stops serving calls.
+	close()
+}
+
+// clusterRPC is a full mesh of net/rpc connections between nodes.
+type clusterRPC struct {
+	// Address to listen on
+	listenOn string
+	// Authentication of connections between nodes; nil if not configured.
+	security *clusterSecurity
+	// Socket for inbound connections
+	inbound *net.TCPListener
+}
+
+func (t *clusterRPC) listen(c *Cluster) error {
+	addr, err := net.ResolveTCPAddr("tcp", t.listenOn)
+	if err != nil {
+		return err
+	}
+	if t.inbound, err = net.ListenTCP("tcp", addr); err != nil {
+		return err
+	}
+	if err = rpc.Register(c); err != nil {
+		return err
+	}
+	go t.accept(c.isKnownPeer)
+	return nil
+}
+
+// accept authenticates inbound connections from other nodes and serves RPC requests.
+func (t *clusterRPC) accept(isKnownPeer func(name string) bool) {
+	for {
+		conn, err := t.inbound.Accept()
+		if err != nil {
+			if !globals.shuttingDown {
+				logs.Err.Println("cluster: accept failed", err)
+			}
+			return
+		}
+		go func() {
+			authConn, names, err := t.security.accept(conn, isKnownPeer)
+			if err != nil {
+				logs.Warn.Println("cluster: rejected connection from", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if names == nil {
+				rpc.ServeConn(authConn)
+			} else {
+				// The node is authenticated by its certificate: it cannot send requests on behalf of other nodes.
+				rpc.ServeCodec(newClusterPeerCodec(authConn, names))
+			}
+		}()
+	}
+}
+
+// clusterPeerCodec is a gob codec of net/rpc requests from the node authenticated by its certificate.
+// Requests which name another node as the sender are rejected.
+type clusterPeerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	// Names of the node from its certificate.
+	names []string
+}
+
+func newClusterPeerCodec(conn io.ReadWriteCloser, names []string) *clusterPeerCodec {
+	buf := bufio.NewWriter(conn)
+	return &clusterPeerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		names:  names,
+	}
+}
+
+func (c *clusterPeerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *clusterPeerCodec) ReadRequestBody(body any) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if err := checkRequestSender(body, c.names); err != nil {
+		logs.Warn.Println(err, c.names)
+		return err
+	}
+	return nil
+}
+
+func (c *clusterPeerCodec) WriteResponse(r *rpc.Response, body any) error {
+	if err := c.enc.Encode(r); err != nil {
+		c.Close()
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		c.Close()
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *clusterPeerCodec) Close() error {
+	return c.rwc.Close()
+}
+
+func (t *clusterRPC) dial(name, addr string) (clusterEndpoint, error) {
+	conn, err := t.security.dial(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (t *clusterRPC) close() {
+	if t.inbound != nil {
+		t.inbound.Close()
+	}
+}
+
+// callAddr makes a single call to the node at the given address.
+func (c *Cluster) callAddr(addr, proc string, req, resp any) error {
+	// The name of the node at the address is not known.
+	ep, err := c.transport.dial("", addr)
+	if err != nil {
+		return err
+	}
+	defer ep.Close()
+
+	call := ep.Go(proc, req, resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(clusterNetworkTimeout):
+		return errors.New("cluster: call timed out")
+	}
+}
@@ -63,6 +63,8 @@ type MsgSetDesc struct {
 	Public     any                `json:"public,omitempty"`  // description of the user or topic
 	Trusted    any                `json:"trusted,omitempty"` // trusted (system-provided) user or topic data
 	Private    any                `json:"private,omitempty"` // per-subscription private data
+	// Notification preferences: global for 'me', per-subscription otherwise.
+	Notify *types.NotifyPrefs `json:"notify,omitempty"`
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -87,6 +89,24 @@ type MsgSetQuery struct {
 	Tags []string `json:"tags,omitempty"`
 	// Update to account credentials.
 	Cred *MsgCredClient `json:"cred,omitempty"`
+	// Report of a message or a user, or moderator's action on a report.
+	Report *MsgSetReport `json:"report,omitempty"`
+}
+
+// MsgSetReport is a complaint about a message or a user, or moderator's action on an existing report.
+type MsgSetReport struct {
+	// ID of the existing report to act on, moderators only.
+	Id string `json:"id,omitempty"`
+	// Action to take on the report: "suspend", "delete" or "resolve".
+	Action string `json:"action,omitempty"`
+	// ID of the reported message in the topic of the request.
+	SeqId int `json:"seq,omitempty"`
+	// ID of the reported user.
+	User string `json:"user,omitempty"`
+	// Reason for the report, such as "spam" or "abuse".
+	Reason string `json:"reason,omitempty"`
+	// Free-form comment to the report or to the action.
+	Comment string `json:"comment,omitempty"`
 }
 
 // MsgDelRange is either an individual ID (HiId=0) or a randge of deleted IDs, low end inclusive (closed),
@@ -186,6 +206,8 @@ const (
 	constMsgMetaTags
 	constMsgMetaDel
 	constMsgMetaCred
+	constMsgMetaMod
+	constMsgMetaReport
 )
 
 const (
@@ -213,6 +235,10 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaDel
 		case "cred":
 			bits |= constMsgMetaCred
+		case "mod":
+			bits |= constMsgMetaMod
+		case "report":
+			bits |= constMsgMetaReport
 		default:
 			// ignore unknown
 		}
@@ -357,6 +383,11 @@ type ClientComMessage struct {
 	sess *Session
 	// The message is initialized (true) as opposite to being used as a wrapper for session.
 	init bool
+	// The message is a {sub} generated by the server to move the session to the topic's new master.
+	migrating bool
+	// The message is a {del} generated by the server on behalf of a moderator acting on a report.
+	// The moderator can delete messages without being subscribed. The result is reported to the channel.
+	moderated chan error
 }
 
 /****************************************************************
@@ -441,6 +472,8 @@ type MsgTopicDesc struct {
 	Trusted any `json:"trusted,omitempty"`
 	// Per-subscription private data
 	Private any `json:"private,omitempty"`
+	// Notification preferences: global for 'me', per-subscription otherwise.
+	Notify *types.NotifyPrefs `json:"notify,omitempty"`
 }
 
 func (src *MsgTopicDesc) describe() string {
@@ -715,6 +748,59 @@ type MsgServerMeta struct {
 	Tags []string `json:"tags,omitempty"`
 	// Account credentials, 'me' only.
 	Cred []*MsgCredServer `json:"cred,omitempty"`
+	// Messages flagged by moderation, topic owner and root only.
+	Mod []MsgModItem `json:"mod,omitempty"`
+	// Unresolved reports, 'sys' topic only.
+	Report []MsgReport `json:"report,omitempty"`
+}
+
+// MsgReport is a user's complaint about a message or another user.
+type MsgReport struct {
+	Id string `json:"id"`
+	// Timestamp when the report was filed.
+	CreatedAt time.Time `json:"created"`
+	// ID of the user who filed the report.
+	From string `json:"from"`
+	// ID of the reported user.
+	User string `json:"user,omitempty"`
+	// Topic of the reported message.
+	Topic string `json:"topic,omitempty"`
+	// ID of the reported message.
+	SeqId int `json:"seq,omitempty"`
+	// Reason for the report.
+	Reason string `json:"reason"`
+	// Comment of the reporter.
+	Comment string `json:"comment,omitempty"`
+	// The report is resolved.
+	Resolved bool `json:"resolved,omitempty"`
+	// Actions taken by moderators.
+	Actions []MsgReportAction `json:"actions,omitempty"`
+}
+
+// MsgReportAction is an action taken by a moderator on a report.
+type MsgReportAction struct {
+	// ID of the moderator.
+	By string `json:"by"`
+	// Action: "suspend", "delete" or "resolve".
+	What string `json:"what"`
+	// Comment of the moderator.
+	Comment string `json:"comment,omitempty"`
+	// Timestamp of the action.
+	When time.Time `json:"ts"`
+}
+
+// MsgModItem is a message flagged for review by moderation.
+type MsgModItem struct {
+	// Sequential ID of the message.
+	SeqId int `json:"seq"`
+	// ID of the sender.
+	From string `json:"from"`
+	// Timestamp when the message was sent.
+	Timestamp time.Time `json:"ts"`
+	// Names of moderation rules which flagged the message.
+	Rules []string `json:"rules"`
+	// Text of the message, possibly truncated.
+	Text string `json:"text,omitempty"`
 }
 
 // Deep-shallow copy of meta message. Deep copy of Id and Topic fields, shallow copy of payload.
@@ -750,6 +836,12 @@ func (src *MsgServerMeta) describe() string {
 		x, _ := json.Marshal(src.Cred)
 		s += " cred=[" + string(x) + "]"
 	}
+	if src.Mod != nil {
+		s += " mod=" + strconv.Itoa(len(src.Mod))
+	}
+	if src.Report != nil {
+		s += " report=" + strconv.Itoa(len(src.Report))
+	}
 	return s
 }
 
@@ -1002,6 +1094,18 @@ func NoErrShutdown(ts time.Time) *ServerComMessage {
 	}
 }
 
+// NoErrReconnect means the server is draining: the client should reconnect after the delay in milliseconds (205).
+func NoErrReconnect(delay int, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Code:      http.StatusResetContent, // 205
+			Text:      "reconnect",
+			Params:    map[string]int{"delay": delay},
+			Timestamp: ts,
+		},
+	}
+}
+
 // NoErrDeliveredParams means requested content has been delivered (208).
 func NoErrDeliveredParams(id, topic string, ts time.Time, params any) *ServerComMessage {
 	return &ServerComMessage{
@@ -60,6 +60,10 @@ type Adapter interface {
 	// UserGetUnvalidated returns a list of no more than 'limit' uids who never logged in,
 	// have no validated credentials and which haven't been updated since 'lastUpdatedBefore'.
 	UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error)
+	// UserGetOffline returns up to 'limit' active users last seen no later than 'lastSeenBefore' and
+	// after the ('lastSeenAfter', 'afterUid') position, ordered by the time they were last seen and by user ID.
+	// Zero 'afterUid' means users last seen after 'lastSeenAfter'.
+	UserGetOffline(lastSeenAfter time.Time, afterUid t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error)
 
 	// Credential management
 
@@ -181,6 +185,22 @@ type Adapter interface {
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
 	// FileLinkAttachments connects given topic or message to the file record IDs from the list.
 	FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error
+	// FileGetEncrypted fetches up to limit records of encrypted files (with non-nil EncKey) ordered by ID,
+	// starting after the file with ID afterId. Used for rotation of the master encryption key.
+	FileGetEncrypted(afterId string, limit int) ([]t.FileDef, error)
+	// FileUpdateEncKey replaces encrypted data key of the file.
+	FileUpdateEncKey(fid string, key []byte) error
+
+	// Reports
+
+	// ReportCreate saves a new report.
+	ReportCreate(report *t.Report) error
+	// ReportGet reads a report by ID.
+	ReportGet(id string) (*t.Report, error)
+	// ReportGetAll returns up to limit most recent reports. Only unresolved reports are returned if unresolvedOnly is true.
+	ReportGetAll(unresolvedOnly bool, limit int) ([]t.Report, error)
+	// ReportAddAction atomically appends the action to the audit log of the report and optionally marks the report as resolved.
+	ReportAddAction(report *t.Report, action *t.ReportAction, resolve bool) error
 
 	// Persistent cache management.
 
@@ -192,4 +212,6 @@ type Adapter interface {
 	PCacheDelete(key string) error
 	// PCacheExpire expires older entries with the specified key prefix.
 	PCacheExpire(keyPrefix string, olderThan time.Time) error
+	// PCacheList returns up to 'limit' oldest entries with the specified key prefix, oldest first.
+	PCacheList(keyPrefix string, limit int) ([]t.KeyValue, error)
 }
@@ -9,6 +9,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -41,7 +42,7 @@ const (
 	defaultHost     = "localhost:27017"
 	defaultDatabase = "tinode"
 
-	adpVersion  = 113
+	adpVersion  = 116
 	adapterName = "mongodb"
 
 	defaultMaxResults = 1024
@@ -403,6 +404,18 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "fileuploads",
 			Field:      "usecount",
 		},
+		// Sparse index on 'fileuploads.enckey' to find encrypted files for rotation of the master key.
+		{
+			Collection: "fileuploads",
+			IndexOpts:  mdb.IndexModel{Keys: b.M{"enckey": 1}, Options: mdbopts.Index().SetSparse(true)},
+		},
+
+		// Complaints about messages and users. See types.Report.
+		// Compound index on 'resolved - createdat' to find recent unresolved reports.
+		{
+			Collection: "reports",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"resolved", 1}, {"createdat", -1}}},
+		},
 	}
 
 	var err error
@@ -531,6 +544,37 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Create sparse index on FileDef.EncKey to find encrypted files for rotation of the master key.
+		if _, err = a.db.Collection("fileuploads").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"enckey": 1}, Options: mdbopts.Index().SetSparse(true)}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Create secondary index on Reports(resolved,createdat) for finding recent unresolved reports.
+		if _, err = a.db.Collection("reports").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{"resolved", 1}, {"createdat", -1}}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -1054,6 +1098,44 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns up to 'limit' active users last seen no later than 'lastSeenBefore' and
+// after the ('lastSeenAfter', 'afterUid') position, ordered by the time they were last seen and by user ID.
+// Zero 'afterUid' means users last seen after 'lastSeenAfter'.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterUid t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	filter := b.M{
+		"state":    t.StateOK,
+		"lastseen": b.M{"$gt": lastSeenAfter, "$lte": lastSeenBefore},
+	}
+	if !afterUid.IsZero() {
+		// Keyset pagination: users last seen at the same time are ordered by ID.
+		filter = b.M{
+			"state": t.StateOK,
+			"$or": b.A{
+				b.M{"lastseen": b.M{"$gt": lastSeenAfter, "$lte": lastSeenBefore}},
+				b.M{"lastseen": lastSeenAfter, "_id": b.M{"$gt": afterUid.String()}},
+			},
+		}
+	}
+	findOpts := mdbopts.Find().SetSort(b.D{{"lastseen", 1}, {"_id", 1}}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("users").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var users []t.User
+	for cur.Next(a.ctx) {
+		var user t.User
+		if err := cur.Decode(&user); err != nil {
+			return nil, err
+		}
+		user.Public = unmarshalBsonD(user.Public)
+		user.Trusted = unmarshalBsonD(user.Trusted)
+		users = append(users, user)
+	}
+	return users, nil
+}
+
 // Credential management
 
 // CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
@@ -2539,6 +2621,39 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	return &fd, nil
 }
 
+// FileGetEncrypted fetches up to limit records of encrypted files with IDs following afterId.
+func (a *adapter) FileGetEncrypted(afterId string, limit int) ([]t.FileDef, error) {
+	filter := b.M{"enckey": b.M{"$exists": true}}
+	if afterId != "" {
+		filter["_id"] = b.M{"$gt": afterId}
+	}
+	findOpts := mdbopts.Find().SetSort(b.D{{"_id", 1}})
+	if limit > 0 {
+		findOpts.SetLimit(int64(limit))
+	}
+
+	cur, err := a.db.Collection("fileuploads").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var fds []t.FileDef
+	if err = cur.All(a.ctx, &fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
+// FileUpdateEncKey replaces encrypted data key of the file.
+func (a *adapter) FileUpdateEncKey(fid string, key []byte) error {
+	// UpdatedAt is not changed: the content of the file remains the same.
+	_, err := a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": fid},
+		b.M{"$set": b.M{"enckey": key}})
+	return err
+}
+
 // FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
 // unused records with UpdatedAt before olderThan.
 // Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
@@ -2671,6 +2786,64 @@ func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []
 	return err
 }
 
+// ReportCreate saves a new report.
+func (a *adapter) ReportCreate(report *t.Report) error {
+	_, err := a.db.Collection("reports").InsertOne(a.ctx, report)
+	return err
+}
+
+// ReportGet reads a report by ID.
+func (a *adapter) ReportGet(id string) (*t.Report, error) {
+	var report t.Report
+	if err := a.db.Collection("reports").FindOne(a.ctx, b.M{"_id": id}).Decode(&report); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ReportGetAll returns up to limit most recent reports.
+func (a *adapter) ReportGetAll(unresolvedOnly bool, limit int) ([]t.Report, error) {
+	filter := b.M{}
+	if unresolvedOnly {
+		filter["resolved"] = false
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	findOpts := mdbopts.Find().SetSort(b.D{{"createdat", -1}}).SetLimit(int64(limit))
+
+	cur, err := a.db.Collection("reports").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var reports []t.Report
+	for cur.Next(a.ctx) {
+		var report t.Report
+		if err = cur.Decode(&report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, cur.Err()
+}
+
+// ReportAddAction atomically appends the action to the audit log of the report and optionally marks it as resolved.
+func (a *adapter) ReportAddAction(report *t.Report, action *t.ReportAction, resolve bool) error {
+	update := b.M{"updatedat": action.When}
+	if resolve {
+		update["resolved"] = true
+	}
+	_, err := a.db.Collection("reports").UpdateOne(a.ctx,
+		b.M{"_id": report.Id},
+		b.M{"$set": update, "$push": b.M{"actions": action}})
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	var value map[string]string
@@ -2724,10 +2897,38 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	}
 
 	_, err := a.db.Collection("kvmeta").DeleteMany(a.ctx, b.M{"createdat": b.M{"$lt": olderThan},
-		"_id": primitive.Regex{Pattern: "^" + keyPrefix}})
+		"_id": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(keyPrefix)}})
 	return err
 }
 
+// PCacheList returns up to 'limit' oldest entries with the given key prefix, oldest first.
+func (a *adapter) PCacheList(keyPrefix string, limit int) ([]t.KeyValue, error) {
+	if keyPrefix == "" {
+		return nil, t.ErrMalformed
+	}
+
+	findOpts := mdbopts.Find().SetSort(b.D{{"createdat", 1}}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("kvmeta").Find(a.ctx, b.M{"_id": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(keyPrefix)}}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var result []t.KeyValue
+	for cur.Next(a.ctx) {
+		var entry struct {
+			Key   string `bson:"_id"`
+			Value string `bson:"value"`
+		}
+		if err = cur.Decode(&entry); err != nil {
+			return nil, err
+		}
+		result = append(result, t.KeyValue{Key: entry.Key, Value: entry.Value})
+	}
+
+	return result, cur.Err()
+}
+
 func (a *adapter) isDbInitialized() bool {
 	var result map[string]int
 
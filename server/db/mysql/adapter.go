@@ -44,7 +44,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 113
+	adpVersion = 116
 
 	adapterName = "mysql"
 
@@ -335,6 +335,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			notify    JSON,
 			PRIMARY KEY(id),
 			INDEX users_state_stateat(state, stateat),
 			INDEX users_lastseen_updatedat(lastseen, updatedat)
@@ -451,6 +452,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			modewant  CHAR(8),
 			modegiven CHAR(8),
 			private   JSON,
+			notify    JSON,
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX subscriptions_topic_userid(topic, userid),
@@ -532,6 +534,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			mimetype  VARCHAR(255) NOT NULL,
 			size      BIGINT NOT NULL,
 			location  VARCHAR(2048) NOT NULL,
+			enckey    VARBINARY(128),
 			PRIMARY KEY(id),
 			INDEX fileuploads_status(status)
 		)`); err != nil {
@@ -556,6 +559,26 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Complaints about messages and users.
+	if _, err = tx.Exec(
+		`CREATE TABLE reports(
+			id        BIGINT NOT NULL,
+			createdat DATETIME(3) NOT NULL,
+			updatedat DATETIME(3) NOT NULL,
+			reporter  BIGINT NOT NULL,
+			userid    BIGINT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			reason    VARCHAR(32) NOT NULL,
+			comment   VARCHAR(1024) NOT NULL,
+			resolved  BOOLEAN NOT NULL,
+			actions   JSON,
+			PRIMARY KEY(id),
+			INDEX reports_resolved_createdat(resolved, createdat)
+		)`); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec(
 		`CREATE TABLE kvmeta(` +
 			"`key`       VARCHAR(64) NOT NULL," +
@@ -776,6 +799,64 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Encryption keys of files encrypted at rest.
+		if _, err := a.db.Exec("ALTER TABLE fileuploads ADD enckey VARBINARY(128) AFTER location"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Notification preferences.
+		if _, err := a.db.Exec("ALTER TABLE users ADD notify JSON AFTER tags"); err != nil {
+			return err
+		}
+
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD notify JSON AFTER private"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Complaints about messages and users.
+		if _, err := a.db.Exec(
+			`CREATE TABLE reports(
+				id        BIGINT NOT NULL,
+				createdat DATETIME(3) NOT NULL,
+				updatedat DATETIME(3) NOT NULL,
+				reporter  BIGINT NOT NULL,
+				userid    BIGINT NOT NULL,
+				topic     CHAR(25) NOT NULL,
+				seqid     INT NOT NULL,
+				reason    VARCHAR(32) NOT NULL,
+				comment   VARCHAR(1024) NOT NULL,
+				resolved  BOOLEAN NOT NULL,
+				actions   JSON,
+				PRIMARY KEY(id),
+				INDEX reports_resolved_createdat(resolved, createdat)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -1450,6 +1531,50 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns up to 'limit' active users last seen no later than 'lastSeenBefore' and
+// after the ('lastSeenAfter', 'afterUid') position, ordered by the time they were last seen and by user ID.
+// Zero 'afterUid' means users last seen after 'lastSeenAfter'.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterUid t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Keyset pagination: users last seen at the same time are ordered by ID.
+	query := "SELECT * FROM users WHERE state=? AND lastseen>? AND lastseen<=? ORDER BY lastseen ASC, id ASC LIMIT ?"
+	args := []interface{}{t.StateOK, lastSeenAfter, lastSeenBefore, limit}
+	if !afterUid.IsZero() {
+		query = "SELECT * FROM users WHERE state=? AND (lastseen>? OR (lastseen=? AND id>?)) AND lastseen<=? " +
+			"ORDER BY lastseen ASC, id ASC LIMIT ?"
+		args = []interface{}{t.StateOK, lastSeenAfter, lastSeenAfter, store.DecodeUid(afterUid), lastSeenBefore, limit}
+	}
+	rows, err := a.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []t.User
+	for rows.Next() {
+		var user t.User
+		if err = rows.StructScan(&user); err != nil {
+			users = nil
+			break
+		}
+
+		user.SetUid(encodeUidString(user.Id))
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return users, err
+}
+
 // *****************************
 
 func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
@@ -1817,7 +1942,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 
 	// Fetch all subscribed users. The number of users is not large
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,s.private
+		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,s.private,s.notify
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id
 		WHERE s.topic=?`
 	args := []interface{}{topic}
@@ -1875,7 +2000,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
 			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
-			&public, &trusted, &lastSeen, &userAgent, &sub.Private); err != nil {
+			&public, &trusted, &lastSeen, &userAgent, &sub.Private, &sub.Notify); err != nil {
 			break
 		}
 
@@ -2122,7 +2247,7 @@ func (a *adapter) SubscriptionGet(topic string, user t.Uid, keepDeleted bool) (*
 	}
 	var sub t.Subscription
 	err := a.db.GetContext(ctx, &sub, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
+		readseqid,modewant,modegiven,private,notify FROM subscriptions WHERE topic=? AND userid=?`,
 		topic, store.DecodeUid(user))
 
 	if err != nil {
@@ -2180,7 +2305,7 @@ func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,modewant,modegiven,private,notify FROM subscriptions WHERE topic=?`
 
 	args := []interface{}{topic}
 	if !keepDeleted {
@@ -3180,10 +3305,10 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 		user = 0
 	}
 	_, err := a.db.ExecContext(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
-			"VALUES(?,?,?,?,?,?,?,?)",
+		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location,enckey) "+
+			"VALUES(?,?,?,?,?,?,?,?,?)",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.Location)
+		fd.Status, fd.MimeType, fd.Size, fd.Location, fd.EncKey)
 	return err
 }
 
@@ -3240,7 +3365,7 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 		defer cancel()
 	}
 	var fd t.FileDef
-	err := a.db.GetContext(ctx, &fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+	err := a.db.GetContext(ctx, &fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location,enckey "+
 		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -3256,6 +3381,59 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileGetEncrypted fetches up to limit records of encrypted files with IDs following afterId.
+func (a *adapter) FileGetEncrypted(afterId string, limit int) ([]t.FileDef, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location,enckey " +
+		"FROM fileuploads WHERE enckey IS NOT NULL"
+	var args []interface{}
+	if afterId != "" {
+		id := t.ParseUid(afterId)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		query += " AND id>?"
+		args = append(args, store.DecodeUid(id))
+	}
+	query += " ORDER BY id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	var fds []t.FileDef
+	if err := a.db.SelectContext(ctx, &fds, query, args...); err != nil {
+		return nil, err
+	}
+
+	for i := range fds {
+		fds[i].Id = encodeUidString(fds[i].Id).String()
+		fds[i].User = encodeUidString(fds[i].User).String()
+	}
+
+	return fds, nil
+}
+
+// FileUpdateEncKey replaces encrypted data key of the file.
+func (a *adapter) FileUpdateEncKey(fid string, key []byte) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// UpdatedAt is not changed: the content of the file remains the same.
+	_, err := a.db.ExecContext(ctx, "UPDATE fileuploads SET enckey=? WHERE id=?", key, store.DecodeUid(id))
+	return err
+}
+
 // FileDeleteUnused deletes file upload records.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	ctx, cancel := a.getContextForTx()
@@ -3395,6 +3573,111 @@ func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []
 	return tx.Commit()
 }
 
+// ReportCreate saves a new report.
+func (a *adapter) ReportCreate(report *t.Report) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var user int64
+	if report.User != "" {
+		user = decodeUidString(report.User)
+	}
+	_, err := a.db.ExecContext(ctx,
+		"INSERT INTO reports(id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions) "+
+			"VALUES(?,?,?,?,?,?,?,?,?,?,?)",
+		store.DecodeUid(report.Uid()), report.CreatedAt, report.UpdatedAt, decodeUidString(report.From), user,
+		report.Topic, report.SeqId, report.Reason, report.Comment, report.Resolved, toJSON(report.Actions))
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(row rowScanner) (*t.Report, error) {
+	var report t.Report
+	var id, reporter, user int64
+	var actions []byte
+	if err := row.Scan(&id, &report.CreatedAt, &report.UpdatedAt, &reporter, &user, &report.Topic, &report.SeqId,
+		&report.Reason, &report.Comment, &report.Resolved, &actions); err != nil {
+		return nil, err
+	}
+	report.SetUid(store.EncodeUid(id))
+	report.From = store.EncodeUid(reporter).String()
+	if user != 0 {
+		report.User = store.EncodeUid(user).String()
+	}
+	if len(actions) > 0 {
+		if err := json.Unmarshal(actions, &report.Actions); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+// ReportGet reads a report by ID.
+func (a *adapter) ReportGet(id string) (*t.Report, error) {
+	uid := t.ParseUid(id)
+	if uid.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	report, err := scanReport(a.db.QueryRowContext(ctx,
+		"SELECT id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions "+
+			"FROM reports WHERE id=?", store.DecodeUid(uid)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+// ReportGetAll returns up to limit most recent reports.
+func (a *adapter) ReportGetAll(unresolvedOnly bool, limit int) ([]t.Report, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := "SELECT id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions FROM reports"
+	if unresolvedOnly {
+		query += " WHERE resolved=FALSE"
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	rows, err := a.db.QueryContext(ctx, query+" ORDER BY createdat DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []t.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+// ReportAddAction atomically appends the action to the audit log of the report and optionally marks it as resolved.
+func (a *adapter) ReportAddAction(report *t.Report, action *t.ReportAction, resolve bool) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE reports SET updatedat=?,resolved=resolved OR ?,"+
+		"actions=JSON_ARRAY_APPEND(COALESCE(actions,JSON_ARRAY()),'$',CAST(? AS JSON)) WHERE id=?",
+		action.When, resolve, string(toJSON(action)), store.DecodeUid(report.Uid()))
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	ctx, cancel := a.getContext()
@@ -3460,12 +3743,50 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 		defer cancel()
 	}
 
-	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key` LIKE ? AND createdat<?", keyPrefix+"%", olderThan)
+	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key` LIKE ? ESCAPE '!' AND createdat<?", likePrefix(keyPrefix), olderThan)
 	return err
 }
 
+// PCacheList returns up to 'limit' oldest entries with the given key prefix, oldest first.
+func (a *adapter) PCacheList(keyPrefix string, limit int) ([]t.KeyValue, error) {
+	if keyPrefix == "" {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.QueryxContext(ctx, "SELECT `key`,`value` FROM kvmeta WHERE `key` LIKE ? ESCAPE '!' ORDER BY createdat LIMIT ?",
+		likePrefix(keyPrefix), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []t.KeyValue
+	for rows.Next() {
+		var kv t.KeyValue
+		if err = rows.Scan(&kv.Key, &kv.Value); err != nil {
+			break
+		}
+		result = append(result, kv)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return result, err
+}
+
 // Helper functions
 
+// likePrefix converts the key prefix to a LIKE pattern with '!' as the escape character.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
 func isDupe(err error) bool {
 	if err == nil {
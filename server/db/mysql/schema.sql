@@ -36,6 +36,7 @@ CREATE TABLE users(
 	useragent 	VARCHAR(255) DEFAULT '',
 	public 		JSON,
 	tags		JSON, -- Denormalized array of tags
+	notify		JSON, -- Notification preferences
 
 	PRIMARY KEY(id),
 	INDEX users_state_stateat(state, stateat),
@@ -135,6 +136,7 @@ CREATE TABLE subscriptions(
 	modewant	CHAR(8),
 	modegiven	CHAR(8),
 	private		JSON,
+	notify		JSON, -- Notification preferences
 
 	PRIMARY KEY(id)	,
 	FOREIGN KEY(userid) REFERENCES users(id),
@@ -209,6 +211,7 @@ CREATE TABLE fileuploads(
 	mimetype	VARCHAR(255) NOT NULL,
 	size		BIGINT NOT NULL,
 	location	VARCHAR(2048) NOT NULL,
+	enckey		VARBINARY(128),
 
 	PRIMARY KEY(id),
 	INDEX fileuploads_status(status)
@@ -229,3 +232,21 @@ CREATE TABLE filemsglinks(
 	FOREIGN KEY(topicid) REFERENCES topics(id) ON DELETE CASCADE,
 	FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
 );
+
+# Complaints about messages and users.
+CREATE TABLE reports(
+	id			BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	reporter	BIGINT NOT NULL,
+	userid		BIGINT NOT NULL, -- Reported user or 0
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL, -- Reported message or 0
+	reason		VARCHAR(32) NOT NULL,
+	comment		VARCHAR(1024) NOT NULL,
+	resolved	BOOLEAN NOT NULL,
+	actions		JSON, -- Audit log of moderator actions
+
+	PRIMARY KEY(id),
+	INDEX reports_resolved_createdat(resolved, createdat)
+);
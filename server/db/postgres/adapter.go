@@ -46,7 +46,7 @@ type adapter struct {
 }
 
 const (
-	adpVersion  = 113
+	adpVersion  = 116
 	adapterName = "postgres"
 
 	defaultMaxResults = 1024
@@ -339,6 +339,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			notify    JSON,
 			PRIMARY KEY(id)
 		);
 		CREATE INDEX users_state_stateat ON users(state, stateat);
@@ -455,6 +456,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			modewant  VARCHAR(8),
 			modegiven VARCHAR(8),
 			private   JSON,
+			notify    JSON,
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id)
 		);
@@ -536,6 +538,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			mimetype  VARCHAR(255) NOT NULL,
 			size      BIGINT NOT NULL,
 			location  VARCHAR(2048) NOT NULL,
+			enckey    BYTEA,
 			PRIMARY KEY(id)
 		);
 		CREATE INDEX fileuploads_status ON fileuploads(status);`); err != nil {
@@ -560,6 +563,26 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Complaints about messages and users.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE reports(
+			id        BIGINT NOT NULL,
+			createdat TIMESTAMP(3) NOT NULL,
+			updatedat TIMESTAMP(3) NOT NULL,
+			reporter  BIGINT NOT NULL,
+			userid    BIGINT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			reason    VARCHAR(32) NOT NULL,
+			comment   VARCHAR(1024) NOT NULL,
+			resolved  BOOLEAN NOT NULL,
+			actions   JSON,
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX reports_resolved_createdat ON reports(resolved, createdat);`); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec(ctx,
 		`CREATE TABLE kvmeta(
 			"key"     VARCHAR(64) NOT NULL,
@@ -628,6 +651,64 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Encryption keys of files encrypted at rest.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD COLUMN enckey BYTEA"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Notification preferences.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE users ADD COLUMN notify JSON"); err != nil {
+			return err
+		}
+
+		if _, err := a.db.Exec(ctx, "ALTER TABLE subscriptions ADD COLUMN notify JSON"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Complaints about messages and users.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE reports(
+				id        BIGINT NOT NULL,
+				createdat TIMESTAMP(3) NOT NULL,
+				updatedat TIMESTAMP(3) NOT NULL,
+				reporter  BIGINT NOT NULL,
+				userid    BIGINT NOT NULL,
+				topic     VARCHAR(25) NOT NULL,
+				seqid     INT NOT NULL,
+				reason    VARCHAR(32) NOT NULL,
+				comment   VARCHAR(1024) NOT NULL,
+				resolved  BOOLEAN NOT NULL,
+				actions   JSON,
+				PRIMARY KEY(id)
+			);
+			CREATE INDEX reports_resolved_createdat ON reports(resolved, createdat);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -886,7 +967,7 @@ func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 		return nil, nil
 	}
 
-	err = row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags)
+	err = row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags, &user.Notify)
 	if err == nil {
 		user.SetUid(uid)
 		return &user, nil
@@ -916,7 +997,7 @@ func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
 	for rows.Next() {
 		var user t.User
 		var id int64
-		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags); err != nil {
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags, &user.Notify); err != nil {
 			users = nil
 			break
 		}
@@ -1308,6 +1389,48 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns up to 'limit' active users last seen no later than 'lastSeenBefore' and
+// after the ('lastSeenAfter', 'afterUid') position, ordered by the time they were last seen and by user ID.
+// Zero 'afterUid' means users last seen after 'lastSeenAfter'.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterUid t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Keyset pagination: users last seen at the same time are ordered by ID.
+	query := "SELECT * FROM users WHERE state=$1 AND lastseen>$2 AND lastseen<=$3 ORDER BY lastseen ASC, id ASC LIMIT $4"
+	args := []interface{}{t.StateOK, lastSeenAfter, lastSeenBefore, limit}
+	if !afterUid.IsZero() {
+		query = "SELECT * FROM users WHERE state=$1 AND (lastseen>$2 OR (lastseen=$2 AND id>$3)) AND lastseen<=$4 " +
+			"ORDER BY lastseen ASC, id ASC LIMIT $5"
+		args = []interface{}{t.StateOK, lastSeenAfter, store.DecodeUid(afterUid), lastSeenBefore, limit}
+	}
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []t.User
+	for rows.Next() {
+		var user t.User
+		var id int64
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags, &user.Notify); err != nil {
+			users = nil
+			break
+		}
+
+		user.SetUid(store.EncodeUid(id))
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return users, err
+}
+
 // *****************************
 
 func (a *adapter) topicCreate(ctx context.Context, tx pgx.Tx, topic *t.Topic) error {
@@ -1515,7 +1638,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 		var sub t.Subscription
 		var modeWant, modeGiven []byte
 		if err = rows.Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &sub.Topic, &sub.DelId,
-			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private); err != nil {
+			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private, &sub.Notify); err != nil {
 			break
 		}
 		sub.ModeWant.Scan(modeWant)
@@ -1700,7 +1823,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 
 	// Fetch all subscribed users. The number of users is not large
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,s.private
+		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,s.private,s.notify
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id
 		WHERE s.topic=?`
 	args := []interface{}{topic}
@@ -1762,7 +1885,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&userId, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
 			&sub.ReadSeqId, &modeWant, &modeGiven,
-			&public, &trusted, &lastSeen, &userAgent, &sub.Private); err != nil {
+			&public, &trusted, &lastSeen, &userAgent, &sub.Private, &sub.Notify); err != nil {
 			break
 		}
 
@@ -2010,9 +2133,9 @@ func (a *adapter) SubscriptionGet(topic string, user t.Uid, keepDeleted bool) (*
 	var userId int64
 	var modeWant, modeGiven []byte
 	err := a.db.QueryRow(ctx, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=$1 AND userid=$2`,
+		readseqid,modewant,modegiven,private,notify FROM subscriptions WHERE topic=$1 AND userid=$2`,
 		topic, store.DecodeUid(user)).Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId,
-		&sub.Topic, &sub.DelId, &sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private)
+		&sub.Topic, &sub.DelId, &sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private, &sub.Notify)
 
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -2077,7 +2200,7 @@ func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,modewant,modegiven,private,notify FROM subscriptions WHERE topic=?`
 
 	args := []interface{}{topic}
 
@@ -2119,7 +2242,7 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	var modeWant, modeGiven []byte
 	for rows.Next() {
 		if err = rows.Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId, &sub.Topic, &sub.DelId,
-			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private); err != nil {
+			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private, &sub.Notify); err != nil {
 			break
 		}
 
@@ -3092,10 +3215,10 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 		user = store.DecodeUid(t.ParseUid(fd.User))
 	}
 	_, err := a.db.Exec(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
-			"VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location,enckey) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.Location)
+		fd.Status, fd.MimeType, fd.Size, fd.Location, fd.EncKey)
 	return err
 }
 
@@ -3154,8 +3277,8 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 	var fd t.FileDef
 	var ID int64
 	var userId int64
-	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
-		"FROM fileuploads WHERE id=$1", store.DecodeUid(id)).Scan(&ID, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status, &fd.MimeType, &fd.Size, &fd.Location)
+	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location,enckey "+
+		"FROM fileuploads WHERE id=$1", store.DecodeUid(id)).Scan(&ID, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status, &fd.MimeType, &fd.Size, &fd.Location, &fd.EncKey)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -3170,6 +3293,72 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileGetEncrypted fetches up to limit records of encrypted files with IDs following afterId.
+func (a *adapter) FileGetEncrypted(afterId string, limit int) ([]t.FileDef, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "SELECT id,createdat,updatedat,COALESCE(userid,0),status,mimetype,size,location,enckey " +
+		"FROM fileuploads WHERE enckey IS NOT NULL"
+	var args []interface{}
+	if afterId != "" {
+		id := t.ParseUid(afterId)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		query += " AND id>?"
+		args = append(args, store.DecodeUid(id))
+	}
+	query += " ORDER BY id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	query, _ = expandQuery(query, args...)
+
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fds []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		var id, userId int64
+		if err = rows.Scan(&id, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status, &fd.MimeType,
+			&fd.Size, &fd.Location, &fd.EncKey); err != nil {
+			break
+		}
+		fd.SetUid(store.EncodeUid(id))
+		fd.User = store.EncodeUid(userId).String()
+		fds = append(fds, fd)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return fds, err
+}
+
+// FileUpdateEncKey replaces encrypted data key of the file.
+func (a *adapter) FileUpdateEncKey(fid string, key []byte) error {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// UpdatedAt is not changed: the content of the file remains the same.
+	_, err := a.db.Exec(ctx, "UPDATE fileuploads SET enckey=$1 WHERE id=$2", key, store.DecodeUid(id))
+	return err
+}
+
 // FileDeleteUnused deletes file upload records.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
 	ctx, cancel := a.getContextForTx()
@@ -3313,6 +3502,107 @@ func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []
 	return tx.Commit(ctx)
 }
 
+// ReportCreate saves a new report.
+func (a *adapter) ReportCreate(report *t.Report) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var user int64
+	if report.User != "" {
+		user = decodeUidString(report.User)
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO reports(id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)",
+		store.DecodeUid(report.Uid()), report.CreatedAt, report.UpdatedAt, decodeUidString(report.From), user,
+		report.Topic, report.SeqId, report.Reason, report.Comment, report.Resolved, toJSON(report.Actions))
+	return err
+}
+
+func scanReport(row pgx.Row) (*t.Report, error) {
+	var report t.Report
+	var id, reporter, user int64
+	var actions []byte
+	if err := row.Scan(&id, &report.CreatedAt, &report.UpdatedAt, &reporter, &user, &report.Topic, &report.SeqId,
+		&report.Reason, &report.Comment, &report.Resolved, &actions); err != nil {
+		return nil, err
+	}
+	report.SetUid(store.EncodeUid(id))
+	report.From = store.EncodeUid(reporter).String()
+	if user != 0 {
+		report.User = store.EncodeUid(user).String()
+	}
+	if len(actions) > 0 {
+		if err := json.Unmarshal(actions, &report.Actions); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
+
+// ReportGet reads a report by ID.
+func (a *adapter) ReportGet(id string) (*t.Report, error) {
+	uid := t.ParseUid(id)
+	if uid.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	report, err := scanReport(a.db.QueryRow(ctx,
+		"SELECT id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions "+
+			"FROM reports WHERE id=$1", store.DecodeUid(uid)))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+// ReportGetAll returns up to limit most recent reports.
+func (a *adapter) ReportGetAll(unresolvedOnly bool, limit int) ([]t.Report, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := "SELECT id,createdat,updatedat,reporter,userid,topic,seqid,reason,comment,resolved,actions FROM reports"
+	if unresolvedOnly {
+		query += " WHERE resolved=FALSE"
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	rows, err := a.db.Query(ctx, query+" ORDER BY createdat DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []t.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+// ReportAddAction atomically appends the action to the audit log of the report and optionally marks it as resolved.
+func (a *adapter) ReportAddAction(report *t.Report, action *t.ReportAction, resolve bool) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE reports SET updatedat=$1,resolved=resolved OR $2,"+
+		"actions=(COALESCE(actions::jsonb,'[]'::jsonb) || jsonb_build_array($3::jsonb))::json WHERE id=$4",
+		action.When, resolve, string(toJSON(action)), store.DecodeUid(report.Uid()))
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	ctx, cancel := a.getContext()
@@ -3378,12 +3668,50 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 		defer cancel()
 	}
 
-	_, err := a.db.Exec(ctx, `DELETE FROM kvmeta WHERE "key" LIKE $1 AND createdat<$2`, keyPrefix+"%", olderThan)
+	_, err := a.db.Exec(ctx, `DELETE FROM kvmeta WHERE "key" LIKE $1 ESCAPE '!' AND createdat<$2`, likePrefix(keyPrefix), olderThan)
 	return err
 }
 
+// PCacheList returns up to 'limit' oldest entries with the given key prefix, oldest first.
+func (a *adapter) PCacheList(keyPrefix string, limit int) ([]t.KeyValue, error) {
+	if keyPrefix == "" {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, `SELECT "key","value" FROM kvmeta WHERE "key" LIKE $1 ESCAPE '!' ORDER BY createdat LIMIT $2`,
+		likePrefix(keyPrefix), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []t.KeyValue
+	for rows.Next() {
+		var kv t.KeyValue
+		if err = rows.Scan(&kv.Key, &kv.Value); err != nil {
+			break
+		}
+		result = append(result, kv)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return result, err
+}
+
 // Helper functions
 
+// likePrefix converts the key prefix to a LIKE pattern with '!' as the escape character.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
 func isDupe(err error) bool {
 	if err == nil {
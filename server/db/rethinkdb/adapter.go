@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -34,7 +35,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 113
+	adpVersion = 116
 
 	adapterName = "rethinkdb"
 
@@ -399,6 +400,14 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreate("UseCount").RunWrite(a.conn); err != nil {
 		return err
 	}
+	if err := createEncryptedIndex(a); err != nil {
+		return err
+	}
+
+	// Complaints about messages and users. See types.Report.
+	if err := createReportsTable(a); err != nil {
+		return err
+	}
 
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
@@ -409,6 +418,15 @@ func (a *adapter) CreateDb(reset bool) error {
 	return nil
 }
 
+func createReportsTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("reports", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Secondary index on reports.CreatedAt to fetch the most recent reports.
+	_, err := rdb.DB(a.dbName).Table("reports").IndexCreate("CreatedAt").RunWrite(a.conn)
+	return err
+}
+
 // UpgradeDb upgrades the database to the latest version.
 func (a *adapter) UpgradeDb() error {
 	bumpVersion := func(a *adapter, x int) error {
@@ -557,6 +575,35 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Index of encrypted files for rotation of the master key.
+		if err := createEncryptedIndex(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Just bump the version to keep up with MySQL.
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Complaints about messages and users.
+		if err := createReportsTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -1134,6 +1181,37 @@ func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]
 	return uids, err
 }
 
+// UserGetOffline returns up to 'limit' active users last seen no later than 'lastSeenBefore' and
+// after the ('lastSeenAfter', 'afterUid') position, ordered by the time they were last seen and by user ID.
+// Zero 'afterUid' means users last seen after 'lastSeenAfter'.
+func (a *adapter) UserGetOffline(lastSeenAfter time.Time, afterUid t.Uid, lastSeenBefore time.Time, limit int) ([]t.User, error) {
+	// Keyset pagination: users last seen at the same time are ordered by ID.
+	after := rdb.Row.Field("LastSeen").Gt(lastSeenAfter)
+	if !afterUid.IsZero() {
+		after = after.Or(rdb.Row.Field("LastSeen").Eq(lastSeenAfter).And(rdb.Row.Field("Id").Gt(afterUid.String())))
+	}
+	cursor, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("State", t.StateOK).
+		Filter(after.And(rdb.Row.Field("LastSeen").Le(lastSeenBefore))).
+		OrderBy("LastSeen", "Id").
+		Limit(limit).
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var users []t.User
+	var user t.User
+	for cursor.Next(&user) {
+		users = append(users, user)
+		user = t.User{}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // *****************************
 
 // TopicCreate creates a topic from template
@@ -2613,6 +2691,46 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// createEncryptedIndex creates a secondary index on IDs of encrypted files. Unencrypted files are not
+// indexed: secondary indexes do not store NULLs.
+func createEncryptedIndex(a *adapter) error {
+	_, err := rdb.DB(a.dbName).Table("fileuploads").IndexCreateFunc("Encrypted_Id",
+		func(row rdb.Term) interface{} {
+			return rdb.Branch(row.Field("EncKey").Default(nil).Ne(nil), row.Field("Id"), nil)
+		}).RunWrite(a.conn)
+	return err
+}
+
+// FileGetEncrypted fetches up to limit records of encrypted files with IDs following afterId.
+func (a *adapter) FileGetEncrypted(afterId string, limit int) ([]t.FileDef, error) {
+	q := rdb.DB(a.dbName).Table("fileuploads").
+		Between(afterId, rdb.MaxVal, rdb.BetweenOpts{Index: "Encrypted_Id", LeftBound: "open"}).
+		OrderBy(rdb.OrderByOpts{Index: "Encrypted_Id"})
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	cursor, err := q.Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var fds []t.FileDef
+	if err = cursor.All(&fds); err != nil {
+		return nil, err
+	}
+	return fds, nil
+}
+
+// FileUpdateEncKey replaces encrypted data key of the file.
+func (a *adapter) FileUpdateEncKey(fid string, key []byte) error {
+	// UpdatedAt is not changed: the content of the file remains the same.
+	_, err := rdb.DB(a.dbName).Table("fileuploads").Get(fid).
+		Update(map[string]interface{}{"EncKey": key}).RunWrite(a.conn)
+	return err
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && userId.IsZero() && msgId.IsZero()) {
@@ -2763,6 +2881,67 @@ func (a *adapter) decFileUseCounter(msgQuery rdb.Term) error {
 	return err
 }
 
+// ReportCreate saves a new report.
+func (a *adapter) ReportCreate(report *t.Report) error {
+	_, err := rdb.DB(a.dbName).Table("reports").Insert(report).RunWrite(a.conn)
+	return err
+}
+
+// ReportGet reads a report by ID.
+func (a *adapter) ReportGet(id string) (*t.Report, error) {
+	cursor, err := rdb.DB(a.dbName).Table("reports").Get(id).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var report t.Report
+	if err = cursor.One(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ReportGetAll returns up to limit most recent reports.
+func (a *adapter) ReportGetAll(unresolvedOnly bool, limit int) ([]t.Report, error) {
+	q := rdb.DB(a.dbName).Table("reports").OrderBy(rdb.OrderByOpts{Index: rdb.Desc("CreatedAt")})
+	if unresolvedOnly {
+		q = q.Filter(rdb.Row.Field("Resolved").Eq(false))
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	cursor, err := q.Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var reports []t.Report
+	if err = cursor.All(&reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// ReportAddAction atomically appends the action to the audit log of the report and optionally marks it as resolved.
+func (a *adapter) ReportAddAction(report *t.Report, action *t.ReportAction, resolve bool) error {
+	_, err := rdb.DB(a.dbName).Table("reports").Get(report.Id).
+		Update(func(row rdb.Term) interface{} {
+			return map[string]interface{}{
+				"UpdatedAt": action.When,
+				"Resolved":  row.Field("Resolved").Or(resolve),
+				"Actions":   row.Field("Actions").Default([]interface{}{}).Append(action),
+			}
+		}).RunWrite(a.conn)
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	cursor, err := rdb.DB(a.dbName).Table("kvmeta").Get(key).Field("value").Run(a.conn)
@@ -2824,13 +3003,41 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	}
 
 	_, err := rdb.DB(a.dbName).Table("kvmeta").
-		Filter(rdb.Row.Field("CreatedAt").Lt(olderThan).And(rdb.Row.Field("key").Match("^" + keyPrefix))).
+		Filter(rdb.Row.Field("CreatedAt").Lt(olderThan).And(rdb.Row.Field("key").Match("^" + regexp.QuoteMeta(keyPrefix)))).
 		Delete().
 		RunWrite(a.conn)
 
 	return err
 }
 
+// PCacheList returns up to 'limit' oldest entries with the given key prefix, oldest first.
+func (a *adapter) PCacheList(keyPrefix string, limit int) ([]t.KeyValue, error) {
+	if keyPrefix == "" {
+		return nil, t.ErrMalformed
+	}
+
+	cursor, err := rdb.DB(a.dbName).Table("kvmeta").
+		Filter(rdb.Row.Field("key").Match("^" + regexp.QuoteMeta(keyPrefix))).
+		OrderBy("CreatedAt").
+		Limit(limit).
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var result []t.KeyValue
+	var entry struct {
+		Key   string `rethinkdb:"key"`
+		Value string `rethinkdb:"value"`
+	}
+	for cursor.Next(&entry) {
+		result = append(result, t.KeyValue{Key: entry.Key, Value: entry.Value})
+	}
+
+	return result, cursor.Err()
+}
+
 // Checks if the given error is 'Database not found'.
 func isMissingDb(err error) bool {
 	if err == nil {
@@ -0,0 +1,439 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Periodic email digests of unread messages for users who have been offline
+ *  for a while.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmlt "html/template"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	textt "text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+	i18n "golang.org/x/text/language"
+)
+
+const (
+	// Default maximum number of topics listed in one digest.
+	defaultDigestMaxTopics = 5
+	// Default maximum number of message previews per topic.
+	defaultDigestMaxMessages = 3
+	// Maximum length of a message preview in characters.
+	digestPreviewLength = 160
+)
+
+// Single message preview in a digest.
+type digestMessage struct {
+	From string
+	Text string
+	Time time.Time
+}
+
+// Summary of a single topic in a digest.
+type digestTopic struct {
+	Name     string
+	Unread   int
+	Messages []digestMessage
+}
+
+type emailDigest struct {
+	offline     time.Duration
+	blockSize   int
+	maxTopics   int
+	maxMessages int
+	hostUrl     string
+	unsubUrl    string
+	mailer      validate.Mailer
+
+	templ       []*textt.Template
+	langMatcher i18n.Matcher
+}
+
+// newEmailDigest validates digest config, loads templates and finds the mailer.
+func newEmailDigest(conf *digestConfig, apiPath string) (*emailDigest, error) {
+	if conf.Period <= 0 || conf.OfflinePeriod <= 0 || conf.BlockSize <= 0 {
+		return nil, errors.New("invalid period, offline_period or block_size")
+	}
+
+	mailer, ok := store.Store.GetValidator("email").(validate.Mailer)
+	if !ok {
+		return nil, errors.New("email validator is not configured")
+	}
+
+	hostUrl, err := validate.ValidateHostURL(conf.HostUrl)
+	if err != nil {
+		return nil, err
+	}
+	unsubUrl, _ := url.Parse(hostUrl)
+	unsubUrl.Path = path.Join(unsubUrl.Path, apiPath, "v0/digest/unsubscribe")
+
+	ed := &emailDigest{
+		offline:     time.Second * time.Duration(conf.OfflinePeriod),
+		blockSize:   conf.BlockSize,
+		maxTopics:   conf.MaxTopics,
+		maxMessages: conf.MaxMessages,
+		hostUrl:     hostUrl,
+		unsubUrl:    unsubUrl.String(),
+		mailer:      mailer,
+	}
+	if ed.maxTopics <= 0 {
+		ed.maxTopics = defaultDigestMaxTopics
+	}
+	if ed.maxMessages <= 0 {
+		ed.maxMessages = defaultDigestMaxMessages
+	}
+
+	templPath, err := validate.ResolveTemplatePath(conf.DigestTemplFile)
+	if err != nil {
+		return nil, err
+	}
+	pathTempl, err := textt.New("digest").Parse(templPath)
+	if err != nil {
+		return nil, err
+	}
+
+	languages := conf.Languages
+	if len(languages) == 0 {
+		// No i18n support. Use defaults.
+		languages = []string{""}
+	}
+	var langTags []i18n.Tag
+	for _, lang := range languages {
+		if lang != "" {
+			tag, err := i18n.Parse(lang)
+			if err != nil {
+				return nil, err
+			}
+			langTags = append(langTags, tag)
+		}
+		templ, path, err := validate.ReadTemplateFile(pathTempl, lang)
+		if err != nil {
+			return nil, err
+		}
+		if templ.Lookup("subject") == nil || (templ.Lookup("body_plain") == nil && templ.Lookup("body_html") == nil) {
+			return nil, fmt.Errorf("parsing %s: template incomplete", path)
+		}
+		ed.templ = append(ed.templ, templ)
+	}
+	if len(langTags) > 0 {
+		ed.langMatcher = i18n.NewMatcher(langTags)
+	}
+
+	return ed, nil
+}
+
+// run starts sending digests periodically. Returns a channel to stop the process.
+func (ed *emailDigest) run(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the digest must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Email digest started with period %s, offline period %s",
+			period.Round(time.Second), ed.offline)
+
+		// Each user gets a single digest when they cross the offline threshold.
+		lastCutoff := time.Now().Add(-ed.offline - period)
+		for {
+			select {
+			case <-ticker.C:
+				cutoff := time.Now().Add(-ed.offline)
+				ed.sendAll(lastCutoff, cutoff)
+				lastCutoff = cutoff
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// sendAll sends digests to users who were last seen in the (after, before] interval.
+func (ed *emailDigest) sendAll(after, before time.Time) {
+	// Position of the last processed user.
+	var afterUid types.Uid
+	for {
+		users, err := store.Users.GetOffline(after, afterUid, before, ed.blockSize)
+		if err != nil {
+			logs.Warn.Println("email digest: failed to load offline users", err)
+			return
+		}
+		if len(users) == 0 {
+			return
+		}
+
+		var uids []types.Uid
+		for i := range users {
+			if users[i].Notify != nil && users[i].Notify.NoDigest {
+				continue
+			}
+			uid := users[i].Uid()
+			if globals.cluster.isRemoteTopic(uid.UserId()) {
+				// The user is handled by another cluster node.
+				continue
+			}
+			uids = append(uids, uid)
+		}
+
+		if len(uids) > 0 {
+			unread, err := store.Users.GetUnreadCount(uids...)
+			if err != nil {
+				logs.Warn.Println("email digest: failed to get unread counts", err)
+				return
+			}
+			for _, uid := range uids {
+				if unread[uid] <= 0 {
+					continue
+				}
+				if err := ed.sendOne(uid, unread[uid]); err != nil {
+					logs.Warn.Println("email digest: failed to send to", uid.UserId(), err)
+				}
+			}
+		}
+
+		if len(users) < ed.blockSize {
+			return
+		}
+		after = *users[len(users)-1].LastSeen
+		afterUid = users[len(users)-1].Uid()
+	}
+}
+
+// sendOne composes and sends a digest to a single user.
+func (ed *emailDigest) sendOne(uid types.Uid, unread int) error {
+	creds, err := store.Users.GetAllCreds(uid, "email", true)
+	if err != nil {
+		return err
+	}
+	if len(creds) == 0 {
+		// No confirmed email address.
+		return nil
+	}
+
+	topics, err := ed.unreadTopics(uid)
+	if err != nil {
+		return err
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+
+	content, err := validate.ExecuteTemplate(ed.templ[ed.templIndex(uid)], []string{"subject", "body_plain", "body_html"},
+		map[string]interface{}{
+			"HostUrl":        ed.hostUrl,
+			"UnsubscribeUrl": ed.unsubUrl + "?uid=" + uid.UserId() + "&sig=" + digestUnsubscribeSig(uid),
+			"Unread":         unread,
+			"Topics":         topics,
+		})
+	if err != nil {
+		return err
+	}
+
+	return ed.mailer.SendMail(creds[0].Value, content)
+}
+
+// templIndex finds the template matching the language of the user's most recently used device.
+func (ed *emailDigest) templIndex(uid types.Uid) int {
+	if ed.langMatcher == nil {
+		return 0
+	}
+	devices, _, err := store.Devices.GetAll(uid)
+	if err != nil {
+		return 0
+	}
+	var lang string
+	var lastSeen time.Time
+	for _, dev := range devices[uid] {
+		if dev.Lang != "" && dev.LastSeen.After(lastSeen) {
+			lang, lastSeen = dev.Lang, dev.LastSeen
+		}
+	}
+	if lang == "" {
+		return 0
+	}
+	_, idx := i18n.MatchStrings(ed.langMatcher, lang)
+	return idx
+}
+
+// unreadTopics lists most recently updated topics with unread messages and their latest messages.
+func (ed *emailDigest) unreadTopics(uid types.Uid) ([]digestTopic, error) {
+	subs, err := store.Users.GetTopics(uid, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var unreadSubs []*types.Subscription
+	for i := range subs {
+		sub := &subs[i]
+		if sub.GetSeqId() > sub.ReadSeqId && (sub.ModeGiven & sub.ModeWant).IsReader() {
+			unreadSubs = append(unreadSubs, sub)
+		}
+	}
+	sort.Slice(unreadSubs, func(i, j int) bool {
+		return unreadSubs[i].GetTouchedAt().After(unreadSubs[j].GetTouchedAt())
+	})
+	if len(unreadSubs) > ed.maxTopics {
+		unreadSubs = unreadSubs[:ed.maxTopics]
+	}
+
+	var topics []digestTopic
+	senders := make(map[types.Uid]string)
+	for _, sub := range unreadSubs {
+		msgs, err := store.Messages.GetAll(sub.Topic, uid,
+			&types.QueryOpt{Since: sub.ReadSeqId + 1, Limit: ed.maxMessages})
+		if err != nil {
+			return nil, err
+		}
+		topic := digestTopic{Name: publicName(sub.GetPublic(), sub.Topic), Unread: sub.GetSeqId() - sub.ReadSeqId}
+		// Messages are sorted newest first.
+		for i := len(msgs) - 1; i >= 0; i-- {
+			text, err := drafty.PlainText(msgs[i].Content)
+			if err != nil || text == "" {
+				continue
+			}
+			from := types.ParseUid(msgs[i].From)
+			senders[from] = ""
+			topic.Messages = append(topic.Messages, digestMessage{
+				From: from.UserId(),
+				Text: truncatePreview(text, digestPreviewLength),
+				Time: msgs[i].CreatedAt,
+			})
+		}
+		topics = append(topics, topic)
+	}
+
+	// Replace sender IDs with their names.
+	if len(senders) > 0 {
+		uids := make([]types.Uid, 0, len(senders))
+		for id := range senders {
+			uids = append(uids, id)
+		}
+		if users, err := store.Users.GetAll(uids...); err == nil {
+			for i := range users {
+				senders[users[i].Uid()] = publicName(users[i].Public, "")
+			}
+		}
+		for i := range topics {
+			for j := range topics[i].Messages {
+				if name := senders[types.ParseUserId(topics[i].Messages[j].From)]; name != "" {
+					topics[i].Messages[j].From = name
+				}
+			}
+		}
+	}
+
+	return topics, nil
+}
+
+// publicName extracts full name 'fn' from the public field of a user or a topic.
+func publicName(public interface{}, fallback string) string {
+	if pub, ok := public.(map[string]interface{}); ok {
+		if fn, ok := pub["fn"].(string); ok && fn != "" {
+			return fn
+		}
+	}
+	return fallback
+}
+
+// truncatePreview shortens the text to at most maxLen characters.
+func truncatePreview(text string, maxLen int) string {
+	if utf8.RuneCountInString(text) <= maxLen {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:maxLen-1]) + "…"
+}
+
+// digestUnsubscribeSig calculates the signature of the unsubscribe link for the given user.
+func digestUnsubscribeSig(uid types.Uid) string {
+	hasher := hmac.New(sha256.New, globals.apiKeySalt)
+	hasher.Write([]byte("digest-unsubscribe:" + uid.UserId()))
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// Confirmation page shown by the unsubscribe link. Link prefetchers and scanners follow links with GET,
+// so the actual change is made by the POST from the page.
+var digestUnsubscribePage = htmlt.Must(htmlt.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body><form method="post">
+<input type="hidden" name="uid" value="{{.Uid}}"><input type="hidden" name="sig" value="{{.Sig}}">
+<p>Stop receiving email digests of unread messages?</p>
+<button type="submit">Unsubscribe</button>
+</form></body></html>
+`))
+
+// serveDigestUnsubscribe handles unsubscribe links from email digests: GET shows a confirmation page,
+// POST turns off digests for the user.
+func serveDigestUnsubscribe(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(wrt, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uid := types.ParseUserId(req.FormValue("uid"))
+	sig, _ := base64.RawURLEncoding.DecodeString(req.FormValue("sig"))
+	expected, _ := base64.RawURLEncoding.DecodeString(digestUnsubscribeSig(uid))
+	if uid.IsZero() || !hmac.Equal(sig, expected) {
+		http.Error(wrt, "invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		wrt.Header().Set("Content-Type", "text/html; charset=utf-8")
+		wrt.Header().Set("Cache-Control", "no-store")
+		digestUnsubscribePage.Execute(wrt, map[string]string{"Uid": req.FormValue("uid"), "Sig": req.FormValue("sig")})
+		return
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		logs.Warn.Println("email digest: unsubscribe failed", uid.UserId(), err)
+		http.Error(wrt, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(wrt, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if user.Notify == nil || !user.Notify.NoDigest {
+		notify := types.NotifyPrefs{}
+		if user.Notify != nil {
+			notify = *user.Notify
+		}
+		notify.NoDigest = true
+		if err := store.Users.Update(uid, map[string]interface{}{"Notify": &notify, "UpdatedAt": types.TimeNow()}); err != nil {
+			logs.Warn.Println("email digest: unsubscribe failed", uid.UserId(), err)
+			http.Error(wrt, "internal error", http.StatusInternalServerError)
+			return
+		}
+		notifyPrefsCache.update(uid, &notify)
+	}
+
+	wrt.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	wrt.WriteHeader(http.StatusOK)
+	wrt.Write([]byte("You have been unsubscribed from email digests.\n"))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	textt "text/template"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/validate"
+)
+
+func TestDigestTemplates(t *testing.T) {
+	pathTempl := textt.Must(textt.New("digest").Parse("./templ/email-digest-{{.Language}}.templ"))
+	params := map[string]interface{}{
+		"HostUrl":        "https://example.com/",
+		"UnsubscribeUrl": "https://example.com/v0/digest/unsubscribe?uid=usrABC&sig=XYZ",
+		"Unread":         3,
+		"Topics": []digestTopic{
+			{
+				Name:   "Alice & Bob",
+				Unread: 3,
+				Messages: []digestMessage{
+					{From: "Alice", Text: "<b>hi</b>", Time: time.Now()},
+				},
+			},
+		},
+	}
+	for _, lang := range []string{"en", "es", "fr", "pt", "ru", "vi", "zh"} {
+		templ, path, err := validate.ReadTemplateFile(pathTempl, lang)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		content, err := validate.ExecuteTemplate(templ, []string{"subject", "body_plain", "body_html"}, params)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !strings.Contains(content["subject"], "3") {
+			t.Errorf("%s: subject missing unread count: '%s'", path, content["subject"])
+		}
+		if !strings.Contains(content["body_html"], "Alice &amp; Bob") || strings.Contains(content["body_html"], "<b>hi</b>") {
+			t.Errorf("%s: body_html is not escaped", path)
+		}
+		if !strings.Contains(content["body_plain"], params["UnsubscribeUrl"].(string)) {
+			t.Errorf("%s: body_plain missing unsubscribe link", path)
+		}
+	}
+}
+
+func TestDigestUnsubscribeSig(t *testing.T) {
+	globals.apiKeySalt = []byte("test salt")
+	defer func() { globals.apiKeySalt = nil }()
+
+	uid1, uid2 := types.Uid(1), types.Uid(2)
+	if digestUnsubscribeSig(uid1) != digestUnsubscribeSig(uid1) {
+		t.Error("signature is not deterministic")
+	}
+	if digestUnsubscribeSig(uid1) == digestUnsubscribeSig(uid2) {
+		t.Error("signatures of different users must differ")
+	}
+}
+
+func TestTruncatePreview(t *testing.T) {
+	if got := truncatePreview("short", 10); got != "short" {
+		t.Errorf("expected 'short', got '%s'", got)
+	}
+	if got := truncatePreview("привет мир", 5); got != "прив…" {
+		t.Errorf("expected 'прив…', got '%s'", got)
+	}
+}
+
+func TestDigestPagination(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() {
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	after := time.Now().Add(-time.Hour)
+	before := time.Now()
+	seen := after.Add(time.Minute)
+	page := make([]types.User, 2)
+	for i := range page {
+		page[i].SetUid(types.Uid(i + 1))
+		page[i].LastSeen = &seen
+		// Opted out users: nothing is sent.
+		page[i].Notify = &types.NotifyPrefs{NoDigest: true}
+	}
+
+	// Users last seen at the same time as the last user of the page are not skipped.
+	gomock.InOrder(
+		uu.EXPECT().GetOffline(after, types.ZeroUid, before, 2).Return(page, nil),
+		uu.EXPECT().GetOffline(seen, types.Uid(2), before, 2).Return(nil, nil),
+	)
+	(&emailDigest{blockSize: 2}).sendAll(after, before)
+}
+
+func TestDigestUnsubscribe(t *testing.T) {
+	globals.apiKeySalt = []byte("test salt")
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() {
+		globals.apiKeySalt = nil
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	query := url.Values{"uid": {uid.UserId()}, "sig": {digestUnsubscribeSig(uid)}}.Encode()
+
+	// GET only shows the confirmation page.
+	wrt := httptest.NewRecorder()
+	serveDigestUnsubscribe(wrt, httptest.NewRequest(http.MethodGet, "/v0/digest/unsubscribe?"+query, nil))
+	if wrt.Code != http.StatusOK || !strings.Contains(wrt.Body.String(), `method="post"`) {
+		t.Fatalf("unexpected confirmation page %d '%s'", wrt.Code, wrt.Body.String())
+	}
+
+	user := &types.User{}
+	user.SetUid(uid)
+	uu.EXPECT().Get(uid).Return(user, nil)
+	uu.EXPECT().Update(uid, gomock.Any()).DoAndReturn(func(_ types.Uid, update map[string]interface{}) error {
+		if !update["Notify"].(*types.NotifyPrefs).NoDigest {
+			t.Error("digests not turned off")
+		}
+		return nil
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v0/digest/unsubscribe", strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	wrt = httptest.NewRecorder()
+	serveDigestUnsubscribe(wrt, req)
+	if wrt.Code != http.StatusOK {
+		t.Errorf("unsubscribe failed %d", wrt.Code)
+	}
+}
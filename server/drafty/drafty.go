@@ -405,6 +405,25 @@ func previewFormatter(n *node, ctx interface{}) error {
 	return nil
 }
 
+// Mentions returns IDs of users mentioned in a Drafty document, i.e. values of 'MN' entities.
+func Mentions(content interface{}) ([]string, error) {
+	doc, err := decodeAsDrafty(content)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var mentions []string
+	for i := range doc.Ent {
+		if doc.Ent[i].Tp != "MN" {
+			continue
+		}
+		if val, ok := nullableMapGet(doc.Ent[i].Data, "val"); ok && val != "" {
+			mentions = append(mentions, val)
+		}
+	}
+	return mentions, nil
+}
+
 // nullableMapGet is a helper method to get a possibly missing string from a possibly nil map.
 func nullableMapGet(data map[string]interface{}, key string) (string, bool) {
 	if data == nil {
@@ -168,3 +168,34 @@ func TestPreview(t *testing.T) {
 		}
 	}
 }
+
+func TestMentions(t *testing.T) {
+	inputs := []string{
+		`"Plain text @alice"`,
+		`{
+			"txt":"Hi @alice and @bob, see https://tinode.co",
+			"fmt":[{"at":3,"len":6},{"at":14,"len":4,"key":1},{"at":24,"len":17,"key":2}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}},{"tp":"MN","data":{"val":"usrBob"}},{"tp":"LN","data":{"url":"https://tinode.co"}}]
+		}`,
+	}
+	expect := [][]string{nil, {"usrAlice", "usrBob"}}
+
+	for i := range inputs {
+		var val interface{}
+		if err := json.Unmarshal([]byte(inputs[i]), &val); err != nil {
+			t.Fatalf("Failed to parse input %d '%s': %s", i, inputs[i], err)
+		}
+		res, err := Mentions(val)
+		if err != nil {
+			t.Errorf("%d failed with error: %s", i, err)
+		} else if len(res) != len(expect[i]) {
+			t.Errorf("%d output %v does not match %v", i, res, expect[i])
+		} else {
+			for j := range res {
+				if res[j] != expect[i][j] {
+					t.Errorf("%d output %v does not match %v", i, res, expect[i])
+				}
+			}
+		}
+	}
+}
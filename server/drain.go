@@ -0,0 +1,245 @@
+/******************************************************************************
+ *  Description :
+ *    Graceful draining of the node before shutdown: stop accepting new
+ *    sessions, move topics to other cluster nodes, ask clients to reconnect,
+ *    wait for the sessions to finish, then shut down.
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default time to wait for sessions to finish.
+	defaultDrainTimeout = 60 * time.Second
+	// Default upper bound of the random delay before clients reconnect.
+	defaultDrainReconnectDelay = 10 * time.Second
+	// How often to check drain progress.
+	drainCheckInterval = 250 * time.Millisecond
+)
+
+// Stages of draining.
+const (
+	drainStageRehashing     = "rehashing"
+	drainStageDisconnecting = "disconnecting"
+	drainStageDone          = "done"
+)
+
+type drainConfig struct {
+	// URL path for starting the drain with an HTTP POST request. Empty string disables the endpoint.
+	Path string `json:"path"`
+	// Secret which must be sent as 'Authorization: Bearer <secret>' to the drain endpoint.
+	Secret string `json:"secret"`
+	// Maximum time in seconds to wait for topics to move and sessions to finish at each stage.
+	Timeout int `json:"timeout"`
+	// Clients are asked to reconnect after a random delay of up to this many seconds.
+	ReconnectDelay int `json:"reconnect_delay"`
+}
+
+// nodeDrain tracks draining of the node.
+type nodeDrain struct {
+	timeout        time.Duration
+	reconnectDelay time.Duration
+	secret         string
+
+	// Non-zero when the drain has started.
+	active int32
+
+	lock    sync.Mutex
+	started time.Time
+	stage   string
+
+	// Channel for requesting the server shutdown once draining is complete. Set by signalHandler.
+	stop chan<- bool
+}
+
+// drainStatus is the drain progress reported by the status endpoint.
+type drainStatus struct {
+	Stage   string    `json:"stage"`
+	Started time.Time `json:"started"`
+	// Number of client sessions still connected.
+	Sessions int `json:"sessions"`
+	// Number of topics still hosted at this node.
+	Topics int `json:"topics"`
+}
+
+func newNodeDrain(conf *drainConfig) *nodeDrain {
+	d := &nodeDrain{
+		timeout:        defaultDrainTimeout,
+		reconnectDelay: defaultDrainReconnectDelay,
+	}
+	if conf != nil {
+		if conf.Timeout > 0 {
+			d.timeout = time.Duration(conf.Timeout) * time.Second
+		}
+		if conf.ReconnectDelay > 0 {
+			d.reconnectDelay = time.Duration(conf.ReconnectDelay) * time.Second
+		}
+		d.secret = conf.Secret
+	}
+	return d
+}
+
+// isActive checks if the node is draining. Nil-safe.
+func (d *nodeDrain) isActive() bool {
+	return d != nil && atomic.LoadInt32(&d.active) > 0
+}
+
+// start begins draining the node in the background. Returns false if the drain has already started.
+func (d *nodeDrain) start() bool {
+	if !atomic.CompareAndSwapInt32(&d.active, 0, 1) {
+		return false
+	}
+	d.lock.Lock()
+	d.started = time.Now()
+	d.stage = drainStageRehashing
+	d.lock.Unlock()
+
+	logs.Info.Println("drain: started")
+	go d.run()
+	return true
+}
+
+func (d *nodeDrain) setStage(stage string) {
+	d.lock.Lock()
+	d.stage = stage
+	d.lock.Unlock()
+	logs.Info.Println("drain:", stage)
+}
+
+func (d *nodeDrain) run() {
+	// Stage 1: remove this node from the ring and wait for the topics to move to other nodes.
+	// The cluster leader removes draining nodes from the ring.
+	if c := globals.cluster; c != nil {
+		if c.fo == nil {
+			logs.Warn.Println("drain: failover is disabled, topics will not be moved to other nodes")
+		} else if !d.waitFor(func() bool {
+			return !c.hashRing().Has(c.thisNodeName) && drainLocalTopics() == 0
+		}) {
+			logs.Warn.Println("drain: timed out waiting for topics to move, topics left:", drainLocalTopics())
+		}
+	}
+
+	// Stage 2: ask clients to reconnect and wait for their sessions to finish.
+	// Sessions wait for their in-flight requests before terminating.
+	d.setStage(drainStageDisconnecting)
+	now := types.TimeNow()
+	globals.sessionStore.Range(func(_ string, s *Session) bool {
+		if !s.isMultiplex() {
+			// Spread reconnects over time to avoid overloading other nodes.
+			delay := rand.Int63n(int64(d.reconnectDelay/time.Millisecond) + 1)
+			_, data := s.serialize(NoErrReconnect(int(delay), now))
+			s.stopSession(data)
+		}
+		return true
+	})
+	if !d.waitFor(func() bool { return drainClientSessions() == 0 }) {
+		logs.Warn.Println("drain: timed out waiting for sessions to finish, sessions left:", drainClientSessions())
+	}
+
+	// Stage 3: shut down. Topics and caches are flushed by the regular shutdown.
+	d.setStage(drainStageDone)
+	if d.stop != nil {
+		d.stop <- true
+	}
+}
+
+// waitFor waits until the condition is met or the drain timeout expires.
+func (d *nodeDrain) waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(d.timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainCheckInterval)
+	}
+	return true
+}
+
+// status returns drain progress or nil if the node is not draining.
+func (d *nodeDrain) status() *drainStatus {
+	if !d.isActive() {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return &drainStatus{
+		Stage:    d.stage,
+		Started:  d.started,
+		Sessions: drainClientSessions(),
+		Topics:   drainLocalTopics(),
+	}
+}
+
+// drainClientSessions counts sessions of clients connected to this node.
+func drainClientSessions() int {
+	count := 0
+	globals.sessionStore.Range(func(_ string, s *Session) bool {
+		if !s.isMultiplex() {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// drainLocalTopics counts master topics hosted at this node.
+func drainLocalTopics() int {
+	count := 0
+	globals.hub.topics.Range(func(_, t any) bool {
+		if !t.(*Topic).isProxy {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// serveDrain starts draining the node in response to an HTTP POST request.
+func serveDrain(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(wrt, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d := globals.drain
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if d.secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.secret)) != 1 {
+		http.Error(wrt, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := http.StatusAccepted
+	if !d.start() {
+		// Already draining.
+		status = http.StatusOK
+	}
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.WriteHeader(status)
+	json.NewEncoder(wrt).Encode(d.status())
+}
+
+// rejectDraining responds to a request for a new session when the node is draining.
+// Returns true if the request was rejected.
+func rejectDraining(wrt http.ResponseWriter) bool {
+	if !globals.drain.isActive() {
+		return false
+	}
+	wrt.Header().Set("Retry-After", strconv.Itoa(int(globals.drain.reconnectDelay/time.Second)))
+	wrt.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(wrt).Encode(ErrServiceUnavailableExplicitTs("", "", types.TimeNow(), time.Time{}))
+	return true
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal which starts draining the node.
+var drainSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Windows has no user-defined signals: draining is available through the HTTP endpoint only.
+var drainSignal os.Signal
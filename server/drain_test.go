@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNodeDrain(t *testing.T) {
+	var d *nodeDrain
+	if d.isActive() {
+		t.Error("nil drain must not be active")
+	}
+
+	d = newNodeDrain(nil)
+	if d.timeout != defaultDrainTimeout || d.reconnectDelay != defaultDrainReconnectDelay {
+		t.Errorf("unexpected defaults %s, %s", d.timeout, d.reconnectDelay)
+	}
+
+	d = newNodeDrain(&drainConfig{Timeout: 5, ReconnectDelay: 3, Secret: "secret"})
+	if d.timeout != 5*time.Second || d.reconnectDelay != 3*time.Second || d.secret != "secret" {
+		t.Errorf("config not applied %+v", d)
+	}
+	if d.status() != nil {
+		t.Error("inactive drain must not report status")
+	}
+
+	globals.drain = d
+	defer func() { globals.drain = nil }()
+
+	rec := httptest.NewRecorder()
+	if rejectDraining(rec) {
+		t.Error("request rejected while not draining")
+	}
+
+	// Mark active without running the drain.
+	d.active = 1
+	rec = httptest.NewRecorder()
+	if !rejectDraining(rec) {
+		t.Fatal("request not rejected while draining")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "3" {
+		t.Errorf("unexpected response %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if d.start() {
+		t.Error("drain started twice")
+	}
+}
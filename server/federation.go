@@ -0,0 +1,952 @@
+/******************************************************************************
+ *  Description :
+ *    Federation between independent Tinode deployments. Users of a trusted
+ *    remote server are addressed as 'usrXXX@host' and represented locally by
+ *    shadow users. Messages between local and remote users are relayed by a
+ *    gateway over authenticated gRPC using the pbx.Federation service.
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Authentication scheme of the records which link shadow users to addresses of remote users.
+	// There is no authenticator for this scheme: shadow users cannot log in.
+	fedAuthScheme = "fed"
+	// Separator of the user ID and the server name in an address of a remote user.
+	fedAddrSeparator = "@"
+	// Metadata key with the name of the calling server.
+	fedPeerMetadataKey = "tinode-peer"
+
+	// Timeout of calls to peers and of requests made by relay sessions.
+	fedCallTimeout = 10 * time.Second
+	// Default time in seconds before Public of a remote user is fetched again.
+	defaultFedUserCacheTTL = 3600
+	// Default delay in seconds before a failed delivery is attempted again. The delay doubles with every attempt.
+	defaultFedRetryDelay = 5
+	// Upper bound of the delay between delivery attempts.
+	fedMaxRetryDelay = 5 * time.Minute
+	// Default time in seconds before an idle relay session is closed.
+	defaultFedIdleTimeout = 300
+
+	// Size of the queue of server messages for shadow users.
+	fedRouteQueueSize = 1024
+	// Size of the queue of best-effort notifications to a peer.
+	fedNotifyQueueSize = 256
+	// Maximum number of local users remembered as not being shadow users.
+	fedMaxLocalUsers = 10000
+	// How long a user is remembered as not being a shadow user.
+	fedLocalUserTTL = 10 * time.Minute
+	// Maximum number of conversations with known mapping of message IDs.
+	fedMaxSeqMaps = 10000
+	// Number of message ID pairs remembered per conversation.
+	fedSeqMapSize = 256
+)
+
+// Configuration of a trusted remote server.
+type federationPeerConfig struct {
+	// Name of the server: the 'host' part of addresses of its users.
+	Name string `json:"name"`
+	// Address of the federation endpoint of the server, host:port.
+	Addr string `json:"addr"`
+	// Shared secret. Both servers present it as a bearer token when calling each other.
+	Secret string `json:"secret"`
+	// TLS config of the connection to the server.
+	TLS *pluginTLSConfig `json:"tls"`
+}
+
+// Federation config.
+type federationConfig struct {
+	Enabled bool `json:"enabled"`
+	// Name of this server as known to the peers.
+	Name string `json:"name"`
+	// Address to listen on for calls from the peers.
+	Listen string `json:"listen"`
+	// Server-side TLS. If 'ca_file' is set, the peers must present client certificates signed by the CA.
+	TLS *pluginTLSConfig `json:"tls"`
+	// Trusted servers.
+	Peers []federationPeerConfig `json:"peers"`
+	// Time in seconds before Public of a remote user is fetched again.
+	UserCacheTTL int `json:"user_cache_ttl"`
+	// Delay in seconds before a failed delivery is attempted again.
+	RetryDelay int `json:"retry_delay"`
+	// Time in seconds of inactivity before a relay session is closed.
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// federationPeer is a connection to a trusted remote server.
+type federationPeer struct {
+	name   string
+	secret string
+	// Name of this server.
+	self string
+
+	conn   *grpc.ClientConn
+	client pbx.FederationClient
+
+	// Best-effort notifications: {info} and {pres}.
+	notifyq chan *pbx.ServerMsg
+}
+
+// fedUser is a remote user represented by a local shadow user.
+type fedUser struct {
+	// ID of the shadow user.
+	uid types.Uid
+	// ID of the user at the remote server.
+	remote string
+	peer   *federationPeer
+	// Time when Public of the user was last fetched from the remote server.
+	refreshed time.Time
+}
+
+// addr returns the address of the remote user: usrXXX@host.
+func (u *fedUser) addr() string {
+	return u.remote + fedAddrSeparator + u.peer.name
+}
+
+// federation is the gateway to trusted remote servers.
+type federation struct {
+	name  string
+	peers map[string]*federationPeer
+
+	server *grpc.Server
+
+	userCacheTTL time.Duration
+	retryDelay   time.Duration
+	idleTimeout  time.Duration
+
+	lock sync.Mutex
+	// Remote users by ID of the shadow user.
+	users map[types.Uid]*fedUser
+	// IDs of shadow users by address of the remote user.
+	addrs map[string]types.Uid
+	// Users known to be local with expiration time of the record.
+	locals map[types.Uid]time.Time
+	// Server messages waiting for users being looked up in the DB.
+	lookups map[types.Uid][]*ServerComMessage
+	// Relay sessions by ID of the shadow user.
+	relays map[types.Uid]*fedRelay
+	// Mapping of message IDs between local and remote copies of conversations.
+	seqMaps map[string]*fedSeqMap
+
+	// Server messages addressed to offline users, possibly shadow users.
+	routeq chan *ServerComMessage
+	done   chan bool
+}
+
+// parseFedAddr splits the address of a remote user 'usrXXX@host' into the user ID and the server name.
+func parseFedAddr(addr string) (string, string, bool) {
+	parts := strings.SplitN(addr, fedAddrSeparator, 2)
+	if len(parts) != 2 || parts[1] == "" || !strings.HasPrefix(parts[0], "usr") ||
+		types.ParseUserId(parts[0]).IsZero() {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// isFedAddr checks if the topic name is an address of a remote user or topic.
+func isFedAddr(name string) bool {
+	return strings.Contains(name, fedAddrSeparator)
+}
+
+func validFedServerName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, fedAddrSeparator+": ")
+}
+
+// fedTLSServerConfig creates server-side TLS config of the federation endpoint.
+func fedTLSServerConfig(conf *pluginTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.CACertFile != "" {
+		pem, err := os.ReadFile(conf.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.ClientCAs = x509.NewCertPool()
+		if !tlsConf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates in " + conf.CACertFile)
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConf, nil
+}
+
+func newFederationPeer(self string, conf *federationPeerConfig) (*federationPeer, error) {
+	if !validFedServerName(conf.Name) || conf.Addr == "" || conf.Secret == "" {
+		return nil, errors.New("peer name, address and secret are required")
+	}
+
+	p := &federationPeer{
+		name:    conf.Name,
+		secret:  conf.Secret,
+		self:    self,
+		notifyq: make(chan *pbx.ServerMsg, fedNotifyQueueSize),
+	}
+
+	var opts []grpc.DialOption
+	secure := conf.TLS != nil && conf.TLS.Enabled
+	if secure {
+		tlsConf, err := pluginTLSClientConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	} else {
+		logs.Warn.Printf("federation: secret of peer '%s' is sent over an unencrypted connection", p.name)
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	opts = append(opts, grpc.WithPerRPCCredentials(pluginTokenAuth{token: conf.Secret, secure: secure}))
+
+	// The connection is established in the background.
+	var err error
+	if p.conn, err = grpc.Dial(conf.Addr, opts...); err != nil {
+		return nil, err
+	}
+	p.client = pbx.NewFederationClient(p.conn)
+	return p, nil
+}
+
+func (p *federationPeer) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), fedCallTimeout)
+	return metadata.AppendToOutgoingContext(ctx, fedPeerMetadataKey, p.self), cancel
+}
+
+// relay sends a message to the peer and returns the peer's {ctrl} response.
+func (p *federationPeer) relay(msg *pbx.ServerMsg) (*MsgServerCtrl, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	resp, err := p.client.Relay(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if ctrl := pbServDeserialize(resp).Ctrl; ctrl != nil {
+		return ctrl, nil
+	}
+	return nil, errors.New("invalid response from " + p.name)
+}
+
+// getUser fetches description of a user of the peer.
+func (p *federationPeer) getUser(remote string) (*MsgTopicDesc, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+
+	resp, err := p.client.GetUser(ctx, &pbx.ClientMsg{
+		Message: &pbx.ClientMsg_Get{Get: &pbx.ClientGet{Topic: remote, Query: &pbx.GetQuery{What: "desc"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := pbServDeserialize(resp)
+	if msg.Meta != nil && msg.Meta.Desc != nil {
+		return msg.Meta.Desc, nil
+	}
+	if msg.Ctrl != nil && msg.Ctrl.Code == 404 {
+		return nil, types.ErrUserNotFound
+	}
+	return nil, errors.New("invalid response from " + p.name)
+}
+
+// notify queues a best-effort notification to the peer.
+func (p *federationPeer) notify(msg *pbx.ServerMsg) {
+	select {
+	case p.notifyq <- msg:
+	default:
+		logs.Warn.Println("federation: notification queue is full, peer", p.name)
+	}
+}
+
+// notifyLoop sends queued notifications. A failed notification is attempted once more.
+func (p *federationPeer) notifyLoop(done <-chan bool) {
+	for {
+		select {
+		case msg := <-p.notifyq:
+			for attempt := 0; attempt < 2; attempt++ {
+				ctrl, err := p.relay(msg)
+				if err == nil {
+					if ctrl.Code >= 300 {
+						logs.Info.Printf("federation: notification rejected by '%s': %d %s", p.name, ctrl.Code, ctrl.Text)
+					}
+					break
+				}
+				logs.Warn.Printf("federation: notification to '%s' failed: %v", p.name, err)
+				select {
+				case <-time.After(time.Second):
+				case <-done:
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// federationInit creates the federation gateway and starts accepting calls from the peers.
+func federationInit(conf *federationConfig) (*federation, error) {
+	if !validFedServerName(conf.Name) {
+		return nil, errors.New("invalid or missing name of this server")
+	}
+	if conf.Listen == "" {
+		return nil, errors.New("missing listen address")
+	}
+	if len(conf.Peers) == 0 {
+		return nil, errors.New("no peers configured")
+	}
+
+	f := &federation{
+		name:         conf.Name,
+		peers:        make(map[string]*federationPeer, len(conf.Peers)),
+		userCacheTTL: time.Duration(conf.UserCacheTTL) * time.Second,
+		retryDelay:   time.Duration(conf.RetryDelay) * time.Second,
+		idleTimeout:  time.Duration(conf.IdleTimeout) * time.Second,
+		users:        make(map[types.Uid]*fedUser),
+		addrs:        make(map[string]types.Uid),
+		locals:       make(map[types.Uid]time.Time),
+		lookups:      make(map[types.Uid][]*ServerComMessage),
+		relays:       make(map[types.Uid]*fedRelay),
+		seqMaps:      make(map[string]*fedSeqMap),
+		routeq:       make(chan *ServerComMessage, fedRouteQueueSize),
+		done:         make(chan bool),
+	}
+	if f.userCacheTTL <= 0 {
+		f.userCacheTTL = defaultFedUserCacheTTL * time.Second
+	}
+	if f.retryDelay <= 0 {
+		f.retryDelay = defaultFedRetryDelay * time.Second
+	}
+	if f.idleTimeout <= 0 {
+		f.idleTimeout = defaultFedIdleTimeout * time.Second
+	}
+
+	for i := range conf.Peers {
+		pconf := &conf.Peers[i]
+		if pconf.Name == f.name || f.peers[pconf.Name] != nil {
+			return nil, errors.New("duplicate peer name '" + pconf.Name + "'")
+		}
+		peer, err := newFederationPeer(f.name, pconf)
+		if err != nil {
+			return nil, errors.New("peer '" + pconf.Name + "': " + err.Error())
+		}
+		f.peers[peer.name] = peer
+	}
+
+	lis, err := netListener(conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	var opts []grpc.ServerOption
+	opts = append(opts, grpc.MaxRecvMsgSize(int(globals.maxMessageSize)))
+	secure := ""
+	if conf.TLS != nil && conf.TLS.Enabled {
+		tlsConf, err := fedTLSServerConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+		secure = " secure"
+	}
+	f.server = grpc.NewServer(opts...)
+	pbx.RegisterFederationServer(f.server, &federationServer{f: f})
+
+	go func() {
+		if err := f.server.Serve(lis); err != nil {
+			logs.Err.Println("federation: server failed:", err)
+		}
+	}()
+
+	for _, peer := range f.peers {
+		go peer.notifyLoop(f.done)
+	}
+	go f.run()
+
+	statsRegisterInt("FederationMessagesInTotal")
+	statsRegisterInt("FederationMessagesOutTotal")
+
+	logs.Info.Printf("federation: '%s'%s is listening at [%s], %d peer(s)", f.name, secure, conf.Listen, len(f.peers))
+	return f, nil
+}
+
+// shutdown stops the gateway. Relay sessions are terminated with the rest of the sessions.
+func (f *federation) shutdown() {
+	if f == nil {
+		return
+	}
+	close(f.done)
+	f.server.Stop()
+	for _, peer := range f.peers {
+		peer.conn.Close()
+	}
+	logs.Info.Println("federation: stopped")
+}
+
+// resolve returns ID of the local user which represents the user with the given address 'usrXXX@host'.
+// The shadow user is created if needed.
+func (f *federation) resolve(addr string) (types.Uid, error) {
+	remote, host, ok := parseFedAddr(addr)
+	if !ok {
+		return types.ZeroUid, types.ErrMalformed
+	}
+	if host == f.name {
+		// Address of a local user.
+		return types.ParseUserId(remote), nil
+	}
+	peer := f.peers[host]
+	if peer == nil {
+		return types.ZeroUid, types.ErrNotFound
+	}
+	u, err := f.remoteUser(peer, remote)
+	if err != nil {
+		return types.ZeroUid, err
+	}
+	return u.uid, nil
+}
+
+// remoteUser finds or creates the shadow user for the user of the peer.
+func (f *federation) remoteUser(peer *federationPeer, remote string) (*fedUser, error) {
+	if !strings.HasPrefix(remote, "usr") || types.ParseUserId(remote).IsZero() {
+		return nil, types.ErrMalformed
+	}
+	addr := remote + fedAddrSeparator + peer.name
+
+	f.lock.Lock()
+	if uid, ok := f.addrs[addr]; ok {
+		u := f.users[uid]
+		stale := time.Since(u.refreshed) > f.userCacheTTL
+		if stale {
+			u.refreshed = time.Now()
+		}
+		f.lock.Unlock()
+		if stale {
+			go f.refresh(u)
+		}
+		return u, nil
+	}
+	f.lock.Unlock()
+
+	u := &fedUser{remote: remote, peer: peer}
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(fedAuthScheme, addr)
+	if err != nil {
+		return nil, err
+	}
+	if uid.IsZero() {
+		if uid, err = f.createShadow(peer, remote, addr); err != nil {
+			return nil, err
+		}
+	}
+	u.uid = uid
+	u.refreshed = time.Now()
+
+	u, fresh := f.cacheUser(u)
+	if fresh {
+		// The user was loaded from the database: Public may be outdated.
+		go f.refresh(u)
+	}
+	return u, nil
+}
+
+// createShadow creates a local user which represents the remote user.
+func (f *federation) createShadow(peer *federationPeer, remote, addr string) (types.Uid, error) {
+	desc, err := peer.getUser(remote)
+	if err != nil {
+		return types.ZeroUid, err
+	}
+
+	user := &types.User{
+		Access: types.DefaultAccess{Auth: types.ModeCP2P, Anon: types.ModeNone},
+		Public: desc.Public,
+		// Let clients tell remote users apart.
+		Trusted: map[string]any{"remote": addr},
+	}
+	if _, err := store.Users.Create(user, nil); err != nil {
+		return types.ZeroUid, err
+	}
+	if err := store.Users.AddAuthRecord(user.Uid(), auth.LevelAuth, fedAuthScheme, addr, nil, time.Time{}); err != nil {
+		// The same user may have been created concurrently. Keep the other record.
+		store.Users.Delete(user.Uid(), true)
+		if err == types.ErrDuplicate {
+			uid, _, _, _, err := store.Users.GetAuthUniqueRecord(fedAuthScheme, addr)
+			return uid, err
+		}
+		return types.ZeroUid, err
+	}
+
+	logs.Info.Printf("federation: created user %s for '%s'", user.Uid().UserId(), addr)
+	return user.Uid(), nil
+}
+
+// cacheUser adds the user to cache unless it's already there. Returns the cached user
+// and true if the user was added.
+func (f *federation) cacheUser(u *fedUser) (*fedUser, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if cached := f.users[u.uid]; cached != nil {
+		return cached, false
+	}
+	delete(f.locals, u.uid)
+	f.users[u.uid] = u
+	f.addrs[u.addr()] = u.uid
+	return u, true
+}
+
+// refresh fetches Public of the remote user and saves it to the shadow user.
+func (f *federation) refresh(u *fedUser) {
+	desc, err := u.peer.getUser(u.remote)
+	if err != nil {
+		logs.Warn.Printf("federation: failed to fetch '%s': %v", u.addr(), err)
+		return
+	}
+	if err := store.Users.Update(u.uid, map[string]any{"Public": desc.Public}); err != nil {
+		logs.Warn.Printf("federation: failed to update '%s': %v", u.addr(), err)
+	}
+}
+
+// cachedShadowLocked returns the cached remote user represented by the local user. Returns false if
+// it's not known if the user is a shadow user.
+func (f *federation) cachedShadowLocked(uid types.Uid) (*fedUser, bool) {
+	if u := f.users[uid]; u != nil {
+		return u, true
+	}
+	if expires, ok := f.locals[uid]; ok {
+		if expires.After(time.Now()) {
+			return nil, true
+		}
+		delete(f.locals, uid)
+	}
+	return nil, false
+}
+
+// addLocalLocked remembers that the user is not a shadow user.
+func (f *federation) addLocalLocked(uid types.Uid) {
+	if len(f.locals) >= fedMaxLocalUsers {
+		// Evict expired records, then arbitrary ones if it's not enough.
+		now := time.Now()
+		for id, expires := range f.locals {
+			if !expires.After(now) {
+				delete(f.locals, id)
+			}
+		}
+		for id := range f.locals {
+			if len(f.locals) < fedMaxLocalUsers*9/10 {
+				break
+			}
+			delete(f.locals, id)
+		}
+	}
+	f.locals[uid] = time.Now().Add(fedLocalUserTTL)
+}
+
+// shadow returns the remote user represented by the local user or nil if the user is not a shadow user.
+// The user may be looked up in the DB.
+func (f *federation) shadow(uid types.Uid) *fedUser {
+	f.lock.Lock()
+	u, known := f.cachedShadowLocked(uid)
+	f.lock.Unlock()
+	if known {
+		return u
+	}
+
+	addr, _, _, _, err := store.Users.GetAuthRecord(uid, fedAuthScheme)
+	if err != nil && err != types.ErrNotFound {
+		logs.Warn.Println("federation: failed to check user", uid.UserId(), err)
+		return nil
+	}
+	var peer *federationPeer
+	remote, host, ok := parseFedAddr(addr)
+	if ok {
+		if peer = f.peers[host]; peer == nil {
+			logs.Warn.Printf("federation: server of '%s' is not a peer", addr)
+		}
+	}
+	if peer == nil {
+		f.lock.Lock()
+		f.addLocalLocked(uid)
+		f.lock.Unlock()
+		return nil
+	}
+
+	u, _ = f.cacheUser(&fedUser{uid: uid, remote: remote, peer: peer})
+	return u
+}
+
+// relayFor returns the relay session of the remote user, starting one if needed.
+func (f *federation) relayFor(u *fedUser) *fedRelay {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	r := f.relays[u.uid]
+	if r == nil {
+		r = newFedRelay(f, u)
+		f.relays[u.uid] = r
+	}
+	return r
+}
+
+// dropRelay forgets the relay session.
+func (f *federation) dropRelay(r *fedRelay) {
+	f.lock.Lock()
+	if f.relays[r.user.uid] == r {
+		delete(f.relays, r.user.uid)
+	}
+	f.lock.Unlock()
+}
+
+// seqMap returns mapping of message IDs of the conversation between the shadow user and the local user.
+func (f *federation) seqMap(uid types.Uid, topic string) *fedSeqMap {
+	key := uid.UserId() + ":" + topic
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	m := f.seqMaps[key]
+	if m == nil {
+		if len(f.seqMaps) >= fedMaxSeqMaps {
+			f.seqMaps = make(map[string]*fedSeqMap)
+		}
+		m = &fedSeqMap{}
+		f.seqMaps[key] = m
+	}
+	return m
+}
+
+// route accepts a server message addressed to 'me' of an offline user. If the user is a shadow user,
+// the message is relayed to the remote server.
+func (f *federation) route(msg *ServerComMessage) {
+	if f == nil || (msg.Pres == nil && msg.Info == nil) {
+		return
+	}
+	select {
+	case f.routeq <- msg:
+	default:
+		logs.Warn.Println("federation: route queue is full, message dropped", msg.RcptTo)
+	}
+}
+
+func (f *federation) run() {
+	for {
+		select {
+		case msg := <-f.routeq:
+			f.routeOut(msg)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// routeOut relays {pres} and {info} addressed to a shadow user to its server. Users which are not cached
+// are looked up outside of the run loop. Messages to such users are held until the lookup completes.
+func (f *federation) routeOut(msg *ServerComMessage) {
+	uid := types.ParseUserId(msg.RcptTo)
+	if uid.IsZero() {
+		return
+	}
+
+	f.lock.Lock()
+	if pending, ok := f.lookups[uid]; ok {
+		if len(pending) < fedRouteQueueSize {
+			f.lookups[uid] = append(pending, msg)
+		} else {
+			logs.Warn.Println("federation: too many messages waiting for lookup, message dropped", msg.RcptTo)
+		}
+		f.lock.Unlock()
+		return
+	}
+	u, known := f.cachedShadowLocked(uid)
+	if !known {
+		f.lookups[uid] = []*ServerComMessage{msg}
+		f.lock.Unlock()
+		go f.lookup(uid)
+		return
+	}
+	f.lock.Unlock()
+
+	if u != nil {
+		f.relayOut(u, uid, msg)
+	}
+}
+
+// lookup finds out if the user is a shadow user then relays messages which were waiting for the lookup.
+func (f *federation) lookup(uid types.Uid) {
+	u := f.shadow(uid)
+	for {
+		f.lock.Lock()
+		pending := f.lookups[uid]
+		if len(pending) == 0 {
+			delete(f.lookups, uid)
+			f.lock.Unlock()
+			return
+		}
+		// Messages received meanwhile are appended to the list and relayed in order.
+		f.lookups[uid] = nil
+		f.lock.Unlock()
+
+		if u != nil {
+			for _, msg := range pending {
+				f.relayOut(u, uid, msg)
+			}
+		}
+	}
+}
+
+// relayOut relays {pres} or {info} to the shadow user's server.
+func (f *federation) relayOut(u *fedUser, uid types.Uid, msg *ServerComMessage) {
+	if pres := msg.Pres; pres != nil && pres.Topic == "me" {
+		switch pres.What {
+		case "msg":
+			// New message in a conversation with the remote user: make sure it's relayed.
+			f.relayFor(u).wake(pres.Src, pres.SeqId)
+		case "on", "off", "ua", "upd":
+			u.peer.notify(&pbx.ServerMsg{Message: pbServPresSerialize(&MsgServerPres{
+				Topic:     u.remote,
+				Src:       pres.Src,
+				What:      pres.What,
+				UserAgent: pres.UserAgent,
+			})})
+		}
+	} else if info := msg.Info; info != nil && info.Topic == "me" && info.From != msg.RcptTo {
+		seq := info.SeqId
+		switch info.What {
+		case "kp":
+		case "read", "recv":
+			// The remote copy of the conversation has different message IDs.
+			if seq = f.seqMap(uid, info.Src).toRemote(seq); seq == 0 {
+				return
+			}
+		default:
+			return
+		}
+		u.peer.notify(&pbx.ServerMsg{Message: pbServInfoSerialize(&MsgServerInfo{
+			Topic: u.remote,
+			From:  info.From,
+			What:  info.What,
+			SeqId: seq,
+		})})
+	}
+}
+
+// relayIn handles a message from a user of the peer to a user of this server. Returns a {ctrl} response.
+func (f *federation) relayIn(peer *federationPeer, msg *ServerComMessage) *ServerComMessage {
+	now := types.TimeNow()
+
+	var rcpt, from string
+	switch {
+	case msg.Data != nil:
+		rcpt, from = msg.Data.Topic, msg.Data.From
+	case msg.Info != nil:
+		rcpt, from = msg.Info.Topic, msg.Info.From
+	case msg.Pres != nil:
+		rcpt, from = msg.Pres.Topic, msg.Pres.Src
+	default:
+		return ErrMalformed("", "", now)
+	}
+
+	uid := types.ParseUserId(rcpt)
+	if uid.IsZero() {
+		return ErrMalformed("", rcpt, now)
+	}
+	if f.shadow(uid) != nil {
+		// Messages are not relayed between remote servers.
+		return ErrPermissionDenied("", rcpt, now)
+	}
+
+	u, err := f.remoteUser(peer, from)
+	if err != nil {
+		logs.Warn.Printf("federation: failed to resolve '%s%s%s': %v", from, fedAddrSeparator, peer.name, err)
+		return decodeStoreErrorExplicitTs(err, "", rcpt, now, now, nil)
+	}
+
+	switch {
+	case msg.Data != nil:
+		statsInc("FederationMessagesInTotal", 1)
+		return f.relayFor(u).publish(rcpt, msg.Data)
+	case msg.Info != nil:
+		return f.relayFor(u).note(rcpt, msg.Info)
+	default:
+		f.presIn(u, uid, msg.Pres)
+		return NoErr("", rcpt, now)
+	}
+}
+
+// presIn delivers presence of the remote user to the local user. Called from the Relay handler,
+// must not block.
+func (f *federation) presIn(u *fedUser, rcpt types.Uid, pres *MsgServerPres) {
+	msg := &ServerComMessage{
+		Pres: &MsgServerPres{
+			Topic:     "me",
+			Src:       u.uid.UserId(),
+			What:      pres.What,
+			UserAgent: pres.UserAgent,
+		},
+		RcptTo: rcpt.UserId(),
+	}
+
+	switch pres.What {
+	case "upd":
+		// Fetching the description is a call to the peer. Announce the update once it's saved.
+		go func() {
+			f.refresh(u)
+			routePresIn(msg)
+		}()
+	case "on", "off", "ua":
+		routePresIn(msg)
+	}
+}
+
+// routePresIn hands presence of a remote user to the hub without waiting.
+func routePresIn(msg *ServerComMessage) {
+	select {
+	case globals.hub.routeSrv <- msg:
+	default:
+		logs.Err.Println("federation: hub.route channel full, presence dropped", msg.Pres.Src, msg.RcptTo)
+	}
+}
+
+// authenticate identifies the calling peer.
+func (f *federation) authenticate(ctx context.Context) (*federationPeer, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	names := md.Get(fedPeerMetadataKey)
+	tokens := md.Get("authorization")
+	if len(names) != 1 || len(tokens) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	peer := f.peers[names[0]]
+	if peer == nil || subtle.ConstantTimeCompare([]byte(tokens[0]), []byte("Bearer "+peer.secret)) != 1 {
+		logs.Warn.Printf("federation: authentication of '%s' failed", names[0])
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	return peer, nil
+}
+
+// federationServer handles calls from the peers.
+type federationServer struct {
+	pbx.UnimplementedFederationServer
+	f *federation
+}
+
+// Relay delivers a message from a user of the calling server.
+func (fs *federationServer) Relay(ctx context.Context, in *pbx.ServerMsg) (*pbx.ServerMsg, error) {
+	peer, err := fs.f.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pbServSerialize(fs.f.relayIn(peer, pbServDeserialize(in))), nil
+}
+
+// GetUser returns the public description of a user of this server.
+func (fs *federationServer) GetUser(ctx context.Context, in *pbx.ClientMsg) (*pbx.ServerMsg, error) {
+	if _, err := fs.f.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	now := types.TimeNow()
+	topic := in.GetGet().GetTopic()
+	uid := types.ParseUserId(topic)
+	if uid.IsZero() {
+		return pbServSerialize(ErrMalformed("", topic, now)), nil
+	}
+	if fs.f.shadow(uid) != nil {
+		// Remote users are not exposed to other servers.
+		return pbServSerialize(ErrUserNotFound("", topic, now, now)), nil
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return pbServSerialize(decodeStoreErrorExplicitTs(err, "", topic, now, now, nil)), nil
+	}
+	if user == nil || user.State != types.StateOK {
+		return pbServSerialize(ErrUserNotFound("", topic, now, now)), nil
+	}
+
+	return pbServSerialize(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Topic:     topic,
+			Timestamp: &now,
+			Desc: &MsgTopicDesc{
+				UpdatedAt: &user.UpdatedAt,
+				Public:    user.Public,
+			},
+		},
+	}), nil
+}
+
+// fedSeqMap maps IDs of messages in the local copy of a conversation with a remote user to IDs
+// of the same messages in the remote copy. Only recent messages are remembered.
+type fedSeqMap struct {
+	lock sync.Mutex
+	// Pairs of local and remote IDs sorted by the local ID.
+	local  []int
+	remote []int
+}
+
+// add remembers a pair of message IDs.
+func (m *fedSeqMap) add(local, remote int) {
+	if local <= 0 || remote <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	i := len(m.local)
+	for i > 0 && m.local[i-1] > local {
+		i--
+	}
+	if i > 0 && m.local[i-1] == local {
+		m.remote[i-1] = remote
+		return
+	}
+	m.local = append(m.local[:i], append([]int{local}, m.local[i:]...)...)
+	m.remote = append(m.remote[:i], append([]int{remote}, m.remote[i:]...)...)
+	if len(m.local) > fedSeqMapSize {
+		m.local = m.local[len(m.local)-fedSeqMapSize:]
+		m.remote = m.remote[len(m.remote)-fedSeqMapSize:]
+	}
+}
+
+// toRemote converts the local ID of a read or received message to the remote ID: the greatest remote ID
+// of the known messages at or before the local ID. Returns 0 if no such message is known.
+func (m *fedSeqMap) toRemote(local int) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := 0
+	for i := 0; i < len(m.local) && m.local[i] <= local; i++ {
+		result = max(result, m.remote[i])
+	}
+	return result
+}
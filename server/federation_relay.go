@@ -0,0 +1,686 @@
+/******************************************************************************
+ *  Description :
+ *    Relay session of a remote user. Messages from the remote user are
+ *    published to local topics through the session. Messages in conversations
+ *    with the remote user are read through the session and delivered to the
+ *    remote server. The 'recv' marker of the remote user is the delivery
+ *    cursor: undelivered messages are fetched again after a restart.
+ *****************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of messages fetched with one {get}.
+	fedFetchLimit = 64
+	// Maximum number of messages held per topic while the delivery cursor is unknown.
+	fedMaxStash = 256
+	// Prefix of IDs of requests made by relay sessions.
+	fedReqIdPrefix = "fed"
+)
+
+// Kinds of relay work items.
+const (
+	// Attach to topic and deliver missed messages.
+	fedItemSync = iota
+	// Fetch messages missing from the sequence.
+	fedItemFetch
+	// Deliver a message to the remote server.
+	fedItemData
+	// Retry delivery of messages which failed to deliver.
+	fedItemRetry
+)
+
+type fedRelayItem struct {
+	kind  int
+	topic string
+	data  *MsgServerData
+}
+
+// State of a conversation of the remote user.
+type fedRelayTopic struct {
+	// Relay session is attached to the topic.
+	attached bool
+	// Delivery cursor is known.
+	synced bool
+	// ID of the last message queued for delivery or skipped.
+	queued int
+	// ID of the last message in the topic.
+	seq int
+	// Messages waiting for the preceding messages.
+	stash map[int]*MsgServerData
+	// A {get data} request is pending or queued.
+	fetching bool
+	// Remote ID of the last message received from the remote user.
+	received int
+	// Messages waiting for redelivery after a failed attempt followed by later messages of the topic.
+	retryq []*MsgServerData
+	// Delay before the next delivery attempt.
+	retryDelay time.Duration
+}
+
+// fedRelay is a background session of a shadow user.
+type fedRelay struct {
+	f    *federation
+	user *fedUser
+	sess *Session
+
+	// Messages to the remote user are relayed only by the cluster node which hosts the user's 'me' topic.
+	outbound bool
+
+	// Serializes attaching to topics.
+	attachLock sync.Mutex
+	// Guards dispatching requests against closing the session.
+	reqLock sync.Mutex
+	closed  bool
+
+	lock       sync.Mutex
+	nextReqId  int
+	pending    map[string]chan *ServerComMessage
+	topics     map[string]*fedRelayTopic
+	backlog    []fedRelayItem
+	busy       bool
+	lastActive time.Time
+
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFedRelay(f *federation, u *fedUser) *fedRelay {
+	r := &fedRelay{
+		f:          f,
+		user:       u,
+		outbound:   !globals.cluster.isRemoteTopic(u.uid.UserId()),
+		pending:    make(map[string]chan *ServerComMessage),
+		topics:     make(map[string]*fedRelayTopic),
+		lastActive: time.Now(),
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	sess, _ := globals.sessionStore.NewSession(r, "")
+	sess.uid = u.uid
+	sess.authLvl = auth.LevelAuth
+	sess.ver = parseVersion(currentVersion)
+	sess.userAgent = "Tinode federation relay (" + u.peer.name + ")"
+	// Shadow users should not appear online.
+	sess.background = true
+	r.sess = sess
+
+	go r.writeLoop()
+	go r.worker()
+
+	logs.Info.Printf("federation: relay for '%s' started, sid=%s", u.addr(), sess.sid)
+	return r
+}
+
+// writeLoop reads messages sent to the relay session.
+func (r *fedRelay) writeLoop() {
+	idle := time.NewTicker(r.f.idleTimeout / 2)
+	defer idle.Stop()
+
+	for {
+		select {
+		case msg := <-r.sess.send:
+			if m, ok := msg.(*ServerComMessage); ok {
+				r.onMessage(m)
+			}
+		case <-r.sess.stop:
+			go r.close()
+			return
+		case topic := <-r.sess.detach:
+			r.sess.delSub(topic)
+			r.lock.Lock()
+			if t := r.topics[topic]; t != nil {
+				t.attached = false
+			}
+			r.lock.Unlock()
+		case <-idle.C:
+			r.lock.Lock()
+			isIdle := !r.busy && len(r.backlog) == 0 && len(r.pending) == 0 && !r.retryingLocked() &&
+				time.Since(r.lastActive) > r.f.idleTimeout
+			r.lock.Unlock()
+			if isIdle {
+				go r.close()
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *fedRelay) onMessage(msg *ServerComMessage) {
+	var id string
+	if msg.Ctrl != nil {
+		id = msg.Ctrl.Id
+	} else if msg.Meta != nil {
+		id = msg.Meta.Id
+	} else if msg.Data != nil {
+		r.onData(msg.Data)
+		return
+	}
+	if !strings.HasPrefix(id, fedReqIdPrefix) {
+		return
+	}
+
+	r.lock.Lock()
+	resp := r.pending[id]
+	delete(r.pending, id)
+	r.lock.Unlock()
+
+	if resp != nil {
+		resp <- msg
+	}
+}
+
+// onData handles a message in a conversation with the remote user.
+func (r *fedRelay) onData(data *MsgServerData) {
+	if !r.outbound {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t := r.topicLocked(data.Topic)
+	t.seq = max(t.seq, data.SeqId)
+	if !t.synced {
+		if len(t.stash) < fedMaxStash {
+			t.stash[data.SeqId] = data
+		}
+		return
+	}
+	if data.SeqId <= t.queued {
+		return
+	}
+	t.stash[data.SeqId] = data
+	r.drainLocked(data.Topic, t)
+	if t.seq > t.queued && !t.fetching {
+		// There is a gap in the sequence.
+		t.fetching = true
+		r.pushLocked(fedRelayItem{kind: fedItemFetch, topic: data.Topic})
+	}
+}
+
+// drainLocked queues stashed messages which follow the last queued message.
+func (r *fedRelay) drainLocked(topic string, t *fedRelayTopic) {
+	for {
+		data := t.stash[t.queued+1]
+		if data == nil {
+			break
+		}
+		delete(t.stash, t.queued+1)
+		t.queued++
+		r.pushLocked(fedRelayItem{kind: fedItemData, topic: topic, data: data})
+	}
+	for seq := range t.stash {
+		if seq <= t.queued {
+			delete(t.stash, seq)
+		}
+	}
+}
+
+func (r *fedRelay) topicLocked(topic string) *fedRelayTopic {
+	t := r.topics[topic]
+	if t == nil {
+		t = &fedRelayTopic{stash: make(map[int]*MsgServerData)}
+		r.topics[topic] = t
+	}
+	return t
+}
+
+func (r *fedRelay) pushLocked(item fedRelayItem) {
+	r.backlog = append(r.backlog, item)
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+}
+
+// worker processes queued items one at a time, preserving the order of messages.
+func (r *fedRelay) worker() {
+	for {
+		select {
+		case <-r.ready:
+		case <-r.done:
+			return
+		}
+
+		for {
+			r.lock.Lock()
+			if len(r.backlog) == 0 {
+				r.busy = false
+				r.lock.Unlock()
+				break
+			}
+			item := r.backlog[0]
+			r.backlog = r.backlog[1:]
+			r.busy = true
+			r.lastActive = time.Now()
+			r.lock.Unlock()
+
+			switch item.kind {
+			case fedItemSync:
+				if resp := r.attach(item.topic); resp != nil && resp.Ctrl != nil {
+					logs.Warn.Printf("federation: relay for '%s' failed to attach to '%s': %d %s",
+						r.user.addr(), item.topic, resp.Ctrl.Code, resp.Ctrl.Text)
+				}
+			case fedItemFetch:
+				r.fetch(item.topic)
+			case fedItemData:
+				r.send(item.topic, item.data)
+			case fedItemRetry:
+				r.retry(item.topic)
+			}
+
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// wake makes sure the relay is attached to the topic where a new message was posted.
+func (r *fedRelay) wake(topic string, seq int) {
+	if !r.outbound || topic == "" {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lastActive = time.Now()
+	t := r.topicLocked(topic)
+	t.seq = max(t.seq, seq)
+	if !t.attached {
+		r.pushLocked(fedRelayItem{kind: fedItemSync, topic: topic})
+	}
+}
+
+// attach subscribes the relay session to the topic. If messages to the remote user are relayed by this
+// node, the delivery cursor is read and missed messages are fetched. Returns an error response or nil.
+func (r *fedRelay) attach(topic string) *ServerComMessage {
+	r.attachLock.Lock()
+	defer r.attachLock.Unlock()
+
+	r.lock.Lock()
+	attached := r.topicLocked(topic).attached
+	r.lock.Unlock()
+	if attached {
+		return nil
+	}
+
+	resp, err := r.request(&ClientComMessage{Sub: &MsgClientSub{Topic: topic}})
+	if err != nil {
+		return ErrServiceUnavailableExplicitTs("", topic, types.TimeNow(), types.TimeNow())
+	}
+	if resp.Ctrl == nil || (resp.Ctrl.Code >= 300 && resp.Ctrl.Code != 304) {
+		return resp
+	}
+
+	r.lock.Lock()
+	r.topicLocked(topic).attached = true
+	r.lock.Unlock()
+
+	if !r.outbound {
+		return nil
+	}
+
+	resp, err = r.request(&ClientComMessage{Get: &MsgClientGet{Topic: topic, MsgGetQuery: MsgGetQuery{What: "desc"}}})
+	if err != nil {
+		return ErrServiceUnavailableExplicitTs("", topic, types.TimeNow(), types.TimeNow())
+	}
+	if resp.Meta == nil || resp.Meta.Desc == nil {
+		return resp
+	}
+
+	desc := resp.Meta.Desc
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t := r.topicLocked(topic)
+	if !t.synced {
+		t.queued = max(desc.RecvSeqId, desc.ReadSeqId)
+		t.synced = true
+	}
+	t.seq = max(t.seq, desc.SeqId)
+	r.drainLocked(topic, t)
+	if t.seq > t.queued && !t.fetching {
+		t.fetching = true
+		r.pushLocked(fedRelayItem{kind: fedItemFetch, topic: topic})
+	}
+	return nil
+}
+
+// fetch requests messages which follow the last queued message.
+func (r *fedRelay) fetch(topic string) {
+	r.lock.Lock()
+	t := r.topicLocked(topic)
+	since := t.queued + 1
+	r.lock.Unlock()
+
+	before := since + fedFetchLimit
+	resp, err := r.request(&ClientComMessage{Get: &MsgClientGet{
+		Topic: topic,
+		MsgGetQuery: MsgGetQuery{
+			What: "data",
+			Data: &MsgGetOpts{SinceId: since, BeforeId: before, Limit: fedFetchLimit},
+		},
+	}})
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	t.fetching = false
+	if err != nil || resp.Ctrl == nil || resp.Ctrl.Code >= 300 {
+		// Try again when the next message is posted.
+		logs.Warn.Printf("federation: relay for '%s' failed to fetch messages from '%s'", r.user.addr(), topic)
+		t.attached = false
+		return
+	}
+
+	// Messages which were not returned are deleted.
+	end := before - 1
+	if t.seq < end {
+		end = t.seq
+	}
+	for t.queued < end {
+		if t.stash[t.queued+1] != nil {
+			r.drainLocked(topic, t)
+		} else {
+			t.queued++
+		}
+	}
+	r.drainLocked(topic, t)
+	if t.seq > t.queued {
+		t.fetching = true
+		r.pushLocked(fedRelayItem{kind: fedItemFetch, topic: topic})
+	}
+}
+
+// send delivers the message unless earlier messages of the topic are waiting for redelivery.
+// A message which failed to deliver waits for redelivery, other topics are not blocked.
+func (r *fedRelay) send(topic string, data *MsgServerData) {
+	r.lock.Lock()
+	t := r.topicLocked(topic)
+	if !t.synced {
+		// Undelivered messages were dropped. This one is fetched again after the cursor.
+		r.lock.Unlock()
+		return
+	}
+	if len(t.retryq) > 0 {
+		r.holdLocked(topic, t, data)
+		r.lock.Unlock()
+		return
+	}
+	r.lock.Unlock()
+
+	if !r.deliver(topic, data) {
+		r.lock.Lock()
+		r.holdLocked(topic, t, data)
+		r.lock.Unlock()
+	}
+}
+
+// retry attempts to deliver messages waiting for redelivery, in order.
+func (r *fedRelay) retry(topic string) {
+	for {
+		r.lock.Lock()
+		t := r.topicLocked(topic)
+		if len(t.retryq) == 0 {
+			t.retryDelay = 0
+			r.lock.Unlock()
+			return
+		}
+		data := t.retryq[0]
+		r.lock.Unlock()
+
+		if !r.deliver(topic, data) {
+			r.lock.Lock()
+			if len(t.retryq) > 0 && t.retryq[0] == data {
+				r.scheduleRetryLocked(topic, t)
+			}
+			r.lock.Unlock()
+			return
+		}
+
+		r.lock.Lock()
+		if len(t.retryq) > 0 && t.retryq[0] == data {
+			t.retryq[0] = nil
+			t.retryq = t.retryq[1:]
+		}
+		r.lock.Unlock()
+	}
+}
+
+// holdLocked adds the message to the redelivery queue of the topic. If the queue is full, the queued messages
+// are dropped: they are fetched again from the delivery cursor once the relay is attached to the topic again.
+func (r *fedRelay) holdLocked(topic string, t *fedRelayTopic, data *MsgServerData) {
+	if len(t.retryq) >= fedMaxStash {
+		logs.Warn.Printf("federation: relay for '%s' dropped %d undelivered messages of '%s'",
+			r.user.addr(), len(t.retryq), topic)
+		t.retryq = nil
+		t.synced = false
+		t.attached = false
+		t.stash = make(map[int]*MsgServerData)
+		return
+	}
+	t.retryq = append(t.retryq, data)
+	if len(t.retryq) == 1 {
+		r.scheduleRetryLocked(topic, t)
+	}
+}
+
+// scheduleRetryLocked queues a retry of the topic after a delay which doubles with every attempt.
+func (r *fedRelay) scheduleRetryLocked(topic string, t *fedRelayTopic) {
+	if t.retryDelay == 0 {
+		t.retryDelay = r.f.retryDelay
+	} else if t.retryDelay *= 2; t.retryDelay > fedMaxRetryDelay {
+		t.retryDelay = fedMaxRetryDelay
+	}
+	time.AfterFunc(t.retryDelay, func() {
+		r.lock.Lock()
+		r.pushLocked(fedRelayItem{kind: fedItemRetry, topic: topic})
+		r.lock.Unlock()
+	})
+}
+
+// retryingLocked checks if any messages are waiting for redelivery.
+func (r *fedRelay) retryingLocked() bool {
+	for _, t := range r.topics {
+		if len(t.retryq) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver makes one attempt to send the message to the remote server. Returns false if the attempt
+// failed for a transient reason and should be retried.
+func (r *fedRelay) deliver(topic string, data *MsgServerData) bool {
+	if data.From == r.user.uid.UserId() || data.DeletedAt != nil {
+		// Message from the remote user itself.
+		return true
+	}
+
+	msg := &pbx.ServerMsg{Message: pbServDataSerialize(&MsgServerData{
+		Topic:     r.user.remote,
+		From:      data.From,
+		Timestamp: data.Timestamp,
+		SeqId:     data.SeqId,
+		Head:      data.Head,
+		Content:   data.Content,
+	})}
+
+	ctrl, err := r.user.peer.relay(msg)
+	if err != nil {
+		logs.Warn.Printf("federation: failed to deliver %s:%d to '%s': %v", topic, data.SeqId, r.user.peer.name, err)
+		return false
+	}
+	if ctrl.Code >= 500 {
+		logs.Warn.Printf("federation: failed to deliver %s:%d to '%s': %d %s",
+			topic, data.SeqId, r.user.peer.name, ctrl.Code, ctrl.Text)
+		return false
+	}
+	if ctrl.Code >= 300 {
+		logs.Warn.Printf("federation: message %s:%d rejected by '%s': %d %s",
+			topic, data.SeqId, r.user.peer.name, ctrl.Code, ctrl.Text)
+	} else {
+		statsInc("FederationMessagesOutTotal", 1)
+		r.f.seqMap(r.user.uid, topic).add(data.SeqId, ctrlSeq(ctrl))
+	}
+
+	// Move the delivery cursor.
+	r.dispatch(&ClientComMessage{Note: &MsgClientNote{Topic: topic, What: "recv", SeqId: data.SeqId}})
+	return true
+}
+
+// publish posts a message from the remote user to the topic. Returns the {ctrl} response.
+func (r *fedRelay) publish(topic string, data *MsgServerData) *ServerComMessage {
+	now := types.TimeNow()
+
+	r.lock.Lock()
+	r.lastActive = time.Now()
+	duplicate := data.SeqId > 0 && data.SeqId <= r.topicLocked(topic).received
+	r.lock.Unlock()
+	if duplicate {
+		// The remote server did not receive the previous response.
+		return NoErr("", topic, now)
+	}
+
+	if resp := r.attach(topic); resp != nil {
+		return resp
+	}
+
+	resp, err := r.request(&ClientComMessage{Pub: &MsgClientPub{
+		Topic:   topic,
+		NoEcho:  true,
+		Head:    data.Head,
+		Content: data.Content,
+	}})
+	if err != nil {
+		return ErrServiceUnavailableExplicitTs("", topic, now, now)
+	}
+	if resp.Ctrl != nil && resp.Ctrl.Code < 300 {
+		r.lock.Lock()
+		t := r.topicLocked(topic)
+		t.received = max(t.received, data.SeqId)
+		r.lock.Unlock()
+		r.f.seqMap(r.user.uid, topic).add(ctrlSeq(resp.Ctrl), data.SeqId)
+	}
+	return resp
+}
+
+// note posts a notification from the remote user to the topic.
+func (r *fedRelay) note(topic string, info *MsgServerInfo) *ServerComMessage {
+	now := types.TimeNow()
+
+	switch info.What {
+	case "kp", "read", "recv":
+	default:
+		return ErrMalformed("", topic, now)
+	}
+
+	r.lock.Lock()
+	r.lastActive = time.Now()
+	r.lock.Unlock()
+
+	if resp := r.attach(topic); resp != nil {
+		return resp
+	}
+	r.dispatch(&ClientComMessage{Note: &MsgClientNote{Topic: topic, What: info.What, SeqId: info.SeqId}})
+	return NoErr("", topic, now)
+}
+
+// request sends a request through the relay session and waits for the response.
+func (r *fedRelay) request(msg *ClientComMessage) (*ServerComMessage, error) {
+	resp := make(chan *ServerComMessage, 1)
+
+	r.lock.Lock()
+	r.nextReqId++
+	id := fedReqIdPrefix + strconv.Itoa(r.nextReqId)
+	r.pending[id] = resp
+	r.lock.Unlock()
+
+	switch {
+	case msg.Sub != nil:
+		msg.Sub.Id = id
+	case msg.Pub != nil:
+		msg.Pub.Id = id
+	case msg.Get != nil:
+		msg.Get.Id = id
+	}
+
+	defer func() {
+		r.lock.Lock()
+		delete(r.pending, id)
+		r.lock.Unlock()
+	}()
+
+	if !r.dispatch(msg) {
+		return nil, types.ErrNotFound
+	}
+
+	select {
+	case m := <-resp:
+		return m, nil
+	case <-time.After(fedCallTimeout):
+		return nil, types.ErrInternal
+	case <-r.done:
+		return nil, types.ErrNotFound
+	}
+}
+
+// dispatch passes the message to the relay session. Returns false if the session is closed.
+func (r *fedRelay) dispatch(msg *ClientComMessage) bool {
+	r.reqLock.Lock()
+	defer r.reqLock.Unlock()
+
+	if r.closed {
+		return false
+	}
+	r.sess.dispatch(msg)
+	return true
+}
+
+// close terminates the relay session.
+func (r *fedRelay) close() {
+	r.closeOnce.Do(func() {
+		r.f.dropRelay(r)
+		close(r.done)
+
+		r.reqLock.Lock()
+		r.closed = true
+		r.reqLock.Unlock()
+
+		r.sess.cleanUp(false)
+		logs.Info.Printf("federation: relay for '%s' stopped", r.user.addr())
+	})
+}
+
+// ctrlSeq returns the 'seq' parameter of a {ctrl} response to {pub} or 0.
+func ctrlSeq(ctrl *MsgServerCtrl) int {
+	params, _ := ctrl.Params.(map[string]any)
+	switch seq := params["seq"].(type) {
+	case int:
+		return seq
+	case float64:
+		return int(seq)
+	}
+	return 0
+}
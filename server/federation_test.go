@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFedAddr(t *testing.T) {
+	uid := types.Uid(12345).UserId()
+
+	remote, host, ok := parseFedAddr(uid + "@example.com")
+	if !ok || remote != uid || host != "example.com" {
+		t.Errorf("valid address rejected: '%s', '%s', %v", remote, host, ok)
+	}
+
+	for _, addr := range []string{
+		uid,
+		uid + "@",
+		"@example.com",
+		"grpAbCdEf@example.com",
+		"usr@example.com",
+		"usr!!!@example.com",
+	} {
+		if _, _, ok := parseFedAddr(addr); ok {
+			t.Errorf("invalid address '%s' accepted", addr)
+		}
+	}
+
+	if !isFedAddr(uid+"@example.com") || isFedAddr(uid) {
+		t.Error("isFedAddr failed")
+	}
+	if validFedServerName("") || validFedServerName("a@b") || validFedServerName("host:80") || !validFedServerName("example.com") {
+		t.Error("validFedServerName failed")
+	}
+}
+
+func TestFedSeqMap(t *testing.T) {
+	var m fedSeqMap
+	if m.toRemote(10) != 0 {
+		t.Error("empty map must not translate IDs")
+	}
+
+	m.add(3, 7)
+	m.add(1, 5)
+	m.add(5, 6)
+	m.add(0, 1)
+	if len(m.local) != 3 || m.local[0] != 1 || m.local[1] != 3 || m.local[2] != 5 {
+		t.Fatalf("pairs are not sorted: %v", m.local)
+	}
+
+	for local, remote := range map[int]int{0: 0, 1: 5, 2: 5, 3: 7, 4: 7, 5: 7, 100: 7} {
+		if got := m.toRemote(local); got != remote {
+			t.Errorf("toRemote(%d) = %d, expected %d", local, got, remote)
+		}
+	}
+
+	for i := 1; i <= fedSeqMapSize+10; i++ {
+		m.add(i+10, i+20)
+	}
+	if len(m.local) != fedSeqMapSize {
+		t.Errorf("map is not bounded: %d", len(m.local))
+	}
+	if m.local[0] != 21 {
+		t.Errorf("oldest pairs must be dropped first, got %d", m.local[0])
+	}
+}
+
+func TestFederationAuthenticate(t *testing.T) {
+	f := &federation{
+		name: "local",
+		peers: map[string]*federationPeer{
+			"remote": {name: "remote", secret: "s3cr3t"},
+		},
+	}
+
+	incoming := func(kv ...string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(kv...))
+	}
+
+	peer, err := f.authenticate(incoming(fedPeerMetadataKey, "remote", "authorization", "Bearer s3cr3t"))
+	if err != nil || peer == nil || peer.name != "remote" {
+		t.Fatalf("valid peer rejected: %v", err)
+	}
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		incoming("authorization", "Bearer s3cr3t"),
+		incoming(fedPeerMetadataKey, "remote"),
+		incoming(fedPeerMetadataKey, "remote", "authorization", "Bearer wrong"),
+		incoming(fedPeerMetadataKey, "other", "authorization", "Bearer s3cr3t"),
+	} {
+		if _, err := f.authenticate(ctx); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+	}
+}
+
+func TestFedRelayOrdering(t *testing.T) {
+	r := &fedRelay{
+		outbound: true,
+		topics:   make(map[string]*fedRelayTopic),
+		ready:    make(chan struct{}, 1),
+	}
+	topic := types.Uid(1).UserId()
+
+	// Messages received before the cursor is known are held.
+	r.onData(&MsgServerData{Topic: topic, SeqId: 3})
+	if len(r.backlog) != 0 {
+		t.Fatal("messages queued before the cursor is known")
+	}
+
+	tt := r.topics[topic]
+	tt.synced = true
+	tt.queued = 1
+	r.drainLocked(topic, tt)
+	if len(tt.stash) != 1 || len(r.backlog) != 0 {
+		t.Fatalf("unexpected state: stash %d, backlog %d", len(tt.stash), len(r.backlog))
+	}
+
+	// Out of order message.
+	r.onData(&MsgServerData{Topic: topic, SeqId: 4})
+	if len(r.backlog) != 1 || r.backlog[0].kind != fedItemFetch || !tt.fetching {
+		t.Fatalf("gap must trigger a fetch, backlog %+v", r.backlog)
+	}
+
+	// The missing message arrives.
+	r.onData(&MsgServerData{Topic: topic, SeqId: 2})
+	if len(r.backlog) != 4 {
+		t.Fatalf("expected fetch and 3 messages, got %d items", len(r.backlog))
+	}
+	for i, seq := range []int{2, 3, 4} {
+		item := r.backlog[i+1]
+		if item.kind != fedItemData || item.data.SeqId != seq {
+			t.Errorf("item %d: expected message %d, got %+v", i, seq, item)
+		}
+	}
+	if tt.queued != 4 || len(tt.stash) != 0 {
+		t.Errorf("unexpected state: queued %d, stash %d", tt.queued, len(tt.stash))
+	}
+
+	// Already queued messages are ignored.
+	r.onData(&MsgServerData{Topic: topic, SeqId: 3})
+	if len(r.backlog) != 4 {
+		t.Error("duplicate message queued")
+	}
+}
+
+// fedTestClient is a peer which accepts messages of some topics and fails the others.
+type fedTestClient struct {
+	pbx.FederationClient
+
+	mu       sync.Mutex
+	failing  map[int]bool
+	received []int
+}
+
+func (c *fedTestClient) Relay(ctx context.Context, in *pbx.ServerMsg, opts ...grpc.CallOption) (*pbx.ServerMsg, error) {
+	seq := int(in.GetData().GetSeqId())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failing[seq] {
+		return nil, errors.New("unavailable")
+	}
+	c.received = append(c.received, seq)
+	return &pbx.ServerMsg{Message: pbServCtrlSerialize(&MsgServerCtrl{Code: 200})}, nil
+}
+
+func TestFedRelayRetry(t *testing.T) {
+	client := &fedTestClient{failing: map[int]bool{1: true, 2: true}}
+	r := &fedRelay{
+		f:        &federation{retryDelay: time.Hour, seqMaps: make(map[string]*fedSeqMap)},
+		user:     &fedUser{uid: types.Uid(1), remote: types.Uid(2).UserId(), peer: &federationPeer{client: client}},
+		outbound: true,
+		// Delivery cursor is not moved.
+		closed: true,
+		topics: make(map[string]*fedRelayTopic),
+		ready:  make(chan struct{}, 1),
+	}
+	failing, other := types.Uid(10).UserId(), types.Uid(11).UserId()
+	r.topicLocked(failing).synced = true
+	r.topicLocked(other).synced = true
+
+	r.send(failing, &MsgServerData{Topic: failing, SeqId: 1})
+	// Not attempted: the previous message of the topic is waiting for redelivery.
+	r.send(failing, &MsgServerData{Topic: failing, SeqId: 2})
+	// Other topics are not blocked.
+	r.send(other, &MsgServerData{Topic: other, SeqId: 3})
+
+	if len(client.received) != 1 || client.received[0] != 3 {
+		t.Fatalf("unexpected deliveries %v", client.received)
+	}
+	if q := r.topics[failing].retryq; len(q) != 2 || q[0].SeqId != 1 || q[1].SeqId != 2 {
+		t.Fatalf("failed messages must wait for redelivery in order: %v", q)
+	}
+
+	client.mu.Lock()
+	client.failing = nil
+	client.mu.Unlock()
+	r.retry(failing)
+	if len(client.received) != 3 || client.received[1] != 1 || client.received[2] != 2 {
+		t.Errorf("messages redelivered out of order: %v", client.received)
+	}
+	if len(r.topics[failing].retryq) != 0 || r.topics[failing].retryDelay != 0 {
+		t.Error("redelivery queue not cleared")
+	}
+
+	// Overflowing queue is dropped: the messages are fetched again after the delivery cursor.
+	tt := r.topics[failing]
+	tt.retryq = make([]*MsgServerData, fedMaxStash)
+	r.holdLocked(failing, tt, &MsgServerData{Topic: failing, SeqId: 4})
+	if len(tt.retryq) != 0 || tt.synced || tt.attached {
+		t.Error("overflowing redelivery queue must be dropped and the topic resynced")
+	}
+}
+
+func TestFedRouteOutLookup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() { store.Users = nil }()
+
+	uid := types.Uid(5)
+	unblock := make(chan struct{})
+	uu.EXPECT().GetAuthRecord(uid, fedAuthScheme).DoAndReturn(
+		func(types.Uid, string) (string, auth.Level, []byte, time.Time, error) {
+			<-unblock
+			return "", auth.LevelNone, nil, time.Time{}, types.ErrNotFound
+		}).Times(1)
+
+	f := &federation{
+		users:   make(map[types.Uid]*fedUser),
+		locals:  make(map[types.Uid]time.Time),
+		lookups: make(map[types.Uid][]*ServerComMessage),
+	}
+	msg := &ServerComMessage{RcptTo: uid.UserId(), Pres: &MsgServerPres{Topic: "me", What: "on"}}
+
+	done := make(chan bool)
+	go func() {
+		// The DB lookup does not block the caller, messages wait for the lookup.
+		f.routeOut(msg)
+		f.routeOut(msg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("routeOut blocked on the DB lookup")
+	}
+	f.lock.Lock()
+	if len(f.lookups[uid]) != 2 {
+		t.Errorf("expected 2 messages waiting for lookup, got %d", len(f.lookups[uid]))
+	}
+	f.lock.Unlock()
+
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.lock.Lock()
+		_, pending := f.lookups[uid]
+		f.lock.Unlock()
+		if !pending || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The local user is cached: no more lookups.
+	f.routeOut(msg)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, pending := f.lookups[uid]; pending {
+		t.Error("lookup of a cached local user")
+	}
+
+	// Negative records expire.
+	f.locals[uid] = time.Now().Add(-time.Second)
+	if _, known := f.cachedShadowLocked(uid); known {
+		t.Error("expired record must not be used")
+	}
+	// Full cache evicts expired records first.
+	for i := 0; i < fedMaxLocalUsers; i++ {
+		f.locals[types.Uid(1000+i)] = time.Now().Add(-time.Second)
+	}
+	f.addLocalLocked(uid)
+	if len(f.locals) != 1 {
+		t.Errorf("expired records not evicted: %d", len(f.locals))
+	}
+}
+
+func TestFedPresInDoesNotBlock(t *testing.T) {
+	globals.hub = &Hub{routeSrv: make(chan *ServerComMessage, 1)}
+	defer func() { globals.hub = nil }()
+
+	f := &federation{}
+	u := &fedUser{uid: types.Uid(1), remote: types.Uid(2).UserId(), peer: &federationPeer{name: "example.com"}}
+	rcpt := types.Uid(3)
+
+	done := make(chan bool)
+	go func() {
+		f.presIn(u, rcpt, &MsgServerPres{What: "on"})
+		// The queue is full: the presence is dropped rather than blocking the relay.
+		f.presIn(u, rcpt, &MsgServerPres{What: "off"})
+		// Not delivered to users.
+		f.presIn(u, rcpt, &MsgServerPres{What: "acs"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("presIn blocked on a full hub queue")
+	}
+
+	msg := <-globals.hub.routeSrv
+	if msg.RcptTo != rcpt.UserId() || msg.Pres.Src != u.uid.UserId() || msg.Pres.What != "on" {
+		t.Errorf("unexpected presence %+v", msg.Pres)
+	}
+	if len(globals.hub.routeSrv) != 0 {
+		t.Error("presence must be dropped when the queue is full")
+	}
+}
+
+func TestExpandFedTopicName(t *testing.T) {
+	globals.federation = &federation{name: "local"}
+	defer func() { globals.federation = nil }()
+
+	me := types.Uid(1)
+	other := types.Uid(2)
+	s := &Session{sid: "test"}
+
+	// Address of a user of this server resolves to the local user.
+	msg := &ClientComMessage{Id: "1", Original: other.UserId() + "@local", AsUser: me.UserId()}
+	routeTo, resp := s.expandTopicName(msg)
+	if resp != nil {
+		t.Fatalf("unexpected error %+v", resp.Ctrl)
+	}
+	if routeTo != me.P2PName(other) || msg.Original != other.UserId() {
+		t.Errorf("unexpected expansion '%s', '%s'", routeTo, msg.Original)
+	}
+
+	msg = &ClientComMessage{Id: "2", Original: me.UserId() + "@local", AsUser: me.UserId()}
+	if _, resp = s.expandTopicName(msg); resp == nil || resp.Ctrl.Code != 403 {
+		t.Error("self-subscription must be rejected")
+	}
+
+	msg = &ClientComMessage{Id: "3", Original: "grpAbC@local", AsUser: me.UserId()}
+	if _, resp = s.expandTopicName(msg); resp == nil || resp.Ctrl.Code != 400 {
+		t.Error("malformed address must be rejected")
+	}
+}
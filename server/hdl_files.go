@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -66,22 +67,38 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Check for API key presence
-	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
-		writeHttpResponse(ErrAPIKeyRequired(now), errors.New("invalid or missing API key"))
-		return
-	}
+	var uid types.Uid
+	var err error
+	signed := media.IsSignedURL(req.URL.String())
+	if signed {
+		// Signed URL: access is granted by the signature, API key and credentials are not required.
+		if globals.mediaUrlSigner == nil {
+			writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("signed URLs are disabled"))
+			return
+		}
+		if uid, err = globals.mediaUrlSigner.Verify(req.URL.String(), now); err != nil {
+			writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+			return
+		}
+	} else {
+		// Check for API key presence
+		if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+			writeHttpResponse(ErrAPIKeyRequired(now), errors.New("invalid or missing API key"))
+			return
+		}
 
-	// Check authorization: either auth information or SID must be present
-	uid, challenge, err := authHttpRequest(req)
-	if err != nil {
-		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
-		return
-	}
+		// Check authorization: either auth information or SID must be present
+		var challenge []byte
+		uid, challenge, err = authHttpRequest(req)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+			return
+		}
 
-	if challenge != nil {
-		writeHttpResponse(InfoChallenge("", now, challenge), nil)
-		return
+		if challenge != nil {
+			writeHttpResponse(InfoChallenge("", now, challenge), nil)
+			return
+		}
 	}
 
 	if uid.IsZero() {
@@ -90,6 +107,12 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if sign, _ := strconv.ParseBool(req.URL.Query().Get("sign")); sign {
+		// The client requests a signed URL for the file.
+		largeFileSignUrl(wrt, req, uid, signed, writeHttpResponse)
+		return
+	}
+
 	// Check if media handler redirects or adds headers.
 	headers, statusCode, err := mh.Headers(req, true)
 	if err != nil {
@@ -142,6 +165,52 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	logs.Info.Println("media serve: OK, uid=", uid)
 }
 
+// largeFileSignUrl issues a signed time-limited URL for downloading the requested file by the user uid.
+func largeFileSignUrl(wrt http.ResponseWriter, req *http.Request, uid types.Uid, signed bool,
+	writeHttpResponse func(msg *ServerComMessage, err error)) {
+	now := types.TimeNow()
+
+	if req.Method != http.MethodGet {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if signed {
+		// Signed URLs cannot be used to obtain new signed URLs, otherwise they would never expire.
+		writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("signing request with a signed URL"))
+		return
+	}
+
+	if globals.mediaUrlSigner == nil {
+		writeHttpResponse(ErrNotImplemented("", "", now, now), errors.New("signed URLs are disabled"))
+		return
+	}
+
+	mh := store.Store.GetMediaHandler()
+	if mh.GetIdFromUrl(req.URL.Path).IsZero() {
+		writeHttpResponse(ErrNotFound("", "", now), errors.New("invalid file URL"))
+		return
+	}
+
+	// Keep query parameters other than 'sign', like 'asatt'.
+	fileUrl := *req.URL
+	query := fileUrl.Query()
+	query.Del("sign")
+	fileUrl.RawQuery = query.Encode()
+
+	url, expires, err := mh.SignUrl(fileUrl.String(), uid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	writeHttpResponse(NoErrParams("", "", now, map[string]string{
+		"url":     url,
+		"expires": expires.Format(types.TimeFormatRFC3339),
+	}), nil)
+	logs.Info.Println("media serve: signed URL issued, uid=", uid)
+}
+
 // largeFileReceive receives files from client over HTTP(S) and passes them to the configured media handler.
 func largeFileReceive(wrt http.ResponseWriter, req *http.Request) {
 	now := types.TimeNow()
@@ -17,9 +17,11 @@ import (
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/logs"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type grpcNodeServer struct {
@@ -36,6 +38,10 @@ func (sess *Session) closeGrpc() {
 
 // Equivalent of starting a new session and a read loop in one.
 func (*grpcNodeServer) MessageLoop(stream pbx.Node_MessageLoopServer) error {
+	if globals.drain.isActive() {
+		return status.Error(codes.Unavailable, "server is draining")
+	}
+
 	sess, count := globals.sessionStore.NewSession(stream, "")
 	if p, ok := peer.FromContext(stream.Context()); ok {
 		sess.remoteAddr = p.Addr.String()
@@ -156,6 +156,10 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 	sid := req.FormValue("sid")
 	var sess *Session
 	if sid == "" {
+		if rejectDraining(wrt) {
+			return
+		}
+
 		// New session
 		var count int
 		sess, count = globals.sessionStore.NewSession(wrt, "")
@@ -0,0 +1,394 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of server-sent events clients. Server to client messages are
+ *    streamed as text/event-stream, client to server messages are sent with
+ *    HTTP POST. See also hdl_longpoll.go for long polling.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	// Number of recently sent events kept for resumption of the stream.
+	sseReplaySize = 256
+	// Separator of the session ID and the sequential number of the event in event IDs.
+	sseEventIdSeparator = "."
+)
+
+// Event sent to the client.
+type sseEvent struct {
+	seq  uint64
+	data []byte
+}
+
+// sseStream is the state of a server-sent events session which outlives individual HTTP connections.
+type sseStream struct {
+	lock sync.Mutex
+	// Sequential number of the last event.
+	seq uint64
+	// Recently sent events.
+	replay []sseEvent
+
+	// Cancels the currently attached connection.
+	cancel context.CancelFunc
+	// Closed when the currently attached connection is released.
+	released chan struct{}
+}
+
+// attach makes the HTTP connection the one to stream events to. The previously attached connection,
+// if any, is terminated. Returns the context of the connection and a function to release it.
+func (st *sseStream) attach(parent context.Context) (context.Context, func()) {
+	st.lock.Lock()
+	for st.cancel != nil {
+		cancel, released := st.cancel, st.released
+		st.lock.Unlock()
+		cancel()
+		<-released
+		st.lock.Lock()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	released := make(chan struct{})
+	st.cancel, st.released = cancel, released
+	st.lock.Unlock()
+
+	return ctx, func() {
+		st.lock.Lock()
+		st.cancel, st.released = nil, nil
+		st.lock.Unlock()
+		cancel()
+		close(released)
+	}
+}
+
+// record assigns the next sequential number to the event and keeps it for resumption.
+func (st *sseStream) record(data []byte) uint64 {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.seq++
+	st.replay = append(st.replay, sseEvent{seq: st.seq, data: data})
+	if len(st.replay) > sseReplaySize {
+		st.replay = st.replay[len(st.replay)-sseReplaySize:]
+	}
+	return st.seq
+}
+
+// since returns events sent after the event 'last'. Returns false if some of the events are no longer available.
+func (st *sseStream) since(last uint64) ([]sseEvent, bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if last > st.seq {
+		return nil, false
+	}
+	if last == st.seq {
+		return nil, true
+	}
+	if len(st.replay) == 0 || st.replay[0].seq > last+1 {
+		return nil, false
+	}
+	events := make([]sseEvent, st.seq-last)
+	copy(events, st.replay[len(st.replay)-len(events):])
+	return events, true
+}
+
+// sseParseEventId splits the event ID into the session ID and the sequential number of the event.
+func sseParseEventId(id string) (string, uint64, bool) {
+	i := strings.LastIndex(id, sseEventIdSeparator)
+	if i <= 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return id[:i], seq, true
+}
+
+func sseWrite(wrt io.Writer, sid string, evt sseEvent) error {
+	_, err := fmt.Fprintf(wrt, "id: %s%s%d\ndata: %s\n\n", sid, sseEventIdSeparator, evt.seq, evt.data)
+	return err
+}
+
+// recordSse assigns the next event ID to the serialized message and keeps it for resumption.
+// Returns false if the outbound queue limit is exceeded.
+func (sess *Session) recordSse(msg any) (sseEvent, bool) {
+	if len(sess.send) > sendQueueLimit {
+		logs.Err.Println("sse: outbound queue limit exceeded", sess.sid)
+		return sseEvent{}, false
+	}
+
+	statsInc("OutgoingMessagesSseTotal", 1)
+	// This will panic if msg is not []byte. This is intentional.
+	data := msg.([]byte)
+	return sseEvent{seq: sess.sse.record(data), data: data}, true
+}
+
+// writeEventsSse writes recorded events to the client.
+func (sess *Session) writeEventsSse(wrt io.Writer, events []sseEvent) bool {
+	for _, evt := range events {
+		if err := sseWrite(wrt, sess.sid, evt); err != nil {
+			// The event will be resent when the client reconnects.
+			logs.Warn.Println("sse: write failed", sess.sid, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (sess *Session) sendMessageSse(wrt io.Writer, msg any) bool {
+	evt, ok := sess.recordSse(msg)
+	return ok && sess.writeEventsSse(wrt, []sseEvent{evt})
+}
+
+// sendBatchSse records all messages of the batch before writing any of them, so the part of the batch
+// which was not written is resent when the client reconnects.
+func (sess *Session) sendBatchSse(wrt io.Writer, batch []*ServerComMessage) bool {
+	events := make([]sseEvent, 0, len(batch))
+	for _, msg := range batch {
+		evt, ok := sess.recordSse(sess.serializeAndUpdateStats(msg))
+		if !ok {
+			return false
+		}
+		events = append(events, evt)
+	}
+	return sess.writeEventsSse(wrt, events)
+}
+
+// writeSseLoop streams messages to the client until the connection is closed or replaced.
+func (sess *Session) writeSseLoop(ctx context.Context, wrt http.ResponseWriter, flusher http.Flusher) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				return
+			}
+			switch v := msg.(type) {
+			case []*ServerComMessage: // batch of unserialized messages
+				if !sess.sendBatchSse(wrt, v) {
+					return
+				}
+			case *ServerComMessage: // single unserialized message
+				w := sess.serializeAndUpdateStats(v)
+				if !sess.sendMessageSse(wrt, w) {
+					return
+				}
+			default: // serialized message
+				if !sess.sendMessageSse(wrt, v) {
+					return
+				}
+			}
+			// Messages of a batch are flushed together.
+			flusher.Flush()
+
+		case <-sess.bkgTimer.C:
+			if sess.background {
+				sess.background = false
+				sess.onBackgroundTimer()
+			}
+
+		case msg := <-sess.stop:
+			// Request to close the session. Make it unavailable.
+			globals.sessionStore.Delete(sess)
+			// Don't care if the write fails.
+			if msg != nil {
+				sess.sendMessageSse(wrt, msg)
+				flusher.Flush()
+			}
+			return
+
+		case topic := <-sess.detach:
+			sess.delSub(topic)
+
+		case <-ticker.C:
+			// Keep the connection and the session alive.
+			if _, err := io.WriteString(wrt, ": ping\n\n"); err != nil {
+				logs.Warn.Println("sse: ping failed", sess.sid, err)
+				return
+			}
+			flusher.Flush()
+			globals.sessionStore.Get(sess.sid)
+
+		case <-ctx.Done():
+			// HTTP request canceled, connection lost or replaced by another connection.
+			return
+		}
+	}
+}
+
+func (sess *Session) readSse(wrt http.ResponseWriter, req *http.Request) (int, error) {
+	if req.ContentLength > globals.maxMessageSize {
+		return http.StatusExpectationFailed, errors.New("request too large")
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) == 0 {
+		return 0, errors.New("empty request")
+	}
+
+	// The client may issue multiple requests in parallel.
+	sess.lock.Lock()
+	statsInc("IncomingMessagesSseTotal", 1)
+	sess.dispatchRaw(raw)
+	sess.lock.Unlock()
+	return 0, nil
+}
+
+// serveSSE handles server-sent events clients.
+//   - GET without session ID creates a session and streams events. The first event is a {ctrl}
+//     with the session ID.
+//   - GET with a session ID in the 'sid' parameter or with 'Last-Event-ID' header resumes streaming
+//     events to the existing session. Events after the 'Last-Event-ID' are sent again.
+//   - POST with the session ID in the 'sid' parameter sends a message to the server. The response,
+//     if any, is delivered as an event.
+func serveSSE(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+
+	if globals.tlsStrictMaxAge != "" {
+		wrt.Header().Set("Strict-Transport-Security", "max-age"+globals.tlsStrictMaxAge)
+	}
+
+	enc := json.NewEncoder(wrt)
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		wrt.WriteHeader(http.StatusForbidden)
+		enc.Encode(ErrAPIKeyRequired(now))
+		return
+	}
+
+	wrt.Header().Set("Access-Control-Allow-Origin", "*")
+	wrt.Header().Set("Cache-Control", "no-cache")
+
+	// The session ID is in the URL or in the ID of the last event received by the client.
+	sid, lastSeq, resume := sseParseEventId(req.Header.Get("Last-Event-ID"))
+	if qsid := req.URL.Query().Get("sid"); qsid != "" {
+		if resume && qsid != sid {
+			resume = false
+		}
+		sid = qsid
+	}
+
+	var sess *Session
+	if sid != "" {
+		sess = globals.sessionStore.Get(sid)
+		if sess == nil || sess.proto != SSE {
+			logs.Warn.Println("sse: invalid or expired session id", sid)
+			wrt.WriteHeader(http.StatusForbidden)
+			enc.Encode(ErrSessionNotFound(now))
+			return
+		}
+		if addr := getRemoteAddr(req); sess.remoteAddr != addr {
+			sess.remoteAddr = addr
+			logs.Warn.Println("sse: remote address changed", sid, addr)
+		}
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		if sess == nil {
+			wrt.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrSessionNotFound(now))
+			return
+		}
+		if code, err := sess.readSse(wrt, req); err != nil {
+			logs.Warn.Println("sse: read failed", sess.sid, err)
+			if code == 0 {
+				code = http.StatusBadRequest
+			}
+			wrt.WriteHeader(code)
+			enc.Encode(ErrMalformed("", "", now))
+		}
+		return
+
+	case http.MethodGet:
+
+	default:
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	flusher, ok := wrt.(http.Flusher)
+	if !ok {
+		logs.Err.Println("sse: streaming is not supported by the connection")
+		wrt.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrUnknown("", "", now))
+		return
+	}
+
+	created := sess == nil
+	if created {
+		if rejectDraining(wrt) {
+			return
+		}
+
+		var count int
+		sess, count = globals.sessionStore.NewSession(&sseStream{}, "")
+		sess.remoteAddr = getRemoteAddr(req)
+		logs.Info.Println("sse: session started", sess.sid, sess.remoteAddr, count)
+	}
+
+	// Attaching terminates the previous connection, so it no longer sends events which are being replayed.
+	ctx, release := sess.sse.attach(req.Context())
+	defer release()
+
+	var replay []sseEvent
+	if !created && resume {
+		if replay, ok = sess.sse.since(lastSeq); !ok {
+			// Some events are lost, the client must start a new session.
+			logs.Warn.Println("sse: cannot resume stream", sess.sid, lastSeq)
+			wrt.WriteHeader(http.StatusGone)
+			enc.Encode(ErrSessionNotFound(now))
+			sess.cleanUp(false)
+			return
+		}
+	}
+
+	wrt.Header().Set("Content-Type", "text/event-stream")
+	// Disable buffering in nginx.
+	wrt.Header().Set("X-Accel-Buffering", "no")
+	wrt.WriteHeader(http.StatusOK)
+
+	if created {
+		pkt := NoErrCreated(req.URL.Query().Get("id"), "", now)
+		pkt.Ctrl.Params = map[string]string{
+			"sid": sess.sid,
+		}
+		if !sess.sendMessageSse(wrt, sess.serializeAndUpdateStats(pkt)) {
+			return
+		}
+	}
+	for _, evt := range replay {
+		if err := sseWrite(wrt, sess.sid, evt); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	sess.writeSseLoop(ctx, wrt, flusher)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSseStream(t *testing.T) {
+	st := &sseStream{}
+	if events, ok := st.since(0); !ok || len(events) != 0 {
+		t.Error("empty stream must resume from 0")
+	}
+
+	for i := 1; i <= sseReplaySize+10; i++ {
+		if seq := st.record([]byte("x")); seq != uint64(i) {
+			t.Fatalf("expected seq %d, got %d", i, seq)
+		}
+	}
+
+	events, ok := st.since(sseReplaySize + 5)
+	if !ok || len(events) != 5 || events[0].seq != sseReplaySize+6 {
+		t.Errorf("unexpected replay %v %v", ok, events)
+	}
+	if events, ok = st.since(sseReplaySize + 10); !ok || len(events) != 0 {
+		t.Error("up to date client must get no events")
+	}
+	if _, ok = st.since(5); ok {
+		t.Error("events no longer available must not be resumed")
+	}
+	if _, ok = st.since(sseReplaySize + 11); ok {
+		t.Error("events from the future must not be resumed")
+	}
+
+	// A new connection replaces the old one.
+	ctx1, release1 := st.attach(context.Background())
+	go func() {
+		<-ctx1.Done()
+		release1()
+	}()
+	ctx2, release2 := st.attach(context.Background())
+	if ctx1.Err() == nil || ctx2.Err() != nil {
+		t.Error("previous connection not terminated")
+	}
+	release2()
+}
+
+func TestSseParseEventId(t *testing.T) {
+	sid, seq, ok := sseParseEventId("abc-_DEF.42")
+	if !ok || sid != "abc-_DEF" || seq != 42 {
+		t.Errorf("unexpected result '%s' %d %v", sid, seq, ok)
+	}
+	for _, id := range []string{"", "abc", ".42", "abc.", "abc.x"} {
+		if _, _, ok := sseParseEventId(id); ok {
+			t.Errorf("invalid event ID '%s' accepted", id)
+		}
+	}
+}
+
+// sseFailingWriter accepts the given number of writes and fails the rest.
+type sseFailingWriter struct {
+	writes int
+}
+
+func (w *sseFailingWriter) Write(p []byte) (int, error) {
+	if w.writes <= 0 {
+		return 0, errors.New("connection lost")
+	}
+	w.writes--
+	return len(p), nil
+}
+
+// Messages of the batch which were not written because of a failure are resent on resumption.
+func TestSseBatchWriteFailure(t *testing.T) {
+	sess := &Session{proto: SSE, sid: "sseTestSid", sse: &sseStream{}, send: make(chan any, 1)}
+	batch := []*ServerComMessage{NoErr("1", "", time.Now()), NoErr("2", "", time.Now()), NoErr("3", "", time.Now())}
+	if sess.sendBatchSse(&sseFailingWriter{writes: 1}, batch) {
+		t.Fatal("write failure not reported")
+	}
+	events, ok := sess.sse.since(1)
+	if !ok || len(events) != 2 || events[0].seq != 2 || events[1].seq != 3 {
+		t.Errorf("unwritten messages of the batch are not available for resumption: %v, %v", events, ok)
+	}
+}
+
+func sseTestApiKey() string {
+	data := make([]byte, apikeyLength)
+	data[0] = 1
+	hasher := hmac.New(md5.New, globals.apiKeySalt)
+	hasher.Write(data[:apikeyVersion+apikeyAppID+apikeySequence+apikeyWho])
+	copy(data[apikeyVersion+apikeyAppID+apikeySequence+apikeyWho:], hasher.Sum(nil))
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// Reads events from the stream until the expected number of events is received.
+func sseReadEvents(t *testing.T, scanner *bufio.Scanner, count int) []string {
+	var ids []string
+	for len(ids) < count && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		} else if strings.HasPrefix(line, "data: ") {
+			var msg ServerComMessage
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil || msg.Ctrl == nil {
+				t.Errorf("invalid event data '%s'", line)
+			}
+		}
+	}
+	return ids
+}
+
+func TestServeSSE(t *testing.T) {
+	globals.apiKeySalt = []byte("test salt")
+	globals.sessionStore = NewSessionStore(time.Minute)
+	defer func() {
+		globals.apiKeySalt = nil
+		globals.sessionStore = nil
+	}()
+
+	sess, _ := globals.sessionStore.NewSession(&sseStream{}, "sseTestSid")
+	if sess.proto != SSE || !sess.supportsMessageBatching() {
+		t.Fatal("unexpected session type")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(serveSSE))
+	defer srv.Close()
+
+	connect := func(query, lastEventId string) (*http.Response, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?apikey="+sseTestApiKey()+query, nil)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, cancel
+	}
+
+	// Unknown session.
+	resp, cancel := connect("&sid=unknown", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for unknown session, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	cancel()
+
+	resp, cancel = connect("&sid=sseTestSid", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d '%s'", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	sess.queueOutBatch([]*ServerComMessage{NoErr("1", "", time.Now()), NoErr("2", "", time.Now())})
+	ids := sseReadEvents(t, bufio.NewScanner(resp.Body), 2)
+	if len(ids) != 2 || ids[0] != "sseTestSid.1" || ids[1] != "sseTestSid.2" {
+		t.Fatalf("unexpected events %v", ids)
+	}
+	// Connection lost.
+	cancel()
+	resp.Body.Close()
+
+	// Resume using the ID of the first event only: the second event is sent again.
+	resp, cancel = connect("", "sseTestSid.1")
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resume failed %d", resp.StatusCode)
+	}
+	sess.queueOut(NoErr("3", "", time.Now()))
+	scanner := bufio.NewScanner(resp.Body)
+	ids = sseReadEvents(t, scanner, 2)
+	if len(ids) != 2 || ids[0] != "sseTestSid.2" || ids[1] != "sseTestSid.3" {
+		t.Errorf("unexpected events after resume %v", ids)
+	}
+
+	// Resume while the previous connection is still attached: it's terminated before the replay is computed.
+	resp2, cancel2 := connect("", "sseTestSid.2")
+	defer cancel2()
+	defer resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		t.Fatalf("second resume failed %d", resp2.StatusCode)
+	}
+	if ids = sseReadEvents(t, scanner, 1); len(ids) != 0 {
+		t.Errorf("previous connection must be terminated, got %v", ids)
+	}
+	sess.queueOut(NoErr("4", "", time.Now()))
+	ids = sseReadEvents(t, bufio.NewScanner(resp2.Body), 2)
+	if len(ids) != 2 || ids[0] != "sseTestSid.3" || ids[1] != "sseTestSid.4" {
+		t.Errorf("unexpected events after second resume %v", ids)
+	}
+
+	// Messages must be posted to an existing session.
+	post, err := http.Post(srv.URL+"?apikey="+sseTestApiKey(), "text/plain", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for POST without session, got %d", post.StatusCode)
+	}
+}
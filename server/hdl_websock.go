@@ -181,6 +181,11 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if rejectDraining(wrt) {
+		logs.Info.Println("ws: new session rejected, draining")
+		return
+	}
+
 	ws, err := upgrader.Upgrade(wrt, req, nil)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		logs.Err.Println("ws: Not a websocket handshake")
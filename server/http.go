@@ -115,6 +115,9 @@ Loop:
 			// While the server shuts down, termianate all sessions.
 			globals.sessionStore.Shutdown()
 
+			// Stop accepting messages from remote servers.
+			globals.federation.shutdown()
+
 			// Wait for http server to stop Accept()-ing connections.
 			<-httpdone
 			cancel()
@@ -156,14 +159,28 @@ Loop:
 func signalHandler() <-chan bool {
 	stop := make(chan bool)
 
+	// Shut down once the node is drained.
+	globals.drain.stop = stop
+
 	signchan := make(chan os.Signal, 1)
 	signal.Notify(signchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if drainSignal != nil {
+		signal.Notify(signchan, drainSignal)
+	}
 
 	go func() {
-		// Wait for a signal. Don't care which signal it is
-		sig := <-signchan
-		logs.Info.Printf("Signal received: '%s', shutting down", sig)
-		stop <- true
+		for sig := range signchan {
+			if sig == drainSignal {
+				// Drain the node, then shut down.
+				logs.Info.Printf("Signal received: '%s', draining", sig)
+				globals.drain.start()
+				continue
+			}
+			// Any other signal shuts down the server immediately.
+			logs.Info.Printf("Signal received: '%s', shutting down", sig)
+			stop <- true
+			return
+		}
 	}()
 
 	return stop
@@ -400,6 +417,8 @@ type debugTopic struct {
 	PerUser  []string `json:"per_user,omitempty"`
 	PerSubs  []string `json:"per_subs,omitempty"`
 	Sessions []string `json:"sessions,omitempty"`
+	// Node which hosts the topic according to the ring hash.
+	Master string `json:"master,omitempty"`
 }
 
 // debugCachedUser is a user cache entry debug info.
@@ -413,15 +432,71 @@ type debugCachedUser struct {
 type debugDump struct {
 	Version   string            `json:"server_version,omitempty"`
 	Build     string            `json:"build_id,omitempty"`
+	Node      string            `json:"node,omitempty"`
 	Timestamp time.Time         `json:"ts,omitempty"`
 	Sessions  []debugSession    `json:"sessions,omitempty"`
 	Topics    []debugTopic      `json:"topics,omitempty"`
 	UserCache []debugCachedUser `json:"user_cache,omitempty"`
+	Drain     *drainStatus      `json:"drain,omitempty"`
+	Cluster   *debugCluster     `json:"cluster,omitempty"`
+}
+
+// debugFilter limits the state dump to the user and/or the topic.
+type debugFilter struct {
+	// User ID in the same form as in the dump, without the 'usr' prefix.
+	User string
+	// Topic name.
+	Topic string
+}
+
+func (f *debugFilter) matchSession(s *debugSession) bool {
+	if f.User != "" && f.User != s.Uid {
+		return false
+	}
+	if f.Topic == "" {
+		return true
+	}
+	for _, name := range s.Subs {
+		if name == f.Topic {
+			return true
+		}
+	}
+	return false
 }
 
+func (f *debugFilter) matchTopic(t *debugTopic) bool {
+	if f.Topic != "" && f.Topic != t.Topic {
+		return false
+	}
+	if f.User == "" {
+		return true
+	}
+	for _, uid := range t.PerUser {
+		if uid == f.User {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStatus dumps the state of this node or, with ?cluster=true, of all cluster nodes.
+// The dump can be limited to the user and/or the topic with ?user=usrXXX&topic=grpXXX.
 func serveStatus(wrt http.ResponseWriter, req *http.Request) {
 	wrt.Header().Set("Content-Type", "application/json")
 
+	filter := &debugFilter{
+		User:  strings.TrimPrefix(req.FormValue("user"), "usr"),
+		Topic: req.FormValue("topic"),
+	}
+	if cluster, _ := strconv.ParseBool(req.FormValue("cluster")); cluster && globals.cluster != nil {
+		json.NewEncoder(wrt).Encode(globals.cluster.clusterStatus(filter))
+		return
+	}
+	json.NewEncoder(wrt).Encode(localStatus(filter))
+}
+
+// localStatus collects the state of this node.
+func localStatus(filter *debugFilter) *debugDump {
 	result := &debugDump{
 		Version:   currentVersion,
 		Build:     buildstamp,
@@ -429,6 +504,11 @@ func serveStatus(wrt http.ResponseWriter, req *http.Request) {
 		Sessions:  make([]debugSession, 0, len(globals.sessionStore.sessCache)),
 		Topics:    make([]debugTopic, 0, 10),
 		UserCache: make([]debugCachedUser, 0, 10),
+		Drain:     globals.drain.status(),
+	}
+	if globals.cluster != nil {
+		result.Node = globals.cluster.thisNodeName
+		result.Cluster = globals.cluster.status(filter)
 	}
 	// Sessions.
 	globals.sessionStore.Range(func(sid string, s *Session) bool {
@@ -441,14 +521,17 @@ func serveStatus(wrt http.ResponseWriter, req *http.Request) {
 		if s.clnode != nil {
 			clnode = s.clnode.name
 		}
-		result.Sessions = append(result.Sessions, debugSession{
+		sess := debugSession{
 			RemoteAddr: s.remoteAddr,
 			Ua:         s.userAgent,
 			Uid:        s.uid.String(),
 			Sid:        sid,
 			Clnode:     clnode,
 			Subs:       keys,
-		})
+		}
+		if filter.matchSession(&sess) {
+			result.Sessions = append(result.Sessions, sess)
+		}
 		return true
 	})
 	// Topics.
@@ -466,17 +549,26 @@ func serveStatus(wrt http.ResponseWriter, req *http.Request) {
 		for key := range topic.perSubs {
 			ps = append(ps, key)
 		}
-		result.Topics = append(result.Topics, debugTopic{
+		dt := debugTopic{
 			Topic:    topic.name,
 			Xorig:    topic.xoriginal,
 			IsProxy:  topic.isProxy,
 			PerUser:  pud,
 			PerSubs:  ps,
 			Sessions: psd,
-		})
+		}
+		if globals.cluster != nil {
+			dt.Master = globals.cluster.hashRing().Get(topic.name)
+		}
+		if filter.matchTopic(&dt) {
+			result.Topics = append(result.Topics, dt)
+		}
 		return true
 	})
 	for k, v := range usersCache {
+		if filter.Topic != "" || (filter.User != "" && filter.User != k.String()) {
+			continue
+		}
 		result.UserCache = append(result.UserCache, debugCachedUser{
 			Uid:    k.UserId(),
 			Unread: v.unread,
@@ -484,5 +576,5 @@ func serveStatus(wrt http.ResponseWriter, req *http.Request) {
 		})
 	}
 
-	json.NewEncoder(wrt).Encode(result)
+	return result
 }
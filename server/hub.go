@@ -126,6 +126,9 @@ func newHub() *Hub {
 	statsRegisterInt("IncomingMessagesLongpollTotal")
 	statsRegisterInt("OutgoingMessagesLongpollTotal")
 
+	statsRegisterInt("IncomingMessagesSseTotal")
+	statsRegisterInt("OutgoingMessagesSseTotal")
+
 	statsRegisterInt("IncomingMessagesGrpcTotal")
 	statsRegisterInt("OutgoingMessagesGrpcTotal")
 
@@ -184,11 +187,13 @@ func (h *Hub) run() {
 				if globals.cluster != nil {
 					if t.isProxy {
 						t.proxy = make(chan *ClusterResp, 32)
-						t.masterNode = globals.cluster.ring.Get(t.name)
+						t.masterNode = globals.cluster.hashRing().Get(t.name)
 					} else {
 						// It's a master topic. Make a channel for handling
 						// direct messages from the proxy.
 						t.master = make(chan *ClusterSessUpdate, 8)
+						// Channel for receiving topic state from the previous master.
+						t.handoff = make(chan *ClusterTopicState, 1)
 					}
 				}
 				// Topic is created in suspended state because it's not yet configured.
@@ -200,12 +205,15 @@ func (h *Hub) run() {
 				go topicInit(t, join, h)
 			} else {
 				// Topic found.
-				if t.isInactive() {
+				// Sessions moved from another node may join the topic while it's still being loaded:
+				// many sessions are moved at once.
+				if t.isInactive() && !(join.migrating && !t.isDeleted()) {
 					// Topic is either not ready or being deleted.
 					if join.sess.inflightReqs != nil {
 						join.sess.inflightReqs.Done()
 					}
 					join.sess.queueOut(ErrLockedReply(join, join.Timestamp))
+					abortMigration(join)
 					continue
 				}
 				// Topic will check access rights and send appropriate {ctrl}
@@ -216,6 +224,7 @@ func (h *Hub) run() {
 						join.sess.inflightReqs.Done()
 					}
 					join.sess.queueOut(ErrServiceUnavailableReply(join, join.Timestamp))
+					abortMigration(join)
 					logs.Err.Println("hub.join loop: topic's reg queue full", join.RcptTo, join.sess.sid,
 						" - total queue len:", len(t.reg))
 				}
@@ -262,6 +271,9 @@ func (h *Hub) run() {
 				if err := globals.cluster.routeToTopicIntraCluster(msg.RcptTo, msg, msg.sess); err != nil {
 					logs.Warn.Printf("hub: routing to '%s' failed", msg.RcptTo)
 				}
+			} else if strings.HasPrefix(msg.RcptTo, "usr") {
+				// The offline user may be a user of a remote server.
+				globals.federation.route(msg)
 			}
 		case msg := <-h.meta:
 			// Metadata read or update from a user who is not attached to the topic.
@@ -300,16 +312,28 @@ func (h *Hub) run() {
 			// Such topics must be shut down at this node.
 			h.topics.Range(func(_, t any) bool {
 				topic := t.(*Topic)
-				// Handle two cases:
+				// Handle three cases:
 				// 1. Master topic has moved out to another node.
 				// 2. Proxy topic is running on a new master node
 				//    (i.e. the master topic has moved to this node).
+				// 3. Master topic has moved between two other nodes. Proxy topics are
+				//    restarted only when topics are handed off to the new master.
 				if topic.isProxy != globals.cluster.isRemoteTopic(topic.name) {
-					h.topicUnreg(nil, topic.name, nil, StopRehashing)
+					reason := StopRehashing
+					if globals.cluster.topicHandoff {
+						reason = StopMigrating
+					}
+					h.topicUnreg(nil, topic.name, nil, reason)
+				} else if topic.isProxy && globals.cluster.topicHandoff &&
+					topic.masterNode != globals.cluster.hashRing().Get(topic.name) {
+					h.topicUnreg(nil, topic.name, nil, StopMigrating)
 				}
 				return true
 			})
 
+			// Users may have moved between nodes: discard cached unread counters.
+			usersRehashed()
+
 			// Check if 'sys' topic has migrated to this node.
 			if h.topicGet("sys") == nil && !globals.cluster.isRemoteTopic("sys") {
 				// Yes, 'sys' has migrated here. Initialize it.
@@ -545,7 +569,13 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 		// Case 2: just unregister.
 		// If t is nil, it's not registered, no action is needed
 		if t := h.topicGet(topic); t != nil {
-			t.markDeleted()
+			if reason == StopMigrating {
+				// Migrating topic continues to process queued requests before moving to the new master,
+				// but no longer saves messages.
+				t.markMigrating()
+			} else {
+				t.markDeleted()
+			}
 			h.topicDel(topic)
 
 			t.exit <- &shutDown{reason: reason}
@@ -64,6 +64,7 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 
 		logs.Err.Println("init_topic: failed to load or create topic:", join.RcptTo, err)
 		join.sess.queueOut(decodeStoreErrorExplicitTs(err, join.Id, t.xoriginal, timestamp, join.Timestamp, nil))
+		abortMigration(join)
 
 		// Re-queue pending requests to join the topic.
 		for len(t.reg) > 0 {
@@ -117,6 +118,13 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 	statsInc("TotalTopics", 1)
 	usersRegisterTopic(t, true)
 
+	// The topic was moved from another node which sent its state before the topic was loaded here.
+	if t.handoff != nil {
+		if state := globals.cluster.takeHandoff(t.name); state != nil {
+			t.handoff <- state
+		}
+	}
+
 	// Topic will check access rights, send invite to p2p user, send {ctrl} message to the initiator session
 	if join.Sub != nil {
 		subscribeReqIssued = true
@@ -160,6 +168,12 @@ func initTopicMe(t *Topic, sreg *ClientComMessage) error {
 	t.public = user.Public
 	t.trusted = user.Trusted
 
+	// Notification preferences of 'me' are the user's global preferences.
+	if pud, ok := t.perUser[user.Uid()]; ok {
+		pud.notify = user.Notify
+		t.perUser[user.Uid()] = pud
+	}
+
 	t.created = user.CreatedAt
 	t.updated = user.UpdatedAt
 
@@ -285,6 +299,7 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 				topicName: types.ParseUid(subs[(i+1)%2].User).UserId(),
 
 				private:   subs[i].Private,
+				notify:    subs[i].Notify,
 				modeWant:  subs[i].ModeWant,
 				modeGiven: subs[i].ModeGiven,
 				delID:     subs[i].DelId,
@@ -474,6 +489,7 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 		userData.delID = sub1.DelId
 		userData.readID = sub1.ReadSeqId
 		userData.recvID = sub1.RecvSeqId
+		userData.notify = sub1.Notify
 		t.perUser[userID1] = userData
 
 		t.perUser[userID2] = perUserData{
@@ -485,6 +501,7 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 			delID:     sub2.DelId,
 			readID:    sub2.ReadSeqId,
 			recvID:    sub2.RecvSeqId,
+			notify:    sub2.Notify,
 		}
 	}
 
@@ -718,6 +735,7 @@ func (t *Topic) loadSubscribers() error {
 			readID:    sub.ReadSeqId,
 			recvID:    sub.RecvSeqId,
 			private:   sub.Private,
+			notify:    sub.Notify,
 			modeWant:  sub.ModeWant,
 			modeGiven: sub.ModeGiven,
 		}
@@ -44,9 +44,12 @@ import (
 
 	// Push notifications
 	"github.com/tinode/chat/server/push"
+	_ "github.com/tinode/chat/server/push/apns"
 	_ "github.com/tinode/chat/server/push/fcm"
 	_ "github.com/tinode/chat/server/push/stdout"
 	_ "github.com/tinode/chat/server/push/tnpg"
+	_ "github.com/tinode/chat/server/push/webhook"
+	_ "github.com/tinode/chat/server/push/webpush"
 
 	"github.com/tinode/chat/server/store"
 
@@ -56,7 +59,9 @@ import (
 	"google.golang.org/grpc"
 
 	// File upload handlers
+	"github.com/tinode/chat/server/media"
 	_ "github.com/tinode/chat/server/media/fs"
+	_ "github.com/tinode/chat/server/media/gcs"
 	_ "github.com/tinode/chat/server/media/s3"
 )
 
@@ -109,6 +114,9 @@ const (
 
 	// Default timeout to drop an unanswered call, seconds.
 	defaultCallEstablishmentTimeout = 30
+
+	// Default lifetime of signed download URLs, seconds.
+	defaultSignedUrlTTL = 300
 )
 
 // Build version number defined by the compiler:
@@ -184,6 +192,17 @@ var globals struct {
 	maxFileUploadSize int64
 	// Periodicity of a garbage collector for abandoned media uploads.
 	mediaGcPeriod time.Duration
+	// Signer of time-limited download URLs; nil if signed URLs are disabled.
+	mediaUrlSigner *media.URLSigner
+
+	// Moderation of published messages; nil if moderation is disabled.
+	moderator *moderator
+	// Handler of user reports; nil if reports are disabled.
+	reports *reportsHandler
+	// Draining of the node before shutdown.
+	drain *nodeDrain
+	// Gateway to trusted remote servers; nil if federation is disabled.
+	federation *federation
 
 	// Prioritize X-Forwarded-For header as the source of IP address of the client.
 	useXForwardedFor bool
@@ -226,6 +245,67 @@ type accountGcConfig struct {
 	GcMinAccountAge int `json:"gc_min_account_age"`
 }
 
+// Email digest config.
+type digestConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for offline users (seconds).
+	Period int `json:"period"`
+	// Minimum time since the user was last seen before the digest is sent (seconds).
+	OfflinePeriod int `json:"offline_period"`
+	// Number of users to load from the DB in one pass.
+	BlockSize int `json:"block_size"`
+	// Base URL of the web app and of the unsubscribe endpoint, e.g. "https://example.com/".
+	HostUrl string `json:"host_url"`
+	// List of languages supported by templates.
+	Languages []string `json:"languages"`
+	// Path to the digest template, could be language-dependent, e.g. "./templ/email-digest-{{.Language}}.templ".
+	DigestTemplFile string `json:"digest_templ"`
+	// Maximum number of topics listed in one digest.
+	MaxTopics int `json:"max_topics"`
+	// Maximum number of message previews per topic.
+	MaxMessages int `json:"max_messages"`
+}
+
+// Moderation config.
+type moderationConfig struct {
+	Enabled bool `json:"enabled"`
+	// Character which replaces masked text, "*" by default.
+	MaskChar string `json:"mask_char"`
+	// Maximum number of flagged messages returned by {get what="mod"}.
+	QueueLimit int `json:"queue_limit"`
+	// Time in seconds to keep flagged messages in the moderation queue.
+	QueueTTL int `json:"queue_ttl"`
+	// Moderation rules.
+	Rules []moderationRuleConfig `json:"rules"`
+}
+
+// Configuration of user reports.
+type reportsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Group topic of moderators. Owners and admins of the topic can act on reports.
+	ModeratorsTopic string `json:"moderators_topic"`
+	// Acceptable reasons for reports.
+	Reasons []string `json:"reasons"`
+}
+
+// Single moderation rule.
+type moderationRuleConfig struct {
+	// Name of the rule reported in the moderation queue.
+	Name string `json:"name"`
+	// What to do with the matching message: "reject", "mask" or "flag".
+	Action string `json:"action"`
+	// Case-insensitive words to look for.
+	Words []string `json:"words"`
+	// File with a list of words, one per line.
+	WordsFile string `json:"words_file"`
+	// Regular expressions to look for.
+	Patterns []string `json:"patterns"`
+	// Topic names or name prefixes ending with '*' to apply the rule to, all topics if empty.
+	Topics []string `json:"topics"`
+	// Languages of the sender to apply the rule to, all languages if empty.
+	Languages []string `json:"languages"`
+}
+
 // Large file handler config.
 type mediaConfig struct {
 	// The name of the handler to use for file uploads.
@@ -238,6 +318,17 @@ type mediaConfig struct {
 	GcBlockSize int `json:"gc_block_size"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
+	// Signed time-limited download URLs.
+	SignedUrls *signedUrlConfig `json:"signed_urls"`
+}
+
+// Config of signed download URLs.
+type signedUrlConfig struct {
+	Enabled bool `json:"enabled"`
+	// HMAC key for signing URLs, base64-encoded, at least 32 bytes.
+	Key []byte `json:"key"`
+	// Lifetime of signed URLs in seconds.
+	TTL int `json:"ttl"`
 }
 
 // Contentx of the configuration file
@@ -292,16 +383,23 @@ type configType struct {
 	DefaultCountryCode string `json:"default_country_code"`
 
 	// Configs for subsystems
-	Cluster   json.RawMessage             `json:"cluster_config"`
-	Plugin    json.RawMessage             `json:"plugins"`
-	Store     json.RawMessage             `json:"store_config"`
-	Push      json.RawMessage             `json:"push"`
-	TLS       json.RawMessage             `json:"tls"`
-	Auth      map[string]json.RawMessage  `json:"auth_config"`
-	Validator map[string]*validatorConfig `json:"acc_validation"`
-	AccountGC *accountGcConfig            `json:"acc_gc_config"`
-	Media     *mediaConfig                `json:"media"`
-	WebRTC    json.RawMessage             `json:"webrtc"`
+	Cluster        json.RawMessage             `json:"cluster_config"`
+	Plugin         json.RawMessage             `json:"plugins"`
+	Store          json.RawMessage             `json:"store_config"`
+	Push           json.RawMessage             `json:"push"`
+	PushOutbox     json.RawMessage             `json:"push_outbox"`
+	TLS            json.RawMessage             `json:"tls"`
+	Auth           map[string]json.RawMessage  `json:"auth_config"`
+	Validator      map[string]*validatorConfig `json:"acc_validation"`
+	AccountGC      *accountGcConfig            `json:"acc_gc_config"`
+	Digest         *digestConfig               `json:"email_digest"`
+	Moderation     *moderationConfig           `json:"moderation"`
+	Reports        *reportsConfig              `json:"reports"`
+	Media          *mediaConfig                `json:"media"`
+	WebRTC         json.RawMessage             `json:"webrtc"`
+	Drain          *drainConfig                `json:"drain"`
+	Federation     *federationConfig           `json:"federation"`
+	UnreadCounters *unreadConfig               `json:"unread_counters"`
 }
 
 func main() {
@@ -573,6 +671,16 @@ func main() {
 					logs.Err.Fatalf("Failed to init media handler '%s': %s", config.Media.UseHandler, err)
 				}
 			}
+			if sc := config.Media.SignedUrls; sc != nil && sc.Enabled && store.Store.GetMediaHandler() != nil {
+				ttl := sc.TTL
+				if ttl <= 0 {
+					ttl = defaultSignedUrlTTL
+				}
+				if globals.mediaUrlSigner, err = media.NewURLSigner(sc.Key, time.Second*time.Duration(ttl)); err != nil {
+					logs.Err.Fatal("Invalid config of signed URLs: ", err)
+				}
+				store.Store.GetMediaHandler().UseURLSigner(globals.mediaUrlSigner)
+			}
 			if config.Media.GcPeriod > 0 && config.Media.GcBlockSize > 0 {
 				globals.mediaGcPeriod = time.Second * time.Duration(config.Media.GcPeriod)
 				stopFilesGc := largeFileRunGarbageCollection(globals.mediaGcPeriod, config.Media.GcBlockSize)
@@ -599,6 +707,42 @@ func main() {
 		}()
 	}
 
+	// Email digests of unread messages for offline users.
+	if config.Digest != nil && config.Digest.Enabled {
+		digest, err := newEmailDigest(config.Digest, config.ApiPath)
+		if err != nil {
+			logs.Err.Fatalln("Invalid email digest config:", err)
+		}
+		stopDigest := digest.run(time.Second * time.Duration(config.Digest.Period))
+
+		defer func() {
+			stopDigest <- true
+			logs.Info.Println("Stopped email digest")
+		}()
+	}
+
+	// Moderation of published messages.
+	if config.Moderation != nil && config.Moderation.Enabled {
+		mod, err := newModerator(config.Moderation)
+		if err != nil {
+			logs.Err.Fatalln("Invalid moderation config:", err)
+		}
+		globals.moderator = mod
+		stopModeration := mod.run(time.Hour)
+
+		defer func() {
+			stopModeration <- true
+			logs.Info.Println("Stopped moderation queue cleanup")
+		}()
+	}
+
+	// Reports of abusive messages and users.
+	if config.Reports != nil && config.Reports.Enabled {
+		if globals.reports, err = newReportsHandler(config.Reports); err != nil {
+			logs.Err.Fatalln("Invalid reports config:", err)
+		}
+	}
+
 	pushHandlers, err := push.Init(config.Push)
 	if err != nil {
 		logs.Err.Fatal("Failed to initialize push notifications:", err)
@@ -609,10 +753,22 @@ func main() {
 	}()
 	logs.Info.Println("Push handlers configured:", pushHandlers)
 
+	var nodeName string
+	if globals.cluster != nil {
+		nodeName = globals.cluster.thisNodeName
+	}
+	if ok, err := push.InitOutbox(config.PushOutbox, nodeName); err != nil {
+		logs.Err.Fatal("Failed to initialize push outbox:", err)
+	} else if ok {
+		logs.Info.Println("Push outbox enabled")
+	}
+
 	if err = initVideoCalls(config.WebRTC); err != nil {
 		logs.Err.Fatal("Failed to init video calls: %w", err)
 	}
 
+	globals.drain = newNodeDrain(config.Drain)
+
 	// Keep inactive LP sessions for 15 seconds
 	globals.sessionStore = NewSessionStore(idleSessionTimeout + 15*time.Second)
 	// The hub (the main message router)
@@ -623,6 +779,13 @@ func main() {
 		globals.cluster.start()
 	}
 
+	// Start accepting messages from trusted remote servers.
+	if config.Federation != nil && config.Federation.Enabled {
+		if globals.federation, err = federationInit(config.Federation); err != nil {
+			logs.Err.Fatalln("Failed to init federation:", err)
+		}
+	}
+
 	tlsConfig, err := parseTLSConfig(*tlsEnabled, config.TLS)
 	if err != nil {
 		logs.Err.Fatalln(err)
@@ -632,7 +795,7 @@ func main() {
 	pluginsInit(config.Plugin)
 
 	// Initialize users cache
-	usersInit()
+	usersInit(config.UnreadCounters)
 
 	// Set up gRPC server, if one is configured
 	if *listenGrpc == "" {
@@ -717,10 +880,20 @@ func main() {
 		mux.HandleFunc(sspath, serveStatus)
 	}
 
+	if config.Drain != nil && config.Drain.Path != "" {
+		if config.Drain.Secret == "" {
+			logs.Err.Fatalln("Drain endpoint requires a secret")
+		}
+		logs.Info.Printf("Drain endpoint is available at '%s'", config.Drain.Path)
+		mux.HandleFunc(config.Drain.Path, serveDrain)
+	}
+
 	// Handle websocket clients.
 	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
 	// Handle long polling clients. Enable compression.
 	mux.Handle(config.ApiPath+"v0/channels/lp", gh.CompressHandler(http.HandlerFunc(serveLongPoll)))
+	// Handle server-sent events clients. Not compressed: events must be flushed as they are written.
+	mux.HandleFunc(config.ApiPath+"v0/channels/sse", serveSSE)
 	if config.Media != nil {
 		// Handle uploads of large files.
 		mux.Handle(config.ApiPath+"v0/file/u/", gh.CompressHandler(http.HandlerFunc(largeFileReceive)))
@@ -728,6 +901,10 @@ func main() {
 		mux.Handle(config.ApiPath+"v0/file/s/", gh.CompressHandler(http.HandlerFunc(largeFileServe)))
 		logs.Info.Println("Large media handling enabled", config.Media.UseHandler)
 	}
+	if config.Digest != nil && config.Digest.Enabled {
+		// Unsubscribe links from email digests.
+		mux.HandleFunc(config.ApiPath+"v0/digest/unsubscribe", serveDigestUnsubscribe)
+	}
 
 	if staticMountPoint != "/" {
 		// Serve json-formatted 404 for all other URLs
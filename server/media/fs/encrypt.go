@@ -0,0 +1,303 @@
+package fs
+
+// Envelope encryption of stored files.
+//
+// Every file is encrypted with its own random AES-256 data key. The data key is encrypted (wrapped)
+// with the master key and saved in the file record as FileDef.EncKey prefixed with the ID of the master
+// key. The ID makes it possible to use several master keys while the keys are being rotated. The file is stored as a sequence
+// of independently sealed AES-GCM chunks which makes it possible to seek in the encrypted file without
+// decrypting it from the beginning.
+//
+// Chunk i of the file is sealed with the nonce built from the chunk index. The same nonce is never
+// reused with the same key because every file has a unique data key. The additional authenticated data
+// contains the chunk index and the flag if the chunk is the last one, which protects against
+// reordering and truncation of the chunks.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	// Size of the plaintext chunk.
+	chunkSize = 64 * 1024
+	// Size of the GCM authentication tag appended to every chunk.
+	tagSize = 16
+	// Size of the sealed chunk on disk.
+	sealedChunkSize = chunkSize + tagSize
+	// Length of AES-256 keys.
+	keySize = 32
+	// Length of the master key ID stored in front of the wrapped data key.
+	keyIdSize = 8
+)
+
+var errBadKey = errors.New("invalid encryption key")
+
+// newGCM creates AES-GCM AEAD for the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, errBadKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyId returns the ID of the master key: hex-encoded prefix of the key's SHA-256 hash.
+func KeyId(masterKey []byte) string {
+	sum := sha256.Sum256(masterKey)
+	return hex.EncodeToString(sum[:keyIdSize])
+}
+
+// WrappedKeyId returns the ID of the master key which wrapped the data key.
+func WrappedKeyId(wrapped []byte) string {
+	if len(wrapped) < keyIdSize {
+		return ""
+	}
+	return hex.EncodeToString(wrapped[:keyIdSize])
+}
+
+// WrapDataKey encrypts the data key of the file fid with the master key.
+func WrapDataKey(fid string, dataKey, masterKey []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(masterKey)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(sum[:keyIdSize:keyIdSize], nonce...)
+	// File ID is used as additional data to bind the key to the file.
+	return aead.Seal(out, nonce, dataKey, []byte(fid)), nil
+}
+
+// UnwrapDataKey decrypts the data key of the file fid with the master key.
+func UnwrapDataKey(fid string, wrapped, masterKey []byte) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(wrapped) < keyIdSize+nonceSize+aead.Overhead() || WrappedKeyId(wrapped) != KeyId(masterKey) {
+		return nil, errBadKey
+	}
+	wrapped = wrapped[keyIdSize:]
+	dataKey, err := aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(fid))
+	if err != nil {
+		return nil, errBadKey
+	}
+	return dataKey, nil
+}
+
+// RewrapDataKey re-encrypts the data key of the file fid with the new master key.
+func RewrapDataKey(fid string, wrapped, oldKey, newKey []byte) ([]byte, error) {
+	dataKey, err := UnwrapDataKey(fid, wrapped, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	return WrapDataKey(fid, dataKey, newKey)
+}
+
+// newDataKey generates a random data key.
+func newDataKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// chunkNonce returns nonce for the chunk with the given index.
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+// chunkAD returns additional authenticated data for the chunk.
+func chunkAD(index int64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// encryptCopy reads plaintext from src, encrypts it with dataKey and writes it to dst.
+// Returns the number of plaintext bytes copied.
+func encryptCopy(dst io.Writer, src io.Reader, dataKey []byte) (int64, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// Read one chunk ahead to find out if the current chunk is the last one.
+	curr := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	sealed := make([]byte, 0, sealedChunkSize)
+
+	n, err := io.ReadFull(src, curr)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	var total, index int64
+	for {
+		var m int
+		if n == chunkSize {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return total, err
+			}
+		}
+		last := m == 0
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(aead, index), curr[:n], chunkAD(index, last))
+		if _, err = dst.Write(sealed); err != nil {
+			return total, err
+		}
+		total += int64(n)
+
+		if last {
+			return total, nil
+		}
+
+		curr, next = next, curr
+		n = m
+		index++
+	}
+}
+
+// decryptingReader is a media.ReadSeekCloser which decrypts chunked encrypted file on the fly.
+type decryptingReader struct {
+	file *os.File
+	aead cipher.AEAD
+	// Size of the encrypted file.
+	sealedSize int64
+	// Size of the decrypted content.
+	size int64
+	// Total number of chunks.
+	chunks int64
+	// Current read position in the plaintext.
+	offset int64
+
+	// Index of the currently decrypted chunk, -1 if none.
+	index int64
+	// Decrypted content of the current chunk.
+	plain []byte
+	// Buffer for reading sealed chunks.
+	sealed []byte
+}
+
+// newDecryptingReader creates a decrypting reader for the file encrypted with the dataKey.
+func newDecryptingReader(file *os.File, dataKey []byte) (*decryptingReader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sealedSize := info.Size()
+	chunks := (sealedSize + sealedChunkSize - 1) / sealedChunkSize
+	// Even an empty file has one chunk with the tag. The last chunk cannot be shorter than the tag.
+	if chunks == 0 || (sealedSize-1)%sealedChunkSize < tagSize-1 {
+		return nil, errors.New("encrypted file is corrupted")
+	}
+
+	return &decryptingReader{
+		file:       file,
+		aead:       aead,
+		sealedSize: sealedSize,
+		size:       sealedSize - chunks*tagSize,
+		chunks:     chunks,
+		index:      -1,
+		sealed:     make([]byte, sealedChunkSize),
+	}, nil
+}
+
+// loadChunk reads and decrypts the chunk with the given index.
+func (dr *decryptingReader) loadChunk(index int64) error {
+	if dr.index == index {
+		return nil
+	}
+
+	start := index * sealedChunkSize
+	length := int64(sealedChunkSize)
+	if start+length > dr.sealedSize {
+		length = dr.sealedSize - start
+	}
+
+	if _, err := dr.file.ReadAt(dr.sealed[:length], start); err != nil && err != io.EOF {
+		return err
+	}
+
+	plain, err := dr.aead.Open(dr.plain[:0], chunkNonce(dr.aead, index), dr.sealed[:length],
+		chunkAD(index, index == dr.chunks-1))
+	if err != nil {
+		dr.index = -1
+		return errors.New("failed to decrypt file chunk")
+	}
+
+	dr.plain = plain
+	dr.index = index
+	return nil
+}
+
+// Read reads decrypted content of the file.
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	if dr.offset >= dr.size {
+		return 0, io.EOF
+	}
+
+	var total int
+	for len(p) > 0 && dr.offset < dr.size {
+		if err := dr.loadChunk(dr.offset / chunkSize); err != nil {
+			return total, err
+		}
+		n := copy(p, dr.plain[dr.offset%chunkSize:])
+		p = p[n:]
+		total += n
+		dr.offset += int64(n)
+	}
+	return total, nil
+}
+
+// Seek sets the read position in the decrypted content.
+func (dr *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.offset = offset
+	return offset, nil
+}
+
+// Close closes the underlying file.
+func (dr *decryptingReader) Close() error {
+	return dr.file.Close()
+}
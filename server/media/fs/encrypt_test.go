@@ -0,0 +1,204 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encryptToTempFile(t *testing.T, plain, dataKey []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "encrypted")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := encryptCopy(out, bytes.NewReader(plain), dataKey)
+	out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(plain)) {
+		t.Fatalf("Wrong plaintext size: expected %d, got %d", len(plain), size)
+	}
+
+	in, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dataKey, _ := newDataKey()
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		reader, err := newDecryptingReader(encryptToTempFile(t, plain, dataKey), dataKey)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+
+		decrypted, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(plain, decrypted) {
+			t.Errorf("Decrypted content mismatch, size %d", size)
+		}
+
+		if end, _ := reader.Seek(0, io.SeekEnd); end != int64(size) {
+			t.Errorf("Wrong size reported: expected %d, got %d", size, end)
+		}
+
+		if size > 10 {
+			// Read across the chunk boundary from the middle of the file.
+			offset := int64(size - 10)
+			reader.Seek(offset, io.SeekStart)
+			tail, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(size, err)
+			}
+			if !bytes.Equal(plain[offset:], tail) {
+				t.Errorf("Content mismatch after seek, size %d", size)
+			}
+		}
+		reader.Close()
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	dataKey, _ := newDataKey()
+	plain := make([]byte, 2*chunkSize+100)
+	rand.Read(plain)
+
+	file := encryptToTempFile(t, plain, dataKey)
+	name := file.Name()
+	file.Close()
+
+	// Truncate the last chunk away: the new last chunk must fail authentication.
+	if err := os.Truncate(name, 2*sealedChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	file, _ = os.Open(name)
+	reader, err := newDecryptingReader(file, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err = io.ReadAll(reader); err == nil {
+		t.Error("Truncated file must fail decryption")
+	}
+
+	// Wrong data key.
+	otherKey, _ := newDataKey()
+	file, _ = os.Open(name)
+	reader, _ = newDecryptingReader(file, otherKey)
+	defer reader.Close()
+	if _, err = io.ReadAll(reader); err == nil {
+		t.Error("Decryption with a wrong key must fail")
+	}
+}
+
+func TestServeContentRange(t *testing.T) {
+	dataKey, _ := newDataKey()
+	plain := make([]byte, 2*chunkSize+500)
+	rand.Read(plain)
+
+	reader, err := newDecryptingReader(encryptToTempFile(t, plain, dataKey), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/v0/file/s/abc.bin", nil)
+	req.Header.Set("Range", "bytes=65530-65545")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "", time.Now(), reader)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, got %d", rec.Code)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), plain[65530:65546]) {
+		t.Error("Range content mismatch")
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	masterKey, _ := newDataKey()
+	newMasterKey, _ := newDataKey()
+	dataKey, _ := newDataKey()
+
+	wrapped, err := WrapDataKey("abcdef", dataKey, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapDataKey("fedcba", wrapped, masterKey); err == nil {
+		t.Error("Key must be bound to the file ID")
+	}
+	if WrappedKeyId(wrapped) != KeyId(masterKey) {
+		t.Error("Wrapped key must be tagged with the ID of the master key")
+	}
+
+	rewrapped, err := RewrapDataKey("abcdef", wrapped, masterKey, newMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapDataKey("abcdef", rewrapped, masterKey); err == nil {
+		t.Error("Rewrapped key must not be decryptable with the old master key")
+	}
+	unwrapped, err := UnwrapDataKey("abcdef", rewrapped, newMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dataKey, unwrapped) {
+		t.Error("Data key mismatch after rotation")
+	}
+	if WrappedKeyId(rewrapped) != KeyId(newMasterKey) {
+		t.Error("Rewrapped key must be tagged with the ID of the new master key")
+	}
+}
+
+func TestMasterKeysDuringRotation(t *testing.T) {
+	oldKey, _ := newDataKey()
+	newKey, _ := newDataKey()
+	dataKey, _ := newDataKey()
+
+	wrapped, _ := WrapDataKey("abcdef", dataKey, oldKey)
+
+	// The new key is the current one, the old key is still accepted.
+	fh := &fshandler{}
+	conf, _ := json.Marshal(map[string]interface{}{
+		"upload_dir":      t.TempDir(),
+		"encryption_key":  newKey,
+		"decryption_keys": [][]byte{oldKey},
+	})
+	if err := fh.Init(string(conf)); err != nil {
+		t.Fatal(err)
+	}
+	masterKey := fh.masterKeys[WrappedKeyId(wrapped)]
+	if !bytes.Equal(masterKey, oldKey) {
+		t.Fatal("Old key not found by ID")
+	}
+	unwrapped, err := UnwrapDataKey("abcdef", wrapped, masterKey)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Error("Failed to unwrap data key with the old master key", err)
+	}
+
+	conf, _ = json.Marshal(map[string]interface{}{
+		"upload_dir":      t.TempDir(),
+		"encryption_key":  newKey,
+		"decryption_keys": [][]byte{oldKey[:16]},
+	})
+	if err := (&fshandler{}).Init(string(conf)); err == nil {
+		t.Error("Short decryption key must be rejected")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/media"
@@ -27,6 +28,10 @@ type configType struct {
 	FileUploadDirectory string   `json:"upload_dir"`
 	ServeURL            string   `json:"serve_url"`
 	CorsOrigins         []string `json:"cors_origins"`
+	// Base64-encoded 32 byte master key. If set, uploaded files are encrypted at rest.
+	EncryptionKey []byte `json:"encryption_key"`
+	// Other master keys accepted for decrypting files, e.g. the old and the new keys during rotation.
+	DecryptionKeys [][]byte `json:"decryption_keys"`
 }
 
 type fshandler struct {
@@ -34,6 +39,12 @@ type fshandler struct {
 	fileUploadLocation string
 	serveURL           string
 	corsOrigins        []string
+	// Signer of download URLs. Could be nil.
+	urlSigner *media.URLSigner
+	// Master key for encrypting per-file data keys. Nil if encryption is disabled.
+	masterKey []byte
+	// All master keys which can decrypt data keys, by key ID.
+	masterKeys map[string][]byte
 }
 
 func (fh *fshandler) Init(jsconf string) error {
@@ -54,13 +65,42 @@ func (fh *fshandler) Init(jsconf string) error {
 		fh.serveURL = defaultServeURL
 	}
 
+	if len(config.EncryptionKey) > 0 {
+		if len(config.EncryptionKey) != keySize {
+			return errors.New("encryption key must be 32 bytes long")
+		}
+		fh.masterKey = config.EncryptionKey
+	}
+	fh.masterKeys = make(map[string][]byte)
+	for _, key := range append(config.DecryptionKeys, fh.masterKey) {
+		if key == nil {
+			continue
+		}
+		if len(key) != keySize {
+			return errors.New("decryption keys must be 32 bytes long")
+		}
+		fh.masterKeys[KeyId(key)] = key
+	}
+
 	// Make sure the upload directory exists.
 	return os.MkdirAll(fh.fileUploadLocation, 0777)
 }
 
-// Headers is used for serving CORS headers.
+// Headers is used for serving CORS headers and for verifying signed download URLs.
 func (fh *fshandler) Headers(req *http.Request, serve bool) (http.Header, int, error) {
 	header, status := media.CORSHandler(req, fh.corsOrigins, serve)
+	if status != 0 || !serve {
+		return header, status, nil
+	}
+
+	if url := req.URL.String(); media.IsSignedURL(url) {
+		if fh.urlSigner == nil {
+			return nil, 0, types.ErrPermissionDenied
+		}
+		if _, err := fh.urlSigner.Verify(url, time.Now()); err != nil {
+			return nil, 0, err
+		}
+	}
 	return header, status, nil
 }
 
@@ -73,6 +113,17 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, in
 	// file name collisions on Windows due to case-insensitive file names there.
 	fdef.Location = filepath.Join(fh.fileUploadLocation, fdef.Uid().String32())
 
+	var dataKey []byte
+	if fh.masterKey != nil {
+		var err error
+		if dataKey, err = newDataKey(); err != nil {
+			return "", 0, err
+		}
+		if fdef.EncKey, err = WrapDataKey(fdef.Id, dataKey, fh.masterKey); err != nil {
+			return "", 0, err
+		}
+	}
+
 	outfile, err := os.Create(fdef.Location)
 	if err != nil {
 		logs.Warn.Println("Upload: failed to create file", fdef.Location, err)
@@ -86,7 +137,12 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, in
 		return "", 0, err
 	}
 
-	size, err := io.Copy(outfile, file)
+	var size int64
+	if dataKey != nil {
+		size, err = encryptCopy(outfile, file, dataKey)
+	} else {
+		size, err = io.Copy(outfile, file)
+	}
 	outfile.Close()
 	if err != nil {
 		os.Remove(fdef.Location)
@@ -125,7 +181,28 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 		return nil, nil, err
 	}
 
-	return fd, file, nil
+	if fd.EncKey == nil {
+		return fd, file, nil
+	}
+
+	masterKey := fh.masterKeys[WrappedKeyId(fd.EncKey)]
+	if masterKey == nil {
+		file.Close()
+		logs.Warn.Println("Download: file is encrypted with a key which is not configured", fid, WrappedKeyId(fd.EncKey))
+		return nil, nil, types.ErrInternal
+	}
+
+	dataKey, err := UnwrapDataKey(fd.Id, fd.EncKey, masterKey)
+	if err == nil {
+		var reader *decryptingReader
+		if reader, err = newDecryptingReader(file, dataKey); err == nil {
+			return fd, reader, nil
+		}
+	}
+
+	file.Close()
+	logs.Warn.Println("Download: failed to decrypt file", fid, err)
+	return nil, nil, types.ErrInternal
 }
 
 // Delete deletes files from storage by provided slice of locations.
@@ -145,6 +222,19 @@ func (fh *fshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, fh.serveURL)
 }
 
+// UseURLSigner sets signer for download URLs.
+func (fh *fshandler) UseURLSigner(signer *media.URLSigner) {
+	fh.urlSigner = signer
+}
+
+// SignUrl issues a signed URL for downloading the file from the local server.
+func (fh *fshandler) SignUrl(url string, uid types.Uid) (string, time.Time, error) {
+	if fh.urlSigner == nil {
+		return "", time.Time{}, types.ErrUnsupported
+	}
+	return fh.urlSigner.Sign(url, uid, time.Now())
+}
+
 // getFileRecord given file ID reads file record from the database.
 func (fh *fshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
 	fd, err := store.Files.Get(fid.String())
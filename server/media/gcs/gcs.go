@@ -0,0 +1,301 @@
+// Package gcs implements media interface by storing media objects in Google Cloud Storage bucket.
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultServeURL = "/v0/file/s/"
+	handlerName     = "gcs"
+	// Presign GET URLs for this number of seconds by default.
+	defaultPresignDuration = 120
+)
+
+type gcsconfig struct {
+	// Service account key as JSON object.
+	Credentials json.RawMessage `json:"credentials"`
+	// Path to the file with the service account key. Used if Credentials is not set.
+	CredentialsFile string `json:"credentials_file"`
+	// ID of the project where the bucket is created.
+	ProjectID   string   `json:"project_id"`
+	BucketName  string   `json:"bucket"`
+	CorsOrigins []string `json:"cors_origins"`
+	ServeURL    string   `json:"serve_url"`
+	// Lifetime of presigned GET URLs in seconds.
+	PresignTTL int `json:"presign_ttl"`
+	// Address of the GCS emulator, like fake-gcs-server, e.g. "http://localhost:4443".
+	// Credentials are not needed when the emulator is used. Must be blank in production.
+	EmulatorHost string `json:"emulator_host"`
+}
+
+type gcshandler struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+	conf   gcsconfig
+	// Service account email and private key for signing GET URLs.
+	accessID   string
+	privateKey []byte
+	// Base URL of the emulator without the trailing slash. Empty if the emulator is not used.
+	emulatorURL string
+	// Signer of download URLs. Could be nil.
+	urlSigner *media.URLSigner
+}
+
+// Init initializes the media handler.
+func (gh *gcshandler) Init(jsconf string) error {
+	var err error
+	if err = json.Unmarshal([]byte(jsconf), &gh.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if gh.conf.BucketName == "" {
+		return errors.New("missing Bucket")
+	}
+	if gh.conf.ProjectID == "" {
+		return errors.New("missing Project ID")
+	}
+
+	if gh.conf.ServeURL == "" {
+		gh.conf.ServeURL = defaultServeURL
+	}
+
+	if gh.conf.PresignTTL <= 0 {
+		gh.conf.PresignTTL = defaultPresignDuration
+	}
+
+	var opts []option.ClientOption
+	if gh.conf.EmulatorHost != "" {
+		// Emulators do not check credentials and are usually served over plain HTTP.
+		gh.emulatorURL = strings.TrimSuffix(gh.conf.EmulatorHost, "/")
+		if !strings.Contains(gh.emulatorURL, "://") {
+			gh.emulatorURL = "http://" + gh.emulatorURL
+		}
+		opts = append(opts, option.WithEndpoint(gh.emulatorURL+"/storage/v1/"), option.WithoutAuthentication())
+	} else {
+		credentials := []byte(gh.conf.Credentials)
+		if len(credentials) == 0 && gh.conf.CredentialsFile != "" {
+			if credentials, err = os.ReadFile(gh.conf.CredentialsFile); err != nil {
+				return err
+			}
+		}
+		if len(credentials) == 0 {
+			return errors.New("missing credentials")
+		}
+
+		// Service account key is needed for signing URLs.
+		jwtConf, err := google.JWTConfigFromJSON(credentials)
+		if err != nil {
+			return errors.New("invalid service account key: " + err.Error())
+		}
+		gh.accessID = jwtConf.Email
+		gh.privateKey = jwtConf.PrivateKey
+
+		opts = append(opts, option.WithCredentialsJSON(credentials))
+	}
+
+	ctx := context.Background()
+	if gh.client, err = storage.NewClient(ctx, opts...); err != nil {
+		return err
+	}
+	gh.bucket = gh.client.Bucket(gh.conf.BucketName)
+
+	// Check if bucket already exists.
+	_, err = gh.bucket.Attrs(ctx)
+	if err == nil {
+		// Bucket exists
+		return nil
+	}
+
+	if err != storage.ErrBucketNotExist {
+		// Hard error.
+		return err
+	}
+
+	// Bucket does not exist. Create one.
+	// CORS policy is needed to be able to serve media directly from GCS.
+	origins := gh.conf.CorsOrigins
+	if len(origins) == 0 {
+		origins = append(origins, "*")
+	}
+	err = gh.bucket.Create(ctx, gh.conf.ProjectID, &storage.BucketAttrs{
+		CORS: []storage.CORS{{
+			Methods:         []string{http.MethodGet, http.MethodHead},
+			Origins:         origins,
+			ResponseHeaders: []string{"*"},
+		}},
+	})
+	if err != nil {
+		// Check if someone has already created a bucket (possible in a cluster).
+		if _, err2 := gh.bucket.Attrs(ctx); err2 == nil {
+			// Clear benign error
+			err = nil
+		}
+	}
+	return err
+}
+
+// Headers redirects GET, HEAD requests to the GCS server.
+func (gh *gcshandler) Headers(req *http.Request, serve bool) (http.Header, int, error) {
+	if req.Method == http.MethodPut || req.Method == http.MethodPost {
+		return nil, 0, nil
+	}
+
+	if headers, status := media.CORSHandler(req, gh.conf.CorsOrigins, serve); status != 0 {
+		return headers, status, nil
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, 0, nil
+	}
+
+	fid := gh.GetIdFromUrl(req.URL.String())
+	if fid.IsZero() {
+		return nil, 0, types.ErrNotFound
+	}
+
+	fd, err := gh.getFileRecord(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	url, err := gh.downloadURL(fd, req)
+	headers := map[string][]string{
+		"Location":      {url},
+		"Content-Type":  {"application/json; charset=utf-8"},
+		"Cache-Control": {"no-cache, no-store, must-revalidate"},
+	}
+	return headers, http.StatusTemporaryRedirect, err
+}
+
+// downloadURL returns the URL to redirect the download request to.
+func (gh *gcshandler) downloadURL(fd *types.FileDef, req *http.Request) (string, error) {
+	if gh.emulatorURL != "" {
+		// Emulators do not check signatures: serve the object directly.
+		return gh.emulatorURL + "/storage/v1/b/" + url.PathEscape(gh.conf.BucketName) + "/o/" +
+			url.PathEscape(fd.Location) + "?alt=media", nil
+	}
+
+	opts := &storage.SignedURLOptions{
+		GoogleAccessID: gh.accessID,
+		PrivateKey:     gh.privateKey,
+		Method:         req.Method,
+		// Presigned URL will stop working after a short period of time to prevent use of Tinode
+		// as a free file server.
+		Expires: time.Now().Add(time.Second * time.Duration(gh.conf.PresignTTL)),
+		Scheme:  storage.SigningSchemeV4,
+	}
+	if req.Method == http.MethodGet {
+		opts.QueryParameters = url.Values{"response-content-type": {fd.MimeType}}
+		if isAttachment, _ := strconv.ParseBool(req.URL.Query().Get("asatt")); isAttachment {
+			opts.QueryParameters.Set("response-content-disposition", "attachment")
+		}
+	}
+
+	// Return presigned URL.
+	return gh.bucket.SignedURL(fd.Location, opts)
+}
+
+// Upload processes request for a file upload. The file is given as io.Reader.
+func (gh *gcshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, int64, error) {
+	// Using String32 just for consistency with the file handler.
+	key := fdef.Uid().String32()
+	fdef.Location = key
+
+	if err := store.Files.StartUpload(fdef); err != nil {
+		logs.Warn.Println("failed to create file record", fdef.Id, err)
+		return "", 0, err
+	}
+
+	writer := gh.bucket.Object(key).NewWriter(context.Background())
+	writer.ContentType = fdef.MimeType
+	size, err := io.Copy(writer, file)
+	if err != nil {
+		writer.Close()
+		return "", 0, err
+	}
+	// The object is not created until the writer is successfully closed.
+	if err = writer.Close(); err != nil {
+		return "", 0, err
+	}
+
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+
+	return gh.conf.ServeURL + fname, size, nil
+}
+
+// Download processes request for file download.
+// The returned ReadSeekCloser must be closed after use.
+func (gh *gcshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	return nil, nil, types.ErrUnsupported
+}
+
+// Delete deletes files from GCS by provided slice of locations.
+func (gh *gcshandler) Delete(locations []string) error {
+	ctx := context.Background()
+	for _, key := range locations {
+		if err := gh.bucket.Object(key).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			logs.Warn.Println("gcs: error deleting file", key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetIdFromUrl converts an attahment URL to a file UID.
+func (gh *gcshandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, gh.conf.ServeURL)
+}
+
+// UseURLSigner sets signer for download URLs.
+func (gh *gcshandler) UseURLSigner(signer *media.URLSigner) {
+	gh.urlSigner = signer
+}
+
+// SignUrl issues a signed URL for downloading the file. The signed URL points to the Tinode server
+// which redirects it to a short-lived presigned GCS GET URL.
+func (gh *gcshandler) SignUrl(url string, uid types.Uid) (string, time.Time, error) {
+	if gh.urlSigner == nil {
+		return "", time.Time{}, types.ErrUnsupported
+	}
+	return gh.urlSigner.Sign(url, uid, time.Now())
+}
+
+// getFileRecord given file ID reads file record from the database.
+func (gh *gcshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
+	fd, err := store.Files.Get(fid.String())
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, types.ErrNotFound
+	}
+	return fd, nil
+}
+
+func init() {
+	store.RegisterMediaHandler(handlerName, &gcshandler{})
+}
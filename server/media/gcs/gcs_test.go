@@ -0,0 +1,211 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testBucket = "test-bucket"
+
+// fakeGCS implements the small subset of the GCS JSON API used by the handler.
+type fakeGCS struct {
+	lock    sync.Mutex
+	created bool
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	bucketPath := "/storage/v1/b/" + testBucket
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == bucketPath:
+		if !f.created {
+			f.notFound(wrt)
+			return
+		}
+		json.NewEncoder(wrt).Encode(map[string]string{"kind": "storage#bucket", "name": testBucket})
+
+	case req.Method == http.MethodPost && req.URL.Path == "/storage/v1/b":
+		var attrs map[string]any
+		json.NewDecoder(req.Body).Decode(&attrs)
+		if attrs["name"] != testBucket || req.URL.Query().Get("project") == "" {
+			wrt.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.created = true
+		json.NewEncoder(wrt).Encode(attrs)
+
+	case req.Method == http.MethodPost && req.URL.Path == "/upload"+bucketPath+"/o":
+		name, data, err := readMultipartUpload(req)
+		if err != nil {
+			wrt.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[name] = data
+		json.NewEncoder(wrt).Encode(map[string]string{
+			"bucket": testBucket,
+			"name":   name,
+			"size":   strconv.Itoa(len(data)),
+		})
+
+	case strings.HasPrefix(req.URL.Path, bucketPath+"/o/"):
+		name := strings.TrimPrefix(req.URL.Path, bucketPath+"/o/")
+		data, ok := f.objects[name]
+		if !ok {
+			f.notFound(wrt)
+			return
+		}
+		if req.Method == http.MethodDelete {
+			delete(f.objects, name)
+			wrt.WriteHeader(http.StatusNoContent)
+		} else if req.Method == http.MethodGet && req.URL.Query().Get("alt") == "media" {
+			wrt.Write(data)
+		} else {
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	default:
+		f.notFound(wrt)
+	}
+}
+
+func (f *fakeGCS) notFound(wrt http.ResponseWriter) {
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.WriteHeader(http.StatusNotFound)
+	io.WriteString(wrt, `{"error":{"code":404,"message":"Not Found"}}`)
+}
+
+// readMultipartUpload parses the metadata and the content of a multipart upload.
+func readMultipartUpload(req *http.Request) (string, []byte, error) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, err
+	}
+	reader := multipart.NewReader(req.Body, params["boundary"])
+	part, err := reader.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	var meta struct {
+		Name string `json:"name"`
+	}
+	if err = json.NewDecoder(part).Decode(&meta); err != nil {
+		return "", nil, err
+	}
+	if part, err = reader.NextPart(); err != nil {
+		return "", nil, err
+	}
+	data, err := io.ReadAll(part)
+	return meta.Name, data, err
+}
+
+// fakeFiles keeps file records in memory.
+type fakeFiles struct {
+	store.FilePersistenceInterface
+	files map[string]*types.FileDef
+}
+
+func (f *fakeFiles) StartUpload(fd *types.FileDef) error {
+	f.files[fd.Id] = fd
+	return nil
+}
+
+func (f *fakeFiles) Get(fid string) (*types.FileDef, error) {
+	return f.files[fid], nil
+}
+
+func newTestHandler(t *testing.T, emulatorHost string) *gcshandler {
+	gh := &gcshandler{}
+	conf, _ := json.Marshal(map[string]string{
+		"project_id":    "test-project",
+		"bucket":        testBucket,
+		"emulator_host": emulatorHost,
+	})
+	if err := gh.Init(string(conf)); err != nil {
+		t.Fatal(err)
+	}
+	return gh
+}
+
+func TestInit(t *testing.T) {
+	fake := &fakeGCS{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	// Credentials are not needed for the emulator. The bucket is created.
+	newTestHandler(t, srv.URL)
+	if !fake.created {
+		t.Fatal("bucket not created")
+	}
+	// Existing bucket is used, the scheme of the emulator address is optional.
+	newTestHandler(t, strings.TrimPrefix(srv.URL, "http://"))
+
+	// Credentials are required without the emulator.
+	if err := (&gcshandler{}).Init(`{"project_id":"test-project","bucket":"test-bucket"}`); err == nil {
+		t.Error("missing credentials not detected")
+	}
+}
+
+func TestUploadDownloadDelete(t *testing.T) {
+	fake := &fakeGCS{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	files := &fakeFiles{files: make(map[string]*types.FileDef)}
+	saved := store.Files
+	store.Files = files
+	defer func() { store.Files = saved }()
+
+	gh := newTestHandler(t, srv.URL)
+
+	content := []byte("hello, world")
+	fdef := &types.FileDef{MimeType: "text/plain"}
+	fdef.Id = types.Uid(12345).String()
+	url, size, err := gh.Upload(fdef, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) || !strings.HasPrefix(url, defaultServeURL+fdef.Id) {
+		t.Errorf("unexpected upload result '%s' %d", url, size)
+	}
+	if !bytes.Equal(fake.objects[fdef.Location], content) {
+		t.Fatal("object not stored")
+	}
+
+	// Download is redirected to the emulator.
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	headers, status, err := gh.Headers(req, true)
+	if err != nil || status != http.StatusTemporaryRedirect {
+		t.Fatalf("unexpected redirect %d %v", status, err)
+	}
+	resp, err := http.Get(headers.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(data, content) {
+		t.Errorf("unexpected download '%s'", data)
+	}
+
+	if err = gh.Delete([]string{fdef.Location, "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Error("object not deleted")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/tinode/chat/server/store/types"
 )
@@ -39,6 +40,14 @@ type Handler interface {
 
 	// GetIdFromUrl extracts file ID from download URL.
 	GetIdFromUrl(url string) types.Uid
+
+	// UseURLSigner sets the signer used for issuing and verifying signed download URLs.
+	// Nil signer disables signed URLs.
+	UseURLSigner(signer *URLSigner)
+
+	// SignUrl issues a time-limited download URL for the file at url to the user uid.
+	// Returns the URL and its expiration time.
+	SignUrl(url string, uid types.Uid) (string, time.Time, error)
 }
 
 var fileNamePattern = regexp.MustCompile(`^[-_A-Za-z0-9]+`)
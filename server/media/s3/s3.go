@@ -28,8 +28,8 @@ import (
 const (
 	defaultServeURL = "/v0/file/s/"
 	handlerName     = "s3"
-	// Presign GET URLs for this number of seconds.
-	presignDuration = 120
+	// Presign GET URLs for this number of seconds by default.
+	defaultPresignDuration = 120
 )
 
 type awsconfig struct {
@@ -42,11 +42,15 @@ type awsconfig struct {
 	BucketName      string   `json:"bucket"`
 	CorsOrigins     []string `json:"cors_origins"`
 	ServeURL        string   `json:"serve_url"`
+	// Lifetime of presigned GET URLs in seconds.
+	PresignTTL int `json:"presign_ttl"`
 }
 
 type awshandler struct {
 	svc  *s3.S3
 	conf awsconfig
+	// Signer of download URLs. Could be nil.
+	urlSigner *media.URLSigner
 }
 
 // readerCounter is a byte counter for bytes read through the io.Reader
@@ -87,6 +91,10 @@ func (ah *awshandler) Init(jsconf string) error {
 		ah.conf.ServeURL = defaultServeURL
 	}
 
+	if ah.conf.PresignTTL <= 0 {
+		ah.conf.PresignTTL = defaultPresignDuration
+	}
+
 	var sess *session.Session
 	if sess, err = session.NewSession(&aws.Config{
 		Region:           aws.String(ah.conf.Region),
@@ -193,7 +201,7 @@ func (ah *awshandler) Headers(req *http.Request, serve bool) (http.Header, int,
 	if awsReq != nil {
 		// Return presigned URL. The URL will stop working after a short period of time to prevent use of Tinode
 		// as a free file server.
-		url, err := awsReq.Presign(time.Second * presignDuration)
+		url, err := awsReq.Presign(time.Second * time.Duration(ah.conf.PresignTTL))
 		headers := map[string][]string{
 			"Location":      {url},
 			"Content-Type":  {"application/json; charset=utf-8"},
@@ -266,6 +274,20 @@ func (ah *awshandler) GetIdFromUrl(url string) types.Uid {
 	return media.GetIdFromUrl(url, ah.conf.ServeURL)
 }
 
+// UseURLSigner sets signer for download URLs.
+func (ah *awshandler) UseURLSigner(signer *media.URLSigner) {
+	ah.urlSigner = signer
+}
+
+// SignUrl issues a signed URL for downloading the file. The signed URL points to the Tinode server
+// which redirects it to a short-lived presigned S3 GET URL.
+func (ah *awshandler) SignUrl(url string, uid types.Uid) (string, time.Time, error) {
+	if ah.urlSigner == nil {
+		return "", time.Time{}, types.ErrUnsupported
+	}
+	return ah.urlSigner.Sign(url, uid, time.Now())
+}
+
 // getFileRecord given file ID reads file record from the database.
 func (ah *awshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
 	fd, err := store.Files.Get(fid.String())
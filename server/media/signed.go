@@ -0,0 +1,132 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Query parameters of a signed download URL.
+	signedParamUid     = "uid"
+	signedParamExpires = "exp"
+	signedParamSig     = "sig"
+
+	// Minimum acceptable length of the signing key.
+	minSigningKeyLength = 32
+)
+
+// URLSigner issues and verifies HMAC-signed time-limited download URLs. Signed URLs permit
+// downloading of one specific file by anyone who holds the URL until the URL expires. They
+// are used instead of passing long-lived credentials in URL query strings.
+type URLSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewURLSigner creates a new URL signer with the given HMAC key and the lifetime of issued URLs.
+func NewURLSigner(key []byte, ttl time.Duration) (*URLSigner, error) {
+	if len(key) < minSigningKeyLength {
+		return nil, errors.New("URL signing key is too short")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("invalid URL signature TTL")
+	}
+	return &URLSigner{key: key, ttl: ttl}, nil
+}
+
+// TTL returns the lifetime of signed URLs.
+func (us *URLSigner) TTL() time.Duration {
+	return us.ttl
+}
+
+// Sign issues a signed URL for downloading the file at fileUrl by the user uid. The fileUrl
+// may be either absolute or relative, only the path part of the URL is signed.
+// Returns the signed URL and its expiration time.
+func (us *URLSigner) Sign(fileUrl string, uid types.Uid, now time.Time) (string, time.Time, error) {
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return "", time.Time{}, types.ErrMalformed
+	}
+
+	expires := now.Add(us.ttl).Round(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	query := u.Query()
+	// Drop existing signature, if any, and all credentials.
+	for _, param := range []string{signedParamUid, signedParamExpires, signedParamSig, "apikey", "auth", "secret", "sid"} {
+		query.Del(param)
+	}
+	query.Set(signedParamUid, uid.UserId())
+	query.Set(signedParamExpires, exp)
+	query.Set(signedParamSig, us.signature(u.Path, uid.UserId(), exp))
+	u.RawQuery = query.Encode()
+
+	return u.String(), expires, nil
+}
+
+// Verify checks signature and expiration time of the signed URL. Returns ID of the user
+// the URL was issued to.
+func (us *URLSigner) Verify(fileUrl string, now time.Time) (types.Uid, error) {
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return types.ZeroUid, types.ErrMalformed
+	}
+
+	query := u.Query()
+	user := query.Get(signedParamUid)
+	exp := query.Get(signedParamExpires)
+	sig := query.Get(signedParamSig)
+	if user == "" || exp == "" || sig == "" {
+		return types.ZeroUid, types.ErrMalformed
+	}
+
+	uid := types.ParseUserId(user)
+	if uid.IsZero() {
+		return types.ZeroUid, types.ErrMalformed
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return types.ZeroUid, types.ErrMalformed
+	}
+
+	// Check signature before expiration to avoid leaking information about tampered URLs.
+	if !hmac.Equal([]byte(sig), []byte(us.signature(u.Path, user, exp))) {
+		return types.ZeroUid, types.ErrPermissionDenied
+	}
+
+	if now.Unix() > expires {
+		return types.ZeroUid, types.ErrExpired
+	}
+
+	return uid, nil
+}
+
+// signature calculates URL-safe base64-encoded HMAC-SHA256 of the URL path, user ID and
+// the expiration time.
+func (us *URLSigner) signature(urlPath, user, exp string) string {
+	hasher := hmac.New(sha256.New, us.key)
+	hasher.Write([]byte(path.Clean(urlPath)))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(user))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(exp))
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// IsSignedURL checks if the URL carries a signature. It does not check validity of the signature.
+func IsSignedURL(fileUrl string) bool {
+	u, err := url.Parse(fileUrl)
+	if err != nil {
+		return false
+	}
+	return u.Query().Get(signedParamSig) != ""
+}
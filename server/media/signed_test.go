@@ -0,0 +1,85 @@
+package media
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+var testSigningKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestURLSigner(t *testing.T) {
+	signer, err := NewURLSigner(testSigningKey, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid := types.Uid(12345)
+	now := time.Now()
+	signed, expires, err := signer.Sign("/v0/file/s/abcdefg.jpeg?asatt=true&apikey=AQEAAAABAAD_rAp4DJh05a1HAwFT3A6K", uid, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expires.After(now) {
+		t.Error("Expiration time must be in the future", expires)
+	}
+	if !IsSignedURL(signed) {
+		t.Error("URL must be signed", signed)
+	}
+	if strings.Contains(signed, "apikey") {
+		t.Error("Credentials must be removed from signed URL", signed)
+	}
+
+	got, err := signer.Verify(signed, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != uid {
+		t.Errorf("Uid mismatch: expected %s, got %s", uid.UserId(), got.UserId())
+	}
+
+	// Expired URL.
+	if _, err = signer.Verify(signed, now.Add(2*time.Minute)); err != types.ErrExpired {
+		t.Error("Expected ErrExpired, got", err)
+	}
+
+	// Tampered path.
+	if _, err = signer.Verify(strings.Replace(signed, "abcdefg", "gfedcba", 1), now); err != types.ErrPermissionDenied {
+		t.Error("Expected ErrPermissionDenied for tampered path, got", err)
+	}
+
+	// Tampered user.
+	u, _ := url.Parse(signed)
+	query := u.Query()
+	query.Set(signedParamUid, types.Uid(54321).UserId())
+	u.RawQuery = query.Encode()
+	if _, err = signer.Verify(u.String(), now); err != types.ErrPermissionDenied {
+		t.Error("Expected ErrPermissionDenied for tampered user, got", err)
+	}
+
+	// Signature issued with a different key.
+	other, _ := NewURLSigner([]byte("fedcba9876543210fedcba9876543210"), time.Minute)
+	if _, err = other.Verify(signed, now); err != types.ErrPermissionDenied {
+		t.Error("Expected ErrPermissionDenied for foreign key, got", err)
+	}
+
+	// Unsigned URL.
+	if IsSignedURL("/v0/file/s/abcdefg.jpeg") {
+		t.Error("URL must not be reported as signed")
+	}
+	if _, err = signer.Verify("/v0/file/s/abcdefg.jpeg", now); err != types.ErrMalformed {
+		t.Error("Expected ErrMalformed for unsigned URL, got", err)
+	}
+}
+
+func TestNewURLSignerInvalid(t *testing.T) {
+	if _, err := NewURLSigner([]byte("short"), time.Minute); err == nil {
+		t.Error("Short key must be rejected")
+	}
+	if _, err := NewURLSigner(testSigningKey, 0); err == nil {
+		t.Error("Zero TTL must be rejected")
+	}
+}
@@ -0,0 +1,397 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Built-in moderation of published messages: word lists and regular
+ *  expressions applied per topic and language with reject, mask or flag
+ *  actions. Flagged messages are kept in a queue for review by topic owners.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// Moderation actions.
+	modActionMask = 1 << iota
+	modActionFlag
+	modActionReject
+)
+
+const (
+	// Default maximum number of flagged messages returned to the client.
+	defaultModerationQueueLimit = 100
+	// Default time to keep flagged messages in the queue.
+	defaultModerationQueueTTL = 30 * 24 * time.Hour
+	// Maximum length of the text of a flagged message in characters.
+	moderationPreviewLength = 256
+	// Prefix of persistent cache keys of flagged messages: "modq:<topic>:<seq>".
+	moderationQueuePrefix = "modq:"
+)
+
+// Single moderation rule.
+type moderationRule struct {
+	name   string
+	action int
+	// Lowercase words to look for.
+	words    map[string]bool
+	patterns []*regexp.Regexp
+	// Topics the rule applies to. All topics if both are empty.
+	topics        map[string]bool
+	topicPrefixes []string
+	// Primary language subtags the rule applies to. All languages if empty.
+	languages map[string]bool
+}
+
+type moderator struct {
+	rules      []*moderationRule
+	mask       rune
+	queueLimit int
+	queueTTL   time.Duration
+}
+
+// Outcome of checking the message.
+type moderationResult struct {
+	// Bit mask of actions of matched rules.
+	action int
+	// Names of matched rules.
+	rules []string
+}
+
+// newModerator validates the config and loads word lists.
+func newModerator(conf *moderationConfig) (*moderator, error) {
+	m := &moderator{
+		mask:       '*',
+		queueLimit: defaultModerationQueueLimit,
+		queueTTL:   defaultModerationQueueTTL,
+	}
+	if conf.MaskChar != "" {
+		m.mask, _ = utf8.DecodeRuneInString(conf.MaskChar)
+	}
+	if conf.QueueLimit > 0 {
+		m.queueLimit = conf.QueueLimit
+	}
+	if conf.QueueTTL > 0 {
+		m.queueTTL = time.Duration(conf.QueueTTL) * time.Second
+	}
+
+	for i := range conf.Rules {
+		rule, err := newModerationRule(&conf.Rules[i])
+		if err != nil {
+			return nil, fmt.Errorf("rule %d '%s': %w", i, conf.Rules[i].Name, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if len(m.rules) == 0 {
+		return nil, errors.New("no rules defined")
+	}
+
+	statsRegisterInt("ModerationRejected")
+	statsRegisterInt("ModerationMasked")
+	statsRegisterInt("ModerationFlagged")
+
+	return m, nil
+}
+
+func newModerationRule(conf *moderationRuleConfig) (*moderationRule, error) {
+	rule := &moderationRule{name: conf.Name, words: make(map[string]bool)}
+	if rule.name == "" {
+		return nil, errors.New("missing name")
+	}
+
+	switch conf.Action {
+	case "mask":
+		rule.action = modActionMask
+	case "flag":
+		rule.action = modActionFlag
+	case "reject":
+		rule.action = modActionReject
+	default:
+		return nil, errors.New("unknown action '" + conf.Action + "'")
+	}
+
+	for _, word := range conf.Words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			rule.words[word] = true
+		}
+	}
+	if conf.WordsFile != "" {
+		// One word per line. Lines starting with '#' are comments.
+		file, err := os.Open(conf.WordsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if word := strings.ToLower(strings.TrimSpace(scanner.Text())); word != "" && word[0] != '#' {
+				rule.words[word] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, expr := range conf.Patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		rule.patterns = append(rule.patterns, re)
+	}
+	if len(rule.words) == 0 && len(rule.patterns) == 0 {
+		return nil, errors.New("no words or patterns")
+	}
+
+	for _, topic := range conf.Topics {
+		// "grp*" matches all topics which start with "grp".
+		if prefix := strings.TrimSuffix(topic, "*"); prefix != topic {
+			rule.topicPrefixes = append(rule.topicPrefixes, prefix)
+		} else {
+			if rule.topics == nil {
+				rule.topics = make(map[string]bool)
+			}
+			rule.topics[topic] = true
+		}
+	}
+
+	for _, lang := range conf.Languages {
+		if rule.languages == nil {
+			rule.languages = make(map[string]bool)
+		}
+		rule.languages[primaryLanguage(lang)] = true
+	}
+
+	return rule, nil
+}
+
+// primaryLanguage returns lowercase primary subtag of the language tag: "en-US" -> "en".
+func primaryLanguage(lang string) string {
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	return strings.ToLower(lang)
+}
+
+// appliesTo checks if the rule should be applied to messages in the given topic and language.
+func (r *moderationRule) appliesTo(topic, lang string) bool {
+	if r.languages != nil && !r.languages[primaryLanguage(lang)] {
+		return false
+	}
+	if r.topics == nil && r.topicPrefixes == nil {
+		return true
+	}
+	if r.topics[topic] {
+		return true
+	}
+	for _, prefix := range r.topicPrefixes {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns byte ranges [start, end) of the text matched by the rule.
+func (r *moderationRule) find(text string) [][]int {
+	var found [][]int
+	if len(r.words) > 0 {
+		// Split text into words: sequences of letters and digits.
+		start := -1
+		for i, ch := range text + " " {
+			if unicode.IsLetter(ch) || unicode.IsDigit(ch) {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start >= 0 {
+				if r.words[strings.ToLower(text[start:i])] {
+					found = append(found, []int{start, i})
+				}
+				start = -1
+			}
+		}
+	}
+	for _, re := range r.patterns {
+		found = append(found, re.FindAllStringIndex(text, -1)...)
+	}
+	return found
+}
+
+// check applies moderation rules to the content of the message published to the topic by a user
+// with the given language. Returns content, possibly with masked text, and the outcome of the check
+// or nil if no rules matched.
+func (m *moderator) check(topic, lang string, content any) (any, *moderationResult) {
+	text, err := drafty.PlainText(content)
+	if err != nil || text == "" {
+		// Not a text message.
+		return content, nil
+	}
+
+	var result *moderationResult
+	for _, rule := range m.rules {
+		if !rule.appliesTo(topic, lang) || len(rule.find(text)) == 0 {
+			continue
+		}
+		if result == nil {
+			result = &moderationResult{}
+		}
+		result.action |= rule.action
+		result.rules = append(result.rules, rule.name)
+	}
+
+	if result == nil {
+		return content, nil
+	}
+
+	if result.action&modActionReject != 0 {
+		statsInc("ModerationRejected", 1)
+		return content, result
+	}
+	if result.action&modActionMask != 0 {
+		content = m.maskContent(topic, lang, content)
+		statsInc("ModerationMasked", 1)
+	}
+	if result.action&modActionFlag != 0 {
+		statsInc("ModerationFlagged", 1)
+	}
+	return content, result
+}
+
+// maskContent masks text of a plain text or Drafty message matched by masking rules.
+func (m *moderator) maskContent(topic, lang string, content any) any {
+	switch val := content.(type) {
+	case string:
+		return m.maskText(topic, lang, val)
+	case map[string]any:
+		if txt, ok := val["txt"].(string); ok {
+			// Don't modify the original: it may be referenced elsewhere.
+			masked := make(map[string]any, len(val))
+			for k, v := range val {
+				masked[k] = v
+			}
+			// Characters are masked one by one, so Drafty formatting offsets remain valid.
+			masked["txt"] = m.maskText(topic, lang, txt)
+			return masked
+		}
+	}
+	return content
+}
+
+// maskText replaces every character matched by masking rules with the mask character.
+func (m *moderator) maskText(topic, lang, text string) string {
+	var masked []bool
+	for _, rule := range m.rules {
+		if rule.action != modActionMask || !rule.appliesTo(topic, lang) {
+			continue
+		}
+		for _, span := range rule.find(text) {
+			if masked == nil {
+				masked = make([]bool, len(text))
+			}
+			for i := span[0]; i < span[1]; i++ {
+				masked[i] = true
+			}
+		}
+	}
+	if masked == nil {
+		return text
+	}
+
+	var sb strings.Builder
+	for i, ch := range text {
+		if masked[i] && !unicode.IsSpace(ch) {
+			sb.WriteRune(m.mask)
+		} else {
+			sb.WriteRune(ch)
+		}
+	}
+	return sb.String()
+}
+
+// moderationQueueKey generates a persistent cache key for the flagged message.
+func moderationQueueKey(topic string, seq int) string {
+	// Zero-padded seq ID so the keys are sorted in the order of messages.
+	return fmt.Sprintf("%s%s:%010d", moderationQueuePrefix, topic, seq)
+}
+
+// enqueue adds the flagged message to the moderation queue of the topic.
+func (m *moderator) enqueue(topic string, item *MsgModItem) {
+	if runes := []rune(item.Text); len(runes) > moderationPreviewLength {
+		item.Text = string(runes[:moderationPreviewLength])
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		logs.Warn.Println("moderation: failed to serialize flagged message", topic, err)
+		return
+	}
+	if err := store.PCache.Upsert(moderationQueueKey(topic, item.SeqId), string(data), true); err != nil {
+		logs.Warn.Println("moderation: failed to save flagged message", topic, err)
+	}
+}
+
+// queue returns up to queueLimit oldest messages flagged in the topic sorted by seq ID.
+// The cache lists entries in the order they were added, so the limit keeps the oldest ones.
+func (m *moderator) queue(topic string) ([]MsgModItem, error) {
+	prefix := moderationQueuePrefix + topic + ":"
+	entries, err := store.PCache.List(prefix, m.queueLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MsgModItem, 0, len(entries))
+	for _, kv := range entries {
+		var item MsgModItem
+		if err := json.Unmarshal([]byte(kv.Value), &item); err != nil {
+			logs.Warn.Println("moderation: invalid queue entry", kv.Key, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].SeqId < items[j].SeqId })
+	return items, nil
+}
+
+// run periodically removes expired messages from moderation queues.
+func (m *moderator) run(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the cleanup must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.PCache.Expire(moderationQueuePrefix, time.Now().Add(-m.queueTTL)); err != nil {
+					logs.Warn.Println("moderation: failed to expire flagged messages", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
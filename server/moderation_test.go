@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestModeratorCheck(t *testing.T) {
+	m, err := newModerator(&moderationConfig{
+		MaskChar: "#",
+		Rules: []moderationRuleConfig{
+			{Name: "swear", Action: "mask", Words: []string{"Darn", "heck"}, Languages: []string{"en"}},
+			{Name: "links", Action: "flag", Patterns: []string{`https?://\S+`}, Topics: []string{"grp*"}},
+			{Name: "spam", Action: "reject", Words: []string{"casino"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, res := m.check("grpAbC", "en-US", "Darn it, what the HECK")
+	if res == nil || res.action != modActionMask || content != "#### it, what the ####" {
+		t.Errorf("expected masked text, got '%v' %+v", content, res)
+	}
+
+	// Language does not match.
+	if content, res = m.check("grpAbC", "fr", "darn"); res != nil || content != "darn" {
+		t.Errorf("rule must not apply to other languages, got '%v' %+v", content, res)
+	}
+
+	// Partial words are not matched.
+	if _, res = m.check("grpAbC", "en", "darning socks"); res != nil {
+		t.Errorf("partial word must not match, got %+v", res)
+	}
+
+	drafty := map[string]any{
+		"txt": "see http://example.com darn",
+		"fmt": []any{map[string]any{"at": 4, "len": 18}},
+	}
+	content, res = m.check("grpAbC", "en", drafty)
+	if res == nil || res.action != modActionMask|modActionFlag || len(res.rules) != 2 {
+		t.Fatalf("expected mask and flag, got %+v", res)
+	}
+	if txt := content.(map[string]any)["txt"]; txt != "see http://example.com ####" {
+		t.Errorf("expected masked Drafty text, got '%v'", txt)
+	}
+	if drafty["txt"] != "see http://example.com darn" {
+		t.Error("original content must not be modified")
+	}
+
+	// Topic does not match.
+	if _, res = m.check("usrAbC", "en", "http://example.com"); res != nil {
+		t.Errorf("rule must not apply to other topics, got %+v", res)
+	}
+
+	if content, res = m.check("usrAbC", "en", "Darn CASINO"); res == nil || res.action&modActionReject == 0 ||
+		content != "Darn CASINO" {
+		t.Errorf("expected rejection of unmodified content, got '%v' %+v", content, res)
+	}
+
+	// Not a text message.
+	if _, res = m.check("grpAbC", "en", 12345); res != nil {
+		t.Errorf("non-text content must pass, got %+v", res)
+	}
+}
+
+func TestModeratorConfigErrors(t *testing.T) {
+	for _, rule := range []moderationRuleConfig{
+		{Action: "mask", Words: []string{"darn"}},
+		{Name: "bad action", Action: "ban", Words: []string{"darn"}},
+		{Name: "empty", Action: "flag"},
+		{Name: "bad pattern", Action: "flag", Patterns: []string{"("}},
+		{Name: "missing file", Action: "flag", WordsFile: "/nonexistent/words.txt"},
+	} {
+		if _, err := newModerator(&moderationConfig{Rules: []moderationRuleConfig{rule}}); err == nil {
+			t.Errorf("rule '%s': expected error", rule.Name)
+		}
+	}
+	if _, err := newModerator(&moderationConfig{}); err == nil {
+		t.Error("expected error when no rules are defined")
+	}
+}
+
+// setUpModerationTest creates a group topic with the given moderation rules and a mock persistent cache.
+func setUpModerationTest(t *testing.T, rules ...moderationRuleConfig) (*TopicTestHelper, *mock_store.MockPersistentCacheInterface) {
+	helper := &TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, "grpModTest", true)
+
+	// Not using newModerator: it registers stats variables which can be registered only once.
+	m := &moderator{mask: '*', queueLimit: defaultModerationQueueLimit, queueTTL: defaultModerationQueueTTL}
+	for i := range rules {
+		rule, err := newModerationRule(&rules[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	globals.moderator = m
+	pc := mock_store.NewMockPersistentCacheInterface(helper.ctrl)
+	store.PCache = pc
+
+	t.Cleanup(func() {
+		globals.moderator = nil
+		store.PCache = nil
+		helper.tearDown()
+	})
+	return helper, pc
+}
+
+func modPubMessage(helper *TopicTestHelper, sess *Session, content string) *ClientComMessage {
+	return &ClientComMessage{
+		Id:       "1",
+		AsUser:   helper.uids[0].UserId(),
+		Original: helper.topic.name,
+		RcptTo:   helper.topic.name,
+		Pub:      &MsgClientPub{Topic: helper.topic.name, Content: content},
+		sess:     sess,
+	}
+}
+
+func TestModerationRejectedMessage(t *testing.T) {
+	helper, _ := setUpModerationTest(t, moderationRuleConfig{Name: "spam", Action: "reject", Words: []string{"casino"}})
+	// No calls to store.Messages.Save are expected.
+
+	err := helper.topic.saveAndBroadcastMessage(modPubMessage(helper, helper.sessions[0], "Visit our casino"),
+		helper.uids[0], false, nil, nil, "Visit our casino")
+	if err != types.ErrPolicy {
+		t.Error("expected ErrPolicy, got", err)
+	}
+	// Messages without a session are moderated too.
+	err = helper.topic.saveAndBroadcastMessage(modPubMessage(helper, nil, "casino"),
+		helper.uids[0], false, nil, nil, "casino")
+	if err != types.ErrPolicy {
+		t.Error("server message: expected ErrPolicy, got", err)
+	}
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Error("rejected message must not be saved, lastID", helper.topic.lastID)
+	}
+	if msgs := helper.results[0].messages; len(msgs) != 1 ||
+		msgs[0].(*ServerComMessage).Ctrl == nil || msgs[0].(*ServerComMessage).Ctrl.Code != http.StatusUnprocessableEntity {
+		t.Error("sender expected to receive 422, got", msgs)
+	}
+	if len(helper.results[1].messages) != 0 {
+		t.Error("rejected message must not be broadcast")
+	}
+}
+
+func TestModerationFlaggedMessage(t *testing.T) {
+	helper, pc := setUpModerationTest(t, moderationRuleConfig{Name: "links", Action: "flag", Patterns: []string{`https?://\S+`}})
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	pc.EXPECT().Upsert(moderationQueueKey(helper.topic.name, 1), gomock.Any(), true).DoAndReturn(
+		func(key, value string, failOnDuplicate bool) error {
+			var item MsgModItem
+			if err := json.Unmarshal([]byte(value), &item); err != nil {
+				t.Fatal(err)
+			}
+			if item.SeqId != 1 || item.From != helper.uids[0].UserId() || len(item.Rules) != 1 || item.Rules[0] != "links" {
+				t.Errorf("unexpected queue item %+v", item)
+			}
+			return nil
+		})
+
+	err := helper.topic.saveAndBroadcastMessage(modPubMessage(helper, nil, "see http://example.com"),
+		helper.uids[0], false, nil, nil, "see http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.finish()
+
+	if helper.topic.lastID != 1 {
+		t.Error("flagged message must be saved, lastID", helper.topic.lastID)
+	}
+	if len(helper.results[1].messages) != 1 {
+		t.Error("flagged message must be broadcast")
+	}
+}
+
+func TestModerationGetMod(t *testing.T) {
+	helper, pc := setUpModerationTest(t, moderationRuleConfig{Name: "links", Action: "flag", Patterns: []string{`https?://\S+`}})
+	owner, member := helper.uids[0], helper.uids[1]
+	// Only the owner has the O permission.
+	pud := helper.topic.perUser[member]
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[member] = pud
+
+	item, _ := json.Marshal(&MsgModItem{SeqId: 3, From: member.UserId(), Rules: []string{"links"}})
+	pc.EXPECT().List(moderationQueuePrefix+helper.topic.name+":", defaultModerationQueueLimit).
+		Return([]types.KeyValue{{Key: moderationQueueKey(helper.topic.name, 3), Value: string(item)}}, nil).Times(2)
+
+	get := &ClientComMessage{Id: "1", Original: helper.topic.name, Get: &MsgClientGet{Topic: helper.topic.name}}
+	if err := helper.topic.replyGetMod(helper.sessions[1], member, auth.LevelAuth, get); err != types.ErrPermissionDenied {
+		t.Error("member: expected ErrPermissionDenied, got", err)
+	}
+	if err := helper.topic.replyGetMod(helper.sessions[0], owner, auth.LevelAuth, get); err != nil {
+		t.Error("owner:", err)
+	}
+	if err := helper.topic.replyGetMod(helper.sessions[1], member, auth.LevelRoot, get); err != nil {
+		t.Error("root:", err)
+	}
+	helper.finish()
+
+	if msgs := helper.results[0].messages; len(msgs) != 1 || msgs[0].(*ServerComMessage).Meta == nil ||
+		len(msgs[0].(*ServerComMessage).Meta.Mod) != 1 || msgs[0].(*ServerComMessage).Meta.Mod[0].SeqId != 3 {
+		t.Error("owner expected to receive the queue, got", msgs)
+	}
+	msgs := helper.results[1].messages
+	if len(msgs) != 2 || msgs[0].(*ServerComMessage).Ctrl == nil || msgs[0].(*ServerComMessage).Ctrl.Code != http.StatusForbidden {
+		t.Fatal("member expected to receive 403, got", msgs)
+	}
+	if msgs[1].(*ServerComMessage).Meta == nil || len(msgs[1].(*ServerComMessage).Meta.Mod) != 1 {
+		t.Error("root expected to receive the queue, got", msgs[1])
+	}
+}
@@ -162,7 +162,7 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			DeletedAt: int64ToTime(data.GetDeletedAt()),
 			SeqId:     int(data.GetSeqId()),
 			Head:      byteMapToInterfaceMap(data.GetHead()),
-			Content:   data.GetContent(),
+			Content:   bytesToInterface(data.GetContent()),
 		}
 	} else if pres := pkt.GetPres(); pres != nil {
 		var what string
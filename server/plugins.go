@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store/types"
 	"google.golang.org/grpc"
@@ -57,6 +58,12 @@ const (
 	plgFilterByTopicType = 1 << iota
 	plgFilterByPacket
 	plgFilterByAction
+	plgFilterByTopicName
+	plgFilterByUser
+	plgFilterByTag
+	plgFilterByAuthLevel
+	plgFilterByHead
+	plgFilterByServerPacket
 )
 
 var (
@@ -66,6 +73,15 @@ var (
 	}
 
 	plgTopicCatNames = []string{"me", "fnd", "p2p", "grp", "sys", "new"}
+
+	// Names of qualified filter parts "name:value1,value2" and what they filter by.
+	plgQualifierNames = map[string]int{
+		"topic": plgFilterByTopicName,
+		"user":  plgFilterByUser,
+		"tag":   plgFilterByTag,
+		"auth":  plgFilterByAuthLevel,
+		"head":  plgFilterByHead,
+	}
 )
 
 // PluginFilter is a enum which defines filtering types.
@@ -73,6 +89,19 @@ type PluginFilter struct {
 	byPacket    int
 	byTopicType int
 	byAction    int
+
+	// Exact topic names.
+	topics map[string]bool
+	// Topic name prefixes.
+	topicPrefixes []string
+	// User IDs, like "usrAbC123".
+	users map[string]bool
+	// User tags.
+	tags map[string]bool
+	// Bit mask of accepted auth levels: 1 << (level / 10).
+	byAuthLevel int
+	// Keys of message head.
+	headKeys []string
 }
 
 // ParsePluginFilter parses filter config string.
@@ -153,7 +182,76 @@ func ParsePluginFilter(s *string, filterBy int) (*PluginFilter, error) {
 	}
 
 	filter := PluginFilter{}
-	parts := strings.Split(*s, ";")
+	var parts []string
+	// Parse qualified parts like "topic:grpAbC,grpXyZ" and keep the rest for parsing by content.
+	for _, part := range strings.Split(*s, ";") {
+		name, list, found := strings.Cut(part, ":")
+		if !found {
+			parts = append(parts, part)
+			continue
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		what, known := plgQualifierNames[name]
+		if !known {
+			return nil, errors.New("plugin: unknown filter " + name)
+		}
+		if filterBy&what == 0 {
+			return nil, errors.New("plugin: filter by " + name + " is not supported here")
+		}
+
+		var values []string
+		for _, val := range strings.Split(list, ",") {
+			if val = strings.TrimSpace(val); val != "" {
+				values = append(values, val)
+			}
+		}
+		if len(values) == 0 {
+			return nil, errors.New("plugin: empty filter " + name)
+		}
+
+		switch what {
+		case plgFilterByTopicName:
+			if filter.topics == nil {
+				filter.topics = make(map[string]bool)
+			}
+			for _, val := range values {
+				// "grpBot*" matches all topics which start with "grpBot".
+				if prefix := strings.TrimSuffix(val, "*"); prefix != val {
+					filter.topicPrefixes = append(filter.topicPrefixes, prefix)
+				} else {
+					filter.topics[val] = true
+				}
+			}
+		case plgFilterByUser:
+			if filter.users == nil {
+				filter.users = make(map[string]bool)
+			}
+			for _, val := range values {
+				if types.ParseUserId(val).IsZero() {
+					return nil, errors.New("plugin: invalid user ID in filter " + val)
+				}
+				filter.users[val] = true
+			}
+		case plgFilterByTag:
+			if filter.tags == nil {
+				filter.tags = make(map[string]bool)
+			}
+			for _, val := range values {
+				filter.tags[strings.ToLower(val)] = true
+			}
+		case plgFilterByAuthLevel:
+			for _, val := range values {
+				var lvl auth.Level
+				if err := lvl.UnmarshalText([]byte(val)); err != nil || lvl == auth.LevelNone {
+					return nil, errors.New("plugin: invalid auth level in filter " + val)
+				}
+				filter.byAuthLevel |= 1 << uint(lvl/10)
+			}
+		case plgFilterByHead:
+			filter.headKeys = append(filter.headKeys, values...)
+		}
+	}
 	var err error
 
 	if filterBy&plgFilterByPacket != 0 {
@@ -162,6 +260,15 @@ func ParsePluginFilter(s *string, filterBy int) (*PluginFilter, error) {
 		}
 	}
 
+	if filterBy&plgFilterByServerPacket != 0 {
+		if filter.byPacket, err = parseByName(parts, plgPacketNames, plgServerMask); err != nil {
+			return nil, err
+		}
+		if filter.byPacket&^plgServerMask != 0 {
+			return nil, errors.New("plugin: only server packets can be filtered")
+		}
+	}
+
 	if filterBy&plgFilterByTopicType != 0 {
 		if filter.byTopicType, err = parseByName(parts, plgTopicCatNames, plgTopicCatMask); err != nil {
 			return nil, err
@@ -176,21 +283,33 @@ func ParsePluginFilter(s *string, filterBy int) (*PluginFilter, error) {
 }
 
 // PluginRPCFilterConfig filters for an individual RPC call. Filter strings are formatted as follows:
-// <comma separated list of packet names> ; <comma separated list of topics or topic types> ; <actions (combination of C U D)>
+// <comma separated list of packet names> ; <comma separated list of topic types> ; <actions (combination of C U D)>
+// followed by optional qualified parts <name>:<comma separated list of values>:
+//   - topic:grpAbC,grpBot* - exact topic names; a name ending with '*' is a prefix;
+//   - user:usrAbC,usrXyZ - user IDs;
+//   - tag:email:alice@example.com,bot - user tags;
+//   - auth:auth,root - auth levels of the session;
+//   - head:mime,webrtc - keys of the message head; the message must have at least one of the keys.
+//
+// All qualified parts must match. Packets without a topic, like {hi}, are not filtered by topic name,
+// packets other than {pub} are not filtered by head.
 // For instance:
 // "acc,login;;CU" - grab packets {acc} or {login}; no filtering by topic, Create or Update action
 // "pub,pres;me,p2p;"
+// "pub;topic:grpAbC,grpXyZ;auth:auth" - {pub} packets from authenticated users to topics grpAbC and grpXyZ.
 type pluginRPCFilterConfig struct {
-	// Filter by packet name, topic type [or exact name - not supported yet]. 2D: "pub,pres;p2p,me"
+	// Filter by packet name, topic type, topic name, user ID, auth level, head keys. 2D: "pub,pres;p2p,me"
 	FireHose *string `json:"fire_hose"`
+	// Filter broadcast server packets by name, topic type, topic name, sender user ID, head keys: "data;grp"
+	FireHoseOut *string `json:"fire_hose_out"`
 
-	// Filter by CUD, [exact user name - not supported yet]. 1D: "C"
+	// Filter by CUD, user ID, user tag. 1D: "C"
 	Account *string `json:"account"`
-	// Filter by CUD, topic type[, exact name]: "p2p;CU"
+	// Filter by CUD, topic type, topic name: "p2p;CU"
 	Topic *string `json:"topic"`
-	// Filter by CUD, topic type[, exact topic name, exact user name]: "CU"
+	// Filter by CUD, topic type, topic name, user ID: "CU"
 	Subscription *string `json:"subscription"`
-	// Filter by C.D, topic type[, exact topic name, exact user name]: "grp;CD"
+	// Filter by C.D, topic type, topic name, sender user ID, head keys: "grp;CD"
 	Message *string `json:"message"`
 
 	// Call Find service, true or false
@@ -209,8 +328,23 @@ type pluginConfig struct {
 	FailureCode int `json:"failure_code"`
 	// HTTP Error message to go with the code
 	FailureMessage string `json:"failure_text"`
-	// Address of plugin server of the form "tcp://localhost:123" or "unix://path_to_socket_file"
+	// Address of plugin server of the form "tcp://localhost:123" or "unix://path_to_socket_file",
+	// or URL of the HTTP endpoint "https://example.com/plugin".
 	ServiceAddr string `json:"service_addr"`
+	// Transport security of the connection to the plugin.
+	TLS *pluginTLSConfig `json:"tls"`
+	// Bearer token sent to the plugin as 'authorization' metadata with every call.
+	AuthToken string `json:"auth_token"`
+	// Stop calling the plugin when it's unreachable.
+	CircuitBreaker *pluginBreakerConfig `json:"circuit_breaker"`
+	// Microseconds to wait for FireHoseOut response before delivering the message unchanged.
+	OutTimeout int64 `json:"out_timeout"`
+	// HTTP transport only: secret for signing requests.
+	Secret string `json:"secret"`
+	// HTTP transport only: number of retries of a failed asynchronous event.
+	MaxRetries int `json:"max_retries"`
+	// HTTP transport only: maximum number of asynchronous events waiting to be sent.
+	Buffer int `json:"buffer"`
 }
 
 // Plugin defines client-side parameters of a gRPC plugin.
@@ -219,6 +353,7 @@ type Plugin struct {
 	timeout time.Duration
 	// Filters for individual methods
 	filterFireHose     *PluginFilter
+	filterFireHoseOut  *PluginFilter
 	filterAccount      *PluginFilter
 	filterTopic        *PluginFilter
 	filterSubscription *PluginFilter
@@ -226,11 +361,17 @@ type Plugin struct {
 	filterFind         bool
 	failureCode        int
 	failureText        string
+	outTimeout         time.Duration
 	network            string
 	addr               string
 
 	conn   *grpc.ClientConn
 	client pbx.PluginClient
+	// Set when the plugin uses HTTP transport.
+	httpClient *httpPluginClient
+
+	breaker    *pluginBreaker
+	stopHealth context.CancelFunc
 }
 
 func pluginsInit(configString json.RawMessage) {
@@ -262,26 +403,39 @@ func pluginsInit(configString json.RawMessage) {
 			timeout:     time.Duration(conf.Timeout) * time.Microsecond,
 			failureCode: conf.FailureCode,
 			failureText: conf.FailureMessage,
+			outTimeout:  time.Duration(conf.OutTimeout) * time.Microsecond,
+		}
+		if globals.plugins[count].outTimeout <= 0 {
+			globals.plugins[count].outTimeout = defaultPluginOutTimeout
 		}
 		var err error
 		if globals.plugins[count].filterFireHose, err =
-			ParsePluginFilter(conf.Filters.FireHose, plgFilterByTopicType|plgFilterByPacket); err != nil {
+			ParsePluginFilter(conf.Filters.FireHose,
+				plgFilterByTopicType|plgFilterByPacket|plgFilterByTopicName|plgFilterByUser|plgFilterByAuthLevel|plgFilterByHead); err != nil {
 			logs.Err.Fatal("plugins: bad FireHose filter", err)
 		}
+		if globals.plugins[count].filterFireHoseOut, err =
+			ParsePluginFilter(conf.Filters.FireHoseOut,
+				plgFilterByTopicType|plgFilterByServerPacket|plgFilterByTopicName|plgFilterByUser|plgFilterByHead); err != nil {
+			logs.Err.Fatal("plugins: bad FireHoseOut filter", err)
+		}
 		if globals.plugins[count].filterAccount, err =
-			ParsePluginFilter(conf.Filters.Account, plgFilterByAction); err != nil {
+			ParsePluginFilter(conf.Filters.Account, plgFilterByAction|plgFilterByUser|plgFilterByTag); err != nil {
 			logs.Err.Fatal("plugins: bad Account filter", err)
 		}
 		if globals.plugins[count].filterTopic, err =
-			ParsePluginFilter(conf.Filters.Topic, plgFilterByTopicType|plgFilterByAction); err != nil {
+			ParsePluginFilter(conf.Filters.Topic,
+				plgFilterByTopicType|plgFilterByAction|plgFilterByTopicName); err != nil {
 			logs.Err.Fatal("plugins: bad Topic filter", err)
 		}
 		if globals.plugins[count].filterSubscription, err =
-			ParsePluginFilter(conf.Filters.Subscription, plgFilterByTopicType|plgFilterByAction); err != nil {
+			ParsePluginFilter(conf.Filters.Subscription,
+				plgFilterByTopicType|plgFilterByAction|plgFilterByTopicName|plgFilterByUser); err != nil {
 			logs.Err.Fatal("plugins: bad Subscription filter", err)
 		}
 		if globals.plugins[count].filterMessage, err =
-			ParsePluginFilter(conf.Filters.Message, plgFilterByTopicType|plgFilterByAction); err != nil {
+			ParsePluginFilter(conf.Filters.Message,
+				plgFilterByTopicType|plgFilterByAction|plgFilterByTopicName|plgFilterByUser|plgFilterByHead); err != nil {
 			logs.Err.Fatal("plugins: bad Message filter", err)
 		}
 
@@ -294,13 +448,10 @@ func pluginsInit(configString json.RawMessage) {
 			globals.plugins[count].addr = parts[1]
 		}
 
-		globals.plugins[count].conn, err = grpc.Dial(globals.plugins[count].addr, grpc.WithInsecure())
-		if err != nil {
-			logs.Err.Fatalf("plugins: connection failure %v", err)
+		if err = globals.plugins[count].dial(conf); err != nil {
+			logs.Err.Fatalf("plugins: connection failure '%s': %v", conf.Name, err)
 		}
 
-		globals.plugins[count].client = pbx.NewPluginClient(globals.plugins[count].conn)
-
 		nameIndex[conf.Name] = true
 		count++
 	}
@@ -325,7 +476,7 @@ func pluginsShutdown() {
 	}
 
 	for i := range globals.plugins {
-		globals.plugins[i].conn.Close()
+		globals.plugins[i].close()
 	}
 }
 
@@ -360,7 +511,7 @@ func pluginFireHose(sess *Session, msg *ClientComMessage) (*ClientComMessage, *S
 	ts := time.Now().UTC().Round(time.Millisecond)
 	for i := range globals.plugins {
 		p := &globals.plugins[i]
-		if !pluginDoFiltering(p.filterFireHose, msg) {
+		if !pluginDoFiltering(p.filterFireHose, sess, msg) {
 			// Plugin is not interested in FireHose
 			continue
 		}
@@ -374,15 +525,11 @@ func pluginFireHose(sess *Session, msg *ClientComMessage) (*ClientComMessage, *S
 			}
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		if resp, err := p.client.FireHose(ctx, req); err == nil {
+		var resp *pbx.ServerResp
+		if err := p.invoke(func(ctx context.Context) (err error) {
+			resp, err = p.client.FireHose(ctx, req)
+			return
+		}); err == nil {
 			respStatus := resp.GetStatus()
 			// CONTINUE means default processing
 			if respStatus == pbx.RespCode_CONTINUE {
@@ -421,6 +568,84 @@ func pluginFireHose(sess *Session, msg *ClientComMessage) (*ClientComMessage, *S
 	return msg, nil
 }
 
+// pluginFireHoseOut lets plugins inspect, replace or drop a server message before the topic broadcasts it.
+// Returns the message to broadcast or nil if the message should be dropped. Called once per message.
+func pluginFireHoseOut(msg *ServerComMessage) *ServerComMessage {
+	if globals.plugins == nil || (msg.Data == nil && msg.Pres == nil && msg.Info == nil) {
+		return msg
+	}
+
+	var req *pbx.ServerReq
+	for i := range globals.plugins {
+		p := &globals.plugins[i]
+		if !pluginDoFilteringOut(p.filterFireHoseOut, msg) {
+			continue
+		}
+
+		if req == nil {
+			req = &pbx.ServerReq{Msg: pbServSerialize(msg)}
+			if sess := msg.sess; sess != nil {
+				req.Sess = &pbx.Session{
+					SessionId:  sess.sid,
+					UserId:     sess.uid.UserId(),
+					AuthLevel:  pbx.AuthLevel(sess.authLvl),
+					UserAgent:  sess.userAgent,
+					RemoteAddr: sess.remoteAddr,
+					DeviceId:   sess.deviceID,
+					Language:   sess.lang,
+				}
+			}
+		}
+
+		var resp *pbx.ServerResp
+		// The topic must not be held up by a slow plugin: use a short timeout and deliver
+		// the message unchanged on failure.
+		if err := p.invokeWithTimeout(p.outTimeout, func(ctx context.Context) (err error) {
+			resp, err = p.client.FireHoseOut(ctx, req)
+			return
+		}); err != nil {
+			logs.Warn.Println("plugin: FireHoseOut failure ignored,", p.name, err)
+			continue
+		}
+
+		switch resp.GetStatus() {
+		case pbx.RespCode_DROP:
+			return nil
+		case pbx.RespCode_REPLACE:
+			if replaced := pbServDeserialize(resp.GetSrvmsg()); replaced != nil {
+				msg = pluginReplaceOut(msg, replaced)
+				// Subsequent plugins see the updated message.
+				req = nil
+			}
+		}
+	}
+
+	return msg
+}
+
+// pluginReplaceOut replaces content of the message with the content returned by the plugin.
+// Routing details which are not sent to the plugin are preserved. Content of a different kind is ignored.
+func pluginReplaceOut(msg, replaced *ServerComMessage) *ServerComMessage {
+	out := *msg
+	switch {
+	case msg.Data != nil && replaced.Data != nil:
+		out.Data = replaced.Data
+	case msg.Pres != nil && replaced.Pres != nil:
+		pres := *replaced.Pres
+		pres.WantReply, pres.FilterIn, pres.FilterOut = msg.Pres.WantReply, msg.Pres.FilterIn, msg.Pres.FilterOut
+		pres.SkipTopic, pres.SingleUser, pres.ExcludeUser = msg.Pres.SkipTopic, msg.Pres.SingleUser, msg.Pres.ExcludeUser
+		out.Pres = &pres
+	case msg.Info != nil && replaced.Info != nil:
+		info := *replaced.Info
+		info.SkipTopic = msg.Info.SkipTopic
+		out.Info = &info
+	default:
+		logs.Warn.Println("plugin: FireHoseOut replacement ignored,", msg.describe())
+		return msg
+	}
+	return &out
+}
+
 // Ask plugin to perform search.
 func pluginFind(user types.Uid, query string) (string, []types.Subscription, error) {
 	if globals.plugins == nil {
@@ -438,15 +663,11 @@ func pluginFind(user types.Uid, query string) (string, []types.Subscription, err
 			continue
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		resp, err := p.client.Find(ctx, find)
+		var resp *pbx.SearchFound
+		err := p.invoke(func(ctx context.Context) (err error) {
+			resp, err = p.client.Find(ctx, find)
+			return
+		})
 		if err != nil {
 			logs.Warn.Println("plugins: Find call failed", p.name, err)
 			return "", nil, err
@@ -479,7 +700,8 @@ func pluginAccount(user *types.User, action int) {
 	var event *pbx.AccountEvent
 	for i := range globals.plugins {
 		p := &globals.plugins[i]
-		if p.filterAccount == nil || p.filterAccount.byAction&action == 0 {
+		if p.filterAccount == nil || p.filterAccount.byAction&action == 0 ||
+			!p.filterAccount.matchUser(user.Uid().UserId()) || !p.filterAccount.matchTags(user.Tags) {
 			// Plugin is not interested in Account actions
 			continue
 		}
@@ -497,15 +719,10 @@ func pluginAccount(user *types.User, action int) {
 			}
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		if _, err := p.client.Account(ctx, event); err != nil {
+		if err := p.invoke(func(ctx context.Context) error {
+			_, err := p.client.Account(ctx, event)
+			return err
+		}); err != nil {
 			logs.Warn.Println("plugins: Account call failed", p.name, err)
 		}
 	}
@@ -519,7 +736,7 @@ func pluginTopic(topic *Topic, action int) {
 	var event *pbx.TopicEvent
 	for i := range globals.plugins {
 		p := &globals.plugins[i]
-		if p.filterTopic == nil || p.filterTopic.byAction&action == 0 {
+		if p.filterTopic == nil || p.filterTopic.byAction&action == 0 || !p.filterTopic.matchTopic(topic.name) {
 			// Plugin is not interested in Message actions
 			continue
 		}
@@ -532,15 +749,10 @@ func pluginTopic(topic *Topic, action int) {
 			}
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		if _, err := p.client.Topic(ctx, event); err != nil {
+		if err := p.invoke(func(ctx context.Context) error {
+			_, err := p.client.Topic(ctx, event)
+			return err
+		}); err != nil {
 			logs.Warn.Println("plugins: Topic call failed", p.name, err)
 		}
 	}
@@ -554,7 +766,9 @@ func pluginSubscription(sub *types.Subscription, action int) {
 	var event *pbx.SubscriptionEvent
 	for i := range globals.plugins {
 		p := &globals.plugins[i]
-		if p.filterSubscription == nil || p.filterSubscription.byAction&action == 0 {
+		if p.filterSubscription == nil || p.filterSubscription.byAction&action == 0 ||
+			!p.filterSubscription.matchTopic(sub.Topic) ||
+			!p.filterSubscription.matchUser(types.ParseUid(sub.User).UserId()) {
 			// Plugin is not interested in Message actions
 			continue
 		}
@@ -578,15 +792,10 @@ func pluginSubscription(sub *types.Subscription, action int) {
 			}
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		if _, err := p.client.Subscription(ctx, event); err != nil {
+		if err := p.invoke(func(ctx context.Context) error {
+			_, err := p.client.Subscription(ctx, event)
+			return err
+		}); err != nil {
 			logs.Warn.Println("plugins: Subscription call failed", p.name, err)
 		}
 	}
@@ -601,7 +810,9 @@ func pluginMessage(data *MsgServerData, action int) {
 	var event *pbx.MessageEvent
 	for i := range globals.plugins {
 		p := &globals.plugins[i]
-		if p.filterMessage == nil || p.filterMessage.byAction&action == 0 {
+		if p.filterMessage == nil || p.filterMessage.byAction&action == 0 ||
+			!p.filterMessage.matchTopic(data.Topic) || !p.filterMessage.matchUser(data.From) ||
+			(p.filterMessage.headKeys != nil && !p.filterMessage.matchHead(data.Head)) {
 			// Plugin is not interested in Message actions
 			continue
 		}
@@ -613,46 +824,145 @@ func pluginMessage(data *MsgServerData, action int) {
 			}
 		}
 
-		var ctx context.Context
-		var cancel context.CancelFunc
-		if p.timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
-			defer cancel()
-		} else {
-			ctx = context.Background()
-		}
-		if _, err := p.client.Message(ctx, event); err != nil {
+		if err := p.invoke(func(ctx context.Context) error {
+			_, err := p.client.Message(ctx, event)
+			return err
+		}); err != nil {
 			logs.Warn.Println("plugins: Message call failed", p.name, err)
 		}
 	}
 }
 
-// Returns false to skip, true to process
-func pluginDoFiltering(filter *PluginFilter, msg *ClientComMessage) bool {
-	filterByTopic := func(topic string, flt int) bool {
-		if topic == "" || flt == plgTopicCatMask {
+// matchTopic checks if the topic name passes the topic name filter.
+func (f *PluginFilter) matchTopic(topic string) bool {
+	if f.topics == nil || topic == "" {
+		return true
+	}
+	if f.topics[topic] {
+		return true
+	}
+	for _, prefix := range f.topicPrefixes {
+		if strings.HasPrefix(topic, prefix) {
 			return true
 		}
+	}
+	return false
+}
+
+// matchUser checks if the user ID passes the user filter.
+func (f *PluginFilter) matchUser(uid string) bool {
+	return f.users == nil || f.users[uid]
+}
 
-		tt := topic
-		if len(tt) > 3 {
-			tt = topic[:3]
+// matchTags checks if any of the user's tags passes the tag filter.
+func (f *PluginFilter) matchTags(tags []string) bool {
+	if f.tags == nil {
+		return true
+	}
+	for _, tag := range tags {
+		if f.tags[strings.ToLower(tag)] {
+			return true
 		}
-		switch tt {
-		case "me":
-			return flt&plgTopicMe != 0
-		case "fnd":
-			return flt&plgTopicFnd != 0
-		case "usr":
-			return flt&plgTopicP2P != 0
-		case "grp":
-			return flt&plgTopicGrp != 0
-		case "new":
-			return flt&plgTopicNew != 0
+	}
+	return false
+}
+
+// matchAuthLevel checks if the auth level passes the auth level filter.
+func (f *PluginFilter) matchAuthLevel(lvl auth.Level) bool {
+	return f.byAuthLevel == 0 || f.byAuthLevel&(1<<uint(lvl/10)) != 0
+}
+
+// matchHead checks if the message head has any of the keys from the head filter.
+func (f *PluginFilter) matchHead(head map[string]any) bool {
+	if f.headKeys == nil {
+		return true
+	}
+	for _, key := range f.headKeys {
+		if _, ok := head[key]; ok {
+			return true
 		}
+	}
+	return false
+}
+
+// Returns false to skip, true to process
+func pluginDoFiltering(filter *PluginFilter, sess *Session, msg *ClientComMessage) bool {
+	if !pluginFilterByPacket(filter, msg) {
+		return false
+	}
+
+	if !filter.matchUser(sess.uid.UserId()) || !filter.matchAuthLevel(sess.authLvl) {
+		return false
+	}
+	if _, topic := pluginIDAndTopic(msg); !filter.matchTopic(topic) {
+		return false
+	}
+	if msg.Pub != nil && !filter.matchHead(msg.Pub.Head) {
+		return false
+	}
+	return true
+}
+
+// pluginDoFilteringOut checks if the server message broadcast by the topic should be sent to the plugin.
+func pluginDoFilteringOut(filter *PluginFilter, msg *ServerComMessage) bool {
+	if filter == nil || filter.byPacket == 0 {
+		return false
+	}
+
+	var packet int
+	var topic string
+	var head map[string]any
+	switch {
+	case msg.Data != nil:
+		packet, topic, head = plgData, msg.Data.Topic, msg.Data.Head
+	case msg.Pres != nil:
+		packet, topic = plgPres, msg.Pres.Topic
+	case msg.Info != nil:
+		packet, topic = plgInfo, msg.Info.Topic
+	default:
 		return false
 	}
 
+	if filter.byPacket&packet == 0 || !pluginFilterByTopicType(topic, filter.byTopicType) {
+		return false
+	}
+	// Messages are filtered by the sender.
+	if !filter.matchUser(msg.AsUser) || !filter.matchTopic(topic) {
+		return false
+	}
+	if msg.Data != nil && !filter.matchHead(head) {
+		return false
+	}
+	return true
+}
+
+// pluginFilterByTopicType checks if the topic passes the topic type filter.
+func pluginFilterByTopicType(topic string, flt int) bool {
+	if topic == "" || flt == plgTopicCatMask {
+		return true
+	}
+
+	tt := topic
+	if len(tt) > 3 {
+		tt = topic[:3]
+	}
+	switch tt {
+	case "me":
+		return flt&plgTopicMe != 0
+	case "fnd":
+		return flt&plgTopicFnd != 0
+	case "usr":
+		return flt&plgTopicP2P != 0
+	case "grp":
+		return flt&plgTopicGrp != 0
+	case "new":
+		return flt&plgTopicNew != 0
+	}
+	return false
+}
+
+// pluginFilterByPacket filters the message by packet name and topic type.
+func pluginFilterByPacket(filter *PluginFilter, msg *ClientComMessage) bool {
 	// Check if plugin has any filters for this call
 	if filter == nil || filter.byPacket == 0 {
 		return false
@@ -672,25 +982,25 @@ func pluginDoFiltering(filter *PluginFilter, msg *ClientComMessage) bool {
 		return filter.byPacket&plgLogin != 0
 	}
 	if msg.Sub != nil {
-		return filter.byPacket&plgSub != 0 && filterByTopic(msg.Sub.Topic, filter.byTopicType)
+		return filter.byPacket&plgSub != 0 && pluginFilterByTopicType(msg.Sub.Topic, filter.byTopicType)
 	}
 	if msg.Leave != nil {
-		return filter.byPacket&plgLeave != 0 && filterByTopic(msg.Leave.Topic, filter.byTopicType)
+		return filter.byPacket&plgLeave != 0 && pluginFilterByTopicType(msg.Leave.Topic, filter.byTopicType)
 	}
 	if msg.Pub != nil {
-		return filter.byPacket&plgPub != 0 && filterByTopic(msg.Pub.Topic, filter.byTopicType)
+		return filter.byPacket&plgPub != 0 && pluginFilterByTopicType(msg.Pub.Topic, filter.byTopicType)
 	}
 	if msg.Get != nil {
-		return filter.byPacket&plgGet != 0 && filterByTopic(msg.Get.Topic, filter.byTopicType)
+		return filter.byPacket&plgGet != 0 && pluginFilterByTopicType(msg.Get.Topic, filter.byTopicType)
 	}
 	if msg.Set != nil {
-		return filter.byPacket&plgSet != 0 && filterByTopic(msg.Set.Topic, filter.byTopicType)
+		return filter.byPacket&plgSet != 0 && pluginFilterByTopicType(msg.Set.Topic, filter.byTopicType)
 	}
 	if msg.Del != nil {
-		return filter.byPacket&plgDel != 0 && filterByTopic(msg.Del.Topic, filter.byTopicType)
+		return filter.byPacket&plgDel != 0 && pluginFilterByTopicType(msg.Del.Topic, filter.byTopicType)
 	}
 	if msg.Note != nil {
-		return filter.byPacket&plgNote != 0 && filterByTopic(msg.Note.Topic, filter.byTopicType)
+		return filter.byPacket&plgNote != 0 && pluginFilterByTopicType(msg.Note.Topic, filter.byTopicType)
 	}
 	return false
 }
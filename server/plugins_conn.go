@@ -0,0 +1,328 @@
+// Connections to plugins: transport security, authentication, health checking.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Default number of consecutive failures which open the circuit breaker.
+	defaultPluginFailureThreshold = 5
+	// Default time in seconds before a call is attempted again after the breaker was opened.
+	defaultPluginRetryAfter = 10
+	// Maximum delay between reconnection attempts.
+	pluginMaxReconnectDelay = 30 * time.Second
+	// Default timeout of FireHoseOut calls.
+	defaultPluginOutTimeout = 50 * time.Millisecond
+)
+
+// errPluginUnavailable is returned when the call is not made because the plugin is unhealthy.
+var errPluginUnavailable = status.Error(codes.Unavailable, "plugin unavailable: circuit breaker open")
+
+// TLS config of a connection to the plugin.
+type pluginTLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// PEM-encoded CA certificate(s) which must have signed the plugin's certificate.
+	// If missing, system root CAs are used.
+	CACertFile string `json:"ca_file"`
+	// PEM-encoded client certificate and key for mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Name to verify in the plugin's certificate. The host from service_addr is used by default.
+	ServerName string `json:"server_name"`
+}
+
+// Circuit breaker config.
+type pluginBreakerConfig struct {
+	// Number of consecutive failures after which the plugin is no longer called.
+	FailureThreshold int `json:"failure_threshold"`
+	// Seconds to wait before calling the plugin again.
+	RetryAfter int `json:"retry_after"`
+}
+
+// pluginBreaker is a circuit breaker which stops calling a failing plugin for a while.
+type pluginBreaker struct {
+	sync.Mutex
+	threshold  int
+	retryAfter time.Duration
+
+	failures int
+	// The breaker is open until this time.
+	openUntil time.Time
+	// A trial call is in progress after retryAfter has expired.
+	probing bool
+}
+
+func newPluginBreaker(conf *pluginBreakerConfig) *pluginBreaker {
+	b := &pluginBreaker{
+		threshold:  defaultPluginFailureThreshold,
+		retryAfter: defaultPluginRetryAfter * time.Second,
+	}
+	if conf != nil {
+		if conf.FailureThreshold > 0 {
+			b.threshold = conf.FailureThreshold
+		}
+		if conf.RetryAfter > 0 {
+			b.retryAfter = time.Duration(conf.RetryAfter) * time.Second
+		}
+	}
+	return b
+}
+
+// allow checks if the call can be made. Once the breaker opens, a single trial call is allowed
+// after retryAfter.
+func (b *pluginBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// report records the outcome of a call.
+func (b *pluginBreaker) report(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if err == nil || !isPluginTransportError(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.retryAfter)
+	}
+}
+
+// trip opens the breaker immediately.
+func (b *pluginBreaker) trip() {
+	b.Lock()
+	if b.failures < b.threshold {
+		b.failures = b.threshold
+	}
+	b.openUntil = time.Now().Add(b.retryAfter)
+	b.Unlock()
+}
+
+// reset closes the breaker.
+func (b *pluginBreaker) reset() {
+	b.Lock()
+	b.failures = 0
+	b.probing = false
+	b.Unlock()
+}
+
+// isPluginTransportError checks if the error means the plugin is unreachable or too slow as opposed to
+// the plugin rejecting the request.
+func isPluginTransportError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// pluginTokenAuth adds a bearer token to every call.
+type pluginTokenAuth struct {
+	token  string
+	secure bool
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (a pluginTokenAuth) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + a.token}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (a pluginTokenAuth) RequireTransportSecurity() bool {
+	return a.secure
+}
+
+// pluginTLSClientConfig creates client-side TLS config.
+func pluginTLSClientConfig(conf *pluginTLSConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName: conf.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if conf.CACertFile != "" {
+		pem, err := os.ReadFile(conf.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid certificates in " + conf.CACertFile)
+		}
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConf, nil
+}
+
+// dial creates a connection to the plugin. The connection is established in the background.
+func (p *Plugin) dial(conf *pluginConfig) error {
+	switch p.network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	case "http", "https":
+		if conf.AuthToken != "" && p.network == "http" {
+			logs.Warn.Printf("plugins: auth token of '%s' is sent over an unencrypted connection", p.name)
+		}
+		client, err := newHttpPluginClient(p, conf)
+		if err != nil {
+			return err
+		}
+		p.httpClient = client
+		p.client = client
+		p.breaker = newPluginBreaker(conf.CircuitBreaker)
+		return nil
+	default:
+		return errors.New("unsupported network '" + p.network + "'")
+	}
+
+	network, addr := p.network, p.addr
+	opts := []grpc.DialOption{
+		// Dial the configured network, in particular unix sockets, directly.
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  time.Second,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   pluginMaxReconnectDelay,
+			},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	}
+
+	secure := conf.TLS != nil && conf.TLS.Enabled
+	if secure {
+		tlsConf, err := pluginTLSClientConfig(conf.TLS)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	if conf.AuthToken != "" {
+		if !secure && p.network != "unix" {
+			logs.Warn.Printf("plugins: auth token of '%s' is sent over an unencrypted connection", p.name)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(pluginTokenAuth{token: conf.AuthToken, secure: secure}))
+	}
+
+	// The target is used only as the default :authority and TLS server name: the dialer above
+	// connects to the actual address.
+	target := "passthrough:///" + p.addr
+	if p.network == "unix" {
+		target = "passthrough:///localhost"
+	}
+
+	var err error
+	if p.conn, err = grpc.Dial(target, opts...); err != nil {
+		return err
+	}
+
+	p.client = pbx.NewPluginClient(p.conn)
+	p.breaker = newPluginBreaker(conf.CircuitBreaker)
+	var ctx context.Context
+	ctx, p.stopHealth = context.WithCancel(context.Background())
+	go p.watchHealth(ctx)
+
+	return nil
+}
+
+// watchHealth tracks state of the connection: opens the circuit breaker when the connection fails
+// and closes it when the connection is restored.
+func (p *Plugin) watchHealth(ctx context.Context) {
+	// Start connecting right away instead of waiting for the first call.
+	p.conn.Connect()
+
+	for {
+		state := p.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			p.breaker.reset()
+		case connectivity.TransientFailure:
+			logs.Warn.Println("plugins: connection failed", p.name)
+			p.breaker.trip()
+		case connectivity.Idle:
+			// Reconnect after the connection was dropped.
+			p.conn.Connect()
+		case connectivity.Shutdown:
+			return
+		}
+		if !p.conn.WaitForStateChange(ctx, state) {
+			// Context cancelled.
+			return
+		}
+	}
+}
+
+// invoke makes a call to the plugin with the configured timeout unless the circuit breaker is open.
+func (p *Plugin) invoke(call func(ctx context.Context) error) error {
+	return p.invokeWithTimeout(p.timeout, call)
+}
+
+// invokeWithTimeout makes a call to the plugin with the given timeout unless the circuit breaker is open.
+func (p *Plugin) invokeWithTimeout(timeout time.Duration, call func(ctx context.Context) error) error {
+	if !p.breaker.allow() {
+		return errPluginUnavailable
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := call(ctx)
+	p.breaker.report(err)
+	return err
+}
+
+// close stops health checking and closes the connection.
+func (p *Plugin) close() {
+	if p.httpClient != nil {
+		p.httpClient.stop()
+		return
+	}
+	p.stopHealth()
+	p.conn.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testPluginServer struct {
+	pbx.UnimplementedPluginServer
+	auth chan string
+}
+
+func (s *testPluginServer) Account(ctx context.Context, _ *pbx.AccountEvent) (*pbx.Unused, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if vals := md.Get("authorization"); len(vals) > 0 {
+		s.auth <- vals[0]
+	} else {
+		s.auth <- ""
+	}
+	return &pbx.Unused{}, nil
+}
+
+func TestPluginDialUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "plugin.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	impl := &testPluginServer{auth: make(chan string, 1)}
+	pbx.RegisterPluginServer(srv, impl)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	p := &Plugin{name: "test", network: "unix", addr: sock, timeout: 5 * time.Second}
+	if err := p.dial(&pluginConfig{AuthToken: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	if err := p.invoke(func(ctx context.Context) error {
+		_, err := p.client.Account(ctx, &pbx.AccountEvent{})
+		return err
+	}); err != nil {
+		t.Fatal("call failed:", err)
+	}
+	if auth := <-impl.auth; auth != "Bearer secret" {
+		t.Errorf("expected bearer token, got '%s'", auth)
+	}
+}
+
+func TestPluginDialUnsupportedNetwork(t *testing.T) {
+	p := &Plugin{name: "test", network: "udp", addr: "localhost:1234"}
+	if err := p.dial(&pluginConfig{}); err == nil {
+		t.Error("expected error for unsupported network")
+	}
+}
+
+func TestPluginBreaker(t *testing.T) {
+	b := newPluginBreaker(&pluginBreakerConfig{FailureThreshold: 2, RetryAfter: 1})
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	// Application errors do not count.
+	b.report(status.Error(codes.InvalidArgument, "bad"))
+	b.report(status.Error(codes.InvalidArgument, "bad"))
+	if !b.allow() {
+		t.Fatal("breaker must stay closed on application errors")
+	}
+
+	b.report(unavailable)
+	if !b.allow() {
+		t.Fatal("breaker must stay closed below threshold")
+	}
+	b.report(unavailable)
+	if b.allow() {
+		t.Fatal("breaker must open at threshold")
+	}
+
+	// Allow a single trial call after retryAfter.
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker must allow a trial call")
+	}
+	if b.allow() {
+		t.Fatal("breaker must allow only one trial call")
+	}
+	b.report(unavailable)
+	if b.allow() {
+		t.Fatal("failed trial must reopen the breaker")
+	}
+
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker must allow a trial call")
+	}
+	b.report(nil)
+	if !b.allow() || !b.allow() {
+		t.Fatal("successful trial must close the breaker")
+	}
+
+	b.trip()
+	if b.allow() {
+		t.Fatal("tripped breaker must be open")
+	}
+	b.reset()
+	if !b.allow() {
+		t.Fatal("reset breaker must be closed")
+	}
+
+	if !isPluginTransportError(errPluginUnavailable) {
+		t.Error("errPluginUnavailable must be a transport error")
+	}
+}
@@ -0,0 +1,289 @@
+// HTTP/JSON transport for plugins: events are delivered as signed JSON POST requests.
+//
+// The body of every request is a JSON object {"type": "<event type>", "payload": {...}} where the payload is
+// the corresponding message from pbx/model.proto in canonical protobuf JSON encoding. Event types are
+// "firehose" (ClientReq), "firehose_out" (ServerReq), "find" (SearchQuery), "account" (AccountEvent),
+// "topic" (TopicEvent), "subscription" (SubscriptionEvent) and "message" (MessageEvent).
+//
+// Requests are signed as described in package sign.
+//
+// "firehose", "firehose_out" and "find" are synchronous: the response body is ServerResp or SearchFound.
+// An empty response body means CONTINUE. Other events are sent asynchronously and retried on failure.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/sign"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Default size of the queue of asynchronous events.
+	defaultPluginHttpBuffer = 1024
+	// Default number of retries of a failed asynchronous event.
+	defaultPluginHttpRetries = 3
+	// Number of goroutines sending asynchronous events.
+	pluginHttpWorkers = 4
+	// Timeout of asynchronous requests when the plugin timeout is not set.
+	pluginHttpAsyncTimeout = 10 * time.Second
+	// Maximum size of the response body.
+	pluginHttpMaxResponse = 1 << 20
+	// Upper limit on the delay between retries.
+	pluginHttpMaxRetryDelay = 30 * time.Second
+)
+
+// Delay before the first retry of an asynchronous event. Doubles with every subsequent attempt.
+var pluginHttpRetryDelay = time.Second
+
+// pluginHttpRequest is the body of the request.
+type pluginHttpRequest struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// httpPluginClient implements pbx.PluginClient over HTTP.
+type httpPluginClient struct {
+	name       string
+	url        string
+	secret     []byte
+	authToken  string
+	timeout    time.Duration
+	maxRetries int
+	client     *http.Client
+
+	// Queue of asynchronous events.
+	events chan []byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newHttpPluginClient(p *Plugin, conf *pluginConfig) (*httpPluginClient, error) {
+	if conf.Secret == "" {
+		return nil, errors.New("missing secret")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLS != nil && conf.TLS.Enabled {
+		tlsConf, err := pluginTLSClientConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+
+	c := &httpPluginClient{
+		name:       p.name,
+		url:        conf.ServiceAddr,
+		secret:     []byte(conf.Secret),
+		authToken:  conf.AuthToken,
+		timeout:    p.timeout,
+		maxRetries: conf.MaxRetries,
+		client:     &http.Client{Transport: transport},
+		done:       make(chan struct{}),
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = defaultPluginHttpRetries
+	} else if c.maxRetries < 0 {
+		c.maxRetries = 0
+	}
+	if c.timeout <= 0 {
+		c.timeout = pluginHttpAsyncTimeout
+	}
+	buffer := conf.Buffer
+	if buffer <= 0 {
+		buffer = defaultPluginHttpBuffer
+	}
+	c.events = make(chan []byte, buffer)
+
+	for i := 0; i < pluginHttpWorkers; i++ {
+		c.wg.Add(1)
+		go c.sendEvents()
+	}
+
+	return c, nil
+}
+
+// encode wraps the message into the request body.
+func (c *httpPluginClient) encode(what string, msg proto.Message) ([]byte, error) {
+	payload, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return json.Marshal(&pluginHttpRequest{Type: what, Payload: payload})
+}
+
+// post sends the request and returns the response body.
+func (c *httpPluginClient) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	sign.Request(req, c.secret, body)
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, status.FromContextError(ctxErr).Err()
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, pluginHttpMaxResponse))
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		code := codes.FailedPrecondition
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			code = codes.Unavailable
+		}
+		return nil, status.Error(code, "plugin responded "+resp.Status)
+	}
+
+	return respBody, nil
+}
+
+// call makes a synchronous request and decodes the response into resp.
+func (c *httpPluginClient) call(ctx context.Context, what string, req, resp proto.Message) error {
+	body, err := c.encode(what, req)
+	if err != nil {
+		return err
+	}
+	respBody, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		// Empty response means CONTINUE.
+		return nil
+	}
+	if err = (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(respBody, resp); err != nil {
+		return status.Error(codes.Internal, "invalid plugin response: "+err.Error())
+	}
+	return nil
+}
+
+// notify queues an asynchronous event.
+func (c *httpPluginClient) notify(what string, event proto.Message) (*pbx.Unused, error) {
+	body, err := c.encode(what, event)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case c.events <- body:
+		return &pbx.Unused{}, nil
+	default:
+		return nil, status.Error(codes.ResourceExhausted, "plugin event queue is full")
+	}
+}
+
+// sendEvents sends queued events retrying with exponential backoff on transient failures.
+func (c *httpPluginClient) sendEvents() {
+	defer c.wg.Done()
+
+	for {
+		var body []byte
+		select {
+		case body = <-c.events:
+		case <-c.done:
+			return
+		}
+
+		delay := pluginHttpRetryDelay
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			_, err := c.post(ctx, body)
+			cancel()
+			if err == nil {
+				break
+			}
+			if !isPluginTransportError(err) || attempt >= c.maxRetries {
+				logs.Warn.Println("plugins: event delivery failed", c.name, err)
+				break
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-c.done:
+				return
+			}
+			if delay *= 2; delay > pluginHttpMaxRetryDelay {
+				delay = pluginHttpMaxRetryDelay
+			}
+		}
+	}
+}
+
+// stop terminates sending of asynchronous events. Queued events are discarded.
+func (c *httpPluginClient) stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// FireHose implements pbx.PluginClient.
+func (c *httpPluginClient) FireHose(ctx context.Context, in *pbx.ClientReq, _ ...grpc.CallOption) (*pbx.ServerResp, error) {
+	resp := &pbx.ServerResp{}
+	if err := c.call(ctx, "firehose", in, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// FireHoseOut implements pbx.PluginClient.
+func (c *httpPluginClient) FireHoseOut(ctx context.Context, in *pbx.ServerReq, _ ...grpc.CallOption) (*pbx.ServerResp, error) {
+	resp := &pbx.ServerResp{}
+	if err := c.call(ctx, "firehose_out", in, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Find implements pbx.PluginClient.
+func (c *httpPluginClient) Find(ctx context.Context, in *pbx.SearchQuery, _ ...grpc.CallOption) (*pbx.SearchFound, error) {
+	resp := &pbx.SearchFound{}
+	if err := c.call(ctx, "find", in, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Account implements pbx.PluginClient.
+func (c *httpPluginClient) Account(_ context.Context, in *pbx.AccountEvent, _ ...grpc.CallOption) (*pbx.Unused, error) {
+	return c.notify("account", in)
+}
+
+// Topic implements pbx.PluginClient.
+func (c *httpPluginClient) Topic(_ context.Context, in *pbx.TopicEvent, _ ...grpc.CallOption) (*pbx.Unused, error) {
+	return c.notify("topic", in)
+}
+
+// Subscription implements pbx.PluginClient.
+func (c *httpPluginClient) Subscription(_ context.Context, in *pbx.SubscriptionEvent, _ ...grpc.CallOption) (*pbx.Unused, error) {
+	return c.notify("subscription", in)
+}
+
+// Message implements pbx.PluginClient.
+func (c *httpPluginClient) Message(_ context.Context, in *pbx.MessageEvent, _ ...grpc.CallOption) (*pbx.Unused, error) {
+	return c.notify("message", in)
+}
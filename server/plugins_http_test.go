@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/sign"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestHttpPlugin(t *testing.T, url string) *Plugin {
+	p := &Plugin{name: "test", network: "http", addr: url[len("http://"):], timeout: 5 * time.Second}
+	if err := p.dial(&pluginConfig{ServiceAddr: url, Secret: "secret", AuthToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+func TestPluginHttpFireHose(t *testing.T) {
+	logs.Init(os.Stderr, "stdFlags")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !sign.Verify(r, []byte("secret"), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Type    string `json:"type"`
+			Payload struct {
+				Msg struct {
+					Pub struct {
+						Topic string `json:"topic"`
+					} `json:"pub"`
+				} `json:"msg"`
+			} `json:"payload"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil || req.Type != "firehose" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch req.Payload.Msg.Pub.Topic {
+		case "drop":
+			w.Write([]byte(`{"status": "DROP"}`))
+		case "replace":
+			w.Write([]byte(`{"status": "REPLACE", "clmsg": {"pub": {"topic": "replaced"}}}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	p := newTestHttpPlugin(t, srv.URL)
+	fire := func(topic string) *pbx.ServerResp {
+		resp, err := p.client.FireHose(context.Background(), &pbx.ClientReq{
+			Msg: &pbx.ClientMsg{Message: &pbx.ClientMsg_Pub{Pub: &pbx.ClientPub{Topic: topic}}},
+		})
+		if err != nil {
+			t.Fatal(topic, err)
+		}
+		return resp
+	}
+
+	if resp := fire("continue"); resp.GetStatus() != pbx.RespCode_CONTINUE {
+		t.Error("expected CONTINUE, got", resp.GetStatus())
+	}
+	if resp := fire("drop"); resp.GetStatus() != pbx.RespCode_DROP {
+		t.Error("expected DROP, got", resp.GetStatus())
+	}
+	resp := fire("replace")
+	if resp.GetStatus() != pbx.RespCode_REPLACE || resp.GetClmsg().GetPub().GetTopic() != "replaced" {
+		t.Error("expected REPLACE with updated message, got", resp)
+	}
+
+	// Wrong secret: the plugin rejects the request, which is not a transport error.
+	p.httpClient.secret = []byte("wrong")
+	_, err := p.client.FireHose(context.Background(), &pbx.ClientReq{})
+	if err == nil || isPluginTransportError(err) {
+		t.Error("expected rejection, got", err)
+	}
+}
+
+func TestPluginHttpEventRetry(t *testing.T) {
+	logs.Init(os.Stderr, "stdFlags")
+	saved := pluginHttpRetryDelay
+	pluginHttpRetryDelay = time.Millisecond
+	defer func() { pluginHttpRetryDelay = saved }()
+
+	var attempts int32
+	delivered := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var req pluginHttpRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		delivered <- req.Type
+	}))
+	defer srv.Close()
+
+	p := newTestHttpPlugin(t, srv.URL)
+	if _, err := p.client.Account(context.Background(), &pbx.AccountEvent{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case what := <-delivered:
+		if what != "account" {
+			t.Error("expected account event, got", what)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Error("expected 3 attempts, got", n)
+	}
+}
+
+func TestPluginHttpQueueFull(t *testing.T) {
+	c := &httpPluginClient{events: make(chan []byte, 1)}
+	if _, err := c.Topic(context.Background(), &pbx.TopicEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Topic(context.Background(), &pbx.TopicEvent{}); status.Code(err) != codes.ResourceExhausted {
+		t.Error("expected ResourceExhausted, got", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParsePluginFilterQualifiers(t *testing.T) {
+	uid := types.Uid(12345)
+	s := "pub,sub;grp;topic:grpAbC,grpBot*;user:" + uid.UserId() + ";auth:auth,root;head:mime"
+	filter, err := ParsePluginFilter(&s,
+		plgFilterByTopicType|plgFilterByPacket|plgFilterByTopicName|plgFilterByUser|plgFilterByAuthLevel|plgFilterByHead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.byPacket != plgPub|plgSub || filter.byTopicType != plgTopicGrp {
+		t.Errorf("packet or topic type filter not parsed: %+v", filter)
+	}
+
+	sess := &Session{uid: uid, authLvl: auth.LevelAuth}
+	pub := func(topic string, head map[string]any) *ClientComMessage {
+		return &ClientComMessage{Pub: &MsgClientPub{Topic: topic, Head: head}}
+	}
+	mime := map[string]any{"mime": "text/x-drafty"}
+
+	cases := []struct {
+		name string
+		sess *Session
+		msg  *ClientComMessage
+		want bool
+	}{
+		{"exact topic", sess, pub("grpAbC", mime), true},
+		{"topic prefix", sess, pub("grpBotXyZ", mime), true},
+		{"other topic", sess, pub("grpXyZ", mime), false},
+		{"missing head", sess, pub("grpAbC", nil), false},
+		{"not filtered by head", sess, &ClientComMessage{Sub: &MsgClientSub{Topic: "grpAbC"}}, true},
+		{"other user", &Session{uid: types.Uid(1), authLvl: auth.LevelAuth}, pub("grpAbC", mime), false},
+		{"anonymous", &Session{uid: uid, authLvl: auth.LevelAnon}, pub("grpAbC", mime), false},
+		{"packet", sess, &ClientComMessage{Get: &MsgClientGet{Topic: "grpAbC"}}, false},
+	}
+	for _, tc := range cases {
+		if got := pluginDoFiltering(filter, tc.sess, tc.msg); got != tc.want {
+			t.Errorf("%s: expected %t, got %t", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestParsePluginFilterErrors(t *testing.T) {
+	for _, s := range []string{"C;tag:", "C;color:red", "C;topic:grpAbC", "C;user:bad", "C;auth:admin"} {
+		if _, err := ParsePluginFilter(&s, plgFilterByAction|plgFilterByUser|plgFilterByTag|plgFilterByAuthLevel); err == nil {
+			t.Errorf("'%s': expected error", s)
+		}
+	}
+
+	s := "C;tag:Email:Alice@Example.com,bot"
+	filter, err := ParsePluginFilter(&s, plgFilterByAction|plgFilterByTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.byAction != plgActCreate {
+		t.Error("action not parsed", filter.byAction)
+	}
+	if !filter.matchTags([]string{"email:alice@example.com"}) || filter.matchTags([]string{"email:bob@example.com"}) {
+		t.Error("tag filter mismatch")
+	}
+}
+
+// testOutPluginClient replies to FireHoseOut calls depending on the topic of the message.
+type testOutPluginClient struct {
+	pbx.PluginClient
+	calls int
+}
+
+func (c *testOutPluginClient) FireHoseOut(_ context.Context, in *pbx.ServerReq, _ ...grpc.CallOption) (*pbx.ServerResp, error) {
+	c.calls++
+	switch in.GetMsg().GetData().GetTopic() {
+	case "grpDrop":
+		return &pbx.ServerResp{Status: pbx.RespCode_DROP}, nil
+	case "grpReplace":
+		return &pbx.ServerResp{
+			Status: pbx.RespCode_REPLACE,
+			Srvmsg: &pbx.ServerMsg{Message: &pbx.ServerMsg_Data{Data: &pbx.ServerData{
+				Topic: "grpReplace", Content: []byte(`"redacted"`)}}},
+		}, nil
+	case "grpSlow":
+		return nil, status.Error(codes.DeadlineExceeded, "timeout")
+	}
+	return &pbx.ServerResp{Status: pbx.RespCode_CONTINUE}, nil
+}
+
+func TestPluginFireHoseOut(t *testing.T) {
+	s := "data;grp"
+	filter, err := ParsePluginFilter(&s, plgFilterByTopicType|plgFilterByServerPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testOutPluginClient{}
+	saved := globals.plugins
+	globals.plugins = []Plugin{{
+		name:              "test",
+		filterFireHoseOut: filter,
+		outTimeout:        defaultPluginOutTimeout,
+		client:            client,
+		breaker:           newPluginBreaker(nil),
+	}}
+	defer func() { globals.plugins = saved }()
+
+	data := func(topic string) *ServerComMessage {
+		return &ServerComMessage{Data: &MsgServerData{Topic: topic, Content: "hello"}, SkipSid: "skip"}
+	}
+
+	if msg := pluginFireHoseOut(data("grpDrop")); msg != nil {
+		t.Error("message must be dropped")
+	}
+	if msg := pluginFireHoseOut(data("grpReplace")); msg == nil || msg.Data.Content != "redacted" || msg.SkipSid != "skip" {
+		t.Error("message must be replaced", msg)
+	}
+	if msg := pluginFireHoseOut(data("grpSlow")); msg == nil || msg.Data.Content != "hello" {
+		t.Error("message must be delivered unchanged on failure", msg)
+	}
+	// Not matched by filter.
+	if msg := pluginFireHoseOut(data("usrDrop")); msg == nil {
+		t.Error("p2p message must not be sent to the plugin")
+	}
+	pres := &ServerComMessage{Pres: &MsgServerPres{Topic: "grpDrop", What: "on"}}
+	if msg := pluginFireHoseOut(pres); msg != pres {
+		t.Error("{pres} must not be sent to the plugin")
+	}
+
+	// The topic calls the plugin once per message, not once per session.
+	topic := &Topic{name: "grpReplace", xoriginal: "grpReplace", cat: types.TopicCatGrp, sessions: make(map[*Session]perSessionData)}
+	var sessions []*Session
+	for i := 0; i < 3; i++ {
+		sess := &Session{sid: fmt.Sprint("sid", i), uid: types.Uid(i + 1), send: make(chan any, 2)}
+		topic.sessions[sess] = perSessionData{uid: sess.uid, isChanSub: true}
+		sessions = append(sessions, sess)
+	}
+	client.calls = 0
+	topic.broadcastToSessions(data("grpReplace"))
+	if client.calls != 1 {
+		t.Error("plugin must be called once per message, called", client.calls)
+	}
+	for _, sess := range sessions {
+		if msg := (<-sess.send).(*ServerComMessage); msg.Data.Content != "redacted" {
+			t.Error("session must receive the replaced message", msg)
+		}
+	}
+	topic.name, topic.xoriginal = "grpDrop", "grpDrop"
+	topic.broadcastToSessions(data("grpDrop"))
+	for _, sess := range sessions {
+		if len(sess.send) != 0 {
+			t.Error("dropped message must not be delivered")
+		}
+	}
+
+	s = "pub;grp"
+	if _, err := ParsePluginFilter(&s, plgFilterByTopicType|plgFilterByServerPacket); err == nil {
+		t.Error("client packets must be rejected in outbound filter")
+	}
+}
@@ -8,12 +8,23 @@
 package main
 
 import (
+	"sync"
 	"time"
 
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
 
+const (
+	// How long users' global notification preferences are cached.
+	notifyPrefsCacheTTL = time.Minute
+	// Maximum number of cached notification preferences.
+	notifyPrefsCacheSize = 10000
+)
+
 // Subscribe or unsubscribe user to/from FCM topic (channel).
 func (t *Topic) channelSubUnsub(uid types.Uid, sub bool) {
 	push.ChannelSub(&push.ChannelReq{
@@ -78,6 +89,7 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsR
 		}
 	}
 	if len(receipt.To) > 0 || receipt.Channel != "" {
+		t.applyNotifyPrefs(&receipt)
 		return &receipt
 	}
 	// If there are no recipient there is no need to send the push notification.
@@ -114,6 +126,7 @@ func (t *Topic) pushForP2PSub(fromUid, toUid types.Uid, want, given types.Access
 	receipt.Payload.ModeGiven = given
 
 	receipt.To[toUid] = push.Recipient{}
+	t.applyNotifyPrefs(receipt)
 
 	return receipt
 }
@@ -137,6 +150,7 @@ func (t *Topic) pushForGroupSub(fromUid types.Uid, now time.Time) *push.Receipt
 		}
 	}
 	if len(receipt.To) > 0 || receipt.Channel != "" {
+		t.applyNotifyPrefs(receipt)
 		return receipt
 	}
 	return nil
@@ -181,6 +195,7 @@ func (t *Topic) pushForReadRcpt(uid types.Uid, seq int, now time.Time) *push.Rec
 		},
 	}
 	receipt.To[uid] = push.Recipient{}
+	t.applyNotifyPrefs(receipt)
 	return receipt
 }
 
@@ -213,6 +228,7 @@ func sendPush(rcpt *push.Receipt) {
 				local.PushRcpt.To[uid] = recipient
 			}
 		}
+		// Global notification preferences of remote users are applied by the nodes which own the users.
 
 		if len(remote.PushRcpt.To) > 0 || remote.PushRcpt.Channel != "" {
 			globals.cluster.routeUserReq(remote)
@@ -222,9 +238,231 @@ func sendPush(rcpt *push.Receipt) {
 	}
 
 	if len(local.PushRcpt.To) > 0 || local.PushRcpt.Channel != "" {
-		select {
-		case globals.usersUpdate <- local:
-		default:
+		if applyUserNotifyPrefs(local.PushRcpt, false) {
+			queueUserPush(local)
+		} else {
+			// Some preferences are not cached. Hold the receipt until they are loaded.
+			go func() {
+				applyUserNotifyPrefs(local.PushRcpt, true)
+				queueUserPush(local)
+			}()
+		}
+	}
+}
+
+func queueUserPush(req *UserCacheReq) {
+	select {
+	case globals.usersUpdate <- req:
+	default:
+	}
+}
+
+// Applies subscribers' per-topic notification preferences to the push receipt.
+func (t *Topic) applyNotifyPrefs(rcpt *push.Receipt) {
+	applyNotifyPrefs(rcpt, func(uid types.Uid) *types.NotifyPrefs {
+		return t.perUser[uid].notify
+	})
+}
+
+// Applies users' global notification preferences to the push receipt. Preferences which are not cached
+// are loaded from the DB if wait is true. Otherwise the receipt is left unchanged and false is returned.
+func applyUserNotifyPrefs(rcpt *push.Receipt, wait bool) bool {
+	if len(rcpt.To) == 0 {
+		return true
+	}
+	uids := make([]types.Uid, 0, len(rcpt.To))
+	for uid := range rcpt.To {
+		uids = append(uids, uid)
+	}
+	prefs, ok := notifyPrefsCache.get(uids, wait)
+	if !ok {
+		return false
+	}
+	applyNotifyPrefs(rcpt, func(uid types.Uid) *types.NotifyPrefs {
+		return prefs[uid]
+	})
+	return true
+}
+
+// applyNotifyPrefs marks recipients of the push according to their notification preferences:
+// recipients who disabled notifications of this kind are marked as disabled, recipients who muted
+// notifications or who want to be notified of mentions only are marked silent.
+func applyNotifyPrefs(rcpt *push.Receipt, prefsFor func(types.Uid) *types.NotifyPrefs) {
+	now := time.Now()
+	var mentioned map[string]bool
+	for uid, to := range rcpt.To {
+		prefs := prefsFor(uid)
+		if prefs.IsZero() {
+			continue
+		}
+
+		if !prefs.IsEnabled(rcpt.Payload.What) {
+			to.Disabled = true
+		} else if prefs.IsMuted(now) {
+			to.Silent = true
+		} else if prefs.MentionsOnly && rcpt.Payload.What == push.ActMsg &&
+			types.GetTopicCat(rcpt.Payload.Topic) == types.TopicCatGrp {
+			if mentioned == nil {
+				mentioned = make(map[string]bool)
+				mentions, _ := drafty.Mentions(rcpt.Payload.Content)
+				for _, user := range mentions {
+					mentioned[user] = true
+				}
+			}
+			if !mentioned[uid.UserId()] {
+				to.Silent = true
+			}
+		}
+		rcpt.To[uid] = to
+	}
+}
+
+// dispatchPush passes the receipt to push handlers. Recipients with disabled notifications
+// are skipped, recipients with muted notifications are sent a separate silent push.
+func dispatchPush(rcpt *push.Receipt) {
+	var silent *push.Receipt
+	for uid, to := range rcpt.To {
+		if to.Disabled {
+			delete(rcpt.To, uid)
+		} else if to.Silent && !rcpt.Payload.Silent {
+			if silent == nil {
+				silent = &push.Receipt{
+					To:      make(map[types.Uid]push.Recipient),
+					Payload: rcpt.Payload,
+				}
+				silent.Payload.Silent = true
+			}
+			silent.To[uid] = to
+			delete(rcpt.To, uid)
+		}
+	}
+
+	if len(rcpt.To) > 0 || rcpt.Channel != "" {
+		push.Push(rcpt)
+	}
+	if silent != nil {
+		push.Push(silent)
+	}
+}
+
+type notifyPrefsEntry struct {
+	prefs   *types.NotifyPrefs
+	expires time.Time
+}
+
+// userNotifyPrefsCache caches global notification preferences of users owned by this node.
+type userNotifyPrefsCache struct {
+	sync.Mutex
+	entries map[types.Uid]notifyPrefsEntry
+	// Users whose preferences are being loaded from the DB.
+	loading map[types.Uid]bool
+}
+
+var notifyPrefsCache = &userNotifyPrefsCache{
+	entries: make(map[types.Uid]notifyPrefsEntry),
+	loading: make(map[types.Uid]bool),
+}
+
+// get returns notification preferences of the given users. Expired entries are returned as is and
+// refreshed in background. Users missing in cache are loaded from the DB if wait is true, otherwise
+// get returns false.
+func (c *userNotifyPrefsCache) get(uids []types.Uid, wait bool) (map[types.Uid]*types.NotifyPrefs, bool) {
+	now := time.Now()
+	result := make(map[types.Uid]*types.NotifyPrefs, len(uids))
+	var missing, expired []types.Uid
+
+	c.Lock()
+	for _, uid := range uids {
+		entry, ok := c.entries[uid]
+		if !ok {
+			missing = append(missing, uid)
+			continue
+		}
+		result[uid] = entry.prefs
+		if !entry.expires.After(now) && !c.loading[uid] {
+			c.loading[uid] = true
+			expired = append(expired, uid)
+		}
+	}
+	if len(missing) > 0 && wait {
+		for _, uid := range missing {
+			c.loading[uid] = true
+		}
+	}
+	c.Unlock()
+
+	if len(expired) > 0 {
+		go c.load(expired)
+	}
+	if len(missing) > 0 {
+		if !wait {
+			return nil, false
+		}
+		for uid, prefs := range c.load(missing) {
+			result[uid] = prefs
+		}
+	}
+	return result, true
+}
+
+// load reads notification preferences of the users from the DB and caches them.
+// Returns preferences of the users which were loaded or updated meanwhile.
+func (c *userNotifyPrefsCache) load(uids []types.Uid) map[types.Uid]*types.NotifyPrefs {
+	users, err := store.Users.GetAll(uids...)
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Users updated while loading are skipped: the update is newer than what's been read.
+	var pending []types.Uid
+	result := make(map[types.Uid]*types.NotifyPrefs, len(uids))
+	for _, uid := range uids {
+		if c.loading[uid] {
+			delete(c.loading, uid)
+			pending = append(pending, uid)
+		} else if entry, ok := c.entries[uid]; ok {
+			result[uid] = entry.prefs
+		}
+	}
+	if err != nil {
+		// Expired entries are kept, the load is retried on the next push.
+		logs.Warn.Println("push: failed to load notification preferences", err)
+		return result
+	}
+
+	loaded := make(map[types.Uid]*types.NotifyPrefs, len(users))
+	for i := range users {
+		loaded[users[i].Uid()] = users[i].Notify
+	}
+	expires := time.Now().Add(notifyPrefsCacheTTL)
+	for _, uid := range pending {
+		// Users not found in the DB are cached with default preferences.
+		c.setLocked(uid, notifyPrefsEntry{prefs: loaded[uid], expires: expires})
+		result[uid] = loaded[uid]
+	}
+	return result
+}
+
+// update replaces cached preferences of the user with the new ones.
+func (c *userNotifyPrefsCache) update(uid types.Uid, prefs *types.NotifyPrefs) {
+	c.Lock()
+	delete(c.loading, uid)
+	c.setLocked(uid, notifyPrefsEntry{prefs: prefs, expires: time.Now().Add(notifyPrefsCacheTTL)})
+	c.Unlock()
+}
+
+func (c *userNotifyPrefsCache) setLocked(uid types.Uid, entry notifyPrefsEntry) {
+	if _, ok := c.entries[uid]; !ok && len(c.entries) >= notifyPrefsCacheSize {
+		// Evict expired entries. Drop everything if it's not enough.
+		now := time.Now()
+		for uid, entry := range c.entries {
+			if !entry.expires.After(now) {
+				delete(c.entries, uid)
+			}
+		}
+		if len(c.entries) >= notifyPrefsCacheSize {
+			c.entries = make(map[types.Uid]notifyPrefsEntry)
 		}
 	}
+	c.entries[uid] = entry
 }
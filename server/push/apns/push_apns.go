@@ -0,0 +1,408 @@
+// Package apns implements push notification plugin which sends notifications directly to
+// Apple Push Notification service over HTTP/2 using token-based (.p8 key) authentication.
+// https://developer.apple.com/documentation/usernotifications/setting_up_a_remote_notification_server
+//
+// iOS clients which want to receive VoIP (PushKit) notifications of incoming calls register
+// their PushKit token as a separate device ID prefixed with "voip:".
+package apns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+// Delay before the first retry of a failed notification, doubled on every subsequent attempt.
+var retryDelay = time.Second
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 1024
+
+	// TTL of a regular push notification in seconds.
+	defaultTimeToLive = 3600
+
+	// Timeout of a single request to APNs.
+	requestTimeout = 15 * time.Second
+
+	// Number of attempts to send a notification which failed for a transient reason.
+	maxAttempts = 3
+
+	// APNs endpoints.
+	productionEndpoint  = "https://api.push.apple.com"
+	developmentEndpoint = "https://api.sandbox.push.apple.com"
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	// APNs server URL.
+	endpoint string
+	client   *http.Client
+	tokens   *tokenProvider
+	params   common.ApnsParams
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// Content of the .p8 authentication key.
+	AuthKey string `json:"auth_key"`
+	// An alternative way to provide the authentication key.
+	AuthKeyFile string `json:"auth_key_file"`
+	// ID of the authentication key.
+	KeyID string `json:"key_id"`
+	// Apple developer team ID.
+	TeamID string `json:"team_id"`
+	// Bundle ID of the iOS app.
+	BundleID string `json:"bundle_id"`
+	// Use APNs sandbox.
+	Development bool `json:"development"`
+	// Custom APNs URL, used for testing.
+	Endpoint   string `json:"endpoint"`
+	TimeToLive int    `json:"time_to_live,omitempty"`
+	// Send notifications of incoming calls as VoIP pushes.
+	Voip bool           `json:"voip"`
+	Apns *common.Config `json:"apns,omitempty"`
+}
+
+// apnsResponse is the body of the APNs error response.
+type apnsResponse struct {
+	Reason string `json:"reason"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	err := json.Unmarshal([]byte(jsonconf), &config)
+	if err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	authKey := []byte(config.AuthKey)
+	if len(authKey) == 0 && config.AuthKeyFile != "" {
+		authKey, err = os.ReadFile(config.AuthKeyFile)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(authKey) == 0 {
+		return false, errors.New("missing auth key")
+	}
+	key, err := parseAuthKey(authKey)
+	if err != nil {
+		return false, errors.New("invalid auth key: " + err.Error())
+	}
+
+	if config.KeyID == "" || config.TeamID == "" || config.BundleID == "" {
+		return false, errors.New("key_id, team_id, and bundle_id are required")
+	}
+
+	handler.tokens = &tokenProvider{keyID: config.KeyID, teamID: config.TeamID, key: key}
+
+	handler.endpoint = config.Endpoint
+	if handler.endpoint == "" {
+		if config.Development {
+			handler.endpoint = developmentEndpoint
+		} else {
+			handler.endpoint = productionEndpoint
+		}
+	}
+	handler.endpoint = strings.TrimSuffix(handler.endpoint, "/")
+
+	if config.TimeToLive <= 0 {
+		config.TimeToLive = defaultTimeToLive
+	}
+	handler.params = common.ApnsParams{
+		BundleID:   config.BundleID,
+		TimeToLive: config.TimeToLive,
+		Alert:      config.Apns,
+		Voip:       config.Voip,
+	}
+
+	// APNs requires HTTP/2. The default transport negotiates it over TLS.
+	handler.client = &http.Client{
+		Transport: &http.Transport{ForceAttemptHTTP2: true},
+		Timeout:   requestTimeout,
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.channel = make(chan *push.ChannelReq, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case <-handler.channel:
+				// APNs does not support topics (channels). Ignored.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// notification is a single APNs notification ready to be sent.
+type notification struct {
+	uid     t.Uid
+	token   string
+	headers map[string]string
+	payload []byte
+}
+
+// prepareNotifications creates notifications for iOS devices of the receipt recipients.
+func prepareNotifications(rcpt *push.Receipt, params *common.ApnsParams) []*notification {
+	if len(rcpt.To) == 0 {
+		// Channel pushes are not supported.
+		return nil
+	}
+
+	data, err := common.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("apns push: could not parse payload:", err)
+		return nil
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("apns push: db error", err)
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+
+	// VoIP notifications are sent for new calls only.
+	isCall := params.Voip && rcpt.Payload.What == push.ActMsg && rcpt.Payload.Webrtc == "started"
+
+	var notifications []*notification
+	for uid, devList := range devices {
+		var regular, voip []string
+		for i := range devList {
+			d := &devList[i]
+			// iOS apps may register FCM tokens too. Those are sent by the fcm adapter.
+			if d.Platform != "ios" || !common.IsApnsToken(d.DeviceId) {
+				continue
+			}
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			if common.IsApnsVoipToken(d.DeviceId) {
+				voip = append(voip, d.DeviceId)
+			} else {
+				regular = append(regular, d.DeviceId)
+			}
+		}
+
+		userParams := *params
+		tokens := regular
+		if isCall && len(voip) > 0 {
+			tokens = voip
+		} else {
+			// Users without VoIP tokens receive notifications of calls as regular alerts.
+			userParams.Voip = false
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		topic := rcpt.Payload.Topic
+		userData := data
+		tcat := t.GetTopicCat(topic)
+		if rcpt.To[uid].Delivered > 0 || tcat == t.TopicCatP2P {
+			userData = common.ClonePayload(data)
+			// Fix topic name for P2P pushes.
+			if tcat == t.TopicCatP2P {
+				topic, _ = t.P2PNameForUser(uid, topic)
+				userData["topic"] = topic
+			}
+			// Silence the push for user who have received the data interactively.
+			if rcpt.To[uid].Delivered > 0 {
+				userData["silent"] = "true"
+			}
+		}
+
+		aps, headers := common.ApnsNotification(rcpt.Payload.What, topic, userData, rcpt.To[uid].Unread, &userParams)
+		// Custom data is sent alongside the 'aps' dictionary.
+		body := make(map[string]interface{}, len(userData)+1)
+		for key, val := range userData {
+			body[key] = val
+		}
+		body["aps"] = aps
+		payload, err := json.Marshal(body)
+		if err != nil {
+			logs.Warn.Println("apns push: failed to serialize payload:", err)
+			continue
+		}
+
+		for _, token := range tokens {
+			notifications = append(notifications, &notification{
+				uid:     uid,
+				token:   token,
+				headers: headers,
+				payload: payload,
+			})
+		}
+	}
+
+	return notifications
+}
+
+func sendPushes(rcpt *push.Receipt) {
+	for _, n := range prepareNotifications(rcpt, &handler.params) {
+		if !send(n) {
+			// Provider credentials are rejected: the rest of the batch will fail too.
+			return
+		}
+	}
+}
+
+// send delivers one notification, retrying transient failures. Returns false if the rest of
+// notifications should not be sent.
+func send(n *notification) bool {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		status, reason, err := sendNotification(n)
+		if err == nil && !isTransient(status, reason) {
+			return handleResponse(n, status, reason)
+		}
+		if attempt >= maxAttempts {
+			// Give up on this notification but keep sending the others.
+			logs.Warn.Println("apns push failed, skipping:", status, reason, err)
+			return true
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransient checks if the request should be retried.
+func isTransient(status int, reason string) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError ||
+		reason == common.ErrorApnsExpiredProviderToken
+}
+
+// handleResponse processes the final APNs response to the notification.
+func handleResponse(n *notification, status int, reason string) bool {
+	switch {
+	case status == http.StatusOK:
+	case reason == common.ErrorApnsUnregistered:
+		// The app was uninstalled. Delete token from DB.
+		logs.Info.Println("apns unregistered token:", n.uid)
+		if err := store.Devices.Delete(n.uid, n.token); err != nil {
+			logs.Warn.Println("apns failed to delete invalid token:", err)
+		}
+	case reason == common.ErrorApnsBadDeviceToken || reason == common.ErrorApnsDeviceTokenNotForTopic:
+		// Token belongs to a different app or environment (sandbox vs production). It may still be valid: skip it.
+		logs.Warn.Println("apns token rejected:", reason, n.headers[common.HeaderApnsTopic])
+	case status == http.StatusForbidden:
+		// Provider token or certificate is invalid.
+		logs.Warn.Println("apns authentication failure:", reason)
+		return false
+	default:
+		// Malformed notification or unknown errors. Skip it.
+		logs.Warn.Println("apns failure:", status, reason)
+	}
+	return true
+}
+
+// sendNotification posts one notification to APNs. Returns HTTP status and the error reason reported by APNs.
+func sendNotification(n *notification) (int, string, error) {
+	token := strings.TrimPrefix(n.token, common.ApnsVoipTokenPrefix)
+	req, err := http.NewRequest(http.MethodPost, handler.endpoint+"/3/device/"+token, bytes.NewReader(n.payload))
+	if err != nil {
+		return 0, "", err
+	}
+
+	jwt, err := handler.tokens.get(time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Authorization", "bearer "+jwt)
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range n.headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, "", nil
+	}
+
+	var result apnsResponse
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result)
+	if result.Reason == common.ErrorApnsExpiredProviderToken {
+		// Force a new token to be generated for the next request.
+		handler.tokens.expire(jwt)
+	}
+	return resp.StatusCode, result.Reason, nil
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel that the server will use to send group requests to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("apns", &handler)
+}
@@ -0,0 +1,320 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// request is a notification received by the mock APNs server.
+type request struct {
+	proto   int
+	token   string
+	auth    string
+	headers http.Header
+	payload map[string]interface{}
+}
+
+// mockApns starts a local HTTP/2 server which imitates APNs. Tokens listed in rejected fail with the given reason.
+// Tokens rejected as ServiceUnavailable fail only once.
+func mockApns(t *testing.T, rejected map[string]string) (*httptest.Server, *[]request, *sync.Mutex) {
+	var received []request
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.URL.Path, "/3/device/")
+		body, _ := io.ReadAll(req.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error("Invalid payload", err)
+		}
+
+		mu.Lock()
+		received = append(received, request{
+			proto:   req.ProtoMajor,
+			token:   token,
+			auth:    req.Header.Get("Authorization"),
+			headers: req.Header.Clone(),
+			payload: payload,
+		})
+		reason := rejected[token]
+		if reason == common.ErrorApnsServiceUnavailable {
+			if failed[token] {
+				reason = ""
+			}
+			failed[token] = true
+		}
+		mu.Unlock()
+
+		switch reason {
+		case "":
+			wrt.WriteHeader(http.StatusOK)
+			return
+		case common.ErrorApnsUnregistered:
+			wrt.WriteHeader(http.StatusGone)
+		case common.ErrorApnsServiceUnavailable:
+			wrt.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			wrt.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(wrt).Encode(map[string]interface{}{"reason": reason, "timestamp": 0})
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv, &received, &mu
+}
+
+func setupHandler(t *testing.T, srv *httptest.Server, voip bool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.tokens = &tokenProvider{keyID: "ABC123DEFG", teamID: "DEF123GHIJ", key: key}
+	handler.endpoint = srv.URL
+	retryDelay = time.Millisecond
+	handler.client = srv.Client()
+	handler.params = common.ApnsParams{
+		BundleID:   "co.tinode.tinodios",
+		TimeToLive: defaultTimeToLive,
+		Alert:      &common.Config{Enabled: true, Payload: common.Payload{Body: "$content"}},
+		Voip:       voip,
+	}
+}
+
+func TestParseAuthKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseAuthKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(key) {
+		t.Error("Parsed key does not match")
+	}
+
+	if _, err = parseAuthKey([]byte("not a key")); err == nil {
+		t.Error("Invalid key must be rejected")
+	}
+}
+
+func TestTokenProvider(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tp := &tokenProvider{keyID: "ABC123DEFG", teamID: "DEF123GHIJ", key: key}
+
+	now := time.Now()
+	token, err := tp.get(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("Malformed JWT", token)
+	}
+	var header, claims map[string]interface{}
+	h, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(h, &header)
+	json.Unmarshal(c, &claims)
+	if header["alg"] != "ES256" || header["kid"] != "ABC123DEFG" {
+		t.Error("Invalid JWT header", header)
+	}
+	if claims["iss"] != "DEF123GHIJ" || int64(claims["iat"].(float64)) != now.Unix() {
+		t.Error("Invalid JWT claims", claims)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("JWT signature verification failed")
+	}
+
+	// Token is cached.
+	if cached, _ := tp.get(now.Add(time.Minute)); cached != token {
+		t.Error("Token must be cached")
+	}
+	// Token is refreshed when it gets old.
+	if refreshed, _ := tp.get(now.Add(tokenRefreshInterval)); refreshed == token {
+		t.Error("Token must be refreshed")
+	}
+	// Token is refreshed when expired by APNs.
+	token, _ = tp.get(now)
+	tp.expire(token)
+	if refreshed, _ := tp.get(now); refreshed == token {
+		t.Error("Expired token must be replaced")
+	}
+}
+
+// Test tokens: APNs tokens are 64 hex digits.
+var (
+	goodToken    = strings.Repeat("a1", 32)
+	unregToken   = strings.Repeat("b2", 32)
+	badToken     = strings.Repeat("c3", 32)
+	flakyToken   = strings.Repeat("d4", 32)
+	regularToken = strings.Repeat("e5", 32)
+	voipToken    = strings.Repeat("f6", 32)
+)
+
+func TestSendPushes(t *testing.T) {
+	srv, received, mu := mockApns(t, map[string]string{
+		unregToken: common.ErrorApnsUnregistered,
+		badToken:   common.ErrorApnsBadDeviceToken,
+		flakyToken: common.ErrorApnsServiceUnavailable,
+	})
+	defer srv.Close()
+	setupHandler(t, srv, false)
+
+	ctrl := gomock.NewController(t)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = dd
+	defer func() {
+		store.Devices = nil
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	dd.EXPECT().GetAll(uid).Return(map[types.Uid][]types.DeviceDef{
+		uid: {
+			{DeviceId: unregToken, Platform: "ios"},
+			{DeviceId: flakyToken, Platform: "ios"},
+			{DeviceId: badToken, Platform: "ios"},
+			{DeviceId: goodToken, Platform: "ios"},
+			{DeviceId: "fcm-token:APA91bHun4MxP5egoKMwt2KZFBaFUH", Platform: "ios"},
+			{DeviceId: "androidtoken", Platform: "android"},
+		},
+	}, 6, nil)
+	// Only the unregistered token is deleted.
+	dd.EXPECT().Delete(uid, unregToken).Return(nil)
+
+	sendPushes(&push.Receipt{
+		To: map[types.Uid]push.Recipient{uid: {Unread: 5}},
+		Payload: push.Payload{
+			What:        push.ActMsg,
+			Topic:       "grpabcdefghijk",
+			From:        "usrabcdefghijk",
+			Timestamp:   time.Now(),
+			SeqId:       7,
+			ContentType: "text/plain",
+			Content:     "Hello, world",
+		},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The flaky token is retried; errors do not stop the batch.
+	if len(*received) != 5 {
+		t.Fatal("Expected 5 notifications, got", len(*received))
+	}
+	sent := make(map[string]int)
+	for _, req := range *received {
+		sent[req.token]++
+	}
+	if sent[goodToken] != 1 || sent[flakyToken] != 2 {
+		t.Error("Unexpected notifications", sent)
+	}
+	for _, req := range *received {
+		if req.proto != 2 {
+			t.Error("Expected HTTP/2, got", req.proto)
+		}
+		if !strings.HasPrefix(req.auth, "bearer ") {
+			t.Error("Missing provider token", req.auth)
+		}
+		if req.headers.Get(common.HeaderApnsTopic) != "co.tinode.tinodios" ||
+			req.headers.Get(common.HeaderApnsPushType) != string(common.ApnsPushTypeAlert) {
+			t.Error("Unexpected headers", req.headers)
+		}
+		aps, _ := req.payload["aps"].(map[string]interface{})
+		if aps == nil || aps["badge"] != float64(5) {
+			t.Fatal("Invalid aps", req.payload)
+		}
+		if alert, _ := aps["alert"].(map[string]interface{}); alert == nil || alert["body"] != "Hello, world" {
+			t.Error("Invalid alert", aps["alert"])
+		}
+		if req.payload["seq"] != "7" || req.payload["topic"] != "grpabcdefghijk" {
+			t.Error("Missing custom data", req.payload)
+		}
+	}
+}
+
+func TestSendVoipPush(t *testing.T) {
+	srv, received, mu := mockApns(t, nil)
+	defer srv.Close()
+	setupHandler(t, srv, true)
+
+	ctrl := gomock.NewController(t)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = dd
+	defer func() {
+		store.Devices = nil
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	dd.EXPECT().GetAll(uid).Return(map[types.Uid][]types.DeviceDef{
+		uid: {
+			{DeviceId: regularToken, Platform: "ios"},
+			{DeviceId: common.ApnsVoipTokenPrefix + voipToken, Platform: "ios"},
+		},
+	}, 2, nil)
+
+	sendPushes(&push.Receipt{
+		To: map[types.Uid]push.Recipient{uid: {}},
+		Payload: push.Payload{
+			What:      push.ActMsg,
+			Topic:     "usrabcdefghijk",
+			Timestamp: time.Now(),
+			SeqId:     8,
+			Content:   "",
+			Webrtc:    "started",
+		},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*received) != 1 {
+		t.Fatal("Expected 1 notification, got", len(*received))
+	}
+	req := (*received)[0]
+	if req.token != voipToken {
+		t.Error("VoIP push sent to wrong token", req.token)
+	}
+	if req.headers.Get(common.HeaderApnsTopic) != "co.tinode.tinodios.voip" ||
+		req.headers.Get(common.HeaderApnsPushType) != string(common.ApnsPushTypeVoip) {
+		t.Error("Unexpected VoIP headers", req.headers)
+	}
+	if req.payload["webrtc"] != "started" {
+		t.Error("Missing call data", req.payload)
+	}
+}
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
@@ -0,0 +1,74 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push/common"
+)
+
+// APNs rejects provider tokens older than one hour and throttles tokens refreshed more often than
+// every 20 minutes.
+const tokenRefreshInterval = 50 * time.Minute
+
+// tokenProvider generates and caches JWT provider authentication tokens.
+type tokenProvider struct {
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// parseAuthKey parses the PKCS#8 PEM-encoded .p8 signing key downloaded from Apple developer account.
+func parseAuthKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("auth key is not PEM-encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("auth key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// get returns a cached token or generates a new one if the cached token is too old.
+func (tp *tokenProvider) get(now time.Time) (string, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.token != "" && now.Sub(tp.issuedAt) < tokenRefreshInterval {
+		return tp.token, nil
+	}
+
+	token, err := common.SignES256(map[string]string{"kid": tp.keyID},
+		map[string]interface{}{"iss": tp.teamID, "iat": now.Unix()}, tp.key)
+	if err != nil {
+		return "", err
+	}
+
+	tp.token = token
+	tp.issuedAt = now
+	return tp.token, nil
+}
+
+// expire invalidates the cached token if APNs rejected it as expired.
+func (tp *tokenProvider) expire(token string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.token == token {
+		tp.token = ""
+	}
+}
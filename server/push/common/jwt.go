@@ -0,0 +1,39 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// SignES256 creates a JWT with the given header and claims signed by the ECDSA P-256 key.
+// The "alg" header is set to "ES256".
+func SignES256(header map[string]string, claims map[string]interface{}, key *ecdsa.PrivateKey) (string, error) {
+	hdr := map[string]string{"alg": "ES256"}
+	for k, v := range header {
+		hdr[k] = v
+	}
+	hdrJSON, err := json.Marshal(hdr)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(hdrJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS ES256 signature is a concatenation of r and s, 32 bytes each.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,170 @@
+package common
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+)
+
+// TTL of a VOIP push notification in seconds.
+const voipTimeToLive = 10
+
+// PayloadToData converts push payload to a flat map of strings suitable for sending as FCM data
+// or as custom fields of an APNs notification.
+func PayloadToData(pl *push.Payload) (map[string]string, error) {
+	if pl == nil {
+		return nil, errors.New("empty push payload")
+	}
+	data := make(map[string]string)
+	var err error
+	data["what"] = pl.What
+	if pl.Silent {
+		data["silent"] = "true"
+	}
+	data["topic"] = pl.Topic
+	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
+	// Must use "xfrom" because "from" is a reserved word. Google did not bother to document it anywhere.
+	data["xfrom"] = pl.From
+	if pl.What == push.ActMsg {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		if pl.ContentType != "" {
+			data["mime"] = pl.ContentType
+		}
+
+		// Convert Drafty content to plain text (clients 0.16 and below).
+		data["content"], err = drafty.PlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+		// Trim long strings to 128 runes.
+		// Check byte length first and don't waste time converting short strings.
+		if len(data["content"]) > push.MaxPayloadLength {
+			runes := []rune(data["content"])
+			if len(runes) > push.MaxPayloadLength {
+				data["content"] = string(runes[:push.MaxPayloadLength]) + "…"
+			}
+		}
+
+		// Rich content for clients version 0.17 and above.
+		data["rc"], err = drafty.Preview(pl.Content, push.MaxPayloadLength)
+
+		if pl.Webrtc != "" {
+			data["webrtc"] = pl.Webrtc
+			if pl.AudioOnly {
+				data["aonly"] = "true"
+			}
+			// Video call push notifications are silent.
+			data["silent"] = "true"
+		}
+		if pl.Replace != "" {
+			// Notification of a message edit should be silent too.
+			data["silent"] = "true"
+			data["replace"] = pl.Replace
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if pl.What == push.ActSub {
+		data["modeWant"] = pl.ModeWant.String()
+		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActRead {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["silent"] = "true"
+	} else {
+		return nil, errors.New("unknown push type")
+	}
+	return data, nil
+}
+
+// ClonePayload makes a shallow copy of the data payload.
+func ClonePayload(src map[string]string) map[string]string {
+	dst := make(map[string]string, len(src))
+	for key, val := range src {
+		dst[key] = val
+	}
+	return dst
+}
+
+// ApnsParams are the parameters of an APNs notification which do not depend on the payload.
+type ApnsParams struct {
+	// Bundle ID of the iOS app.
+	BundleID string
+	// Time in seconds before the notification is discarded if undelivered.
+	TimeToLive int
+	// Configuration of the visible alert, optional.
+	Alert *Config
+	// Send notifications of new video calls as PushKit VoIP pushes.
+	Voip bool
+}
+
+func apnsShouldPresentAlert(what, callStatus, isSilent string, config *Config) bool {
+	return config != nil && config.Enabled && what != push.ActRead && callStatus == "" && isSilent == ""
+}
+
+// ApnsNotification creates the 'aps' dictionary and the HTTP headers of an APNs notification
+// for the given data payload.
+func ApnsNotification(what, topic string, data map[string]string, unread int, params *ApnsParams) (*Aps, map[string]string) {
+	callStatus := data["webrtc"]
+	expires := time.Now().UTC().Add(time.Duration(params.TimeToLive) * time.Second)
+	bundleId := params.BundleID
+	pushType := ApnsPushTypeAlert
+	priority := 10
+	interruptionLevel := InterruptionLevelTimeSensitive
+	if callStatus == "started" {
+		// Send VOIP push only when a new call is started, otherwise send normal alert.
+		interruptionLevel = InterruptionLevelCritical
+		if params.Voip {
+			pushType = ApnsPushTypeVoip
+			bundleId += ".voip"
+		}
+		expires = time.Now().UTC().Add(time.Duration(voipTimeToLive) * time.Second)
+	} else if what == push.ActRead {
+		priority = 5
+		interruptionLevel = InterruptionLevelPassive
+		pushType = ApnsPushTypeBackground
+	}
+
+	aps := &Aps{
+		Badge:             unread,
+		ContentAvailable:  1,
+		MutableContent:    1,
+		InterruptionLevel: interruptionLevel,
+		Sound:             "default",
+		ThreadID:          topic,
+	}
+
+	// Do not present alert for read notifications and video calls.
+	config := params.Alert
+	if apnsShouldPresentAlert(what, callStatus, data["silent"], config) {
+		body := config.GetStringField(what, "Body")
+		if body == "$content" {
+			body = data["content"]
+		}
+
+		aps.Alert = &ApsAlert{
+			Action:          config.GetStringField(what, "Action"),
+			ActionLocKey:    config.GetStringField(what, "ActionLocKey"),
+			Body:            body,
+			LaunchImage:     config.GetStringField(what, "LaunchImage"),
+			LocKey:          config.GetStringField(what, "LocKey"),
+			Title:           config.GetStringField(what, "Title"),
+			Subtitle:        config.GetStringField(what, "Subtitle"),
+			TitleLocKey:     config.GetStringField(what, "TitleLocKey"),
+			SummaryArg:      config.GetStringField(what, "SummaryArg"),
+			SummaryArgCount: config.GetIntField(what, "SummaryArgCount"),
+		}
+	}
+
+	headers := map[string]string{
+		HeaderApnsExpiration: strconv.FormatInt(expires.Unix(), 10),
+		HeaderApnsPriority:   strconv.Itoa(priority),
+		HeaderApnsTopic:      bundleId,
+		HeaderApnsCollapseID: topic,
+		HeaderApnsPushType:   string(pushType),
+	}
+
+	return aps, headers
+}
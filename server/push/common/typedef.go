@@ -544,3 +544,33 @@ func DecodeGoogleApiError(err error) (decoded *GApiError, errs []error) {
 
 	return
 }
+
+// IsWebPushSubscription checks if the device ID is a Web Push (RFC 8030) subscription serialized as JSON
+// rather than a push token issued by a push service like FCM or APNs.
+func IsWebPushSubscription(deviceId string) bool {
+	return strings.HasPrefix(deviceId, "{")
+}
+
+// ApnsVoipTokenPrefix marks device IDs which are APNs PushKit (VoIP) tokens. Such tokens can only be used by
+// the apns adapter for sending VoIP notifications of incoming calls.
+const ApnsVoipTokenPrefix = "voip:"
+
+// IsApnsVoipToken checks if the device ID is an APNs PushKit (VoIP) token.
+func IsApnsVoipToken(deviceId string) bool {
+	return strings.HasPrefix(deviceId, ApnsVoipTokenPrefix)
+}
+
+// IsApnsToken checks if the device ID is a token issued by APNs rather than by FCM: APNs tokens are hex strings
+// of at least 32 bytes, FCM registration tokens are not. VoIP tokens are APNs tokens too.
+func IsApnsToken(deviceId string) bool {
+	token := strings.TrimPrefix(deviceId, ApnsVoipTokenPrefix)
+	if len(token) < 64 || len(token)%2 != 0 {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,13 +2,10 @@ package fcm
 
 import (
 	"encoding/json"
-	"errors"
 	"strconv"
-	"time"
 
 	fcmv1 "google.golang.org/api/fcm/v1"
 
-	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/push/common"
@@ -16,90 +13,13 @@ import (
 	t "github.com/tinode/chat/server/store/types"
 )
 
-const (
-	// TTL of a VOIP push notification in seconds.
-	voipTimeToLive = 10
-	// TTL of a regular push notification in seconds.
-	defaultTimeToLive = 3600
-)
-
-func payloadToData(pl *push.Payload) (map[string]string, error) {
-	if pl == nil {
-		return nil, errors.New("empty push payload")
-	}
-	data := make(map[string]string)
-	var err error
-	data["what"] = pl.What
-	if pl.Silent {
-		data["silent"] = "true"
-	}
-	data["topic"] = pl.Topic
-	data["ts"] = pl.Timestamp.Format(time.RFC3339Nano)
-	// Must use "xfrom" because "from" is a reserved word. Google did not bother to document it anywhere.
-	data["xfrom"] = pl.From
-	if pl.What == push.ActMsg {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		if pl.ContentType != "" {
-			data["mime"] = pl.ContentType
-		}
-
-		// Convert Drafty content to plain text (clients 0.16 and below).
-		data["content"], err = drafty.PlainText(pl.Content)
-		if err != nil {
-			return nil, err
-		}
-		// Trim long strings to 128 runes.
-		// Check byte length first and don't waste time converting short strings.
-		if len(data["content"]) > push.MaxPayloadLength {
-			runes := []rune(data["content"])
-			if len(runes) > push.MaxPayloadLength {
-				data["content"] = string(runes[:push.MaxPayloadLength]) + "…"
-			}
-		}
-
-		// Rich content for clients version 0.17 and above.
-		data["rc"], err = drafty.Preview(pl.Content, push.MaxPayloadLength)
-
-		if pl.Webrtc != "" {
-			data["webrtc"] = pl.Webrtc
-			if pl.AudioOnly {
-				data["aonly"] = "true"
-			}
-			// Video call push notifications are silent.
-			data["silent"] = "true"
-		}
-		if pl.Replace != "" {
-			// Notification of a message edit should be silent too.
-			data["silent"] = "true"
-			data["replace"] = pl.Replace
-		}
-		if err != nil {
-			return nil, err
-		}
-	} else if pl.What == push.ActSub {
-		data["modeWant"] = pl.ModeWant.String()
-		data["modeGiven"] = pl.ModeGiven.String()
-	} else if pl.What == push.ActRead {
-		data["seq"] = strconv.Itoa(pl.SeqId)
-		data["silent"] = "true"
-	} else {
-		return nil, errors.New("unknown push type")
-	}
-	return data, nil
-}
-
-func clonePayload(src map[string]string) map[string]string {
-	dst := make(map[string]string, len(src))
-	for key, val := range src {
-		dst[key] = val
-	}
-	return dst
-}
+// TTL of a regular push notification in seconds.
+const defaultTimeToLive = 3600
 
 // PrepareV1Notifications creates notification payloads ready to be posted
 // to push notification server for the provided receipt.
 func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Message, []t.Uid) {
-	data, err := payloadToData(&rcpt.Payload)
+	data, err := common.PayloadToData(&rcpt.Payload)
 	if err != nil {
 		logs.Warn.Println("fcm push: could not parse payload:", err)
 		return nil, nil
@@ -146,7 +66,7 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 		userData := data
 		tcat := t.GetTopicCat(topic)
 		if rcpt.To[uid].Delivered > 0 || tcat == t.TopicCatP2P {
-			userData = clonePayload(data)
+			userData = common.ClonePayload(data)
 			// Fix topic name for P2P pushes.
 			if tcat == t.TopicCatP2P {
 				topic, _ = t.P2PNameForUser(uid, topic)
@@ -160,6 +80,10 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 
 		for i := range devList {
 			d := &devList[i]
+			if common.IsWebPushSubscription(d.DeviceId) || common.IsApnsToken(d.DeviceId) {
+				// Web Push subscriptions and APNs tokens are handled by the webpush and apns adapters.
+				continue
+			}
 			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
 				msg := fcmv1.Message{
 					Token: d.DeviceId,
@@ -189,7 +113,7 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 
 	if rcpt.Channel != "" {
 		topic := rcpt.Channel
-		userData := clonePayload(data)
+		userData := common.ClonePayload(data)
 		userData["topic"] = topic
 		// Channel receiver should not know the ID of the message sender.
 		delete(userData, "xfrom")
@@ -222,9 +146,12 @@ func DevicesForUser(uid t.Uid) []string {
 		return nil
 	}
 
-	devices := make([]string, count)
-	for i, dd := range ddef[uid] {
-		devices[i] = dd.DeviceId
+	devices := make([]string, 0, count)
+	for _, dd := range ddef[uid] {
+		// Web Push subscriptions and APNs tokens cannot be subscribed to FCM topics.
+		if !common.IsWebPushSubscription(dd.DeviceId) && !common.IsApnsToken(dd.DeviceId) {
+			devices = append(devices, dd.DeviceId)
+		}
 	}
 	return devices
 }
@@ -301,82 +228,27 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 	return ac
 }
 
-func apnsShouldPresentAlert(what, callStatus, isSilent string, config *configType) bool {
-	return config.Apns != nil && config.Apns.Enabled && what != push.ActRead && callStatus == "" && isSilent == ""
-}
-
 func apnsNotificationConfig(what, topic string, data map[string]string, unread int, config *configType) *fcmv1.ApnsConfig {
-	callStatus := data["webrtc"]
-	expires := time.Now().UTC().Add(time.Duration(defaultTimeToLive) * time.Second)
+	timeToLive := defaultTimeToLive
 	if config.TimeToLive > 0 {
-		expires = time.Now().UTC().Add(time.Duration(config.TimeToLive) * time.Second)
-	}
-	bundleId := config.ApnsBundleID
-	pushType := common.ApnsPushTypeAlert
-	priority := 10
-	interruptionLevel := common.InterruptionLevelTimeSensitive
-	if callStatus == "started" {
-		// Send VOIP push only when a new call is started, otherwise send normal alert.
-		interruptionLevel = common.InterruptionLevelCritical
-		// FIXME: PushKit notifications do not work with the current FCM adapter.
-		// Using normal pushes as a poor-man's replacement for VOIP pushes.
-		// Uncomment the following two lines when FCM fixes its problem or when we switch to
-		// a different adapter.
-		// pushType = common.ApnsPushTypeVoip
-		// bundleId += ".voip"
-		expires = time.Now().UTC().Add(time.Duration(voipTimeToLive) * time.Second)
-	} else if what == push.ActRead {
-		priority = 5
-		interruptionLevel = common.InterruptionLevelPassive
-		pushType = common.ApnsPushTypeBackground
+		timeToLive = config.TimeToLive
 	}
 
-	apsPayload := common.Aps{
-		Badge:             unread,
-		ContentAvailable:  1,
-		MutableContent:    1,
-		InterruptionLevel: interruptionLevel,
-		Sound:             "default",
-		ThreadID:          topic,
-	}
-
-	// Do not present alert for read notifications and video calls.
-	if apnsShouldPresentAlert(what, callStatus, data["silent"], config) {
-		body := config.Apns.GetStringField(what, "Body")
-		if body == "$content" {
-			body = data["content"]
-		}
+	// PushKit notifications do not work with the current FCM adapter. Using normal pushes as a poor-man's
+	// replacement for VOIP pushes.
+	aps, headers := common.ApnsNotification(what, topic, data, unread, &common.ApnsParams{
+		BundleID:   config.ApnsBundleID,
+		TimeToLive: timeToLive,
+		Alert:      config.Apns,
+	})
 
-		apsPayload.Alert = &common.ApsAlert{
-			Action:          config.Apns.GetStringField(what, "Action"),
-			ActionLocKey:    config.Apns.GetStringField(what, "ActionLocKey"),
-			Body:            body,
-			LaunchImage:     config.Apns.GetStringField(what, "LaunchImage"),
-			LocKey:          config.Apns.GetStringField(what, "LocKey"),
-			Title:           config.Apns.GetStringField(what, "Title"),
-			Subtitle:        config.Apns.GetStringField(what, "Subtitle"),
-			TitleLocKey:     config.Apns.GetStringField(what, "TitleLocKey"),
-			SummaryArg:      config.Apns.GetStringField(what, "SummaryArg"),
-			SummaryArgCount: config.Apns.GetIntField(what, "SummaryArgCount"),
-		}
-	}
-
-	payload, err := json.Marshal(map[string]interface{}{"aps": apsPayload})
+	payload, err := json.Marshal(map[string]interface{}{"aps": aps})
 	if err != nil {
 		return nil
 	}
-	headers := map[string]string{
-		common.HeaderApnsExpiration: strconv.FormatInt(expires.Unix(), 10),
-		common.HeaderApnsPriority:   strconv.Itoa(priority),
-		common.HeaderApnsTopic:      bundleId,
-		common.HeaderApnsCollapseID: topic,
-		common.HeaderApnsPushType:   string(pushType),
-	}
 
-	ac := &fcmv1.ApnsConfig{
+	return &fcmv1.ApnsConfig{
 		Headers: headers,
 		Payload: payload,
 	}
-
-	return ac
 }
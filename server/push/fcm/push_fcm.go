@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net/http"
 	"os"
 
 	fbase "firebase.google.com/go"
@@ -43,6 +44,7 @@ type Handler struct {
 	channel   chan *push.ChannelReq
 	stop      chan bool
 	projectID string
+	config    *configType
 
 	client *legacy.Client
 	v1     *fcmv1.Service
@@ -112,6 +114,7 @@ func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	handler.channel = make(chan *push.ChannelReq, bufferSize)
 	handler.stop = make(chan bool, 1)
 	handler.projectID = credentials.ProjectID
+	handler.config = &config
 
 	go func() {
 		for {
@@ -129,7 +132,8 @@ func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	return true, nil
 }
 
-func sendFcmV1(rcpt *push.Receipt, config *configType) {
+// sendFcmV1 sends the receipt. Returns push.RetryError with recipients not sent to if the failure is transient.
+func sendFcmV1(rcpt *push.Receipt, config *configType) error {
 	messages, uids := PrepareV1Notifications(rcpt, config)
 	for i := range messages {
 		req := &fcmv1.SendMessageRequest{
@@ -143,15 +147,20 @@ func sendFcmV1(rcpt *push.Receipt, config *configType) {
 				logs.Info.Println("fcm googleapi.Error decoding:", err)
 			}
 			switch gerr.FcmErrCode {
-			case "": // no error
+			case "":
+				if gerr.HttpCode == 0 || gerr.HttpCode == http.StatusTooManyRequests || gerr.HttpCode >= 500 {
+					// Network failure or server error without FCM error code.
+					logs.Warn.Println("fcm request failed:", err)
+					return push.NewRetryError(uids[i:], err)
+				}
 			case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
 				// Transient errors. Stop sending this batch.
 				logs.Warn.Println("fcm transient failure:", gerr.FcmErrCode, gerr.ErrMessage)
-				return
+				return push.NewRetryError(uids[i:], errors.New(gerr.FcmErrCode))
 			case common.ErrorSenderIDMismatch, common.ErrorInvalidArgument, common.ErrorThirdPartyAuth:
 				// Config errors. Stop.
 				logs.Warn.Println("fcm invalid config:", gerr.FcmErrCode, gerr.ErrMessage)
-				return
+				return errors.New("fcm invalid config: " + gerr.FcmErrCode)
 			case common.ErrorUnregistered:
 				// Token is no longer valid. Delete token from DB and continue sending.
 				logs.Warn.Println("fcm invalid token:", gerr.FcmErrCode, gerr.ErrMessage)
@@ -161,10 +170,11 @@ func sendFcmV1(rcpt *push.Receipt, config *configType) {
 			default:
 				// Unknown error. Stop sending just in case.
 				logs.Warn.Println("tnpg unrecognized error:", gerr.FcmErrCode, gerr.ErrMessage)
-				return
+				return errors.New("fcm unrecognized error: " + gerr.FcmErrCode)
 			}
 		}
 	}
+	return nil
 }
 
 func processSubscription(req *push.ChannelReq) {
@@ -176,7 +186,8 @@ func processSubscription(req *push.ChannelReq) {
 	if req.Channel != "" {
 		devices = DevicesForUser(req.Uid)
 		channel = req.Channel
-	} else if req.DeviceID != "" {
+	} else if req.DeviceID != "" &&
+		!common.IsWebPushSubscription(req.DeviceID) && !common.IsApnsToken(req.DeviceID) {
 		channels = ChannelsForUser(req.Uid)
 		device = req.DeviceID
 	}
@@ -256,6 +267,11 @@ func (Handler) Push() chan<- *push.Receipt {
 	return handler.input
 }
 
+// Deliver sends the receipt synchronously; implements push.Deliverer interface.
+func (Handler) Deliver(rcpt *push.Receipt) error {
+	return sendFcmV1(rcpt, handler.config)
+}
+
 // Channel returns a channel for subscribing/unsubscribing devices to FCM topics.
 func (Handler) Channel() chan<- *push.ChannelReq {
 	return handler.channel
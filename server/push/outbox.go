@@ -0,0 +1,629 @@
+package push
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// ErrRetry is returned by Deliverer.Deliver (possibly wrapped) when delivery failed for a transient
+// reason and should be retried later.
+var ErrRetry = errors.New("push: transient failure")
+
+// RetryError is returned by Deliverer.Deliver when delivery to some of the recipients failed for
+// a transient reason. Only the failed recipients are retried, the others have been delivered.
+type RetryError struct {
+	// Recipients to retry. ZeroUid stands for the channel.
+	Failed []t.Uid
+	Err    error
+}
+
+func (e *RetryError) Error() string {
+	return "push: transient failure: " + e.Err.Error()
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrRetry) true for RetryError.
+func (e *RetryError) Is(target error) bool {
+	return target == ErrRetry
+}
+
+// NewRetryError creates a RetryError for the given recipients. Duplicate recipients are removed.
+func NewRetryError(failed []t.Uid, err error) error {
+	seen := make(map[t.Uid]bool, len(failed))
+	unique := make([]t.Uid, 0, len(failed))
+	for _, uid := range failed {
+		if !seen[uid] {
+			seen[uid] = true
+			unique = append(unique, uid)
+		}
+	}
+	return &RetryError{Failed: unique, Err: err}
+}
+
+// Deliverer is an optional interface implemented by handlers which can deliver a receipt synchronously
+// and report the outcome. When the outbox is enabled, such handlers are called through Deliver instead
+// of the Push channel.
+type Deliverer interface {
+	// Deliver sends the receipt and returns an error if it could not be delivered.
+	// Errors wrapping ErrRetry are retried, other errors are final. RetryError limits the retry
+	// to the failed recipients.
+	Deliver(rcpt *Receipt) error
+}
+
+const (
+	defaultOutboxQueueSize      = 10000
+	defaultOutboxMaxAttempts    = 8
+	defaultOutboxInitialBackoff = 1
+	defaultOutboxMaxBackoff     = 300
+	defaultOutboxMaxAge         = 3600
+	defaultOutboxConcurrency    = 16
+	defaultOutboxDeadLetterTTL  = 7 * 24 * 3600
+
+	// How long to wait for a handler without Deliver to accept a receipt into its channel.
+	outboxHandoffTimeout = 5 * time.Second
+	// How often to expire old dead-lettered entries.
+	outboxExpirePeriod = time.Hour
+
+	// Key prefixes of persisted entries: queued for retry and dead-lettered.
+	outboxKeyPrefix     = "pushq:"
+	deadLetterKeyPrefix = "pushdl:"
+)
+
+// OutboxConfig is the configuration of the push outbox.
+type OutboxConfig struct {
+	Enabled bool `json:"enabled"`
+	// Persist receipts in the DB when they are queued so they survive restarts and crashes.
+	Persist bool `json:"persist"`
+	// Maximum number of receipts queued per handler. Receipts over the limit are dead-lettered.
+	QueueSize int `json:"queue_size"`
+	// Maximum number of delivery attempts before the receipt is dead-lettered.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry (seconds), doubled on every subsequent attempt.
+	InitialBackoff int `json:"initial_backoff"`
+	// Maximum delay between retries (seconds).
+	MaxBackoff int `json:"max_backoff"`
+	// Receipts older than this are not retried (seconds): stale notifications are useless.
+	MaxAge int `json:"max_age"`
+	// Number of concurrent deliveries per handler.
+	Concurrency int `json:"concurrency"`
+	// Overrides of concurrency for individual handlers, e.g. {"fcm": 32}.
+	HandlerConcurrency map[string]int `json:"handler_concurrency"`
+	// How long to keep dead-lettered receipts in the DB (seconds).
+	DeadLetterTTL int `json:"dead_letter_ttl"`
+}
+
+// outboxEntry is a receipt queued for delivery by one handler.
+type outboxEntry struct {
+	Id        string    `json:"id"`
+	Handler   string    `json:"handler"`
+	CreatedAt time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"error,omitempty"`
+	// The receipt with recipients keyed by 'usrXXX' IDs: Uid cannot be used as a JSON key.
+	To      map[string]Recipient `json:"to"`
+	Channel string               `json:"channel,omitempty"`
+	Payload Payload              `json:"payload"`
+
+	rcpt *Receipt
+	// The entry is saved in the DB. Accessed by the persister only.
+	persisted bool
+}
+
+func newOutboxEntry(handler string, rcpt *Receipt) *outboxEntry {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return &outboxEntry{
+		Id:        base64.RawURLEncoding.EncodeToString(id),
+		Handler:   handler,
+		CreatedAt: time.Now(),
+		rcpt:      rcpt,
+	}
+}
+
+// retryOnly limits the entry to the recipients which failed. Returns false if there is nothing to retry.
+func (e *outboxEntry) retryOnly(failed []t.Uid) bool {
+	// The receipt is shared with other handlers: make a copy.
+	rcpt := &Receipt{To: make(map[t.Uid]Recipient, len(failed)), Payload: e.rcpt.Payload}
+	for _, uid := range failed {
+		if uid.IsZero() {
+			rcpt.Channel = e.rcpt.Channel
+		} else if r, ok := e.rcpt.To[uid]; ok {
+			rcpt.To[uid] = r
+		}
+	}
+	e.rcpt = rcpt
+	return len(rcpt.To) > 0 || rcpt.Channel != ""
+}
+
+func (e *outboxEntry) marshal() (string, error) {
+	e.To = make(map[string]Recipient, len(e.rcpt.To))
+	for uid, r := range e.rcpt.To {
+		e.To[uid.UserId()] = r
+	}
+	e.Channel = e.rcpt.Channel
+	e.Payload = e.rcpt.Payload
+	data, err := json.Marshal(e)
+	return string(data), err
+}
+
+func unmarshalOutboxEntry(data string) (*outboxEntry, error) {
+	var e outboxEntry
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		return nil, err
+	}
+	e.rcpt = &Receipt{To: make(map[t.Uid]Recipient, len(e.To)), Channel: e.Channel, Payload: e.Payload}
+	for id, r := range e.To {
+		if uid := t.ParseUserId(id); !uid.IsZero() {
+			e.rcpt.To[uid] = r
+		}
+	}
+	e.To, e.persisted = nil, true
+	return &e, nil
+}
+
+// Operations of the outbox persister.
+const (
+	outboxSave = iota
+	outboxDelete
+	outboxDeadLetter
+)
+
+// outboxWrite is a DB write of one entry performed by the persister.
+type outboxWrite struct {
+	op   int
+	e    *outboxEntry
+	data string
+}
+
+// outboxStats are delivery counters of one handler.
+type outboxStats struct {
+	Queued       int64 `json:"queued"`
+	Delivered    int64 `json:"delivered"`
+	Retried      int64 `json:"retried"`
+	DeadLettered int64 `json:"dead_lettered"`
+}
+
+// outboxQueue is a queue of receipts for one handler.
+type outboxQueue struct {
+	// Accessed atomically. Must be the first field for 64-bit alignment.
+	stats outboxStats
+
+	name string
+	hnd  Handler
+	// Semaphore limiting the number of concurrent deliveries.
+	sem chan struct{}
+
+	mu      sync.Mutex
+	pending []*outboxEntry
+	// Signal to the dispatcher that the queue is no longer empty.
+	wake chan struct{}
+}
+
+func (q *outboxQueue) push(e *outboxEntry) {
+	q.mu.Lock()
+	q.pending = append(q.pending, e)
+	q.mu.Unlock()
+	atomic.AddInt64(&q.stats.Queued, 1)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *outboxQueue) pop() *outboxEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	e := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	atomic.AddInt64(&q.stats.Queued, -1)
+	return e
+}
+
+// drain removes all pending entries from the queue.
+func (q *outboxQueue) drain() []*outboxEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := q.pending
+	q.pending = nil
+	atomic.StoreInt64(&q.stats.Queued, 0)
+	return pending
+}
+
+// attempt makes one delivery attempt.
+func (q *outboxQueue) attempt(rcpt *Receipt) error {
+	if d, ok := q.hnd.(Deliverer); ok {
+		return d.Deliver(rcpt)
+	}
+
+	timer := time.NewTimer(outboxHandoffTimeout)
+	defer timer.Stop()
+	select {
+	case q.hnd.Push() <- rcpt:
+		return nil
+	case <-timer.C:
+		return ErrRetry
+	}
+}
+
+// pushOutbox queues receipts between Push and the handlers, retries failed deliveries with
+// exponential backoff and dead-letters receipts which could not be delivered.
+type pushOutbox struct {
+	persist        bool
+	queueSize      int
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxAge         time.Duration
+	deadLetterTTL  time.Duration
+	// Persisted keys are prefixed with the node name so cluster nodes sharing the DB
+	// do not pick up each other's entries.
+	keyPrefix        string
+	deadLetterPrefix string
+
+	queues map[string]*outboxQueue
+
+	// DB writes performed asynchronously by the persister. A write with nil entry stops the persister.
+	writes        chan outboxWrite
+	persisterDone chan struct{}
+
+	done     chan struct{}
+	workers  sync.WaitGroup
+	inflight sync.WaitGroup
+}
+
+var outbox *pushOutbox
+
+// InitOutbox starts the outbox for all ready handlers. Must be called after Init.
+// The node is the name of the current cluster node, could be blank.
+func InitOutbox(jsconfig json.RawMessage, node string) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config OutboxConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse outbox config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	ob := &pushOutbox{
+		persist:          config.Persist,
+		queueSize:        withDefault(config.QueueSize, defaultOutboxQueueSize),
+		maxAttempts:      withDefault(config.MaxAttempts, defaultOutboxMaxAttempts),
+		initialBackoff:   time.Second * time.Duration(withDefault(config.InitialBackoff, defaultOutboxInitialBackoff)),
+		maxBackoff:       time.Second * time.Duration(withDefault(config.MaxBackoff, defaultOutboxMaxBackoff)),
+		maxAge:           time.Second * time.Duration(withDefault(config.MaxAge, defaultOutboxMaxAge)),
+		deadLetterTTL:    time.Second * time.Duration(withDefault(config.DeadLetterTTL, defaultOutboxDeadLetterTTL)),
+		keyPrefix:        outboxKeyPrefix + node + ":",
+		deadLetterPrefix: deadLetterKeyPrefix + node + ":",
+		queues:           make(map[string]*outboxQueue),
+		done:             make(chan struct{}),
+	}
+
+	for name, hnd := range handlers {
+		if !hnd.IsReady() {
+			continue
+		}
+		concurrency := config.HandlerConcurrency[name]
+		if concurrency <= 0 {
+			concurrency = withDefault(config.Concurrency, defaultOutboxConcurrency)
+		}
+		ob.queues[name] = &outboxQueue{
+			name: name,
+			hnd:  hnd,
+			sem:  make(chan struct{}, concurrency),
+			wake: make(chan struct{}, 1),
+		}
+	}
+
+	if ob.persist {
+		ob.writes = make(chan outboxWrite, ob.queueSize)
+		ob.persisterDone = make(chan struct{})
+		ob.restore()
+		go ob.persister()
+	}
+
+	for _, q := range ob.queues {
+		ob.workers.Add(1)
+		go ob.dispatch(q)
+	}
+	if ob.persist {
+		ob.workers.Add(1)
+		go ob.expireDeadLetters()
+	}
+
+	if expvar.Get("PushOutbox") == nil {
+		expvar.Publish("PushOutbox", expvar.Func(func() any {
+			if outbox == nil {
+				return nil
+			}
+			return outbox.stats()
+		}))
+	}
+
+	outbox = ob
+	return true, nil
+}
+
+func withDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
+
+// enqueue adds the receipt to queues of all handlers. It does not block: entries are persisted
+// by the persister in the background.
+func (ob *pushOutbox) enqueue(rcpt *Receipt) {
+	for name, q := range ob.queues {
+		e := newOutboxEntry(name, rcpt)
+		if int(atomic.LoadInt64(&q.stats.Queued)) >= ob.queueSize {
+			e.LastError = "queue full"
+			ob.deadLetter(q, e, false)
+			continue
+		}
+		if ob.persist {
+			ob.save(e, false)
+		}
+		q.push(e)
+	}
+}
+
+// dispatch takes entries from the queue and delivers them subject to the concurrency limit.
+func (ob *pushOutbox) dispatch(q *outboxQueue) {
+	defer ob.workers.Done()
+
+	for {
+		e := q.pop()
+		if e == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-ob.done:
+				return
+			}
+		}
+
+		select {
+		case q.sem <- struct{}{}:
+		case <-ob.done:
+			// Put the entry back so it's persisted on shutdown.
+			q.mu.Lock()
+			q.pending = append([]*outboxEntry{e}, q.pending...)
+			q.mu.Unlock()
+			atomic.AddInt64(&q.stats.Queued, 1)
+			return
+		}
+
+		ob.inflight.Add(1)
+		go func(e *outboxEntry) {
+			defer func() {
+				<-q.sem
+				ob.inflight.Done()
+			}()
+			ob.deliver(q, e)
+		}(e)
+	}
+}
+
+// deliver makes one delivery attempt, then schedules a retry or dead-letters the entry on failure.
+func (ob *pushOutbox) deliver(q *outboxQueue, e *outboxEntry) {
+	e.Attempts++
+	err := q.attempt(e.rcpt)
+	var partial *RetryError
+	if errors.As(err, &partial) && !e.retryOnly(partial.Failed) {
+		// Only recipients which are not in the receipt have failed.
+		err = nil
+	}
+	if err == nil {
+		atomic.AddInt64(&q.stats.Delivered, 1)
+		if ob.persist {
+			ob.write(outboxWrite{op: outboxDelete, e: e}, true)
+		}
+		return
+	}
+
+	e.LastError = err.Error()
+	if !errors.Is(err, ErrRetry) || e.Attempts >= ob.maxAttempts || time.Since(e.CreatedAt) > ob.maxAge {
+		ob.deadLetter(q, e, true)
+		return
+	}
+
+	atomic.AddInt64(&q.stats.Retried, 1)
+	if ob.persist {
+		ob.save(e, true)
+	}
+	time.AfterFunc(ob.backoff(e.Attempts), func() {
+		select {
+		case <-ob.done:
+			// Shutting down. The entry is either persisted or lost.
+		default:
+			q.push(e)
+		}
+	})
+}
+
+// backoff calculates the delay before the next attempt: exponential with jitter.
+func (ob *pushOutbox) backoff(attempts int) time.Duration {
+	delay := ob.maxBackoff
+	if attempts < 32 {
+		if d := ob.initialBackoff << uint(attempts-1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	// Randomize the delay between 0.5 and 1.0 of the nominal value.
+	return delay/2 + time.Duration(mrand.Int63n(int64(delay/2)+1))
+}
+
+// save queues the entry to be persisted for delivery after restart.
+func (ob *pushOutbox) save(e *outboxEntry, wait bool) {
+	data, err := e.marshal()
+	if err != nil {
+		logs.Warn.Println("push outbox: failed to serialize entry", e.Id, err)
+		return
+	}
+	ob.write(outboxWrite{op: outboxSave, e: e, data: data}, wait)
+}
+
+// write passes the write to the persister. If wait is false and the persister is backlogged,
+// the write is dropped.
+func (ob *pushOutbox) write(w outboxWrite, wait bool) {
+	if wait {
+		ob.writes <- w
+		return
+	}
+	select {
+	case ob.writes <- w:
+	default:
+		logs.Warn.Println("push outbox: persister queue full, entry not saved", w.e.Id)
+	}
+}
+
+// persister writes entries to the DB in the order the writes were queued.
+func (ob *pushOutbox) persister() {
+	defer close(ob.persisterDone)
+
+	for w := range ob.writes {
+		e := w.e
+		if e == nil {
+			return
+		}
+		switch w.op {
+		case outboxSave:
+			if err := store.PCache.Upsert(ob.keyPrefix+e.Id, w.data, !e.persisted); err != nil {
+				logs.Warn.Println("push outbox: failed to persist entry", e.Id, err)
+				continue
+			}
+			e.persisted = true
+		case outboxDeadLetter:
+			if err := store.PCache.Upsert(ob.deadLetterPrefix+e.Id, w.data, true); err != nil {
+				logs.Warn.Println("push outbox: failed to dead-letter entry", e.Id, err)
+			}
+			fallthrough
+		case outboxDelete:
+			if e.persisted {
+				if err := store.PCache.Delete(ob.keyPrefix + e.Id); err != nil {
+					logs.Warn.Println("push outbox: failed to delete entry", e.Id, err)
+				}
+			}
+		}
+	}
+}
+
+// deadLetter gives up on delivery of the entry.
+func (ob *pushOutbox) deadLetter(q *outboxQueue, e *outboxEntry, wait bool) {
+	atomic.AddInt64(&q.stats.DeadLettered, 1)
+	logs.Warn.Printf("push outbox: %s failed to deliver %s after %d attempts: %s",
+		q.name, e.Id, e.Attempts, e.LastError)
+
+	if !ob.persist {
+		return
+	}
+	data, err := e.marshal()
+	if err != nil {
+		logs.Warn.Println("push outbox: failed to serialize entry", e.Id, err)
+		return
+	}
+	ob.write(outboxWrite{op: outboxDeadLetter, e: e, data: data}, wait)
+}
+
+// restore loads entries persisted by the previous run, oldest first.
+func (ob *pushOutbox) restore() {
+	entries, err := store.PCache.List(ob.keyPrefix, ob.queueSize*len(ob.queues))
+	if err != nil {
+		logs.Warn.Println("push outbox: failed to restore entries", err)
+		return
+	}
+
+	count := 0
+	for _, kv := range entries {
+		e, err := unmarshalOutboxEntry(kv.Value)
+		if err != nil {
+			logs.Warn.Println("push outbox: invalid entry", kv.Key, err)
+			store.PCache.Delete(kv.Key)
+			continue
+		}
+		q := ob.queues[e.Handler]
+		if q == nil {
+			// The handler is no longer enabled.
+			store.PCache.Delete(kv.Key)
+			continue
+		}
+		q.push(e)
+		count++
+	}
+	if count > 0 {
+		logs.Info.Println("push outbox: restored undelivered entries:", count)
+	}
+}
+
+// expireDeadLetters periodically deletes old dead-lettered entries.
+func (ob *pushOutbox) expireDeadLetters() {
+	defer ob.workers.Done()
+
+	ticker := time.NewTicker(outboxExpirePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.PCache.Expire(ob.deadLetterPrefix, time.Now().Add(-ob.deadLetterTTL)); err != nil {
+				logs.Warn.Println("push outbox: failed to expire dead letters", err)
+			}
+		case <-ob.done:
+			return
+		}
+	}
+}
+
+// stop waits for in-flight deliveries to finish and persists undelivered entries.
+func (ob *pushOutbox) stop() {
+	close(ob.done)
+	ob.workers.Wait()
+	ob.inflight.Wait()
+
+	if !ob.persist {
+		return
+	}
+	for _, q := range ob.queues {
+		for _, e := range q.drain() {
+			ob.save(e, true)
+		}
+	}
+	// Flush pending writes. The channel is not closed: enqueue may still be called concurrently.
+	ob.writes <- outboxWrite{}
+	<-ob.persisterDone
+}
+
+func (ob *pushOutbox) stats() map[string]outboxStats {
+	result := make(map[string]outboxStats, len(ob.queues))
+	for name, q := range ob.queues {
+		result[name] = outboxStats{
+			Queued:       atomic.LoadInt64(&q.stats.Queued),
+			Delivered:    atomic.LoadInt64(&q.stats.Delivered),
+			Retried:      atomic.LoadInt64(&q.stats.Retried),
+			DeadLettered: atomic.LoadInt64(&q.stats.DeadLettered),
+		}
+	}
+	return result
+}
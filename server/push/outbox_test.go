@@ -0,0 +1,225 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// testHandler fails the first 'failures' deliveries with the given error.
+type testHandler struct {
+	mu        sync.Mutex
+	failures  int
+	err       error
+	attempts  int
+	delivered []*Receipt
+}
+
+func (h *testHandler) Init(json.RawMessage) (bool, error) { return true, nil }
+func (h *testHandler) IsReady() bool                      { return true }
+func (h *testHandler) Push() chan<- *Receipt              { return nil }
+func (h *testHandler) Channel() chan<- *ChannelReq        { return nil }
+func (h *testHandler) Stop()                              {}
+
+func (h *testHandler) Deliver(rcpt *Receipt) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.attempts++
+	if h.attempts <= h.failures {
+		return h.err
+	}
+	h.delivered = append(h.delivered, rcpt)
+	return nil
+}
+
+func (h *testHandler) counts() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.attempts, len(h.delivered)
+}
+
+func initTestOutbox(tt *testing.T, hnd Handler, config string) {
+	logs.Init(os.Stderr, "stdFlags")
+	saved := handlers
+	handlers = map[string]Handler{"test": hnd}
+	if ok, err := InitOutbox(json.RawMessage(config), ""); !ok || err != nil {
+		tt.Fatal("failed to init outbox", ok, err)
+	}
+	tt.Cleanup(func() {
+		outbox.stop()
+		outbox = nil
+		handlers = saved
+	})
+}
+
+func waitFor(tt *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tt.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutboxRetry(tt *testing.T) {
+	hnd := &testHandler{failures: 2, err: ErrRetry}
+	initTestOutbox(tt, hnd, `{"enabled": true, "initial_backoff": 1, "max_backoff": 1}`)
+	// Make retries fast.
+	outbox.initialBackoff = time.Millisecond
+	outbox.maxBackoff = time.Millisecond
+
+	Push(&Receipt{To: map[t.Uid]Recipient{t.Uid(1): {}}, Payload: Payload{What: ActMsg}})
+
+	waitFor(tt, func() bool { _, n := hnd.counts(); return n == 1 })
+	if attempts, _ := hnd.counts(); attempts != 3 {
+		tt.Error("expected 3 attempts, got", attempts)
+	}
+	stats := outbox.stats()["test"]
+	if stats.Delivered != 1 || stats.Retried != 2 || stats.DeadLettered != 0 {
+		tt.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestOutboxDeadLetter(tt *testing.T) {
+	hnd := &testHandler{failures: 10, err: errors.New("permanent")}
+	initTestOutbox(tt, hnd, `{"enabled": true}`)
+
+	Push(&Receipt{To: map[t.Uid]Recipient{t.Uid(1): {}}, Payload: Payload{What: ActMsg}})
+
+	waitFor(tt, func() bool { return outbox.stats()["test"].DeadLettered == 1 })
+	if attempts, delivered := hnd.counts(); attempts != 1 || delivered != 0 {
+		tt.Error("permanent failure must not be retried", attempts, delivered)
+	}
+}
+
+func TestOutboxMaxAttempts(tt *testing.T) {
+	hnd := &testHandler{failures: 10, err: ErrRetry}
+	initTestOutbox(tt, hnd, `{"enabled": true, "max_attempts": 3}`)
+	outbox.initialBackoff = time.Millisecond
+	outbox.maxBackoff = time.Millisecond
+
+	Push(&Receipt{To: map[t.Uid]Recipient{t.Uid(1): {}}, Payload: Payload{What: ActMsg}})
+
+	waitFor(tt, func() bool { return outbox.stats()["test"].DeadLettered == 1 })
+	if attempts, _ := hnd.counts(); attempts != 3 {
+		tt.Error("expected 3 attempts, got", attempts)
+	}
+}
+
+func TestOutboxPartialRetry(tt *testing.T) {
+	hnd := &testHandler{failures: 1, err: NewRetryError([]t.Uid{2, 2}, errors.New("unavailable"))}
+	initTestOutbox(tt, hnd, `{"enabled": true}`)
+	outbox.initialBackoff = time.Millisecond
+	outbox.maxBackoff = time.Millisecond
+
+	rcpt := &Receipt{To: map[t.Uid]Recipient{1: {}, 2: {}}, Channel: "chnABC", Payload: Payload{What: ActMsg}}
+	Push(rcpt)
+
+	waitFor(tt, func() bool { _, n := hnd.counts(); return n == 1 })
+	retried := hnd.delivered[0]
+	if _, ok := retried.To[2]; !ok || len(retried.To) != 1 || retried.Channel != "" {
+		tt.Errorf("only the failed recipient must be retried: %+v", retried)
+	}
+	if len(rcpt.To) != 2 {
+		tt.Error("shared receipt modified")
+	}
+}
+
+func TestOutboxPersistOnEnqueue(tt *testing.T) {
+	ctrl := gomock.NewController(tt)
+	pc := mock_store.NewMockPersistentCacheInterface(ctrl)
+	store.PCache = pc
+	// Runs after the outbox is stopped.
+	tt.Cleanup(func() { store.PCache = nil })
+
+	pc.EXPECT().List(gomock.Any(), gomock.Any()).Return([]t.KeyValue(nil), nil)
+	// The entry is saved asynchronously and deleted after the delivery; pending writes are flushed on stop.
+	gomock.InOrder(
+		pc.EXPECT().Upsert(gomock.Any(), gomock.Any(), true).Return(nil),
+		pc.EXPECT().Delete(gomock.Any()).Return(nil),
+	)
+
+	hnd := &testHandler{}
+	initTestOutbox(tt, hnd, `{"enabled": true, "persist": true}`)
+	Push(&Receipt{To: map[t.Uid]Recipient{t.Uid(1): {}}, Payload: Payload{What: ActMsg}})
+	waitFor(tt, func() bool { return outbox.stats()["test"].Delivered == 1 })
+}
+
+func TestOutboxRestoreOrder(tt *testing.T) {
+	ctrl := gomock.NewController(tt)
+	pc := mock_store.NewMockPersistentCacheInterface(ctrl)
+	store.PCache = pc
+	tt.Cleanup(func() { store.PCache = nil })
+
+	var entries []t.KeyValue
+	for i := 1; i <= 3; i++ {
+		e := newOutboxEntry("test", &Receipt{To: map[t.Uid]Recipient{t.Uid(i): {}}, Payload: Payload{SeqId: i}})
+		data, _ := e.marshal()
+		entries = append(entries, t.KeyValue{Key: "pushq::" + e.Id, Value: data})
+	}
+	// Entries are listed oldest first.
+	pc.EXPECT().List("pushq::", gomock.Any()).Return(entries, nil)
+	pc.EXPECT().Delete(gomock.Any()).Return(nil).Times(3)
+
+	hnd := &testHandler{}
+	initTestOutbox(tt, hnd, `{"enabled": true, "persist": true, "concurrency": 1}`)
+	waitFor(tt, func() bool { _, n := hnd.counts(); return n == 3 })
+
+	hnd.mu.Lock()
+	defer hnd.mu.Unlock()
+	for i, rcpt := range hnd.delivered {
+		if rcpt.Payload.SeqId != i+1 {
+			tt.Errorf("entry %d restored out of order: %d", i, rcpt.Payload.SeqId)
+		}
+	}
+}
+
+func TestOutboxEntryMarshal(tt *testing.T) {
+	uid := t.Uid(12345)
+	rcpt := &Receipt{
+		To:      map[t.Uid]Recipient{uid: {Unread: 7, Devices: []string{"dev1"}}},
+		Channel: "chnABC",
+		Payload: Payload{What: ActMsg, Topic: "grpABC", SeqId: 10, ModeWant: t.ModeCP2P},
+	}
+	entry := newOutboxEntry("fcm", rcpt)
+	entry.Attempts = 2
+	data, err := entry.marshal()
+	if err != nil {
+		tt.Fatal(err)
+	}
+
+	restored, err := unmarshalOutboxEntry(data)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if restored.Id != entry.Id || restored.Handler != "fcm" || restored.Attempts != 2 || !restored.persisted {
+		tt.Errorf("entry fields not restored: %+v", restored)
+	}
+	if r, ok := restored.rcpt.To[uid]; !ok || r.Unread != 7 || len(r.Devices) != 1 {
+		tt.Errorf("recipients not restored: %+v", restored.rcpt.To)
+	}
+	if restored.rcpt.Channel != "chnABC" || restored.rcpt.Payload.SeqId != 10 ||
+		restored.rcpt.Payload.ModeWant != t.ModeCP2P {
+		tt.Errorf("payload not restored: %+v", restored.rcpt)
+	}
+}
+
+func TestOutboxBackoff(tt *testing.T) {
+	ob := &pushOutbox{initialBackoff: time.Second, maxBackoff: 10 * time.Second}
+	for attempts, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second,
+		5: 10 * time.Second, 100: 10 * time.Second} {
+		if d := ob.backoff(attempts); d < max/2 || d > max {
+			tt.Errorf("attempt %d: backoff %s out of range [%s, %s]", attempts, d, max/2, max)
+		}
+	}
+}
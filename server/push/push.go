@@ -32,6 +32,11 @@ type Recipient struct {
 	Unread int `json:"unread"`
 	// Indicates whether unread counter in the cache should be incremented before sending the push.
 	ShouldIncrementUnreadCountInCache bool `json:"-"`
+	// The user disabled notifications of this kind. The recipient is used for updating
+	// the unread counter only, the push is not sent.
+	Disabled bool `json:"-"`
+	// The user muted notifications: the push is sent silent.
+	Silent bool `json:"-"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -103,7 +108,8 @@ type Handler interface {
 	IsReady() bool
 
 	// Push returns a channel that the server will use to send messages to.
-	// The message will be dropped if the channel blocks.
+	// The message will be dropped if the channel blocks unless the outbox is enabled,
+	// see InitOutbox.
 	Push() chan<- *Receipt
 
 	// Subscribe/unsubscribe device from FCM topic (channel).
@@ -163,6 +169,11 @@ func Push(msg *Receipt) {
 		return
 	}
 
+	if outbox != nil {
+		outbox.enqueue(msg)
+		return
+	}
+
 	for _, hnd := range handlers {
 		if !hnd.IsReady() {
 			continue
@@ -201,6 +212,11 @@ func Stop() {
 		return
 	}
 
+	if outbox != nil {
+		// Finish in-flight deliveries before stopping the handlers.
+		outbox.stop()
+	}
+
 	for _, hnd := range handlers {
 		if hnd.IsReady() {
 			// Will potentially block
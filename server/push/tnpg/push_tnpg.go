@@ -39,6 +39,7 @@ type Handler struct {
 	stop    chan bool
 	pushUrl string
 	subUrl  string
+	config  *configType
 }
 
 type configType struct {
@@ -137,6 +138,7 @@ func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
 	handler.input = make(chan *push.Receipt, bufferSize)
 	handler.channel = make(chan *push.ChannelReq, bufferSize)
 	handler.stop = make(chan bool, 1)
+	handler.config = &config
 
 	go func() {
 		for {
@@ -204,7 +206,8 @@ func postMessage(endpoint string, body interface{}, config *configType) (*batchR
 	return &batch, nil
 }
 
-func sendPushes(rcpt *push.Receipt, config *configType) {
+// sendPushes sends the receipt. Returns push.RetryError with recipients not sent to if the failure is transient.
+func sendPushes(rcpt *push.Receipt, config *configType) error {
 	messages, uids := fcm.PrepareV1Notifications(rcpt, nil)
 
 	n := len(messages)
@@ -220,19 +223,25 @@ func sendPushes(rcpt *push.Receipt, config *configType) {
 		resp, err := postMessage(handler.pushUrl, payloads, config)
 		if err != nil {
 			logs.Warn.Println("tnpg push request failed:", err)
-			break
+			return push.NewRetryError(uids[i:], err)
 		}
 		if resp.httpCode >= 300 {
 			logs.Warn.Println("tnpg push rejected:", resp.httpStatus)
-			break
+			if resp.httpCode == http.StatusTooManyRequests || resp.httpCode >= 500 {
+				return push.NewRetryError(uids[i:], errors.New(resp.httpStatus))
+			}
+			return errors.New("tnpg push rejected: " + resp.httpStatus)
 		}
 		if resp.FatalCode != "" {
 			logs.Err.Println("tnpg push failed:", resp.FatalMessage)
-			break
+			return errors.New("tnpg push failed: " + resp.FatalCode)
 		}
 		// Check for expired tokens and other errors.
-		handlePushResponse(resp, messages[i:upper], uids[i:upper])
+		if failed := handlePushResponse(resp, messages[i:upper], uids[i:upper]); len(failed) > 0 {
+			return push.NewRetryError(append(failed, uids[upper:]...), errors.New("tnpg transient failure"))
+		}
 	}
+	return nil
 }
 
 func processSubscription(req *push.ChannelReq, config *configType) {
@@ -243,7 +252,8 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	if req.Channel != "" {
 		su.Devices = fcm.DevicesForUser(req.Uid)
 		su.Channel = req.Channel
-	} else if req.DeviceID != "" {
+	} else if req.DeviceID != "" &&
+		!common.IsWebPushSubscription(req.DeviceID) && !common.IsApnsToken(req.DeviceID) {
 		su.Channels = fcm.ChannelsForUser(req.Uid)
 		su.Device = req.DeviceID
 	}
@@ -275,18 +285,21 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	handleSubResponse(resp, req, su.Devices, su.Channels)
 }
 
-func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []types.Uid) {
+// handlePushResponse processes errors of individual messages. Returns recipients of messages which failed
+// for a transient reason.
+func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []types.Uid) []types.Uid {
 	if batch.FailureCount <= 0 {
-		return
+		return nil
 	}
 
+	var failed []types.Uid
 	for i, resp := range batch.Responses {
 		switch resp.ErrorCode {
 		case "": // no error
 		case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
-			// Transient errors. Stop sending this batch.
+			// Transient errors. The message is retried.
 			logs.Warn.Println("tnpg transient failure:", resp.ErrorMessage)
-			return
+			failed = append(failed, uids[i])
 		case common.ErrorInvalidArgument:
 			// Usually an invalid token.
 			logs.Warn.Println("tnpg invalid argument:", resp.ExtendedError, resp.ErrorMessage)
@@ -298,7 +311,7 @@ func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []
 		case common.ErrorSenderIDMismatch, common.ErrorThirdPartyAuth:
 			// Config errors
 			logs.Warn.Println("tnpg invalid config:", resp.ExtendedError, resp.ErrorMessage)
-			return
+			return nil
 		case common.ErrorUnregistered:
 			// Token is no longer valid.
 			logs.Info.Println("tnpg invalid token:", resp.ErrorMessage, resp.ExtendedError, resp.MessageID)
@@ -309,6 +322,7 @@ func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []
 			logs.Warn.Println("tnpg unrecognized error:", resp.ErrorCode, resp.ErrorMessage, resp.ExtendedError, resp.Code)
 		}
 	}
+	return failed
 }
 
 func handleSubResponse(batch *batchResponse, req *push.ChannelReq, devices, channels []string) {
@@ -339,6 +353,11 @@ func (Handler) Push() chan<- *push.Receipt {
 	return handler.input
 }
 
+// Deliver sends the receipt synchronously; implements push.Deliverer interface.
+func (Handler) Deliver(rcpt *push.Receipt) error {
+	return sendPushes(rcpt, handler.config)
+}
+
 // Channel returns a channel that the server will use to send group requests to.
 // If the adapter blocks, the message will be dropped.
 func (Handler) Channel() chan<- *push.ChannelReq {
@@ -0,0 +1,351 @@
+// Package webhook implements push notification plugin which posts notifications to an arbitrary
+// HTTP endpoint as JSON. Requests are signed as described in package sign so the receiver can verify their origin.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/sign"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 1024
+	// Maximum number of recipients in one request.
+	defaultBatchSize = 100
+	// Number of attempts to re-send a failed request.
+	defaultMaxRetries = 3
+	// Timeout of a single request in seconds.
+	defaultTimeout = 10
+	// Upper limit on the delay between retries.
+	maxRetryDelay = 30 * time.Second
+)
+
+// Delay before the first retry. Doubles with every subsequent attempt.
+var retryBaseDelay = time.Second
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+	// Closed when the handler is stopped to abort pending retries.
+	done chan struct{}
+
+	url        string
+	secret     []byte
+	batchSize  int
+	maxRetries int
+	client     *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// URL to post notifications to.
+	URL string `json:"url"`
+	// Shared secret for signing requests.
+	Secret string `json:"secret"`
+	// Maximum number of recipients in one request.
+	BatchSize int `json:"batch_size"`
+	// Number of retries of requests which failed with 5xx errors.
+	MaxRetries int `json:"max_retries"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Device is a device of the recipient.
+type Device struct {
+	DeviceId string    `json:"id"`
+	Platform string    `json:"platform,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Lang     string    `json:"lang,omitempty"`
+}
+
+// Recipient is a user targeted by the push together with the user's devices.
+type Recipient struct {
+	User string `json:"user"`
+	// Count of user's sessions which received the message interactively.
+	Delivered int `json:"delivered,omitempty"`
+	// Unread count to include in the push.
+	Unread int `json:"unread,omitempty"`
+	// Devices to send the push to. Devices which received the message interactively are excluded.
+	Devices []Device `json:"devices,omitempty"`
+}
+
+// PushRequest is the body of the request with a notification.
+type PushRequest struct {
+	Type string `json:"type"`
+	// Channel (FCM topic) for pushes to channel subscribers.
+	Channel    string       `json:"channel,omitempty"`
+	Recipients []Recipient  `json:"recipients,omitempty"`
+	Payload    push.Payload `json:"payload"`
+}
+
+// ChannelRequest is the body of the request to subscribe or unsubscribe devices to a channel.
+// Either one device is (un)subscribed to multiple channels or multiple devices to one channel.
+type ChannelRequest struct {
+	Type     string   `json:"type"`
+	User     string   `json:"user"`
+	Channel  string   `json:"channel,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	Device   string   `json:"device,omitempty"`
+	Devices  []string `json:"devices,omitempty"`
+	Unsub    bool     `json:"unsub"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.URL == "" {
+		return false, errors.New("missing webhook URL")
+	}
+	if config.Secret == "" {
+		return false, errors.New("missing webhook secret")
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	handler.url = config.URL
+	handler.secret = []byte(config.Secret)
+	handler.batchSize = config.BatchSize
+	handler.maxRetries = config.MaxRetries
+	handler.client = &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.channel = make(chan *push.ChannelReq, config.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case req := <-handler.channel:
+				go processSubscription(req)
+			case <-handler.stop:
+				close(handler.done)
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// prepareRequests converts the receipt into one or more requests with at most batchSize recipients each.
+func prepareRequests(rcpt *push.Receipt, batchSize int) []*PushRequest {
+	var requests []*PushRequest
+
+	if len(rcpt.To) > 0 {
+		uids := make([]t.Uid, 0, len(rcpt.To))
+		// Devices which were online in the topic when the message was sent.
+		skipDevices := make(map[string]struct{})
+		for uid, to := range rcpt.To {
+			uids = append(uids, uid)
+			for _, deviceID := range to.Devices {
+				skipDevices[deviceID] = struct{}{}
+			}
+		}
+
+		devices, _, err := store.Devices.GetAll(uids...)
+		if err != nil {
+			logs.Warn.Println("webhook push: db error", err)
+			return nil
+		}
+
+		var batch []Recipient
+		for uid, to := range rcpt.To {
+			recipient := Recipient{
+				User:      uid.UserId(),
+				Delivered: to.Delivered,
+				Unread:    to.Unread,
+			}
+			for _, d := range devices[uid] {
+				if _, ok := skipDevices[d.DeviceId]; ok || d.DeviceId == "" {
+					continue
+				}
+				recipient.Devices = append(recipient.Devices, Device{
+					DeviceId: d.DeviceId,
+					Platform: d.Platform,
+					LastSeen: d.LastSeen,
+					Lang:     d.Lang,
+				})
+			}
+
+			batch = append(batch, recipient)
+			if len(batch) == batchSize {
+				requests = append(requests, &PushRequest{Type: "push", Recipients: batch, Payload: rcpt.Payload})
+				batch = nil
+			}
+		}
+		if len(batch) > 0 {
+			requests = append(requests, &PushRequest{Type: "push", Recipients: batch, Payload: rcpt.Payload})
+		}
+	}
+
+	if rcpt.Channel != "" {
+		payload := rcpt.Payload
+		// Channel receiver should not know the ID of the message sender.
+		payload.From = ""
+		requests = append(requests, &PushRequest{Type: "push", Channel: rcpt.Channel, Payload: payload})
+	}
+
+	return requests
+}
+
+func sendPushes(rcpt *push.Receipt) {
+	for _, req := range prepareRequests(rcpt, handler.batchSize) {
+		if err := post(req); err != nil {
+			logs.Warn.Println("webhook push failed:", err)
+		}
+	}
+}
+
+func processSubscription(req *push.ChannelReq) {
+	cr := &ChannelRequest{
+		Type:  "channel",
+		User:  req.Uid.UserId(),
+		Unsub: req.Unsub,
+	}
+
+	if req.Channel != "" {
+		devices, _, err := store.Devices.GetAll(req.Uid)
+		if err != nil {
+			logs.Warn.Println("webhook channel: db error", err)
+			return
+		}
+		for _, d := range devices[req.Uid] {
+			cr.Devices = append(cr.Devices, d.DeviceId)
+		}
+		cr.Channel = req.Channel
+	} else if req.DeviceID != "" {
+		channels, err := store.Users.GetChannels(req.Uid)
+		if err != nil {
+			logs.Warn.Println("webhook channel: db error", err)
+			return
+		}
+		cr.Channels = channels
+		cr.Device = req.DeviceID
+	}
+
+	if (len(cr.Devices) == 0 && cr.Device == "") || (len(cr.Channels) == 0 && cr.Channel == "") {
+		// No channels or devices to subscribe or unsubscribe.
+		return
+	}
+
+	if err := post(cr); err != nil {
+		logs.Warn.Println("webhook channel request failed:", err)
+	}
+}
+
+// post sends the request to the webhook URL retrying with exponential backoff on server errors.
+func post(req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := postOnce(body)
+		if err == nil || !retry || attempt >= handler.maxRetries {
+			return err
+		}
+
+		logs.Info.Println("webhook: retrying failed request:", err)
+		select {
+		case <-time.After(delay):
+		case <-handler.done:
+			return errors.New("handler stopped")
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// postOnce makes one attempt to post the request body. Returns true if the request should be retried.
+func postOnce(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, handler.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	sign.Request(req, handler.secret, body)
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		// Network errors are transient.
+		return true, err
+	}
+	defer resp.Body.Close()
+	// Drain the body to allow connection reuse.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New("webhook responded " + resp.Status)
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel that the server will use to send group requests to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webhook", &handler)
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/sign"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testSecret = "webhook-test-secret"
+
+// mockReceiver starts a webhook receiver which fails the first `failures` requests with 503.
+func mockReceiver(t *testing.T, failures int) (*httptest.Server, *[][]byte, *sync.Mutex) {
+	var received [][]byte
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if !sign.Verify(req, []byte(testSecret), body) {
+			t.Error("Invalid request signature")
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			wrt.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, body)
+		wrt.WriteHeader(http.StatusOK)
+	}))
+
+	handler.url = srv.URL
+	handler.secret = []byte(testSecret)
+	handler.maxRetries = 2
+	handler.client = srv.Client()
+	handler.done = make(chan struct{})
+	retryBaseDelay = time.Millisecond
+
+	return srv, &received, &mu
+}
+
+func TestSendPushesBatched(t *testing.T) {
+	srv, received, mu := mockReceiver(t, 0)
+	defer srv.Close()
+	handler.batchSize = 2
+
+	ctrl := gomock.NewController(t)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = dd
+	defer func() {
+		store.Devices = nil
+		ctrl.Finish()
+	}()
+
+	uid1, uid2, uid3 := types.Uid(1), types.Uid(2), types.Uid(3)
+	dd.EXPECT().GetAll(gomock.Any()).Return(map[types.Uid][]types.DeviceDef{
+		uid1: {{DeviceId: "dev1", Platform: "android"}, {DeviceId: "online", Platform: "web"}},
+		uid2: {{DeviceId: "dev2", Platform: "ios", Lang: "en"}},
+	}, 3, nil)
+
+	sendPushes(&push.Receipt{
+		To: map[types.Uid]push.Recipient{
+			uid1: {Delivered: 1, Devices: []string{"online"}},
+			uid2: {Unread: 3},
+			uid3: {},
+		},
+		Payload: push.Payload{What: push.ActMsg, Topic: "grpabcdefghijk", SeqId: 5, Timestamp: time.Now()},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*received) != 2 {
+		t.Fatal("Expected 2 batches, got", len(*received))
+	}
+
+	recipients := make(map[string]Recipient)
+	for _, body := range *received {
+		var req PushRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		if req.Type != "push" || req.Payload.SeqId != 5 || req.Payload.Topic != "grpabcdefghijk" {
+			t.Error("Unexpected request", string(body))
+		}
+		if len(req.Recipients) > 2 {
+			t.Error("Batch too large", len(req.Recipients))
+		}
+		for _, r := range req.Recipients {
+			recipients[r.User] = r
+		}
+	}
+
+	if len(recipients) != 3 {
+		t.Fatal("Expected 3 recipients, got", len(recipients))
+	}
+	if r := recipients[uid1.UserId()]; len(r.Devices) != 1 || r.Devices[0].DeviceId != "dev1" || r.Delivered != 1 {
+		t.Error("Online device must be excluded", r)
+	}
+	if r := recipients[uid2.UserId()]; len(r.Devices) != 1 || r.Devices[0].Lang != "en" || r.Unread != 3 {
+		t.Error("Unexpected recipient", r)
+	}
+}
+
+func TestPostRetry(t *testing.T) {
+	srv, received, mu := mockReceiver(t, 2)
+	defer srv.Close()
+
+	if err := post(&ChannelRequest{Type: "channel", User: "usrabcdefghijk", Channel: "chnabcdefghijk"}); err != nil {
+		t.Fatal("Request must succeed after retries:", err)
+	}
+	mu.Lock()
+	if len(*received) != 1 {
+		t.Error("Expected 1 delivered request, got", len(*received))
+	}
+	mu.Unlock()
+
+	// Retries are exhausted.
+	srv2, _, _ := mockReceiver(t, 3)
+	defer srv2.Close()
+	if err := post(&ChannelRequest{Type: "channel"}); err == nil {
+		t.Error("Request must fail when retries are exhausted")
+	}
+}
+
+func TestProcessSubscription(t *testing.T) {
+	srv, received, mu := mockReceiver(t, 0)
+	defer srv.Close()
+
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() {
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	uu.EXPECT().GetChannels(uid).Return([]string{"chnabcdefghijk"}, nil)
+
+	processSubscription(&push.ChannelReq{Uid: uid, DeviceID: "dev1", Unsub: true})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*received) != 1 {
+		t.Fatal("Expected 1 request, got", len(*received))
+	}
+	var req ChannelRequest
+	if err := json.Unmarshal((*received)[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Type != "channel" || req.Device != "dev1" || !req.Unsub || len(req.Channels) != 1 || req.User != uid.UserId() {
+		t.Error("Unexpected channel request", req)
+	}
+}
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
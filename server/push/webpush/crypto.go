@@ -0,0 +1,164 @@
+package webpush
+
+// Message encryption (RFC 8291, RFC 8188) and VAPID authentication (RFC 8292).
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/push/common"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Length of the salt in the aes128gcm content encoding header.
+	saltLength = 16
+	// Length of the user agent authentication secret.
+	authSecretLength = 16
+	// Record size in the aes128gcm content encoding header. The entire message is sent as one record.
+	recordSize = 4096
+	// Length of the header: salt, record size, key ID length, key ID (uncompressed P-256 point).
+	headerLength = saltLength + 4 + 1 + 65
+	// Maximum length of the plaintext which fits into one record: record size less GCM tag and padding delimiter.
+	maxPlaintextLength = recordSize - 16 - 1
+
+	// Lifetime of the VAPID token.
+	vapidTokenTTL = 12 * time.Hour
+)
+
+var errBadKey = errors.New("invalid key")
+
+// decodeBase64 decodes URL-safe base64 with or without padding as used by browsers.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// parsePublicKey decodes uncompressed P-256 public key.
+func parsePublicKey(raw []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errBadKey
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// parsePrivateKey creates P-256 private key from the raw 32-byte scalar.
+func parsePrivateKey(raw []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(raw)
+	if len(raw) != 32 || d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errBadKey
+	}
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(raw)
+	return key, nil
+}
+
+// marshalPublicKey encodes public key as an uncompressed P-256 point.
+func marshalPublicKey(key *ecdsa.PublicKey) []byte {
+	return elliptic.Marshal(key.Curve, key.X, key.Y)
+}
+
+// hkdfRead derives length bytes of key material.
+func hkdfRead(secret, salt, info []byte, length int) []byte {
+	out := make([]byte, length)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	return out
+}
+
+// encrypt encrypts the plaintext for the user agent with the public key uaPublic and the
+// authentication secret authSecret using the 'aes128gcm' content encoding.
+func encrypt(plaintext, uaPublic, authSecret []byte) ([]byte, error) {
+	asPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltLength)
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return encryptWithKeys(plaintext, uaPublic, authSecret, asPrivate, salt)
+}
+
+// encryptWithKeys encrypts the plaintext using the provided application server key and salt.
+func encryptWithKeys(plaintext, uaPublic, authSecret []byte, asPrivate *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext) > maxPlaintextLength {
+		return nil, errors.New("payload too large")
+	}
+	if len(authSecret) != authSecretLength {
+		return nil, errBadKey
+	}
+
+	uaKey, err := parsePublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := marshalPublicKey(&asPrivate.PublicKey)
+
+	// ECDH shared secret: x coordinate of the shared point.
+	sx, _ := uaKey.Curve.ScalarMult(uaKey.X, uaKey.Y, asPrivate.D.FillBytes(make([]byte, 32)))
+	ecdhSecret := sx.FillBytes(make([]byte, 32))
+
+	// Combine shared secret with the authentication secret, RFC 8291 Section 3.4.
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfRead(ecdhSecret, authSecret, keyInfo, 32)
+
+	// Derive content encryption key and nonce, RFC 8188 Section 2.2 and 2.3.
+	cek := hkdfRead(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfRead(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, headerLength, headerLength+len(plaintext)+1+aead.Overhead())
+	copy(out, salt)
+	binary.BigEndian.PutUint32(out[saltLength:], recordSize)
+	out[saltLength+4] = byte(len(asPublic))
+	copy(out[saltLength+5:], asPublic)
+
+	// The only record is the last one: terminate it with the 0x02 padding delimiter.
+	record := append(append(make([]byte, 0, len(plaintext)+1), plaintext...), 2)
+	return aead.Seal(out, nonce, record, nil), nil
+}
+
+// vapidAuthorization creates the value of the Authorization header for the push service at endpoint.
+func vapidAuthorization(endpoint, subject string, key *ecdsa.PrivateKey, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.New("invalid push endpoint")
+	}
+
+	token, err := common.SignES256(map[string]string{"typ": "JWT"}, map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenTTL).Unix(),
+		"sub": subject,
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + token + ", k=" + base64.RawURLEncoding.EncodeToString(marshalPublicKey(&key.PublicKey)), nil
+}
@@ -0,0 +1,110 @@
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Subscription is a browser push subscription as returned by PushSubscription.toJSON().
+// It's saved as DeviceDef.DeviceId serialized to JSON.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// Public key of the user agent, base64-encoded uncompressed P-256 point.
+		P256dh string `json:"p256dh"`
+		// Authentication secret, base64-encoded.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// ParseSubscription parses and validates serialized browser push subscription.
+func ParseSubscription(deviceId string) (*Subscription, error) {
+	var sub Subscription
+	if err := json.Unmarshal([]byte(deviceId), &sub); err != nil {
+		return nil, err
+	}
+	if sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return nil, errors.New("incomplete push subscription")
+	}
+	return &sub, nil
+}
+
+// payloadToData converts push payload to a map which is sent to the browser as JSON.
+func payloadToData(pl *push.Payload) (map[string]interface{}, error) {
+	if pl == nil {
+		return nil, errors.New("empty push payload")
+	}
+
+	data := map[string]interface{}{
+		"what":  pl.What,
+		"topic": pl.Topic,
+		"ts":    pl.Timestamp.Format(time.RFC3339Nano),
+		"from":  pl.From,
+	}
+	if pl.Silent {
+		data["silent"] = true
+	}
+
+	switch pl.What {
+	case push.ActMsg:
+		data["seq"] = pl.SeqId
+		if pl.ContentType != "" {
+			data["mime"] = pl.ContentType
+		}
+		preview, err := drafty.Preview(pl.Content, push.MaxPayloadLength)
+		if err != nil {
+			return nil, err
+		}
+		data["rc"] = preview
+		if pl.Webrtc != "" {
+			data["webrtc"] = pl.Webrtc
+			if pl.AudioOnly {
+				data["aonly"] = true
+			}
+			// Video call push notifications are silent.
+			data["silent"] = true
+		}
+		if pl.Replace != "" {
+			// Notification of a message edit should be silent too.
+			data["silent"] = true
+			data["replace"] = pl.Replace
+		}
+	case push.ActSub:
+		data["modeWant"] = pl.ModeWant.String()
+		data["modeGiven"] = pl.ModeGiven.String()
+	case push.ActRead:
+		data["seq"] = pl.SeqId
+		data["silent"] = true
+	default:
+		return nil, errors.New("unknown push type")
+	}
+	return data, nil
+}
+
+// userPayload serializes the payload for a specific user.
+func userPayload(data map[string]interface{}, uid t.Uid, rcpt *push.Receipt) ([]byte, error) {
+	topic := rcpt.Payload.Topic
+	to := rcpt.To[uid]
+	if to.Delivered == 0 && t.GetTopicCat(topic) != t.TopicCatP2P {
+		return json.Marshal(data)
+	}
+
+	userData := make(map[string]interface{}, len(data)+1)
+	for key, val := range data {
+		userData[key] = val
+	}
+	// Fix topic name for P2P pushes.
+	if t.GetTopicCat(topic) == t.TopicCatP2P {
+		userData["topic"], _ = t.P2PNameForUser(uid, topic)
+	}
+	// Silence the push for user who have received the data interactively.
+	if to.Delivered > 0 {
+		userData["silent"] = true
+	}
+	return json.Marshal(userData)
+}
@@ -0,0 +1,275 @@
+// Package webpush implements push notification plugin which sends notifications directly to browsers
+// using the Web Push protocol (RFC 8030) with VAPID authentication (RFC 8292) and message
+// encryption (RFC 8291). No third-party push gateway is required.
+//
+// The web client subscribes to pushes using the VAPID public key of the server and sends the JSON-serialized
+// PushSubscription to the server as the device ID.
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+var handler Handler
+
+const (
+	// Size of the input channel buffer.
+	defaultBuffer = 1024
+
+	// Time in seconds the push service should retain undelivered notification.
+	defaultTimeToLive = 3600
+
+	// Timeout of a single request to the push service.
+	requestTimeout = 15 * time.Second
+)
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	// VAPID private key.
+	vapidKey *ecdsa.PrivateKey
+	// Contact URI of the application server, "mailto:" or "https:".
+	subject    string
+	timeToLive int
+
+	client *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+	// VAPID private key: base64url-encoded 32-byte P-256 scalar.
+	VapidPrivateKey string `json:"vapid_private_key"`
+	// VAPID public key: base64url-encoded uncompressed P-256 point. Optional, used for validation only.
+	VapidPublicKey string `json:"vapid_public_key"`
+	// Contact information of the server operator.
+	Subject    string `json:"subject"`
+	TimeToLive int    `json:"time_to_live,omitempty"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	raw, err := decodeBase64(config.VapidPrivateKey)
+	if err != nil {
+		return false, errors.New("invalid VAPID private key: " + err.Error())
+	}
+	handler.vapidKey, err = parsePrivateKey(raw)
+	if err != nil {
+		return false, errors.New("invalid VAPID private key")
+	}
+
+	if config.VapidPublicKey != "" {
+		raw, err = decodeBase64(config.VapidPublicKey)
+		if err != nil || !bytes.Equal(raw, marshalPublicKey(&handler.vapidKey.PublicKey)) {
+			return false, errors.New("VAPID public key does not match the private key")
+		}
+	}
+
+	if config.Subject == "" {
+		return false, errors.New("missing VAPID subject")
+	}
+	handler.subject = config.Subject
+
+	handler.timeToLive = config.TimeToLive
+	if handler.timeToLive <= 0 {
+		handler.timeToLive = defaultTimeToLive
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	handler.client = &http.Client{Timeout: requestTimeout}
+	handler.input = make(chan *push.Receipt, config.Buffer)
+	handler.channel = make(chan *push.ChannelReq, config.Buffer)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt)
+			case <-handler.channel:
+				// Web Push has no concept of topics (channels). Ignored.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+func sendPushes(rcpt *push.Receipt) {
+	if len(rcpt.To) == 0 {
+		// Channel pushes are not supported.
+		return
+	}
+
+	data, err := payloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("webpush: could not parse payload:", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("webpush: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	urgency := "high"
+	if rcpt.Payload.What == push.ActRead {
+		urgency = "low"
+	}
+
+	for uid, devList := range devices {
+		var payload []byte
+		for i := range devList {
+			d := &devList[i]
+			if d.Platform != "web" || !common.IsWebPushSubscription(d.DeviceId) {
+				continue
+			}
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+
+			sub, err := ParseSubscription(d.DeviceId)
+			if err != nil {
+				logs.Warn.Println("webpush: invalid subscription", uid.UserId(), err)
+				continue
+			}
+
+			if payload == nil {
+				if payload, err = userPayload(data, uid, rcpt); err != nil {
+					logs.Warn.Println("webpush: failed to serialize payload:", err)
+					break
+				}
+			}
+
+			gone, err := sendOne(sub, payload, urgency)
+			if gone {
+				// Subscription has expired or was revoked by the user.
+				if err := store.Devices.Delete(uid, d.DeviceId); err != nil {
+					logs.Warn.Println("webpush: failed to delete expired subscription:", err)
+				}
+			} else if err != nil {
+				logs.Warn.Println("webpush: push failed:", err)
+			}
+		}
+	}
+}
+
+// sendOne encrypts and posts the payload to the push service. Returns true if the subscription
+// is no longer valid.
+func sendOne(sub *Subscription, payload []byte, urgency string) (bool, error) {
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return false, err
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := encrypt(payload, uaPublic, authSecret)
+	if err != nil {
+		return false, err
+	}
+
+	auth, err := vapidAuthorization(sub.Endpoint, handler.subject, handler.vapidKey, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(handler.timeToLive))
+	req.Header.Set("Urgency", urgency)
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// Drain the body to allow connection reuse.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return true, nil
+	default:
+		return false, errors.New("push service responded " + resp.Status)
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel that the server will use to send group requests to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("webpush", &handler)
+}
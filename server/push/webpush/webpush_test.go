@@ -0,0 +1,149 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+)
+
+// Test vector from RFC 8291, Appendix A.
+const (
+	rfcPlaintext  = "When I grow up, I want to be a watermelon"
+	rfcAsPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfcUaPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfcSalt       = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfcAuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfcCiphertext = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := decodeBase64(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptRFC8291(t *testing.T) {
+	asPrivate, err := parsePrivateKey(mustDecode(t, rfcAsPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := encryptWithKeys([]byte(rfcPlaintext), mustDecode(t, rfcUaPublic), mustDecode(t, rfcAuthSecret),
+		asPrivate, mustDecode(t, rfcSalt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := base64.RawURLEncoding.EncodeToString(out); got != rfcCiphertext {
+		t.Errorf("Ciphertext mismatch:\n expected %s\n got      %s", rfcCiphertext, got)
+	}
+}
+
+func TestEncryptTooLarge(t *testing.T) {
+	if _, err := encrypt(make([]byte, maxPlaintextLength+1), mustDecode(t, rfcUaPublic), mustDecode(t, rfcAuthSecret)); err == nil {
+		t.Error("Oversized payload must be rejected")
+	}
+}
+
+func TestVapidAuthorization(t *testing.T) {
+	key, err := parsePrivateKey(mustDecode(t, rfcAsPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	auth, err := vapidAuthorization("https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV", "mailto:admin@example.com", key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(auth, "vapid t=") {
+		t.Fatal("Invalid authorization scheme:", auth)
+	}
+	parts := strings.Split(strings.TrimPrefix(auth, "vapid t="), ", k=")
+	if len(parts) != 2 {
+		t.Fatal("Malformed authorization header:", auth)
+	}
+	if parts[1] != base64.RawURLEncoding.EncodeToString(marshalPublicKey(&key.PublicKey)) {
+		t.Error("Public key mismatch", parts[1])
+	}
+
+	token := strings.Split(parts[0], ".")
+	if len(token) != 3 {
+		t.Fatal("Malformed JWT:", parts[0])
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(mustDecode(t, token[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != "https://push.example.net" {
+		t.Error("Invalid audience", claims["aud"])
+	}
+	if claims["sub"] != "mailto:admin@example.com" {
+		t.Error("Invalid subject", claims["sub"])
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) != now.Add(vapidTokenTTL).Unix() {
+		t.Error("Invalid expiration", claims["exp"])
+	}
+
+	sig := mustDecode(t, token[2])
+	if len(sig) != 64 {
+		t.Fatal("Invalid signature length", len(sig))
+	}
+	hash := sha256.Sum256([]byte(token[0] + "." + token[1]))
+	if !ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("Signature verification failed")
+	}
+}
+
+func TestParseSubscription(t *testing.T) {
+	sub, err := ParseSubscription(`{"endpoint":"https://push.example.net/abc","expirationTime":null,` +
+		`"keys":{"p256dh":"` + rfcUaPublic + `","auth":"` + rfcAuthSecret + `"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Endpoint != "https://push.example.net/abc" || sub.Keys.P256dh != rfcUaPublic || sub.Keys.Auth != rfcAuthSecret {
+		t.Error("Subscription parsed incorrectly", sub)
+	}
+
+	if _, err = ParseSubscription(`{"endpoint":"https://push.example.net/abc"}`); err == nil {
+		t.Error("Subscription without keys must be rejected")
+	}
+	if _, err = ParseSubscription("fcm-token"); err == nil {
+		t.Error("FCM token must be rejected")
+	}
+}
+
+func TestPayloadToData(t *testing.T) {
+	data, err := payloadToData(&push.Payload{
+		What:        push.ActMsg,
+		Topic:       "grpabcdef",
+		From:        "usrabcdef",
+		SeqId:       12,
+		ContentType: "text/x-drafty",
+		Content:     strings.Repeat("long message ", 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["seq"] != 12 || data["topic"] != "grpabcdef" || data["mime"] != "text/x-drafty" {
+		t.Error("Unexpected payload", data)
+	}
+	if rc, _ := data["rc"].(string); rc == "" {
+		t.Error("Missing message preview")
+	}
+
+	if _, err = payloadToData(&push.Payload{What: "unknown"}); err == nil {
+		t.Error("Unknown push type must be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestUserNotifyPrefsCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = uu
+	defer func() {
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	muted := types.Uid(1)
+	unknown := types.Uid(2)
+	prefs := &types.NotifyPrefs{NoDigest: true}
+	user := types.User{Notify: prefs}
+	user.SetUid(muted)
+
+	// Missing preferences are loaded synchronously, expired ones in background.
+	refreshed := make(chan struct{})
+	gomock.InOrder(
+		uu.EXPECT().GetAll(gomock.Any()).Return([]types.User{user}, nil),
+		uu.EXPECT().GetAll(muted).DoAndReturn(func(uids ...types.Uid) ([]types.User, error) {
+			defer close(refreshed)
+			return []types.User{user}, nil
+		}),
+	)
+
+	c := &userNotifyPrefsCache{
+		entries: make(map[types.Uid]notifyPrefsEntry),
+		loading: make(map[types.Uid]bool),
+	}
+	if _, ok := c.get([]types.Uid{muted, unknown}, false); ok {
+		t.Fatal("get must not return defaults for users which are not cached")
+	}
+
+	got, ok := c.get([]types.Uid{muted, unknown}, true)
+	if !ok || got[muted] != prefs || got[unknown] != nil {
+		t.Errorf("unexpected preferences %+v", got)
+	}
+	if _, ok := got[unknown]; !ok {
+		t.Error("unknown user must be cached with default preferences")
+	}
+
+	// Expired preferences are used until refreshed.
+	c.Lock()
+	c.entries[muted] = notifyPrefsEntry{prefs: prefs, expires: time.Now().Add(-time.Second)}
+	c.Unlock()
+	if got, ok := c.get([]types.Uid{muted}, false); !ok || got[muted] != prefs {
+		t.Error("expired preferences must be returned", got)
+	}
+	<-refreshed
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.Lock()
+		done := len(c.loading) == 0
+		c.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Update replaces cached preferences.
+	c.update(muted, nil)
+	if got, _ := c.get([]types.Uid{muted}, false); got[muted] != nil {
+		t.Error("preferences not updated")
+	}
+}
+
+func TestNotifyPrefsIsMuted(t *testing.T) {
+	prefs := &types.NotifyPrefs{QuietFrom: "22:00", QuietTo: "07:00", TimeZone: "America/New_York"}
+	if err := prefs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// 03:00 UTC is 23:00 or 22:00 in New York.
+	if !prefs.IsMuted(time.Date(2024, 1, 10, 3, 0, 0, 0, time.UTC)) {
+		t.Error("expected quiet hours")
+	}
+	if prefs.IsMuted(time.Date(2024, 1, 10, 15, 0, 0, 0, time.UTC)) {
+		t.Error("unexpected quiet hours")
+	}
+}
@@ -0,0 +1,234 @@
+// Package redis is a minimal client of the Redis serialization protocol (RESP2) sufficient
+// for publishing messages and subscribing to channels: https://redis.io/docs/reference/protocol-spec/
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply returned by the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Options are parameters of the connection.
+type Options struct {
+	// Address of the server in the form host:port.
+	Addr string
+	// Password for the AUTH command. Not sent if empty.
+	Password string
+	// Connect to the server over TLS.
+	TLS *tls.Config
+	// Timeout for connecting and for replies to commands. No timeout if zero.
+	Timeout time.Duration
+}
+
+// Message is a message received from a channel.
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// Conn is a connection to the server. Commands may be issued concurrently. Once Subscribe
+// is called, the connection may only be used for receiving messages.
+type Conn struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	timeout time.Duration
+
+	lock sync.Mutex
+}
+
+// Dial connects to the server and authenticates if the password is given.
+func Dial(opts *Options) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var conn net.Conn
+	var err error
+	if opts.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.Addr, opts.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewConn(conn, opts.Timeout)
+	if opts.Password != "" {
+		if _, err = c.Do("AUTH", opts.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// NewConn wraps an established network connection.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		conn:    conn,
+		rd:      bufio.NewReader(conn),
+		wr:      bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends the command and returns the reply. Arguments must be strings or byte slices.
+// Replies are returned as string (simple string), int64, []byte (bulk string, nil if null),
+// []any (array) or Error.
+func (c *Conn) Do(args ...any) (any, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+	if err := c.writeCommand(args); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// Publish sends the payload to the channel.
+func (c *Conn) Publish(channel string, payload []byte) error {
+	_, err := c.Do("PUBLISH", channel, payload)
+	return err
+}
+
+// Subscribe subscribes the connection to the channels. Confirmations of the subscription are
+// skipped by Receive.
+func (c *Conn) Subscribe(channels ...string) error {
+	args := make([]any, 0, len(channels)+1)
+	args = append(args, "SUBSCRIBE")
+	for _, ch := range channels {
+		args = append(args, ch)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writeCommand(args)
+}
+
+// Receive waits for the next message from the subscribed channels.
+func (c *Conn) Receive() (*Message, error) {
+	for {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(Error); ok {
+			return nil, e
+		}
+		parts, ok := reply.([]any)
+		if !ok || len(parts) == 0 {
+			return nil, errors.New("redis: unexpected reply")
+		}
+		kind, _ := parts[0].([]byte)
+		if string(kind) != "message" {
+			// Subscription confirmations.
+			continue
+		}
+		if len(parts) != 3 {
+			return nil, errors.New("redis: malformed message")
+		}
+		channel, _ := parts[1].([]byte)
+		payload, _ := parts[2].([]byte)
+		return &Message{Channel: string(channel), Payload: payload}, nil
+	}
+}
+
+func (c *Conn) writeCommand(args []any) error {
+	c.wr.WriteByte('*')
+	c.wr.WriteString(strconv.Itoa(len(args)))
+	c.wr.WriteString("\r\n")
+	for _, arg := range args {
+		var val []byte
+		switch arg := arg.(type) {
+		case string:
+			val = []byte(arg)
+		case []byte:
+			val = arg
+		default:
+			return errors.New("redis: unsupported argument type")
+		}
+		c.wr.WriteByte('$')
+		c.wr.WriteString(strconv.Itoa(len(val)))
+		c.wr.WriteString("\r\n")
+		c.wr.Write(val)
+		c.wr.WriteString("\r\n")
+	}
+	return c.wr.Flush()
+}
+
+func (c *Conn) readLine() ([]byte, error) {
+	line, err := c.rd.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *Conn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			// Null bulk string.
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count < 0 {
+			// Null array.
+			return nil, err
+		}
+		parts := make([]any, count)
+		for i := range parts {
+			if parts[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	}
+	return nil, errors.New("redis: unknown reply type '" + string(line[0]) + "'")
+}
@@ -0,0 +1,148 @@
+package redis
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer implements AUTH, PUBLISH and SUBSCRIBE commands.
+type fakeServer struct {
+	ln net.Listener
+
+	lock        sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, subscribers: make(map[string][]net.Conn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func bulk(val []byte) string {
+	return "$" + strconv.Itoa(len(val)) + "\r\n" + string(val) + "\r\n"
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	c := NewConn(conn, 0)
+	for {
+		cmd, err := c.readReply()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		args := cmd.([]any)
+		switch name := string(args[0].([]byte)); name {
+		case "AUTH":
+			if string(args[1].([]byte)) == "secret" {
+				conn.Write([]byte("+OK\r\n"))
+			} else {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+		case "PUBLISH":
+			channel := args[1].([]byte)
+			s.lock.Lock()
+			subs := s.subscribers[string(channel)]
+			for _, sub := range subs {
+				sub.Write([]byte("*3\r\n" + bulk([]byte("message")) + bulk(channel) + bulk(args[2].([]byte))))
+			}
+			s.lock.Unlock()
+			conn.Write([]byte(":" + strconv.Itoa(len(subs)) + "\r\n"))
+		case "SUBSCRIBE":
+			s.lock.Lock()
+			for i, ch := range args[1:] {
+				channel := ch.([]byte)
+				s.subscribers[string(channel)] = append(s.subscribers[string(channel)], conn)
+				conn.Write([]byte("*3\r\n" + bulk([]byte("subscribe")) + bulk(channel) + ":" + strconv.Itoa(i+1) + "\r\n"))
+			}
+			s.lock.Unlock()
+		default:
+			conn.Write([]byte("-ERR unknown command '" + name + "'\r\n"))
+		}
+	}
+}
+
+func testPubSub(t *testing.T, opts *Options) {
+	sub, err := Dial(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub, err := Dial(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	if err = sub.Subscribe("tinode-test.one", "tinode-test.two"); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte("binary\r\n\x00payload")
+	// The subscription may not be active yet.
+	deadline := time.Now().Add(time.Second)
+	for {
+		reply, err := pub.Do("PUBLISH", "tinode-test.two", payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.(int64) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no subscribers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	msg, err := sub.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Channel != "tinode-test.two" || !bytes.Equal(msg.Payload, payload) {
+		t.Errorf("unexpected message %q: %q", msg.Channel, msg.Payload)
+	}
+
+	if _, err = pub.Do("NO-SUCH-COMMAND"); err == nil {
+		t.Error("expected error reply")
+	} else if _, ok := err.(Error); !ok {
+		t.Errorf("expected error reply, got %v", err)
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.ln.Close()
+
+	testPubSub(t, &Options{Addr: s.ln.Addr().String(), Password: "secret", Timeout: time.Second})
+
+	if _, err := Dial(&Options{Addr: s.ln.Addr().String(), Password: "wrong", Timeout: time.Second}); err == nil {
+		t.Error("authenticated with a wrong password")
+	}
+}
+
+// TestServer runs against a real server at the address from REDIS_TEST_ADDR, e.g. localhost:6379.
+func TestServer(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+	testPubSub(t, &Options{Addr: addr, Password: os.Getenv("REDIS_TEST_PASSWORD"), Timeout: time.Second})
+}
@@ -0,0 +1,493 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Reporting of abusive messages and users. Users file reports with
+ *  {set report}, reports are saved to the database and delivered to
+ *  moderators through the 'sys' topic. Moderators act on reports by
+ *  suspending users, hard-deleting messages and resolving reports. Every
+ *  action is recorded in the audit log of the report.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum length of the comment to a report or an action in characters.
+	maxReportCommentLength = 1024
+	// Maximum length of the text of the reported message delivered to moderators.
+	maxReportPreviewLength = 512
+	// How long to wait for the topic to delete the reported message.
+	reportDeleteTimeout = 5 * time.Second
+	// How long results of moderator checks are cached. Changes of moderator rights take effect with this delay.
+	reportModeratorCacheTTL = time.Minute
+	// Maximum number of cached moderator checks.
+	reportModeratorCacheSize = 1024
+)
+
+// Reasons for reports if not configured.
+var defaultReportReasons = []string{"spam", "abuse", "other"}
+
+type reportsHandler struct {
+	// Group topic of moderators. Owners and admins of the topic can act on reports.
+	moderatorsTopic string
+	// Acceptable reasons for reports.
+	reasons map[string]bool
+
+	// Cached results of moderator checks.
+	modLock    sync.Mutex
+	moderators map[types.Uid]moderatorCacheEntry
+}
+
+type moderatorCacheEntry struct {
+	isModerator bool
+	expires     time.Time
+}
+
+func newReportsHandler(conf *reportsConfig) (*reportsHandler, error) {
+	r := &reportsHandler{
+		reasons:    make(map[string]bool),
+		moderators: make(map[types.Uid]moderatorCacheEntry),
+	}
+
+	if conf.ModeratorsTopic != "" {
+		if types.GetTopicCat(conf.ModeratorsTopic) != types.TopicCatGrp {
+			return nil, errors.New("moderators topic must be a group topic")
+		}
+		r.moderatorsTopic = conf.ModeratorsTopic
+	}
+
+	reasons := conf.Reasons
+	if len(reasons) == 0 {
+		reasons = defaultReportReasons
+	}
+	for _, reason := range reasons {
+		if reason = strings.TrimSpace(reason); reason == "" || len(reason) > 32 {
+			return nil, errors.New("invalid report reason '" + reason + "'")
+		}
+		r.reasons[reason] = true
+	}
+
+	return r, nil
+}
+
+// isModerator checks if the user can act on reports: root or an owner or admin of the moderators topic.
+func (r *reportsHandler) isModerator(uid types.Uid, authLvl auth.Level) bool {
+	if authLvl == auth.LevelRoot {
+		return true
+	}
+	if r.moderatorsTopic == "" || uid.IsZero() {
+		return false
+	}
+
+	now := time.Now()
+	r.modLock.Lock()
+	entry, ok := r.moderators[uid]
+	r.modLock.Unlock()
+	if ok && entry.expires.After(now) {
+		return entry.isModerator
+	}
+
+	sub, err := store.Subs.Get(r.moderatorsTopic, uid, false)
+	if err != nil {
+		logs.Warn.Println("reports: failed to check moderator", uid.UserId(), err)
+		return false
+	}
+	isModerator := sub != nil && (sub.ModeGiven & sub.ModeWant).IsAdmin()
+
+	r.modLock.Lock()
+	if len(r.moderators) >= reportModeratorCacheSize {
+		// Evict expired entries, then arbitrary ones if it's not enough.
+		for id, e := range r.moderators {
+			if !e.expires.After(now) || len(r.moderators) >= reportModeratorCacheSize {
+				delete(r.moderators, id)
+			}
+		}
+	}
+	r.moderators[uid] = moderatorCacheEntry{isModerator: isModerator, expires: now.Add(reportModeratorCacheTTL)}
+	r.modLock.Unlock()
+
+	return isModerator
+}
+
+// replySetReport handles {set report}: files a new report or applies moderator's action to an existing report.
+func replySetReport(s *Session, msg *ClientComMessage) {
+	if globals.reports == nil {
+		s.queueOut(ErrNotImplementedReply(msg, types.TimeNow()))
+		return
+	}
+
+	if msg.Set.Report.Id == "" {
+		globals.reports.file(s, msg)
+	} else {
+		globals.reports.act(s, msg)
+	}
+}
+
+// file saves a new report and delivers it to moderators.
+func (r *reportsHandler) file(s *Session, msg *ClientComMessage) {
+	now := types.TimeNow()
+	req := msg.Set.Report
+
+	if !r.reasons[req.Reason] {
+		logs.Warn.Println("reports: invalid reason", req.Reason, s.sid)
+		s.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+
+	report := &types.Report{
+		From:    s.uid.String(),
+		Reason:  req.Reason,
+		Comment: truncateRunes(req.Comment, maxReportCommentLength),
+	}
+
+	var text string
+	if req.SeqId > 0 {
+		// Report of a message in the topic of the request. The user must be able to read it.
+		switch topicCat(msg.RcptTo) {
+		case types.TopicCatP2P, types.TopicCatGrp:
+		default:
+			s.queueOut(ErrMalformedReply(msg, now))
+			return
+		}
+
+		sub, err := store.Subs.Get(msg.RcptTo, s.uid, false)
+		if err != nil {
+			s.queueOut(ErrUnknownReply(msg, now))
+			logs.Warn.Println("reports: failed to get subscription", msg.RcptTo, err, s.sid)
+			return
+		}
+		if sub == nil || !(sub.ModeGiven & sub.ModeWant).IsReader() {
+			s.queueOut(ErrPermissionDeniedReply(msg, now))
+			return
+		}
+
+		msgs, err := store.Messages.GetAll(msg.RcptTo, s.uid,
+			&types.QueryOpt{Since: req.SeqId, Before: req.SeqId + 1, Limit: 1})
+		if err != nil {
+			s.queueOut(ErrUnknownReply(msg, now))
+			logs.Warn.Println("reports: failed to get message", msg.RcptTo, req.SeqId, err, s.sid)
+			return
+		}
+		if len(msgs) == 0 {
+			s.queueOut(ErrNotFoundReply(msg, now))
+			return
+		}
+
+		report.Topic = msg.RcptTo
+		report.SeqId = req.SeqId
+		report.User = msgs[0].From
+		text, _ = drafty.PlainText(msgs[0].Content)
+	} else if req.User != "" {
+		// Report of a user, possibly in the context of the topic of the request.
+		uid := types.ParseUserId(req.User)
+		if uid.IsZero() || uid == s.uid {
+			s.queueOut(ErrMalformedReply(msg, now))
+			return
+		}
+		report.User = uid.String()
+		if msg.RcptTo != "sys" {
+			report.Topic = msg.RcptTo
+		}
+	} else {
+		s.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+
+	if err := store.Reports.Create(report); err != nil {
+		s.queueOut(ErrUnknownReply(msg, now))
+		logs.Warn.Println("reports: failed to save report", err, s.sid)
+		return
+	}
+	logs.Info.Printf("reports[%s]: filed by %s, reason '%s'", report.Id, s.uid.UserId(), report.Reason)
+
+	r.deliver(report, text)
+
+	s.queueOut(NoErrParamsReply(msg, now, map[string]string{"report": report.Id}))
+}
+
+// deliver publishes the report to the 'sys' topic where it's received by root users and moderators.
+func (r *reportsHandler) deliver(report *types.Report, text string) {
+	content := map[string]any{
+		"report": report.Id,
+		"reason": report.Reason,
+	}
+	if report.User != "" {
+		content["user"] = types.ParseUid(report.User).UserId()
+	}
+	if report.Topic != "" {
+		content["topic"] = report.Topic
+	}
+	if report.SeqId > 0 {
+		content["seq"] = report.SeqId
+	}
+	if report.Comment != "" {
+		content["comment"] = report.Comment
+	}
+	if text != "" {
+		// Snapshot of the reported message: it may be edited or deleted later.
+		content["text"] = truncateRunes(text, maxReportPreviewLength)
+	}
+
+	from := types.ParseUid(report.From).UserId()
+	msg := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Topic:   "sys",
+			Head:    map[string]any{"mime": "application/json", "report": report.Id},
+			Content: content,
+		},
+		Original:  "sys",
+		RcptTo:    "sys",
+		AsUser:    from,
+		AuthLvl:   int(auth.LevelAuth),
+		Timestamp: report.CreatedAt,
+	}
+
+	if globals.cluster.isRemoteTopic(msg.RcptTo) {
+		// The 'sys' topic is hosted by another cluster node.
+		if err := globals.cluster.routeToTopicMaster(ProxyReqBroadcast, msg, msg.RcptTo, nil); err != nil {
+			logs.Warn.Println("reports: failed to route report to cluster node, not delivered", report.Id, err)
+		}
+		return
+	}
+
+	if globals.hub.topicGet(msg.RcptTo) == nil {
+		// No moderators online. The report is available through {get what="report"}.
+		logs.Info.Println("reports: 'sys' topic is offline, report not delivered", report.Id)
+		return
+	}
+
+	select {
+	case globals.hub.routeCli <- msg:
+	default:
+		logs.Err.Println("reports: hub.route channel full, report not delivered", report.Id)
+	}
+}
+
+// act applies moderator's action to the report and records it in the audit log.
+func (r *reportsHandler) act(s *Session, msg *ClientComMessage) {
+	now := types.TimeNow()
+	req := msg.Set.Report
+
+	if msg.RcptTo != "sys" {
+		s.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+	if !r.isModerator(s.uid, s.authLvl) {
+		logs.Warn.Println("reports: action by non-moderator", s.uid.UserId(), s.sid)
+		s.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	report, err := store.Reports.Get(req.Id)
+	if err != nil {
+		s.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+	if report == nil {
+		s.queueOut(ErrNotFoundReply(msg, now))
+		return
+	}
+	if report.Resolved {
+		s.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return
+	}
+
+	switch req.Action {
+	case "suspend":
+		if report.User == "" {
+			s.queueOut(ErrMalformedReply(msg, now))
+			return
+		}
+		uid := types.ParseUid(report.User)
+		user, err := store.Users.Get(uid)
+		if err != nil {
+			s.queueOut(ErrUnknownReply(msg, now))
+			logs.Warn.Println("reports: failed to get user", report.User, err, s.sid)
+			return
+		}
+		if user == nil {
+			s.queueOut(ErrNotFoundReply(msg, now))
+			return
+		}
+		susp := &ClientComMessage{Acc: &MsgClientAcc{State: types.StateSuspended.String()}}
+		if _, err := changeUserState(s, uid, user, susp); err != nil {
+			s.queueOut(ErrUnknownReply(msg, now))
+			logs.Warn.Println("reports: failed to suspend user", report.User, err, s.sid)
+			return
+		}
+	case "delete":
+		if report.SeqId == 0 {
+			s.queueOut(ErrMalformedReply(msg, now))
+			return
+		}
+		if err := reportDeleteMessage(report, s.uid); err != nil {
+			s.queueOut(ErrUnknownReply(msg, now))
+			logs.Warn.Println("reports: failed to delete message", report.Topic, report.SeqId, err, s.sid)
+			return
+		}
+	case "resolve":
+	default:
+		s.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+
+	action := &types.ReportAction{
+		By:      s.uid.String(),
+		What:    req.Action,
+		Comment: truncateRunes(req.Comment, maxReportCommentLength),
+	}
+	if err := store.Reports.AddAction(report, action, req.Action == "resolve"); err != nil {
+		s.queueOut(ErrUnknownReply(msg, now))
+		logs.Warn.Println("reports: failed to save action", report.Id, err, s.sid)
+		return
+	}
+	logs.Info.Printf("reports[%s]: '%s' by %s", report.Id, req.Action, s.uid.UserId())
+
+	s.queueOut(NoErrReply(msg, now))
+}
+
+// reportDeleteMessage hard-deletes the reported message on behalf of the moderator. Messages in topics
+// hosted by other cluster nodes are deleted by the topic master.
+func reportDeleteMessage(report *types.Report, asUid types.Uid) error {
+	if globals.cluster.isRemoteTopic(report.Topic) {
+		return globals.cluster.reportDelete(report.Topic, report.SeqId, asUid)
+	}
+	return reportDeleteLocal(report.Topic, report.SeqId, asUid)
+}
+
+// reportDeleteLocal hard-deletes the message in a topic hosted by this node.
+func reportDeleteLocal(topic string, seqId int, asUid types.Uid) error {
+	if t := globals.hub.topicGet(topic); t != nil {
+		if t.isProxy {
+			// The cluster has been rehashed and the topic is moving to this node.
+			return errors.New("topic is being migrated")
+		}
+		// The topic is loaded: delete through the topic to keep its state consistent.
+		result := make(chan error, 1)
+		del := &ClientComMessage{
+			Del: &MsgClientDel{
+				Topic:  topic,
+				What:   "msg",
+				DelSeq: []MsgDelRange{{LowId: seqId}},
+				Hard:   true,
+			},
+			Original:  topic,
+			RcptTo:    topic,
+			AsUser:    asUid.UserId(),
+			AuthLvl:   int(auth.LevelAuth),
+			MetaWhat:  constMsgDelMsg,
+			Timestamp: types.TimeNow(),
+			moderated: result,
+		}
+		select {
+		case t.meta <- del:
+		default:
+			return errors.New("topic meta queue is full")
+		}
+		// Wait for the topic to delete the message.
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(reportDeleteTimeout):
+			return errors.New("timed out waiting for topic to delete message")
+		}
+	}
+
+	// The topic is not loaded: delete directly in the database.
+	stopic, err := store.Topics.Get(topic)
+	if err != nil {
+		return err
+	}
+	if stopic == nil {
+		return types.ErrNotFound
+	}
+	return store.Messages.DeleteList(topic, stopic.DelId+1, types.ZeroUid, []types.Range{{Low: seqId}})
+}
+
+// ClusterReportDelete is a request to the topic master to hard-delete a reported message.
+type ClusterReportDelete struct {
+	// Node which sent the request.
+	Node string
+	// Topic and ID of the message to delete.
+	Topic string
+	SeqId int
+	// Moderator who deletes the message.
+	AsUser types.Uid
+}
+
+// reportDelete asks the master of the topic to delete the reported message and waits for the result.
+func (c *Cluster) reportDelete(topic string, seqId int, asUid types.Uid) error {
+	n := c.nodeForTopic(topic)
+	if n == nil {
+		return errors.New("no cluster node for topic")
+	}
+	var unused bool
+	return n.call("Cluster.ReportDelete",
+		&ClusterReportDelete{Node: c.thisNodeName, Topic: topic, SeqId: seqId, AsUser: asUid}, &unused)
+}
+
+// ReportDelete is an RPC endpoint which deletes a reported message in a topic hosted by this node.
+func (c *Cluster) ReportDelete(req *ClusterReportDelete, unused *bool) error {
+	if c.isRemoteTopic(req.Topic) {
+		// Rings of the nodes disagree. Do not forward again.
+		return errors.New("cluster: node '" + c.thisNodeName + "' is not the master of " + req.Topic)
+	}
+	if err := reportDeleteLocal(req.Topic, req.SeqId, req.AsUser); err != nil {
+		logs.Warn.Println("cluster: failed to delete reported message", req.Topic, req.SeqId, req.Node, err)
+		return err
+	}
+	return nil
+}
+
+// truncateRunes shortens the string to at most maxLen characters.
+func truncateRunes(str string, maxLen int) string {
+	if runes := []rune(str); len(runes) > maxLen {
+		return string(runes[:maxLen])
+	}
+	return str
+}
+
+// reportsSerialize converts stored reports to the wire format.
+func reportsSerialize(reports []types.Report) []MsgReport {
+	out := make([]MsgReport, 0, len(reports))
+	for i := range reports {
+		report := &reports[i]
+		item := MsgReport{
+			Id:        report.Id,
+			CreatedAt: report.CreatedAt,
+			From:      types.ParseUid(report.From).UserId(),
+			Topic:     report.Topic,
+			SeqId:     report.SeqId,
+			Reason:    report.Reason,
+			Comment:   report.Comment,
+			Resolved:  report.Resolved,
+		}
+		if report.User != "" {
+			item.User = types.ParseUid(report.User).UserId()
+		}
+		for _, action := range report.Actions {
+			item.Actions = append(item.Actions, MsgReportAction{
+				By:      types.ParseUid(action.By).UserId(),
+				What:    action.What,
+				Comment: action.Comment,
+				When:    action.When,
+			})
+		}
+		out = append(out, item)
+	}
+	return out
+}
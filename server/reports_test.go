@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+type reportsTestHelper struct {
+	ctrl *gomock.Controller
+	ss   *mock_store.MockSubsPersistenceInterface
+	mm   *mock_store.MockMessagesPersistenceInterface
+	rr   *mock_store.MockReportsPersistenceInterface
+}
+
+func setUpReportsTest(t *testing.T) *reportsTestHelper {
+	h := &reportsTestHelper{ctrl: gomock.NewController(t)}
+	h.ss = mock_store.NewMockSubsPersistenceInterface(h.ctrl)
+	h.mm = mock_store.NewMockMessagesPersistenceInterface(h.ctrl)
+	h.rr = mock_store.NewMockReportsPersistenceInterface(h.ctrl)
+	store.Subs, store.Messages, store.Reports = h.ss, h.mm, h.rr
+
+	reports, err := newReportsHandler(&reportsConfig{ModeratorsTopic: "grpModerators"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.reports = reports
+	globals.hub = &Hub{routeCli: make(chan *ClientComMessage, 1), topics: &sync.Map{}}
+
+	t.Cleanup(func() {
+		h.ctrl.Finish()
+		store.Subs, store.Messages, store.Reports = nil, nil, nil
+		globals.reports = nil
+		globals.hub = nil
+	})
+	return h
+}
+
+func reportRequest(topic string, report *MsgSetReport) *ClientComMessage {
+	return &ClientComMessage{
+		Set:      &MsgClientSet{Id: "1", Topic: topic, MsgSetQuery: MsgSetQuery{Report: report}},
+		Id:       "1",
+		Original: topic,
+		RcptTo:   topic,
+	}
+}
+
+func ctrlCode(t *testing.T, s *Session) int {
+	select {
+	case msg := <-s.send:
+		if resp, ok := msg.(*ServerComMessage); ok && resp.Ctrl != nil {
+			return resp.Ctrl.Code
+		}
+		t.Fatal("expected ctrl response, got", msg)
+	default:
+		t.Fatal("no response")
+	}
+	return 0
+}
+
+func TestReportMessage(t *testing.T) {
+	h := setUpReportsTest(t)
+	reporter, author := types.Uid(1), types.Uid(2)
+	s := &Session{uid: reporter, authLvl: auth.LevelAuth, send: make(chan any, 10)}
+
+	h.ss.EXPECT().Get("grpAbC", reporter, false).
+		Return(&types.Subscription{ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}, nil)
+	h.mm.EXPECT().GetAll("grpAbC", reporter, gomock.Any()).
+		Return([]types.Message{{SeqId: 5, From: author.String(), Content: "buy now"}}, nil)
+	h.rr.EXPECT().Create(gomock.Any()).DoAndReturn(func(report *types.Report) error {
+		if report.From != reporter.String() || report.User != author.String() || report.SeqId != 5 ||
+			report.Topic != "grpAbC" || report.Reason != "spam" {
+			t.Errorf("unexpected report %+v", report)
+		}
+		report.Id = "rep1"
+		return nil
+	})
+
+	replySetReport(s, reportRequest("grpAbC", &MsgSetReport{SeqId: 5, Reason: "spam"}))
+	if code := ctrlCode(t, s); code != http.StatusOK {
+		t.Fatal("expected 200, got", code)
+	}
+	// The report is saved but not delivered when 'sys' is offline.
+	if len(globals.hub.routeCli) != 0 {
+		t.Fatal("report must not be routed to offline 'sys' topic")
+	}
+
+	globals.hub.topics.Store("sys", &Topic{name: "sys"})
+	h.ss.EXPECT().Get("grpAbC", reporter, false).
+		Return(&types.Subscription{ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}, nil)
+	h.mm.EXPECT().GetAll("grpAbC", reporter, gomock.Any()).
+		Return([]types.Message{{SeqId: 5, From: author.String(), Content: "buy now"}}, nil)
+	h.rr.EXPECT().Create(gomock.Any()).DoAndReturn(func(report *types.Report) error {
+		report.Id = "rep1"
+		return nil
+	})
+	replySetReport(s, reportRequest("grpAbC", &MsgSetReport{SeqId: 5, Reason: "spam"}))
+	if code := ctrlCode(t, s); code != http.StatusOK {
+		t.Fatal("expected 200, got", code)
+	}
+
+	msg := <-globals.hub.routeCli
+	if msg.RcptTo != "sys" || msg.AsUser != reporter.UserId() {
+		t.Errorf("report must be published to 'sys' as reporter, got %s %s", msg.RcptTo, msg.AsUser)
+	}
+	content := msg.Pub.Content.(map[string]any)
+	if content["report"] != "rep1" || content["text"] != "buy now" || content["user"] != author.UserId() {
+		t.Errorf("unexpected report content %+v", content)
+	}
+
+	// Invalid reason.
+	replySetReport(s, reportRequest("grpAbC", &MsgSetReport{SeqId: 5, Reason: "boredom"}))
+	if code := ctrlCode(t, s); code != http.StatusBadRequest {
+		t.Error("expected 400, got", code)
+	}
+
+	// Reporting self.
+	replySetReport(s, reportRequest("sys", &MsgSetReport{User: reporter.UserId(), Reason: "abuse"}))
+	if code := ctrlCode(t, s); code != http.StatusBadRequest {
+		t.Error("expected 400, got", code)
+	}
+}
+
+func TestReportModeratorActions(t *testing.T) {
+	h := setUpReportsTest(t)
+	member, moderator, user := types.Uid(2), types.Uid(3), types.Uid(4)
+
+	// Not an admin of the moderators topic. The result is cached.
+	s := &Session{uid: member, authLvl: auth.LevelAuth, send: make(chan any, 10)}
+	h.ss.EXPECT().Get("grpModerators", member, false).
+		Return(&types.Subscription{ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}, nil)
+	for i := 0; i < 2; i++ {
+		replySetReport(s, reportRequest("sys", &MsgSetReport{Id: "rep1", Action: "resolve"}))
+		if code := ctrlCode(t, s); code != http.StatusForbidden {
+			t.Fatal("expected 403, got", code)
+		}
+	}
+
+	// Admin of the moderators topic. The check hits the database once.
+	s = &Session{uid: moderator, authLvl: auth.LevelAuth, send: make(chan any, 10)}
+	h.ss.EXPECT().Get("grpModerators", moderator, false).
+		Return(&types.Subscription{ModeWant: types.ModeCFull, ModeGiven: types.ModeCFull}, nil)
+	report := &types.Report{From: types.Uid(1).String(), User: user.String(), Reason: "abuse"}
+	h.rr.EXPECT().Get("rep1").Return(report, nil).Times(2)
+	h.rr.EXPECT().AddAction(report, gomock.Any(), true).DoAndReturn(
+		func(report *types.Report, action *types.ReportAction, resolve bool) error {
+			if action.By != moderator.String() || action.What != "resolve" || action.Comment != "ok" {
+				t.Errorf("unexpected action %+v", action)
+			}
+			return nil
+		})
+
+	// Message action on a user report.
+	replySetReport(s, reportRequest("sys", &MsgSetReport{Id: "rep1", Action: "delete"}))
+	if code := ctrlCode(t, s); code != http.StatusBadRequest {
+		t.Error("expected 400, got", code)
+	}
+
+	replySetReport(s, reportRequest("sys", &MsgSetReport{Id: "rep1", Action: "resolve", Comment: "ok"}))
+	if code := ctrlCode(t, s); code != http.StatusOK {
+		t.Error("expected 200, got", code)
+	}
+}
+
+func TestReportDeleteMessage(t *testing.T) {
+	h := setUpReportsTest(t)
+	moderator, author := types.Uid(3), types.Uid(4)
+	s := &Session{uid: moderator, authLvl: auth.LevelRoot, send: make(chan any, 10)}
+
+	topic := &Topic{name: "grpAbC", meta: make(chan *ClientComMessage, 1)}
+	globals.hub.topics.Store(topic.name, topic)
+
+	report := &types.Report{From: types.Uid(1).String(), User: author.String(), Topic: topic.name, SeqId: 5, Reason: "spam"}
+	h.rr.EXPECT().Get("rep1").Return(report, nil).Times(2)
+
+	// The topic fails to delete the message: the action is not recorded.
+	go func() {
+		del := <-topic.meta
+		if del.moderated == nil || del.Del.DelSeq[0].LowId != 5 || !del.Del.Hard ||
+			auth.Level(del.AuthLvl) == auth.LevelRoot {
+			t.Errorf("unexpected delete request %+v", del)
+		}
+		del.moderated <- errors.New("failed")
+	}()
+	replySetReport(s, reportRequest("sys", &MsgSetReport{Id: "rep1", Action: "delete"}))
+	if code := ctrlCode(t, s); code != http.StatusInternalServerError {
+		t.Error("expected 500, got", code)
+	}
+
+	// The action is recorded once the message is deleted.
+	h.rr.EXPECT().AddAction(report, gomock.Any(), false).Return(nil)
+	go func() {
+		del := <-topic.meta
+		del.moderated <- nil
+	}()
+	replySetReport(s, reportRequest("sys", &MsgSetReport{Id: "rep1", Action: "delete"}))
+	if code := ctrlCode(t, s); code != http.StatusOK {
+		t.Error("expected 200, got", code)
+	}
+}
+
+func TestReportDeleteRemote(t *testing.T) {
+	c := newTestLeader()
+	c.rehash(nil)
+	globals.cluster = c
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		globals.cluster = nil
+		globals.hub = nil
+	}()
+
+	// Find a topic hosted by another node.
+	var topic string
+	for i := 0; topic == ""; i++ {
+		if name := "grp" + types.Uid(i+1).String(); c.isRemoteTopic(name) {
+			topic = name
+		}
+	}
+
+	// The node is not the master of the topic: the request must not be forwarded again.
+	var unused bool
+	if err := c.ReportDelete(&ClusterReportDelete{Node: "two", Topic: topic, SeqId: 5, AsUser: types.Uid(3)}, &unused); err == nil {
+		t.Error("expected delete to be refused by a non-master node")
+	}
+}
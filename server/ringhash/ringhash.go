@@ -119,6 +119,16 @@ func (ring *Ring) Get(key string) string {
 	return ring.keys[idx].key
 }
 
+// Has checks if the key was added to the ring.
+func (ring *Ring) Has(key string) bool {
+	for _, el := range ring.keys {
+		if el.key == key {
+			return true
+		}
+	}
+	return false
+}
+
 // Signature returns the ring's hash signature. Two identical ringhashes
 // will have the same signature. Two hashes with different
 // number of keys or replicas or hash functions will have different
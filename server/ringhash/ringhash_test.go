@@ -111,6 +111,18 @@ func TestConsistency(t *testing.T) {
 	}
 }
 
+func TestHas(t *testing.T) {
+	ring := ringhash.New(4, nil)
+	ring.Add("owl", "crow")
+
+	if !ring.Has("owl") || !ring.Has("crow") {
+		t.Errorf("Ring must have added keys")
+	}
+	if ring.Has("sparrow") {
+		t.Errorf("Ring must not have keys which were not added")
+	}
+}
+
 func TestSignature(t *testing.T) {
 	ring1 := ringhash.New(4, nil)
 	ring2 := ringhash.New(4, nil)
@@ -55,12 +55,16 @@ const (
 	PROXY
 	// MULTIPLEX is a multiplexing session reprsenting a connection from proxy topic to master.
 	MULTIPLEX
+	// FEDERATED is a relay session of a user of a remote server.
+	FEDERATED
+	// SSE represents a server-sent events session.
+	SSE
 )
 
 // Session represents a single WS connection or a long polling session. A user may have multiple
 // sessions.
 type Session struct {
-	// protocol - NONE (unset), WEBSOCK, LPOLL, GRPC, PROXY, MULTIPLEX
+	// protocol - NONE (unset), WEBSOCK, LPOLL, GRPC, PROXY, MULTIPLEX, FEDERATED, SSE
 	proto SessionProto
 
 	// Session ID
@@ -69,9 +73,12 @@ type Session struct {
 	// Websocket. Set only for websocket sessions.
 	ws *websocket.Conn
 
-	// Pointer to session's record in sessionStore. Set only for Long Poll sessions.
+	// Pointer to session's record in sessionStore. Set only for Long Poll and SSE sessions.
 	lpTracker *list.Element
 
+	// State of the event stream. Set only for SSE sessions.
+	sse *sseStream
+
 	// gRPC handle. Set only for gRPC clients.
 	grpcnode pbx.Node_MessageLoopServer
 
@@ -244,6 +251,11 @@ func (s *Session) isProxy() bool {
 	return s.proto == PROXY
 }
 
+// Indicates whether this session outlives client connections and expires when unused: long polling and SSE.
+func (s *Session) isDetached() bool {
+	return s.proto == LPOLL || s.proto == SSE
+}
+
 // Cluster session: either a proxy or a multiplexing session.
 func (s *Session) isCluster() bool {
 	return s.isProxy() || s.isMultiplex()
@@ -262,6 +274,8 @@ func (s *Session) supportsMessageBatching() bool {
 		return true
 	case GRPC:
 		return true
+	case SSE:
+		return true
 	default:
 		return false
 	}
@@ -845,8 +859,8 @@ func (s *Session) hello(msg *ClientComMessage) {
 
 	var httpStatus int
 	var httpStatusText string
-	if s.proto == LPOLL || deviceIDUpdate {
-		// In case of long polling StatusCreated was reported earlier.
+	if s.isDetached() || deviceIDUpdate {
+		// In case of long polling and SSE StatusCreated was reported earlier.
 		// In case of deviceID update just report success.
 		httpStatus = http.StatusOK
 		httpStatusText = "ok"
@@ -1128,6 +1142,12 @@ func (s *Session) set(msg *ClientComMessage) {
 		return
 	}
 
+	if msg.Set.Report != nil {
+		// Reports are not handled by topics.
+		replySetReport(s, msg)
+		return
+	}
+
 	if msg.Set.Desc != nil {
 		msg.MetaWhat = constMsgMetaDesc
 	}
@@ -1312,6 +1332,21 @@ func (s *Session) expandTopicName(msg *ClientComMessage) (string, *ServerComMess
 		routeTo = msg.AsUser
 	} else if msg.Original == "fnd" {
 		routeTo = types.ParseUserId(msg.AsUser).FndName()
+	} else if globals.federation != nil && isFedAddr(msg.Original) {
+		// p2p topic with a user of a remote server: usrXXX@host.
+		uid2, err := globals.federation.resolve(msg.Original)
+		if err != nil {
+			logs.Warn.Println("s.etn: failed to resolve remote user", msg.Original, err, s.sid)
+			return "", decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, msg.Timestamp, msg.Timestamp, nil)
+		}
+		uid1 := types.ParseUserId(msg.AsUser)
+		if uid2 == uid1 {
+			// Use 'me' to access self-topic.
+			return "", ErrPermissionDeniedReply(msg, msg.Timestamp)
+		}
+		// The client sees the topic under the name of the local user.
+		msg.Original = uid2.UserId()
+		routeTo = uid1.P2PName(uid2)
 	} else if strings.HasPrefix(msg.Original, "usr") {
 		// p2p topic
 		uid1 := types.ParseUserId(msg.AsUser)
@@ -26,7 +26,7 @@ import (
 type SessionStore struct {
 	lock sync.Mutex
 
-	// Support for long polling sessions: a list of sessions sorted by last access time.
+	// Support for long polling and SSE sessions: a list of sessions sorted by last access time.
 	// Needed for cleaning abandoned sessions.
 	lru      *list.List
 	lifeTime time.Duration
@@ -64,6 +64,11 @@ func (ss *SessionStore) NewSession(conn any, sid string) (*Session, int) {
 	case pbx.Node_MessageLoopServer:
 		s.proto = GRPC
 		s.grpcnode = c
+	case *fedRelay:
+		s.proto = FEDERATED
+	case *sseStream:
+		s.proto = SSE
+		s.sse = c
 	default:
 		logs.Err.Panicln("session: unknown connection type", conn)
 	}
@@ -82,14 +87,14 @@ func (ss *SessionStore) NewSession(conn any, sid string) (*Session, int) {
 
 	ss.lock.Lock()
 
-	if s.proto == LPOLL {
-		// Only LP sessions need to be sorted by last active
+	if s.isDetached() {
+		// Only LP and SSE sessions need to be sorted by last active
 		s.lpTracker = ss.lru.PushFront(&s)
 	}
 
 	ss.sessCache[s.sid] = &s
 
-	// Expire stale long polling sessions: ss.lru contains only long polling sessions.
+	// Expire stale long polling and SSE sessions: ss.lru contains only such sessions.
 	// If ss.lru is empty this is a noop.
 	var expired []*Session
 	expire := s.lastTouched.Add(-ss.lifeTime)
@@ -126,7 +131,7 @@ func (ss *SessionStore) Get(sid string) *Session {
 	defer ss.lock.Unlock()
 
 	if sess := ss.sessCache[sid]; sess != nil {
-		if sess.proto == LPOLL {
+		if sess.isDetached() {
 			ss.lru.MoveToFront(sess.lpTracker)
 			sess.lastTouched = time.Now()
 		}
@@ -143,7 +148,7 @@ func (ss *SessionStore) Delete(s *Session) {
 	defer ss.lock.Unlock()
 
 	delete(ss.sessCache, s.sid)
-	if s.proto == LPOLL {
+	if s.isDetached() {
 		ss.lru.Remove(s.lpTracker)
 	}
 
@@ -193,7 +198,7 @@ func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 			_, data := s.serialize(evicted)
 			s.stopSession(data)
 			delete(ss.sessCache, s.sid)
-			if s.proto == LPOLL {
+			if s.isDetached() {
 				ss.lru.Remove(s.lpTracker)
 			}
 		}
@@ -559,6 +559,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetChannels(id interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChannels", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetChannels), id)
 }
 
+// GetOffline mocks base method.
+func (m *MockUsersPersistenceInterface) GetOffline(lastSeenAfter time.Time, afterUid types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOffline", lastSeenAfter, afterUid, lastSeenBefore, limit)
+	ret0, _ := ret[0].([]types.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOffline indicates an expected call of GetOffline.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) GetOffline(lastSeenAfter, afterUid, lastSeenBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOffline", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetOffline), lastSeenAfter, afterUid, lastSeenBefore, limit)
+}
+
 // GetOwnTopics mocks base method.
 func (m *MockUsersPersistenceInterface) GetOwnTopics(id types.Uid) ([]string, error) {
 	m.ctrl.T.Helper()
@@ -1240,6 +1255,87 @@ func (mr *MockFilePersistenceInterfaceMockRecorder) StartUpload(fd interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartUpload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).StartUpload), fd)
 }
 
+// MockReportsPersistenceInterface is a mock of ReportsPersistenceInterface interface.
+type MockReportsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockReportsPersistenceInterfaceMockRecorder
+}
+
+// MockReportsPersistenceInterfaceMockRecorder is the mock recorder for MockReportsPersistenceInterface.
+type MockReportsPersistenceInterfaceMockRecorder struct {
+	mock *MockReportsPersistenceInterface
+}
+
+// NewMockReportsPersistenceInterface creates a new mock instance.
+func NewMockReportsPersistenceInterface(ctrl *gomock.Controller) *MockReportsPersistenceInterface {
+	mock := &MockReportsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockReportsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReportsPersistenceInterface) EXPECT() *MockReportsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// AddAction mocks base method.
+func (m *MockReportsPersistenceInterface) AddAction(report *types.Report, action *types.ReportAction, resolve bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddAction", report, action, resolve)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddAction indicates an expected call of AddAction.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) AddAction(report, action, resolve interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAction", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).AddAction), report, action, resolve)
+}
+
+// Create mocks base method.
+func (m *MockReportsPersistenceInterface) Create(report *types.Report) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", report)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Create(report interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Create), report)
+}
+
+// Get mocks base method.
+func (m *MockReportsPersistenceInterface) Get(id string) (*types.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", id)
+	ret0, _ := ret[0].(*types.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Get(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Get), id)
+}
+
+// GetAll mocks base method.
+func (m *MockReportsPersistenceInterface) GetAll(unresolvedOnly bool, limit int) ([]types.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", unresolvedOnly, limit)
+	ret0, _ := ret[0].([]types.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) GetAll(unresolvedOnly, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).GetAll), unresolvedOnly, limit)
+}
+
 // MockPersistentCacheInterface is a mock of PersistentCacheInterface interface.
 type MockPersistentCacheInterface struct {
 	ctrl     *gomock.Controller
@@ -1306,6 +1402,21 @@ func (mr *MockPersistentCacheInterfaceMockRecorder) Get(key interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockPersistentCacheInterface)(nil).Get), key)
 }
 
+// List mocks base method.
+func (m *MockPersistentCacheInterface) List(keyPrefix string, limit int) ([]types.KeyValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", keyPrefix, limit)
+	ret0, _ := ret[0].([]types.KeyValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockPersistentCacheInterfaceMockRecorder) List(keyPrefix, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockPersistentCacheInterface)(nil).List), keyPrefix, limit)
+}
+
 // Upsert mocks base method.
 func (m *MockPersistentCacheInterface) Upsert(key, value string, failOnDuplicate bool) error {
 	m.ctrl.T.Helper()
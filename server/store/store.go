@@ -279,6 +279,7 @@ type UsersPersistenceInterface interface {
 	DelCred(id types.Uid, method, value string) error
 	GetUnreadCount(ids ...types.Uid) (map[types.Uid]int, error)
 	GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]types.Uid, error)
+	GetOffline(lastSeenAfter time.Time, afterUid types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error)
 }
 
 // usersMapper is a concrete type which implements UsersPersistenceInterface.
@@ -507,6 +508,12 @@ func (usersMapper) GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]typ
 	return adp.UserGetUnvalidated(lastUpdatedBefore, limit)
 }
 
+// GetOffline returns active users who were last seen no later than lastSeenBefore and after the
+// (lastSeenAfter, afterUid) position.
+func (usersMapper) GetOffline(lastSeenAfter time.Time, afterUid types.Uid, lastSeenBefore time.Time, limit int) ([]types.User, error) {
+	return adp.UserGetOffline(lastSeenAfter, afterUid, lastSeenBefore, limit)
+}
+
 // TopicsPersistenceInterface is an interface which defines methods for persistent storage of topics.
 type TopicsPersistenceInterface interface {
 	Create(topic *types.Topic, owner types.Uid, private interface{}) error
@@ -1058,6 +1065,49 @@ func (fileMapper) LinkAttachments(topic string, msgId types.Uid, attachments []s
 	return nil
 }
 
+// ReportsPersistenceInterface is an interface which defines methods for persistent storage of user reports.
+type ReportsPersistenceInterface interface {
+	Create(report *types.Report) error
+	Get(id string) (*types.Report, error)
+	GetAll(unresolvedOnly bool, limit int) ([]types.Report, error)
+	AddAction(report *types.Report, action *types.ReportAction, resolve bool) error
+}
+
+// reportsMapper is concrete type which implements ReportsPersistenceInterface.
+type reportsMapper struct{}
+
+// Reports is an instance of ReportsPersistenceInterface to map methods to.
+var Reports ReportsPersistenceInterface
+
+// Create saves a new report.
+func (reportsMapper) Create(report *types.Report) error {
+	report.SetUid(Store.GetUid())
+	report.InitTimes()
+	return adp.ReportCreate(report)
+}
+
+// Get reads a report by ID.
+func (reportsMapper) Get(id string) (*types.Report, error) {
+	return adp.ReportGet(id)
+}
+
+// GetAll returns up to limit most recent reports, optionally unresolved only.
+func (reportsMapper) GetAll(unresolvedOnly bool, limit int) ([]types.Report, error) {
+	return adp.ReportGetAll(unresolvedOnly, limit)
+}
+
+// AddAction records an action taken on the report in the audit log and optionally marks the report as resolved.
+func (reportsMapper) AddAction(report *types.Report, action *types.ReportAction, resolve bool) error {
+	action.When = types.TimeNow()
+	if err := adp.ReportAddAction(report, action, resolve); err != nil {
+		return err
+	}
+	report.Actions = append(report.Actions, *action)
+	report.Resolved = report.Resolved || resolve
+	report.UpdatedAt = action.When
+	return nil
+}
+
 // PersistentCacheInterface is an interface which defines methods used for accessing persistent key-value cache.
 type PersistentCacheInterface interface {
 	// Get reads a persistent cache entry.
@@ -1068,6 +1118,8 @@ type PersistentCacheInterface interface {
 	Delete(key string) error
 	// Expire expires older entries with the specified key prefix.
 	Expire(keyPrefix string, olderThan time.Time) error
+	// List returns up to 'limit' oldest entries with the specified key prefix, oldest first.
+	List(keyPrefix string, limit int) ([]types.KeyValue, error)
 }
 
 // pcacheMapper is concrete type which implements PersistentCacheInterface.
@@ -1095,6 +1147,11 @@ func (pcacheMapper) Expire(keyPrefix string, olderThan time.Time) error {
 	return adp.PCacheExpire(keyPrefix, olderThan)
 }
 
+// List returns up to 'limit' oldest entries with the specified key prefix, oldest first.
+func (pcacheMapper) List(keyPrefix string, limit int) ([]types.KeyValue, error) {
+	return adp.PCacheList(keyPrefix, limit)
+}
+
 func init() {
 	Store = storeObj{}
 	Users = usersMapper{}
@@ -1104,4 +1161,5 @@ func init() {
 	Devices = deviceMapper{}
 	Files = fileMapper{}
 	PCache = pcacheMapper{}
+	Reports = reportsMapper{}
 }
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -411,6 +412,143 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// NotifyPrefs are user's preferences for push notifications. Preferences stored on the user
+// apply to all topics, preferences stored on a subscription apply to that topic only.
+type NotifyPrefs struct {
+	// Notifications are sent silent until this time.
+	MuteUntil *time.Time `json:"muteUntil,omitempty" bson:",omitempty"`
+	// Daily quiet hours as "HH:MM" in user's time zone. The period wraps around
+	// midnight if QuietFrom is later than QuietTo.
+	QuietFrom string `json:"quietFrom,omitempty" bson:",omitempty"`
+	QuietTo   string `json:"quietTo,omitempty" bson:",omitempty"`
+	// IANA time zone name of the quiet hours, like "America/Los_Angeles". UTC if empty.
+	TimeZone string `json:"tz,omitempty" bson:",omitempty"`
+	// Group topics only: send notifications only when the user is mentioned.
+	MentionsOnly bool `json:"mentionsOnly,omitempty" bson:",omitempty"`
+	// Notifications enabled or disabled by action: "msg", "sub", "read".
+	// Actions not listed are enabled.
+	Actions map[string]bool `json:"actions,omitempty" bson:",omitempty"`
+	// User-level only: do not send email digests of unread messages.
+	NoDigest bool `json:"noDigest,omitempty" bson:",omitempty"`
+}
+
+// Validate checks if the preferences are well-formed.
+func (np *NotifyPrefs) Validate() error {
+	if np == nil {
+		return nil
+	}
+	if (np.QuietFrom == "") != (np.QuietTo == "") {
+		return ErrMalformed
+	}
+	if np.QuietFrom != "" {
+		if _, err := time.Parse("15:04", np.QuietFrom); err != nil {
+			return ErrMalformed
+		}
+		if _, err := time.Parse("15:04", np.QuietTo); err != nil {
+			return ErrMalformed
+		}
+	}
+	if np.TimeZone != "" {
+		if _, err := notifyLocation(np.TimeZone); err != nil {
+			return ErrMalformed
+		}
+	}
+	for what := range np.Actions {
+		if what != "msg" && what != "sub" && what != "read" {
+			return ErrMalformed
+		}
+	}
+	return nil
+}
+
+// IsZero checks if the preferences are empty, i.e. all notifications are enabled.
+func (np *NotifyPrefs) IsZero() bool {
+	return np == nil || (np.MuteUntil == nil && np.QuietFrom == "" && !np.MentionsOnly && len(np.Actions) == 0 &&
+		!np.NoDigest)
+}
+
+// IsEnabled checks if notifications for the given action are enabled.
+func (np *NotifyPrefs) IsEnabled(what string) bool {
+	if np == nil {
+		return true
+	}
+	if on, ok := np.Actions[what]; ok {
+		return on
+	}
+	return true
+}
+
+// IsMuted checks if notifications should be sent silent at the given time:
+// either muted until a later time or the time falls within quiet hours.
+func (np *NotifyPrefs) IsMuted(now time.Time) bool {
+	if np == nil {
+		return false
+	}
+	if np.MuteUntil != nil && now.Before(*np.MuteUntil) {
+		return true
+	}
+	if np.QuietFrom == "" || np.QuietTo == "" {
+		return false
+	}
+
+	from, err := time.Parse("15:04", np.QuietFrom)
+	if err != nil {
+		return false
+	}
+	to, err := time.Parse("15:04", np.QuietTo)
+	if err != nil {
+		return false
+	}
+	loc := time.UTC
+	if np.TimeZone != "" {
+		if loc, err = notifyLocation(np.TimeZone); err != nil {
+			loc = time.UTC
+		}
+	}
+
+	local := now.In(loc)
+	minutes := local.Hour()*60 + local.Minute()
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	if start <= end {
+		return minutes >= start && minutes < end
+	}
+	// Quiet hours span midnight.
+	return minutes >= start || minutes < end
+}
+
+// Time zones of notification preferences by IANA name. Loading a time zone reads the zoneinfo database.
+var notifyLocations sync.Map
+
+// notifyLocation returns the time zone by name, loading it on first use.
+func notifyLocation(name string) (*time.Location, error) {
+	if loc, ok := notifyLocations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	notifyLocations.Store(name, loc)
+	return loc, nil
+}
+
+// Scan implements sql.Scanner interface.
+func (np *NotifyPrefs) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), np)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (np *NotifyPrefs) Value() (driver.Value, error) {
+	if np == nil {
+		return nil, nil
+	}
+	return json.Marshal(np)
+}
+
 // ObjState represents information on objects state,
 // such as an indication that User or Topic is suspended/soft-deleted.
 type ObjState int
@@ -515,6 +653,9 @@ type User struct {
 	// 'users' as well as indexed in 'tagunique'
 	Tags StringSlice
 
+	// Notification preferences applied to all topics.
+	Notify *NotifyPrefs `json:"Notify,omitempty" bson:",omitempty"`
+
 	// Info on known devices, used for push notifications
 	Devices map[string]*DeviceDef `bson:"__devices,skip,omitempty"`
 	// Same for mongodb scheme. Ignore in other db backends if its not suitable.
@@ -900,6 +1041,8 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private interface{}
+	// User's notification preferences for this topic.
+	Notify *NotifyPrefs `json:"Notify,omitempty" bson:",omitempty"`
 
 	// Deserialized ephemeral values
 
@@ -1345,6 +1488,42 @@ type FileDef struct {
 	Size int64
 	// Internal file location, i.e. path on disk or an S3 blob address.
 	Location string
+	// Per-file data encryption key, encrypted with the master key of the media handler.
+	// Nil if the file is stored unencrypted.
+	EncKey []byte `bson:",omitempty"`
+}
+
+// Report is a complaint filed by a user about a message or another user.
+type Report struct {
+	ObjHeader `bson:",inline"`
+	// User who filed the report.
+	From string
+	// Reported user, if any.
+	User string `bson:",omitempty"`
+	// Topic where the reported message was posted or where the user was reported.
+	Topic string `bson:",omitempty"`
+	// ID of the reported message, 0 if the report is not about a message.
+	SeqId int `bson:",omitempty"`
+	// Reason for the report, such as "spam" or "abuse".
+	Reason string
+	// Free-form comment of the reporter.
+	Comment string `bson:",omitempty"`
+	// The report is closed by a moderator.
+	Resolved bool
+	// Audit log of actions taken on the report, oldest first.
+	Actions []ReportAction `bson:",omitempty"`
+}
+
+// ReportAction is a record of an action taken by a moderator on a report.
+type ReportAction struct {
+	// Moderator who took the action.
+	By string
+	// The action: "suspend", "delete" or "resolve".
+	What string
+	// Comment of the moderator.
+	Comment string `json:",omitempty" bson:",omitempty"`
+	// Time of the action.
+	When time.Time
 }
 
 // FlattenDoubleSlice turns 2d slice into a 1d slice.
@@ -1355,3 +1534,9 @@ func FlattenDoubleSlice(data [][]string) []string {
 	}
 	return result
 }
+
+// KeyValue is an entry of the persistent cache.
+type KeyValue struct {
+	Key   string
+	Value string
+}
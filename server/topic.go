@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -103,6 +104,10 @@ type Topic struct {
 	proxy chan *ClusterResp
 	// Channel to receive topic proxy service requests, e.g. sending deferred notifications.
 	master chan *ClusterSessUpdate
+	// Channel to receive topic state from the previous master node (used only by master topics). Buffered = 1.
+	handoff chan *ClusterTopicState
+	// {pub} requests received while the topic is moving to another node, forwarded to the new master.
+	migratingPubs []*ClientComMessage
 
 	// Flag which tells topic lifecycle status: new, ready, paused, marked for deletion.
 	status int32
@@ -138,6 +143,8 @@ type perUserData struct {
 	delID int
 
 	private any
+	// Notification preferences: user's global preferences for 'me', per-topic otherwise.
+	notify *types.NotifyPrefs
 
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
@@ -185,6 +192,8 @@ const (
 	StopDeleted
 	// StopRehashing terminated due to cluster rehashing (moved to a different node).
 	StopRehashing
+	// StopMigrating terminated due to cluster rehashing, sessions are moved to the new node.
+	StopMigrating
 )
 
 // Topic shutdown
@@ -303,7 +312,7 @@ func (t *Topic) unregisterSession(msg *ClientComMessage) {
 		if msg.sess.isMultiplex() {
 			// Check if any of the call party sessions is multiplexed over msg.sess.
 			for _, p := range t.currentCall.parties {
-				if p.sess.isProxy() && p.sess.multi == msg.sess {
+				if p.sess != nil && p.sess.isProxy() && p.sess.multi == msg.sess {
 					shouldTerminateCall = true
 					break
 				}
@@ -334,6 +343,7 @@ func (t *Topic) registerSession(msg *ClientComMessage) {
 	// Request to add a connection to this topic
 	if t.isInactive() {
 		msg.sess.queueOut(ErrLockedReply(msg, types.TimeNow()))
+		abortMigration(msg)
 	} else if msg.sess.getSub(t.name) != nil {
 		// Session is already subscribed to topic. Subscription is checked in session.go,
 		// but there is a gap between topic creation/un-pausing and processing the
@@ -349,12 +359,16 @@ func (t *Topic) registerSession(msg *ClientComMessage) {
 				// Call plugins with the new topic
 				pluginTopic(t, plgActCreate)
 			}
+			if msg.migrating {
+				t.restoreCallParty(msg.sess)
+			}
 		} else {
 			if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
 				// Failed to subscribe, the topic is still inactive
 				t.killTimer.Reset(idleMasterTopicTimeout)
 			}
 			logs.Warn.Printf("topic[%s] subscription failed %v, sid=%s", t.name, err, msg.sess.sid)
+			abortMigration(msg)
 		}
 	}
 	if msg.sess.inflightReqs != nil {
@@ -394,6 +408,16 @@ func (t *Topic) handleMetaGet(msg *ClientComMessage, asUid types.Uid, asChan boo
 			logs.Warn.Printf("topic[%s] meta.Get.Creds failed: %s", t.name, err)
 		}
 	}
+	if msg.MetaWhat&constMsgMetaMod != 0 {
+		if err := t.replyGetMod(msg.sess, asUid, authLevel, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Mod failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaReport != 0 {
+		if err := t.replyGetReports(msg.sess, asUid, authLevel, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Report failed: %s", t.name, err)
+		}
+	}
 }
 
 func (t *Topic) handleMetaSet(msg *ClientComMessage, asUid types.Uid, asChan bool, authLevel auth.Level) {
@@ -508,6 +532,7 @@ func (t *Topic) handleTopicTermination(sd *shutDown) {
 	// 2. Topic is being deleted (reason == StopDeleted)
 	// 3. System shutdown (reason == StopShutdown, done != nil).
 	// 4. Cluster rehashing (reason == StopRehashing)
+	// 5. Cluster rehashing with topic handoff (reason == StopMigrating)
 
 	if sd.reason == StopDeleted {
 		if t.cat == types.TopicCatGrp {
@@ -522,6 +547,9 @@ func (t *Topic) handleTopicTermination(sd *shutDown) {
 		// Must send individual messages to sessions because normal sending through the topic's
 		// broadcast channel won't work - it will be shut down too soon.
 		t.presSubsOnlineDirect("term", nilPresParams, nilPresFilters, "")
+	} else if sd.reason == StopMigrating {
+		// Sessions are not notified: they are moved to the new master.
+		t.migrate()
 	}
 	// In case of a system shutdown don't bother with notifications. They won't be delivered anyway.
 
@@ -554,21 +582,34 @@ func (t *Topic) runLocal(hub *Hub) {
 	t.callEstablishmentTimer = time.NewTimer(time.Second)
 	t.callEstablishmentTimer.Stop()
 
+	// If the topic has just moved from another node, subscriptions, messages and meta requests are queued
+	// until the state arrives from the previous master: it may be still saving messages.
+	regQueue, clientQueue, metaQueue := t.reg, t.clientMsg, t.meta
+	var handoffTimer <-chan time.Time
+	if wait := globals.cluster.handoffWait(t.name); wait > 0 {
+		regQueue, clientQueue, metaQueue = nil, nil, nil
+		handoffTimer = time.After(wait)
+	}
+	resume := func() {
+		regQueue, clientQueue, metaQueue = t.reg, t.clientMsg, t.meta
+		handoffTimer = nil
+	}
+
 	for {
 		select {
-		case msg := <-t.reg:
+		case msg := <-regQueue:
 			t.registerSession(msg)
 
 		case msg := <-t.unreg:
 			t.unregisterSession(msg)
 
-		case msg := <-t.clientMsg:
+		case msg := <-clientQueue:
 			t.handleClientMsg(msg)
 
 		case msg := <-t.serverMsg:
 			t.handleServerMsg(msg)
 
-		case meta := <-t.meta:
+		case meta := <-metaQueue:
 			t.handleMeta(meta)
 
 		case upd := <-t.supd:
@@ -583,6 +624,14 @@ func (t *Topic) runLocal(hub *Hub) {
 		case <-t.callEstablishmentTimer.C:
 			t.terminateCallInProgress(true)
 
+		case state := <-t.handoff:
+			t.applyHandoff(state)
+			resume()
+
+		case <-handoffTimer:
+			logs.Warn.Printf("topic[%s]: state not received from the previous master", t.name)
+			resume()
+
 		case sd := <-t.exit:
 			t.handleTopicTermination(sd)
 			return
@@ -970,6 +1019,26 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 		}
 	}
 
+	var flagged *moderationResult
+	if globals.moderator != nil {
+		// Messages originated by the server or plugins have no session: only rules not limited by language apply.
+		var lang string
+		if msg.sess != nil {
+			lang = msg.sess.lang
+		}
+		var result *moderationResult
+		content, result = globals.moderator.check(t.name, lang, content)
+		if result != nil {
+			if result.action&modActionReject != 0 {
+				msg.sess.queueOut(ErrPolicy(msg.Id, t.original(asUid), msg.Timestamp))
+				return types.ErrPolicy
+			}
+			if result.action&modActionFlag != 0 {
+				flagged = result
+			}
+		}
+	}
+
 	if msg.sess != nil && msg.sess.uid != asUid {
 		// The "sender" header contains ID of the user who sent the message on behalf of asUid.
 		if head == nil {
@@ -1007,6 +1076,17 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 		t.perUser[asUid] = pud
 	}
 
+	if flagged != nil {
+		text, _ := drafty.PlainText(content)
+		globals.moderator.enqueue(t.name, &MsgModItem{
+			SeqId:     t.lastID,
+			From:      asUid.UserId(),
+			Timestamp: msg.Timestamp,
+			Rules:     flagged.rules,
+			Text:      text,
+		})
+	}
+
 	if msg.Id != "" && msg.sess != nil {
 		reply := NoErrAccepted(msg.Id, t.original(asUid), msg.Timestamp)
 		reply.Ctrl.Params = map[string]any{"seq": t.lastID}
@@ -1058,6 +1138,11 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 		msg.sess.queueOut(ErrLocked(msg.Id, t.original(asUid), msg.Timestamp))
 		return
 	}
+	if t.isMigrating() {
+		// The topic is moving to another node. The message will be saved by the new master.
+		t.migratingPubs = append(t.migratingPubs, msg)
+		return
+	}
 
 	if t.isReadOnly() {
 		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
@@ -1087,7 +1172,12 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 	}
 
 	if err := t.saveAndBroadcastMessage(msg, asUid, msg.Pub.NoEcho, attachments, msg.Pub.Head, msg.Pub.Content); err != nil {
-		logs.Err.Printf("topic[%s]: failed to save messagge - %s", t.name, err)
+		if err == types.ErrPolicy {
+			// Rejected by content moderation, not a server error.
+			logs.Info.Printf("topic[%s]: message rejected by moderation, user %s", t.name, asUid.UserId())
+		} else {
+			logs.Err.Printf("topic[%s]: failed to save messagge - %s", t.name, err)
+		}
 		return
 	}
 
@@ -1245,6 +1335,14 @@ func (t *Topic) handlePresence(msg *ServerComMessage) {
 
 // broadcastToSessions writes message to attached sessions.
 func (t *Topic) broadcastToSessions(msg *ServerComMessage) {
+	if !t.isProxy {
+		// Let plugins inspect the message once before it's delivered to sessions.
+		// Proxy topics receive messages already inspected by the master topic.
+		if msg = pluginFireHoseOut(msg); msg == nil {
+			return
+		}
+	}
+
 	// List of sessions to be dropped.
 	var dropSessions []*Session
 	// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
@@ -1417,11 +1515,15 @@ func (t *Topic) subscriptionReply(asChan bool, msg *ClientComMessage) error {
 		msg.Original = toriginal
 	}
 
-	if len(params) == 0 {
-		// Don't send empty params '{}'
-		msg.sess.queueOut(NoErr(msg.Id, toriginal, now))
-	} else {
-		msg.sess.queueOut(NoErrParams(msg.Id, toriginal, now, params))
+	// Sessions moved from another node don't get a response: the client did not ask for the subscription.
+	// Proxy sessions still need the response to attach the session to the proxy topic.
+	if !msg.migrating || msg.sess.isProxy() {
+		if len(params) == 0 {
+			// Don't send empty params '{}'
+			msg.sess.queueOut(NoErr(msg.Id, toriginal, now))
+		} else {
+			msg.sess.queueOut(NoErrParams(msg.Id, toriginal, now, params))
+		}
 	}
 
 	// Some notifications are always sent immediately.
@@ -1503,9 +1605,9 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			// Make sure the user is not asking for unreasonable permissions
 			userData.modeWant = (userData.modeWant & types.ModeCP2P) | types.ModeApprove
 		} else if t.cat == types.TopicCatSys {
-			if asLvl != auth.LevelRoot {
+			if asLvl != auth.LevelRoot && (globals.reports == nil || !globals.reports.isModerator(asUid, asLvl)) {
 				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
-				return nil, errors.New("subscription to 'sys' topic requires root access level")
+				return nil, errors.New("subscription to 'sys' topic requires root access level or moderator rights")
 			}
 
 			// Assign default access levels
@@ -2116,6 +2218,7 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, asChan bool, opts *
 
 		if ifUpdated {
 			desc.Private = pud.private
+			desc.Notify = pud.notify
 		}
 
 		// Don't report message IDs to users without Read access.
@@ -2255,6 +2358,26 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 		}
 
 		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
+
+		if set.Desc.Notify != nil && t.cat != types.TopicCatFnd {
+			if err = set.Desc.Notify.Validate(); err != nil {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return err
+			}
+			// Empty preferences reset notifications to defaults.
+			var notify *types.NotifyPrefs
+			if !set.Desc.Notify.IsZero() {
+				notify = set.Desc.Notify
+			}
+			if t.cat == types.TopicCatMe {
+				// Global preferences are stored on the user.
+				core["Notify"] = notify
+			} else {
+				sub["Notify"] = notify
+			}
+			// Notification preferences are private to the user.
+			sendPriv = true
+		}
 	}
 
 	if len(core)+len(sub) == 0 {
@@ -2317,6 +2440,14 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 		pud.private = private
 		t.perUser[asUid] = pud
 	}
+	if notify, ok := sub["Notify"]; ok {
+		pud.notify = notify.(*types.NotifyPrefs)
+		t.perUser[asUid] = pud
+	} else if notify, ok := core["Notify"]; ok {
+		pud.notify = notify.(*types.NotifyPrefs)
+		t.perUser[asUid] = pud
+		notifyPrefsCache.update(asUid, pud.notify)
+	}
 
 	if sendCommon || sendPriv {
 		// t.public/t.trusted, t.accessAuth/Anon have changed, make an announcement
@@ -2971,20 +3102,108 @@ func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg
 	return nil
 }
 
+// replyGetMod returns messages flagged by moderation. Available to topic owner and root only.
+func (t *Topic) replyGetMod(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	if globals.moderator == nil {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return errors.New("moderation is disabled")
+	}
+
+	if pud := t.perUser[asUid]; authLevel != auth.LevelRoot && !(pud.modeGiven & pud.modeWant).IsOwner() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return types.ErrPermissionDenied
+	}
+
+	items, err := globals.moderator.queue(t.name)
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	if len(items) == 0 {
+		sess.queueOut(NoContentParams(msg.Id, toriginal, now, msg.Timestamp, map[string]string{"what": "mod"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     toriginal,
+			Mod:       items,
+			Timestamp: &now,
+		},
+	})
+	return nil
+}
+
+// replyGetReports returns unresolved reports. Available in 'sys' topic to root and moderators only.
+func (t *Topic) replyGetReports(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("reports are available in 'sys' topic only")
+	}
+
+	if globals.reports == nil {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return errors.New("reports are disabled")
+	}
+
+	if !globals.reports.isModerator(asUid, authLevel) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return types.ErrPermissionDenied
+	}
+
+	reports, err := store.Reports.GetAll(true, 0)
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	if len(reports) == 0 {
+		sess.queueOut(NoContentParams(msg.Id, msg.Original, now, msg.Timestamp, map[string]string{"what": "report"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     msg.Original,
+			Report:    reportsSerialize(reports),
+			Timestamp: &now,
+		},
+	})
+	return nil
+}
+
 // replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
-func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) (err error) {
 	now := types.TimeNow()
 
+	if msg.moderated != nil {
+		defer func() { msg.moderated <- err }()
+	}
+
 	if asChan {
 		// Do not allow channel readers delete messages.
 		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
 		return errors.New("channel readers cannot delete messages")
 	}
 
+	if t.isMigrating() {
+		// The new master assigns delete IDs.
+		sess.queueOut(ErrLockedReply(msg, now))
+		return errors.New("del.msg: topic is moving to another node")
+	}
+
 	del := msg.Del
 
 	pud := t.perUser[asUid]
-	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
+	if msg.moderated == nil && !(pud.modeGiven & pud.modeWant).IsDeleter() {
 		// User must have an R permission: if the user cannot read messages, he has
 		// no business of deleting them.
 		if !(pud.modeGiven & pud.modeWant).IsReader() {
@@ -2997,7 +3216,6 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 		del.Hard = false
 	}
 
-	var err error
 	var ranges []types.Range
 	if len(del.DelSeq) == 0 {
 		err = errors.New("del.msg: no IDs to delete")
@@ -3066,8 +3284,12 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 		// Broadcast the change to all, online and offline, exclude the session making the change.
 		params := &presParams{delID: t.delID, delSeq: dr, actor: asUid.UserId()}
 		filters := &presFilters{filterIn: types.ModeRead}
-		t.presSubsOnline("del", params.actor, params, filters, sess.sid)
-		t.presSubsOffline("del", params, filters, nilPresFilters, sess.sid, true)
+		var skipSid string
+		if sess != nil {
+			skipSid = sess.sid
+		}
+		t.presSubsOnline("del", params.actor, params, filters, skipSid)
+		t.presSubsOffline("del", params, filters, nilPresFilters, skipSid, true)
 	} else {
 		pud := t.perUser[asUid]
 		pud.delID = t.delID
@@ -3489,6 +3711,8 @@ const (
 	topicStatusMarkedDeleted = 0x10
 	// Topic is suspended: read-only mode.
 	topicStatusReadOnly = 0x20
+	// Topic is moving to another cluster node: messages are not saved.
+	topicStatusMigrating = 0x40
 )
 
 // statusChangeBits sets or removes given bits from t.status
@@ -3536,6 +3760,15 @@ func (t *Topic) isInactive() bool {
 	return (atomic.LoadInt32(&t.status) & (topicStatusPaused | topicStatusMarkedDeleted)) != 0
 }
 
+// markMigrating indicates that the topic is moving to another cluster node.
+func (t *Topic) markMigrating() {
+	t.statusChangeBits(topicStatusMigrating, true)
+}
+
+func (t *Topic) isMigrating() bool {
+	return (atomic.LoadInt32(&t.status) & topicStatusMigrating) != 0
+}
+
 func (t *Topic) isReadOnly() bool {
 	return (atomic.LoadInt32(&t.status) & topicStatusReadOnly) != 0
 }
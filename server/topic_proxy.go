@@ -22,12 +22,18 @@ func (t *Topic) runProxy(hub *Hub) {
 		select {
 		case msg := <-t.reg:
 			// Request to add a connection to this topic
+			req := ProxyReqJoin
+			if msg.migrating {
+				req = ProxyReqMigrate
+			}
 			if t.isInactive() {
 				msg.sess.queueOut(ErrLockedReply(msg, types.TimeNow()))
-			} else if err := globals.cluster.routeToTopicMaster(ProxyReqJoin, msg, t.name, msg.sess); err != nil {
+				abortMigration(msg)
+			} else if err := globals.cluster.routeToTopicMaster(req, msg, t.name, msg.sess); err != nil {
 				// Response (ctrl message) will be handled when it's received via the proxy channel.
 				logs.Warn.Printf("proxy topic[%s]: route join request from proxy to master failed - %s", t.name, err)
 				msg.sess.queueOut(ErrClusterUnreachableReply(msg, types.TimeNow()))
+				abortMigration(msg)
 			}
 			if msg.sess.inflightReqs != nil {
 				msg.sess.inflightReqs.Done()
@@ -94,13 +100,21 @@ func (t *Topic) runProxy(hub *Hub) {
 			t.proxyMasterResponse(msg, killTimer)
 
 		case sd := <-t.exit:
+			if sd.reason == StopMigrating {
+				// The master has moved. Subscribe sessions to the topic at the new master.
+				t.migrateSessions()
+			}
+
 			// Tell sessions to remove the topic
 			for s := range t.sessions {
 				s.detachSession(t.name)
 			}
 
-			if err := globals.cluster.topicProxyGone(t.name); err != nil {
-				logs.Warn.Printf("proxy topic[%s] shutdown: failed to notify master - %s", t.name, err)
+			// The old master hands off the topic on its own when migrating.
+			if sd.reason != StopMigrating {
+				if err := globals.cluster.topicProxyGone(t.name); err != nil {
+					logs.Warn.Printf("proxy topic[%s] shutdown: failed to notify master - %s", t.name, err)
+				}
 			}
 
 			// Report completion back to sender, if 'done' is not nil.
@@ -196,7 +210,7 @@ func (t *Topic) proxyMasterResponse(msg *ClusterResp, killTimer *time.Timer) {
 			logs.Warn.Printf("proxy topic[%s]: session %s not found; already terminated?", t.name, msg.OrigSid)
 		}
 		switch msg.OrigReqType {
-		case ProxyReqJoin:
+		case ProxyReqJoin, ProxyReqMigrate:
 			if sess != nil && msg.SrvMsg.Ctrl != nil {
 				// TODO: do we need to let the master topic know that the subscription is not longer valid
 				// or is it already informed by the session when it terminated?
@@ -218,10 +232,20 @@ func (t *Topic) proxyMasterResponse(msg *ClusterResp, killTimer *time.Timer) {
 					sess.sessionStoreLock.Unlock()
 
 					killTimer.Stop()
-				} else if len(t.sessions) == 0 {
-					killTimer.Reset(keepAlive)
+				} else {
+					if len(t.sessions) == 0 {
+						killTimer.Reset(keepAlive)
+					}
+					if msg.OrigReqType == ProxyReqMigrate {
+						// The session could not be moved to the new master: tell the client it lost the subscription.
+						sess.presTermDirect([]string{msg.SrvMsg.Ctrl.Topic})
+					}
 				}
 			}
+			if msg.OrigReqType == ProxyReqMigrate && msg.SrvMsg.Ctrl != nil {
+				// The client did not request the subscription, don't forward the response.
+				return
+			}
 		case ProxyReqBroadcast, ProxyReqMeta, ProxyReqCall:
 			// no processing
 		case ProxyReqLeave:
@@ -11,6 +11,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/mock_store"
 	"github.com/tinode/chat/server/store/types"
@@ -2641,6 +2642,85 @@ func TestHandleTopicTermination(t *testing.T) {
 	}
 }
 
+func TestPushForDataNotifyPrefs(t *testing.T) {
+	uids := []types.Uid{types.Uid(1), types.Uid(2), types.Uid(3), types.Uid(4), types.Uid(5)}
+	mode := types.ModeCPublic
+	muteUntil := time.Now().Add(time.Hour)
+	topic := &Topic{
+		name: "grpTest",
+		cat:  types.TopicCatGrp,
+		perUser: map[types.Uid]perUserData{
+			uids[0]: {modeWant: mode, modeGiven: mode},
+			uids[1]: {modeWant: mode, modeGiven: mode,
+				notify: &types.NotifyPrefs{Actions: map[string]bool{push.ActMsg: false}}},
+			uids[2]: {modeWant: mode, modeGiven: mode,
+				notify: &types.NotifyPrefs{MuteUntil: &muteUntil}},
+			uids[3]: {modeWant: mode, modeGiven: mode,
+				notify: &types.NotifyPrefs{MentionsOnly: true}},
+			uids[4]: {modeWant: mode, modeGiven: mode,
+				notify: &types.NotifyPrefs{MentionsOnly: true}},
+		},
+	}
+	data := &MsgServerData{
+		Topic:     "grpTest",
+		From:      uids[0].UserId(),
+		Timestamp: time.Now(),
+		SeqId:     1,
+		Content: map[string]any{
+			"txt": "@five",
+			"fmt": []any{map[string]any{"len": float64(5)}},
+			"ent": []any{map[string]any{"tp": "MN", "data": map[string]any{"val": uids[4].UserId()}}},
+		},
+	}
+
+	rcpt := topic.pushForData(uids[0], data, false)
+	if rcpt == nil || len(rcpt.To) != 5 {
+		t.Fatal("Expected 5 push recipients, got", rcpt)
+	}
+	expected := []push.Recipient{
+		{},
+		{Disabled: true},
+		{Silent: true},
+		{Silent: true},
+		{},
+	}
+	for i, uid := range uids {
+		to := rcpt.To[uid]
+		if to.Disabled != expected[i].Disabled || to.Silent != expected[i].Silent {
+			t.Errorf("Recipient %d: expected disabled=%t silent=%t, got disabled=%t silent=%t", i,
+				expected[i].Disabled, expected[i].Silent, to.Disabled, to.Silent)
+		}
+	}
+}
+
+func TestNotifyPrefsQuietHours(t *testing.T) {
+	prefs := &types.NotifyPrefs{QuietFrom: "22:00", QuietTo: "07:30", TimeZone: "America/New_York"}
+	if err := prefs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	cases := map[string]bool{"21:59": false, "22:00": true, "03:00": true, "07:29": true, "07:30": false, "12:00": false}
+	for hhmm, muted := range cases {
+		tm, _ := time.ParseInLocation("15:04", hhmm, loc)
+		now := time.Date(2024, 3, 1, tm.Hour(), tm.Minute(), 0, 0, loc).UTC()
+		if prefs.IsMuted(now) != muted {
+			t.Errorf("%s: expected muted=%t", hhmm, muted)
+		}
+	}
+
+	invalid := []*types.NotifyPrefs{
+		{QuietFrom: "22:00"},
+		{QuietFrom: "25:00", QuietTo: "07:00"},
+		{TimeZone: "Nowhere/Invalid"},
+		{Actions: map[string]bool{"bogus": false}},
+	}
+	for i, prefs := range invalid {
+		if prefs.Validate() == nil {
+			t.Errorf("Invalid preferences %d passed validation", i)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	logs.Init(os.Stderr, "stdFlags")
 	// Set max subscriber count to effective infinity.
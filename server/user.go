@@ -724,6 +724,14 @@ type UserCacheReq struct {
 	Inc bool
 	// User is being deleted, remove user from cache.
 	Gone bool
+	// Read the user's unread count from the database again (UserId is set) or discard
+	// all cached unread counts (UserId is zero).
+	Recompute bool
+
+	// Unique ID of the unread count increment: lets the owner node drop increments which were resent.
+	IncId string
+	// Time when the unread count increment was issued.
+	IncTs time.Time
 
 	// Optional push notification
 	PushRcpt *push.Receipt
@@ -732,17 +740,25 @@ type UserCacheReq struct {
 type userCacheEntry struct {
 	unread int
 	topics int
+	// Time when the unread counter was last read from the DB.
+	loaded time.Time
 }
 
 // Preserved update entry kept while we read the unread counter from the DB.
 type bufferedUpdate struct {
 	val int
 	inc bool
+	// Time when the increment was issued, could be zero.
+	ts time.Time
 }
 
 type ioResult struct {
-	counts map[types.Uid]int
-	err    error
+	// Users whose counters were read.
+	uids []types.Uid
+	// Time when the read has started.
+	started time.Time
+	counts  map[types.Uid]int
+	err     error
 }
 
 // Represents pending push notification receipt.
@@ -795,15 +811,26 @@ func (pq *pendingReceiptsQueue) fix(index int) {
 }
 
 // Initialize users cache.
-func usersInit() {
+func usersInit(conf *unreadConfig) {
 	globals.usersUpdate = make(chan *UserCacheReq, 1024)
 
-	go userUpdater()
+	node := ""
+	if globals.cluster != nil {
+		node = globals.cluster.thisNodeName
+	}
+	usersJournal = newUnreadJournal(node, usersSendUnread)
+	usersJournalStop = make(chan bool)
+
+	statsRegisterInt("UnreadCountersCorrectedTotal")
+
+	go userUpdater(conf)
+	go usersJournal.run(usersJournalStop)
 }
 
 // Shutdown users cache.
 func usersShutdown() {
 	if globals.usersUpdate != nil {
+		close(usersJournalStop)
 		globals.usersUpdate <- nil
 	}
 }
@@ -814,14 +841,11 @@ func usersUpdateUnread(uid types.Uid, val int, inc bool) {
 	}
 
 	upd := &UserCacheReq{UserId: uid, Unread: val, Inc: inc}
-	if globals.cluster.isRemoteTopic(uid.UserId()) {
-		// Send request to remote node which owns the user.
-		globals.cluster.routeUserReq(upd)
-	} else {
-		select {
-		case globals.usersUpdate <- upd:
-		default:
-		}
+	if inc {
+		// Increments are journaled until the node which owns the user accepts them.
+		usersJournal.submit(upd)
+	} else if err := usersSendUnread(upd); err != nil {
+		logs.Warn.Println("users: failed to send unread count update", uid, err)
 	}
 }
 
@@ -911,27 +935,31 @@ func usersRegisterTopic(t *Topic, add bool) {
 }
 
 // usersRequestFromCluster handles requests which came from other cluser nodes.
-func usersRequestFromCluster(req *UserCacheReq) {
+// Returns false if the request could not be queued.
+func usersRequestFromCluster(req *UserCacheReq) bool {
 	if globals.usersUpdate == nil {
-		return
+		return false
 	}
 
 	select {
 	case globals.usersUpdate <- req:
+		return true
 	default:
+		return false
 	}
 }
 
 var usersCache map[types.Uid]userCacheEntry
 
+// Journal of unread count increments issued by this node.
+var usersJournal *unreadJournal
+var usersJournalStop chan bool
+
 // The go routine for processing updates to users cache.
-func userUpdater() {
+func userUpdater(conf *unreadConfig) {
 	// Caches unread counters and numbers of topics the user's subscribed to.
 	usersCache = make(map[types.Uid]userCacheEntry)
 
-	// Unread counter updates blocked by IO on per user basis. We flush them when the IO completes.
-	perUserBuffers := make(map[types.Uid][]bufferedUpdate)
-
 	// Push notification recipients blocked by IO (unread counters for some of the recipients
 	// are being read from the database) on the per user basis.
 	perUserPendingReceipts := make(map[types.Uid][]*pendingReceipt)
@@ -942,94 +970,34 @@ func userUpdater() {
 	// IO callback queue.
 	ioDone := make(chan *ioResult, 1024)
 
-	unreadUpdater := func(uids []types.Uid, vals []int, inc bool) map[types.Uid]int {
-		var dbPending []types.Uid
-		counts := make(map[types.Uid]int, len(uids))
-		for i, uid := range uids {
-			counts[uid] = 0
-			uce, ok := usersCache[uid]
-			if !ok {
-				logs.Err.Println("ERROR: attempt to update unread count for user who has not been loaded", uid)
-				counts[uid] = unreadUpdateError
-				continue
+	counters := newUnreadCounters(usersCache, conf, func(uids []types.Uid, started time.Time) {
+		go func() {
+			dbUnread, err := store.Users.GetUnreadCount(uids...)
+			if err != nil {
+				logs.Warn.Println("users: failed to load unread count: ", err)
 			}
+			ioDone <- &ioResult{uids: uids, started: started, counts: dbUnread, err: err}
+		}()
+	})
 
-			val := vals[i]
-			if uce.unread < 0 {
-				// Unread counter not initialized yet. Maybe start a DB read?
-				if updateBuf, ioInProgress := perUserBuffers[uid]; ioInProgress {
-					// Buffer this update.
-					updateBuf = append(updateBuf, bufferedUpdate{val: val, inc: inc})
-					perUserBuffers[uid] = updateBuf
-				} else {
-					// Schedule reading the counter from DB.
-					updateBuf = []bufferedUpdate{}
-					perUserBuffers[uid] = updateBuf
-					dbPending = append(dbPending, uid)
-				}
-				counts[uid] = unreadUpdateIOPending
-				continue
-
-			} else if inc {
-				uce.unread += val
-			} else {
-				uce.unread = val
-			}
-
-			usersCache[uid] = uce
-			counts[uid] = uce.unread
-		}
-
-		if len(dbPending) > 0 {
-			go func() {
-				dbUnread, err := store.Users.GetUnreadCount(dbPending...)
-				if err != nil {
-					logs.Warn.Println("users: failed to load unread count: ", err)
-				}
-				ioDone <- &ioResult{counts: dbUnread, err: err}
-			}()
-		}
-
-		return counts
-	}
+	// Reconciliation of cached counters with the DB and eviction of users without topics.
+	reconcileTicker := time.NewTicker(unreadReconcileInterval)
+	defer reconcileTicker.Stop()
+	reconcile := reconcileTicker.C
 
 	for {
 		select {
 		case io := <-ioDone:
 			// Unread counter read has completed.
-			for uid, count := range io.counts {
-				updateBuf, ok := perUserBuffers[uid]
-				// Stop buffering updates. New updates will be handled normally.
-				delete(perUserBuffers, uid)
-				if io.err != nil {
-					continue
-				}
-
-				// Update counter.
-				if ok {
-					for _, upd := range updateBuf {
-						if upd.inc {
-							count += upd.val
-						} else {
-							count = upd.val
-						}
-					}
-				} else {
-					logs.Warn.Println("ERROR: io didn't have an update buffer, uid", uid)
-				}
-
-				if uce, ok := usersCache[uid]; ok {
-					if uce.unread >= 0 {
-						logs.Warn.Println("users: unread count double initialization, uid", uid)
-					}
-					uce.unread = count
-					usersCache[uid] = uce
-				} else {
-					logs.Warn.Println("users: missing users cache entry after IO completion, uid", uid)
-				}
+			counters.loaded(io)
+			if io.err != nil {
+				logs.Err.Println("users: failed to read unread count:", io.err)
+			}
 
+			for _, uid := range io.uids {
 				// Now that the unread counter is initialized, handle pending push notification receipts.
-				// Decrease pending IO counts in pending push receipts for this user.
+				// Decrease pending IO counts in pending push receipts for this user. If the read has failed,
+				// the push is sent without the unread count.
 				if pendingReceipts, ok := perUserPendingReceipts[uid]; ok {
 					for _, pp := range pendingReceipts {
 						pp.pendingIOs--
@@ -1039,11 +1007,6 @@ func userUpdater() {
 				}
 			}
 
-			if io.err != nil {
-				logs.Err.Println("users: failed to read unread count:", io.err)
-				continue
-			}
-
 			// Send ready receipts.
 			for receiptQueue.Len() > 0 && receiptQueue[0].pendingIOs == 0 {
 				rcpt := heap.Pop(&receiptQueue).(*pendingReceipt).rcpt
@@ -1053,7 +1016,7 @@ func userUpdater() {
 						rcpt.To[uid] = rcptTo
 					}
 				}
-				push.Push(rcpt)
+				dispatchPush(rcpt)
 			}
 		case upd := <-globals.usersUpdate:
 			if globals.shuttingDown {
@@ -1085,7 +1048,7 @@ func userUpdater() {
 					allDeltas = append(allDeltas, delta)
 				}
 
-				allUnread := unreadUpdater(allUids, allDeltas, true)
+				allUnread := counters.update(allUids, allDeltas, true, time.Time{})
 				for uid, unread := range allUnread {
 					rcptTo := upd.PushRcpt.To[uid]
 					// Handle update
@@ -1099,7 +1062,7 @@ func userUpdater() {
 
 				if len(pendingUsers) == 0 {
 					// All data present in memory. Just send the push.
-					push.Push(upd.PushRcpt)
+					dispatchPush(upd.PushRcpt)
 				} else {
 					// We are waiting for IO. Add this receipt to the queues.
 					pp := &pendingReceipt{
@@ -1139,10 +1102,11 @@ func userUpdater() {
 							// Remove user from cache
 							delete(usersCache, uid)
 						}
-					} else {
+					} else if globals.cluster == nil {
 						// BUG!
 						logs.Err.Println("ERROR: request to unregister user which has not been registered", uid)
 					}
+					// In a cluster the user could have been registered with another node before rehashing.
 				}
 				continue
 			}
@@ -1153,8 +1117,11 @@ func userUpdater() {
 				continue
 			}
 
-			// Request to update unread count for one user.
-			unreadUpdater([]types.Uid{upd.UserId}, []int{upd.Unread}, upd.Inc)
+			// Request to update or recompute unread count.
+			counters.handle(upd)
+
+		case now := <-reconcile:
+			counters.reconcile(now)
 		}
 	}
 
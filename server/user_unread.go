@@ -0,0 +1,440 @@
+// Consistency of cached counts of unread messages.
+//
+// The node which owns a user (hosts the user's 'me' topic) caches the user's count of unread messages.
+// The count computed by the database (store.Users.GetUnreadCount) is authoritative, the cached value
+// is the database count at the time it was read plus the increments received since then.
+//
+// * Increments carry the time when they were issued. An increment issued before the counter was read
+//   from the database is already reflected in the database count and is ignored. Clocks of cluster
+//   nodes are assumed to be reasonably synchronized.
+// * Increments are recorded in an in-memory journal before they are handed to the owner node and
+//   removed once the owner accepts them. Increments which could not be handed over, for instance
+//   because the owner node failed or its queue was full, are resent periodically. Once the cluster
+//   is rehashed, they are resent to the new owner. The owner drops increments it has already applied
+//   by their IDs. The journal does not survive a restart of the sending node: increments lost this way
+//   are corrected by reconciliation.
+// * Cached counters are periodically reconciled with the database.
+// * A counter can be recomputed on request, including a request from another cluster node.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default time in seconds between reconciliations of a cached counter with the database.
+	defaultUnreadReconcilePeriod = 600
+	// Default maximum number of counters reconciled at once.
+	defaultUnreadReconcileBatch = 100
+	// How often to check for counters due for reconciliation.
+	unreadReconcileInterval = 10 * time.Second
+	// Users without active topics tracked only because of unread count updates are removed
+	// from cache after this time if reconciliation is disabled.
+	unreadUntrackedTTL = 10 * time.Minute
+
+	// Number of IDs of applied increments remembered by the owner node.
+	unreadAppliedIdsSize = 4096
+
+	// How often to resend increments which were not accepted by the owner node.
+	unreadJournalRetryInterval = 5 * time.Second
+	// Increments not accepted for this long are replaced with a request to recompute the counter.
+	unreadJournalMaxAge = 5 * time.Minute
+	// Maximum number of increments in the journal.
+	unreadJournalMaxSize = 10000
+)
+
+// Configuration of unread counters.
+type unreadConfig struct {
+	// Time in seconds between reconciliations of a cached counter with the database.
+	// Default is used if 0, reconciliation is disabled if negative.
+	ReconcilePeriod int `json:"reconcile_period"`
+	// Maximum number of counters reconciled at once.
+	ReconcileBatch int `json:"reconcile_batch"`
+}
+
+// unreadCounters maintains cached counters of users owned by this node.
+// Methods must be called from a single goroutine: userUpdater.
+type unreadCounters struct {
+	// Users cache shared with userUpdater.
+	cache map[types.Uid]userCacheEntry
+	// Updates received while counters are being read from the database, per user.
+	// A user with a buffer has a read in progress.
+	buffers map[types.Uid][]bufferedUpdate
+
+	// IDs of recently applied increments.
+	applied    map[string]struct{}
+	appliedLog []string
+	appliedPos int
+
+	// Starts reading counters from the database. The result must be passed to loaded().
+	load func(uids []types.Uid, started time.Time)
+
+	reconcilePeriod time.Duration
+	reconcileBatch  int
+}
+
+func newUnreadCounters(cache map[types.Uid]userCacheEntry, conf *unreadConfig,
+	load func(uids []types.Uid, started time.Time)) *unreadCounters {
+	c := &unreadCounters{
+		cache:           cache,
+		buffers:         make(map[types.Uid][]bufferedUpdate),
+		applied:         make(map[string]struct{}, unreadAppliedIdsSize),
+		appliedLog:      make([]string, unreadAppliedIdsSize),
+		load:            load,
+		reconcilePeriod: defaultUnreadReconcilePeriod * time.Second,
+		reconcileBatch:  defaultUnreadReconcileBatch,
+	}
+	if conf != nil {
+		if conf.ReconcilePeriod != 0 {
+			c.reconcilePeriod = time.Duration(conf.ReconcilePeriod) * time.Second
+		}
+		if conf.ReconcileBatch > 0 {
+			c.reconcileBatch = conf.ReconcileBatch
+		}
+	}
+	return c
+}
+
+// markApplied remembers the ID of an increment. Returns false if the increment was already applied.
+func (c *unreadCounters) markApplied(id string) bool {
+	if _, ok := c.applied[id]; ok {
+		return false
+	}
+	if old := c.appliedLog[c.appliedPos]; old != "" {
+		delete(c.applied, old)
+	}
+	c.appliedLog[c.appliedPos] = id
+	c.appliedPos = (c.appliedPos + 1) % len(c.appliedLog)
+	c.applied[id] = struct{}{}
+	return true
+}
+
+// update changes the counters of the given users: increments them by vals if inc is true, otherwise
+// sets them to vals. The ts is the time when the increment was issued, could be zero. Returns the
+// updated counters or unreadUpdateIOPending for the counters being read from the database.
+func (c *unreadCounters) update(uids []types.Uid, vals []int, inc bool, ts time.Time) map[types.Uid]int {
+	var dbPending []types.Uid
+	counts := make(map[types.Uid]int, len(uids))
+	for i, uid := range uids {
+		uce, ok := c.cache[uid]
+		if !ok {
+			if globals.cluster == nil {
+				logs.Err.Println("ERROR: attempt to update unread count for user who has not been loaded", uid)
+				counts[uid] = unreadUpdateError
+				continue
+			}
+			// The user's topics were registered with the previous owner of the user before the cluster
+			// was rehashed. Track the user until the counter is reconciled.
+			uce.unread = -1
+		}
+
+		val := vals[i]
+		buffer, reading := c.buffers[uid]
+		if uce.unread < 0 {
+			// Unread counter not initialized yet.
+			if !reading {
+				// Schedule reading the counter from DB.
+				dbPending = append(dbPending, uid)
+			}
+			c.buffers[uid] = append(buffer, bufferedUpdate{val: val, inc: inc, ts: ts})
+			c.cache[uid] = uce
+			counts[uid] = unreadUpdateIOPending
+			continue
+		}
+
+		if inc && !ts.IsZero() && ts.Before(uce.loaded) {
+			// The increment is already reflected in the database count.
+			counts[uid] = uce.unread
+			continue
+		}
+
+		if inc {
+			uce.unread += val
+		} else {
+			uce.unread = val
+		}
+		if reading {
+			// The counter is being reconciled: the update will be applied to the new value too.
+			c.buffers[uid] = append(buffer, bufferedUpdate{val: val, inc: inc, ts: ts})
+		} else if uce.unread < 0 {
+			// The counter has drifted.
+			logs.Warn.Println("users: negative unread count, recomputing, uid", uid)
+			dbPending = append(dbPending, uid)
+		}
+		if uce.unread < 0 {
+			uce.unread = 0
+		}
+
+		c.cache[uid] = uce
+		counts[uid] = uce.unread
+	}
+
+	c.startLoad(dbPending)
+
+	return counts
+}
+
+// startLoad starts reading the counters of the given users from the database.
+func (c *unreadCounters) startLoad(uids []types.Uid) {
+	if len(uids) == 0 {
+		return
+	}
+	for _, uid := range uids {
+		if _, ok := c.buffers[uid]; !ok {
+			c.buffers[uid] = []bufferedUpdate{}
+		}
+	}
+	c.load(uids, time.Now())
+}
+
+// loaded handles completion of reading counters from the database.
+func (c *unreadCounters) loaded(io *ioResult) {
+	for _, uid := range io.uids {
+		buffer := c.buffers[uid]
+		// Stop buffering updates. New updates will be handled normally.
+		delete(c.buffers, uid)
+
+		uce, ok := c.cache[uid]
+		if !ok {
+			logs.Warn.Println("users: missing users cache entry after IO completion, uid", uid)
+			continue
+		}
+		if io.err != nil {
+			// The counter remains uninitialized or keeps the cached value.
+			continue
+		}
+
+		count := io.counts[uid]
+		for _, upd := range buffer {
+			if upd.inc {
+				if !upd.ts.IsZero() && upd.ts.Before(io.started) {
+					// Already counted by the database.
+					continue
+				}
+				count += upd.val
+			} else {
+				count = upd.val
+			}
+		}
+		if count < 0 {
+			count = 0
+		}
+
+		if uce.unread >= 0 && uce.unread != count {
+			logs.Info.Printf("users: unread count of %s corrected %d -> %d", uid.UserId(), uce.unread, count)
+			statsInc("UnreadCountersCorrectedTotal", 1)
+		}
+		uce.unread = count
+		uce.loaded = io.started
+		c.cache[uid] = uce
+	}
+}
+
+// reconcile starts reading from the database the counters which were not read for too long.
+// Users tracked only because of unread count updates are removed from cache instead, even if
+// reconciliation is disabled.
+func (c *unreadCounters) reconcile(now time.Time) {
+	ttl := c.reconcilePeriod
+	if ttl <= 0 {
+		ttl = unreadUntrackedTTL
+	}
+
+	var due []types.Uid
+	for uid, uce := range c.cache {
+		if _, reading := c.buffers[uid]; reading {
+			continue
+		}
+		if uce.topics <= 0 {
+			// The counter failed to load or is not needed anymore.
+			if uce.unread < 0 || now.Sub(uce.loaded) >= ttl {
+				delete(c.cache, uid)
+			}
+			continue
+		}
+		if c.reconcilePeriod <= 0 || uce.unread < 0 || now.Sub(uce.loaded) < c.reconcilePeriod {
+			continue
+		}
+		due = append(due, uid)
+		if len(due) >= c.reconcileBatch {
+			break
+		}
+	}
+	c.startLoad(due)
+}
+
+// handle applies the request to update or to recompute the unread count.
+func (c *unreadCounters) handle(upd *UserCacheReq) {
+	if upd.Recompute {
+		c.recompute(upd.UserId)
+		return
+	}
+
+	// Request to update unread count for one user.
+	if upd.IncId != "" && !c.markApplied(upd.IncId) {
+		// The increment was resent after a failure but has already been applied.
+		return
+	}
+	c.update([]types.Uid{upd.UserId}, []int{upd.Unread}, upd.Inc, upd.IncTs)
+}
+
+// recompute discards the cached counter of the user or of all users if uid is zero.
+// The counters are read from the database again.
+func (c *unreadCounters) recompute(uid types.Uid) {
+	if uid.IsZero() {
+		// Counters are read again when the users receive new messages.
+		for uid, uce := range c.cache {
+			if _, reading := c.buffers[uid]; !reading && uce.unread >= 0 {
+				uce.unread = -1
+				c.cache[uid] = uce
+			}
+		}
+		return
+	}
+
+	uce, ok := c.cache[uid]
+	if !ok || uce.unread < 0 {
+		// Not loaded yet.
+		return
+	}
+	if _, reading := c.buffers[uid]; !reading {
+		c.startLoad([]types.Uid{uid})
+	}
+}
+
+// unreadJournal is the in-memory journal of unread count increments issued by this node.
+type unreadJournal struct {
+	lock sync.Mutex
+	// Prefix of IDs of increments: unique per node and process.
+	prefix string
+	seq    uint64
+	// Increments not yet accepted by the owner nodes.
+	pending map[string]*UserCacheReq
+
+	// Hands the request to the node which owns the user.
+	send func(*UserCacheReq) error
+}
+
+func newUnreadJournal(node string, send func(*UserCacheReq) error) *unreadJournal {
+	return &unreadJournal{
+		prefix:  node + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + ".",
+		pending: make(map[string]*UserCacheReq),
+		send:    send,
+	}
+}
+
+// submit records the increment and hands it to the owner node.
+func (j *unreadJournal) submit(upd *UserCacheReq) {
+	j.lock.Lock()
+	j.seq++
+	upd.IncId = j.prefix + strconv.FormatUint(j.seq, 36)
+	upd.IncTs = time.Now()
+	recorded := len(j.pending) < unreadJournalMaxSize
+	if recorded {
+		j.pending[upd.IncId] = upd
+	}
+	j.lock.Unlock()
+
+	if !recorded {
+		logs.Warn.Println("users: unread journal is full, uid", upd.UserId)
+	}
+
+	if err := j.send(upd); err != nil {
+		logs.Warn.Println("users: failed to send unread count update, will retry:", err)
+		return
+	}
+
+	j.lock.Lock()
+	delete(j.pending, upd.IncId)
+	j.lock.Unlock()
+}
+
+// retry resends the increments which were not accepted. Increments which were not accepted for too long
+// are replaced with requests to recompute the counters.
+func (j *unreadJournal) retry(now time.Time) {
+	j.lock.Lock()
+	pending := make([]*UserCacheReq, 0, len(j.pending))
+	for _, upd := range j.pending {
+		pending = append(pending, upd)
+	}
+	j.lock.Unlock()
+
+	recompute := make(map[types.Uid]bool)
+	for _, upd := range pending {
+		var err error
+		if now.Sub(upd.IncTs) > unreadJournalMaxAge {
+			recompute[upd.UserId] = true
+		} else if err = j.send(upd); err != nil {
+			continue
+		}
+
+		j.lock.Lock()
+		delete(j.pending, upd.IncId)
+		j.lock.Unlock()
+	}
+
+	for uid := range recompute {
+		if err := j.send(&UserCacheReq{UserId: uid, Recompute: true}); err != nil {
+			logs.Warn.Println("users: failed to request unread count recompute", uid, err)
+		}
+	}
+}
+
+// size returns the number of increments not yet accepted.
+func (j *unreadJournal) size() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.pending)
+}
+
+func (j *unreadJournal) run(stop <-chan bool) {
+	ticker := time.NewTicker(unreadJournalRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			j.retry(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// usersSendUnread hands the unread count request to the node which owns the user.
+func usersSendUnread(upd *UserCacheReq) error {
+	if globals.cluster.isRemoteTopic(upd.UserId.UserId()) {
+		// Send request to remote node which owns the user.
+		return globals.cluster.routeUserReq(upd)
+	}
+
+	updates := globals.usersUpdate
+	if updates == nil {
+		return errors.New("users cache is shut down")
+	}
+	select {
+	case updates <- upd:
+		return nil
+	default:
+		return errors.New("users cache queue is full")
+	}
+}
+
+// usersRehashed discards cached counters after the cluster is rehashed: users which have moved to
+// other nodes may have received updates there.
+func usersRehashed() {
+	if globals.usersUpdate == nil {
+		return
+	}
+	select {
+	case globals.usersUpdate <- &UserCacheReq{Recompute: true}:
+	default:
+		logs.Warn.Println("users: failed to discard unread counters after rehashing")
+	}
+}
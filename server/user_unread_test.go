@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// unreadTestDB is the authoritative count of unread messages.
+type unreadTestDB map[types.Uid]int
+
+// unreadTestNode simulates the cluster node which owns users: the cached counters and
+// reads of counters from the database which are completed on demand.
+type unreadTestNode struct {
+	counters *unreadCounters
+	reads    []*ioResult
+	down     bool
+}
+
+func newUnreadTestNode(db unreadTestDB, conf *unreadConfig) *unreadTestNode {
+	n := &unreadTestNode{}
+	n.counters = newUnreadCounters(make(map[types.Uid]userCacheEntry), conf,
+		func(uids []types.Uid, started time.Time) {
+			// The counts are what the database has when the read starts.
+			counts := make(map[types.Uid]int, len(uids))
+			for _, uid := range uids {
+				counts[uid] = db[uid]
+			}
+			n.reads = append(n.reads, &ioResult{uids: uids, started: started, counts: counts})
+		})
+	return n
+}
+
+// register the user as a subscriber of an active topic.
+func (n *unreadTestNode) register(uid types.Uid) {
+	uce, ok := n.counters.cache[uid]
+	if !ok {
+		uce.unread = -1
+	}
+	uce.topics++
+	n.counters.cache[uid] = uce
+}
+
+// receive handles an update with the code used by userUpdater.
+func (n *unreadTestNode) receive(upd *UserCacheReq) {
+	n.counters.handle(upd)
+}
+
+// completeReads finishes pending reads from the database, optionally with an error.
+func (n *unreadTestNode) completeReads(err error) {
+	reads := n.reads
+	n.reads = nil
+	for _, io := range reads {
+		if err != nil {
+			io.counts, io.err = nil, err
+		}
+		n.counters.loaded(io)
+	}
+}
+
+func (n *unreadTestNode) unread(uid types.Uid) int {
+	return n.counters.cache[uid].unread
+}
+
+// unreadTestCluster routes updates from a sender's journal to the current owner node.
+type unreadTestCluster struct {
+	owner *unreadTestNode
+	// The owner applies the update but the response is lost.
+	loseResponse bool
+	sent         []*UserCacheReq
+}
+
+func (c *unreadTestCluster) send(upd *UserCacheReq) error {
+	c.sent = append(c.sent, upd)
+	if c.owner == nil || c.owner.down {
+		return errors.New("node is down")
+	}
+	// The request is copied as it would be by RPC.
+	cp := *upd
+	c.owner.receive(&cp)
+	if c.loseResponse {
+		return errors.New("timeout")
+	}
+	return nil
+}
+
+// New messages must be counted once: either by the database or by the increment.
+func TestUnreadCountersLoadRace(t *testing.T) {
+	uid := types.Uid(1)
+	db := unreadTestDB{uid: 3}
+	node := newUnreadTestNode(db, nil)
+	node.register(uid)
+
+	// A message is saved, then the increment is issued.
+	db[uid]++
+	early := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// The first increment triggers a read.
+	node.receive(&UserCacheReq{UserId: uid, Unread: 1, Inc: true, IncTs: early})
+	if node.unread(uid) != -1 || len(node.reads) != 1 {
+		t.Fatalf("expected a pending read, unread %d, reads %d", node.unread(uid), len(node.reads))
+	}
+	time.Sleep(time.Millisecond)
+
+	// Another message saved before the read started, its increment delayed.
+	node.receive(&UserCacheReq{UserId: uid, Unread: 1, Inc: true, IncTs: early})
+	// A message saved after the read.
+	node.receive(&UserCacheReq{UserId: uid, Unread: 1, Inc: true, IncTs: time.Now()})
+
+	node.completeReads(nil)
+	if got := node.unread(uid); got != 5 {
+		t.Errorf("expected 5 unread, got %d", got)
+	}
+
+	// Increment issued before the counter was read and delivered late is ignored.
+	node.receive(&UserCacheReq{UserId: uid, Unread: 1, Inc: true, IncTs: early})
+	if got := node.unread(uid); got != 5 {
+		t.Errorf("stale increment applied: %d", got)
+	}
+
+	// Failed read leaves the counter uninitialized and does not block later reads.
+	other := types.Uid(2)
+	node.register(other)
+	node.receive(&UserCacheReq{UserId: other, Unread: 1, Inc: true})
+	node.completeReads(errors.New("db failure"))
+	if node.unread(other) != -1 || len(node.counters.buffers) != 0 {
+		t.Fatalf("failed read left state: unread %d, buffers %d", node.unread(other), len(node.counters.buffers))
+	}
+	node.receive(&UserCacheReq{UserId: other, Unread: 1, Inc: true})
+	if len(node.reads) != 1 {
+		t.Error("read not restarted after a failure")
+	}
+}
+
+// The owner node fails in the middle of an update.
+func TestUnreadNodeFailure(t *testing.T) {
+	uid := types.Uid(1)
+	db := unreadTestDB{uid: 0}
+
+	nodeA := newUnreadTestNode(db, nil)
+	nodeA.register(uid)
+	nodeA.counters.startLoad([]types.Uid{uid})
+	nodeA.completeReads(nil)
+	time.Sleep(time.Millisecond)
+
+	cluster := &unreadTestCluster{owner: nodeA}
+	journal := newUnreadJournal("sender", cluster.send)
+
+	// Normal delivery.
+	db[uid]++
+	journal.submit(&UserCacheReq{UserId: uid, Unread: 1, Inc: true})
+	if nodeA.unread(uid) != 1 || journal.size() != 0 {
+		t.Fatalf("unexpected state: unread %d, journal %d", nodeA.unread(uid), journal.size())
+	}
+
+	// The owner applies the increment but the response is lost.
+	db[uid]++
+	cluster.loseResponse = true
+	journal.submit(&UserCacheReq{UserId: uid, Unread: 1, Inc: true})
+	cluster.loseResponse = false
+	if journal.size() != 1 {
+		t.Fatalf("unacknowledged increment must stay in the journal")
+	}
+	// Resent increment is not applied twice.
+	journal.retry(time.Now())
+	if nodeA.unread(uid) != 2 || journal.size() != 0 {
+		t.Fatalf("resent increment: unread %d, journal %d", nodeA.unread(uid), journal.size())
+	}
+
+	// The owner crashes. The increment cannot be delivered.
+	nodeA.down = true
+	db[uid]++
+	journal.submit(&UserCacheReq{UserId: uid, Unread: 1, Inc: true})
+	if journal.size() != 1 {
+		t.Fatal("undelivered increment must stay in the journal")
+	}
+	time.Sleep(time.Millisecond)
+
+	// The cluster is rehashed, node B owns the user now. The user's topics register with node B.
+	nodeB := newUnreadTestNode(db, nil)
+	nodeB.register(uid)
+	cluster.owner = nodeB
+
+	// A new message arrives and triggers a read at node B.
+	time.Sleep(time.Millisecond)
+	db[uid]++
+	journal.submit(&UserCacheReq{UserId: uid, Unread: 1, Inc: true})
+	time.Sleep(time.Millisecond)
+	// The journaled increment is resent while the counter is being read.
+	journal.retry(time.Now())
+	if journal.size() != 0 {
+		t.Fatalf("journal not drained: %d", journal.size())
+	}
+
+	nodeB.completeReads(nil)
+	if got, want := nodeB.unread(uid), db[uid]; got != want {
+		t.Errorf("after failover expected %d unread, got %d", want, got)
+	}
+
+	// Increments which cannot be delivered for too long are replaced with a recompute request.
+	nodeB.down = true
+	journal.submit(&UserCacheReq{UserId: uid, Unread: 1, Inc: true})
+	nodeB.down = false
+	cluster.sent = nil
+	journal.retry(time.Now().Add(unreadJournalMaxAge + time.Second))
+	if journal.size() != 0 || len(cluster.sent) != 1 || !cluster.sent[0].Recompute {
+		t.Fatalf("expired increment not replaced: journal %d, sent %+v", journal.size(), cluster.sent)
+	}
+	if len(nodeB.reads) != 1 {
+		t.Error("recompute did not start a read")
+	}
+}
+
+func TestUnreadReconcile(t *testing.T) {
+	uid := types.Uid(1)
+	db := unreadTestDB{uid: 7}
+	node := newUnreadTestNode(db, &unreadConfig{ReconcilePeriod: 60, ReconcileBatch: 10})
+	node.register(uid)
+	node.counters.startLoad([]types.Uid{uid})
+	node.completeReads(nil)
+
+	// The cached counter drifts.
+	uce := node.counters.cache[uid]
+	uce.unread = 2
+	node.counters.cache[uid] = uce
+
+	node.counters.reconcile(time.Now())
+	if len(node.reads) != 0 {
+		t.Fatal("counter reconciled too early")
+	}
+	node.counters.reconcile(time.Now().Add(2 * time.Minute))
+	if len(node.reads) != 1 {
+		t.Fatal("counter not reconciled")
+	}
+
+	// Updates during reconciliation are applied to both values.
+	time.Sleep(time.Millisecond)
+	node.receive(&UserCacheReq{UserId: uid, Unread: 1, Inc: true, IncTs: time.Now()})
+	if node.unread(uid) != 3 {
+		t.Errorf("update during reconciliation not applied: %d", node.unread(uid))
+	}
+	node.completeReads(nil)
+	if node.unread(uid) != 8 {
+		t.Errorf("expected 8 unread after reconciliation, got %d", node.unread(uid))
+	}
+
+	// Negative counter is recomputed.
+	node.receive(&UserCacheReq{UserId: uid, Unread: -20, Inc: true})
+	if node.unread(uid) != 0 || len(node.reads) != 1 {
+		t.Errorf("negative counter: unread %d, reads %d", node.unread(uid), len(node.reads))
+	}
+	node.completeReads(nil)
+
+	// Rehashing discards all counters.
+	node.receive(&UserCacheReq{Recompute: true})
+	if node.unread(uid) != -1 {
+		t.Error("counter not discarded")
+	}
+}
+
+// Users tracked only because of unread count updates are evicted even if reconciliation is disabled.
+func TestUnreadEvictUntracked(t *testing.T) {
+	globals.cluster = &Cluster{thisNodeName: "one"}
+	defer func() { globals.cluster = nil }()
+
+	loaded, failed, active := types.Uid(1), types.Uid(2), types.Uid(3)
+	db := unreadTestDB{loaded: 3, failed: 4, active: 5}
+	node := newUnreadTestNode(db, &unreadConfig{ReconcilePeriod: -1})
+	node.register(active)
+	node.counters.startLoad([]types.Uid{active})
+	node.completeReads(nil)
+
+	// The users' topics were registered with the previous owner.
+	node.receive(&UserCacheReq{UserId: loaded, Unread: 1, Inc: true, IncTs: time.Now()})
+	node.completeReads(nil)
+	node.receive(&UserCacheReq{UserId: failed, Unread: 1, Inc: true, IncTs: time.Now()})
+	node.completeReads(errors.New("failed"))
+
+	// Failed counter is evicted right away.
+	node.counters.reconcile(time.Now())
+	if _, ok := node.counters.cache[failed]; ok {
+		t.Error("counter which failed to load must be evicted")
+	}
+	if _, ok := node.counters.cache[loaded]; !ok {
+		t.Error("recently loaded counter must be kept")
+	}
+
+	node.counters.reconcile(time.Now().Add(unreadUntrackedTTL))
+	if _, ok := node.counters.cache[loaded]; ok {
+		t.Error("untracked counter must be evicted")
+	}
+	if _, ok := node.counters.cache[active]; !ok || len(node.reads) != 0 {
+		t.Error("user with topics must be kept and not reconciled")
+	}
+}
+
+// The owner rejects the increment it cannot queue, so the sender keeps it in the journal.
+func TestUnreadOwnerQueueFull(t *testing.T) {
+	globals.usersUpdate = make(chan *UserCacheReq, 1)
+	defer func() { globals.usersUpdate = nil }()
+
+	c := &Cluster{}
+	var rejected bool
+	if err := c.UserCacheUpdate(&UserCacheReq{UserId: types.Uid(1), Unread: 1, Inc: true}, &rejected); err != nil || rejected {
+		t.Fatalf("request not accepted: %v, rejected %v", err, rejected)
+	}
+	if err := c.UserCacheUpdate(&UserCacheReq{UserId: types.Uid(1), Unread: 1, Inc: true}, &rejected); err != nil || !rejected {
+		t.Errorf("request must be rejected when the queue is full: %v, rejected %v", err, rejected)
+	}
+}
@@ -393,6 +393,11 @@ func (v *validator) TempAuthScheme() (string, error) {
 	return "code", nil
 }
 
+// SendMail sends an email message using validator's SMTP settings.
+func (v *validator) SendMail(to string, content map[string]string) error {
+	return v.send(to, content)
+}
+
 // SendMail replacement
 func (v *validator) sendMail(rcpt []string, msg []byte) error {
 	client, err := smtp.Dial(v.SMTPAddr + ":" + v.SMTPPort)
@@ -58,6 +58,13 @@ type Validator interface {
 	TempAuthScheme() (string, error)
 }
 
+// Mailer is an optional interface implemented by validators which can send arbitrary email messages.
+type Mailer interface {
+	// SendMail sends a message to the given email address. The content must contain the 'subject'
+	// and at least one of 'body_plain' or 'body_html'.
+	SendMail(to string, content map[string]string) error
+}
+
 func ValidateHostURL(origUrl string) (string, error) {
 	hostUrl, err := url.Parse(origUrl)
 	if err != nil {
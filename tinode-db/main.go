@@ -25,6 +25,12 @@ import (
 
 type configType struct {
 	StoreConfig json.RawMessage `json:"store_config"`
+	Media       *mediaConfig    `json:"media"`
+}
+
+// Media handler config: the same as in the server config file.
+type mediaConfig struct {
+	Handlers map[string]json.RawMessage `json:"handlers"`
 }
 
 type theCard struct {
@@ -199,6 +205,8 @@ func main() {
 	makeRoot := flag.String("make_root", "", "promote ordinary user to ROOT, auth scheme 'basic'")
 	datafile := flag.String("data", "", "name of file with sample data to load")
 	conffile := flag.String("config", "./tinode.conf", "config of the database connection")
+	rotateKey := flag.String("rotate_media_key", "",
+		"re-encrypt keys of media files with the given base64-encoded master key")
 
 	flag.Parse()
 
@@ -352,6 +360,11 @@ func main() {
 		log.Printf("ROOT user created: '%s:%s'", uname, password)
 	}
 
+	// Rotate master key of media files encrypted at rest.
+	if *rotateKey != "" {
+		rotateMediaKey(config.Media, *rotateKey)
+	}
+
 	log.Println("All done.")
 
 	os.Exit(0)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/tinode/chat/server/media/fs"
+	"github.com/tinode/chat/server/store"
+)
+
+// Number of file records to process in one batch.
+const rotateBatchSize = 256
+
+// Config of the 'fs' media handler: only the encryption keys are needed here.
+type fsMediaConfig struct {
+	EncryptionKey  []byte   `json:"encryption_key"`
+	DecryptionKeys [][]byte `json:"decryption_keys"`
+}
+
+// rotateMediaKey re-encrypts data keys of the files stored by the 'fs' media handler with the new master key.
+// The current keys are taken from the config. The files themselves are not re-encrypted. The rotation can
+// be safely restarted if interrupted: keys already encrypted with the new key are skipped.
+func rotateMediaKey(conf *mediaConfig, newKeyB64 string) {
+	newKey, err := base64.StdEncoding.DecodeString(newKeyB64)
+	if err != nil {
+		log.Fatalln("Media key rotation: new key must be base64-encoded:", err)
+	}
+	if len(newKey) != 32 {
+		log.Fatalln("Media key rotation: new key must be 32 bytes long, got", len(newKey))
+	}
+	newKeyId := fs.KeyId(newKey)
+
+	if conf == nil || conf.Handlers["fs"] == nil {
+		log.Fatalln("Media key rotation: config of the 'fs' media handler not found")
+	}
+
+	var fsConf fsMediaConfig
+	if err := json.Unmarshal(conf.Handlers["fs"], &fsConf); err != nil {
+		log.Fatalln("Media key rotation: failed to parse 'fs' media config:", err)
+	}
+	// Master keys which may have encrypted the data keys, by key ID.
+	oldKeys := make(map[string][]byte)
+	for _, key := range append(fsConf.DecryptionKeys, fsConf.EncryptionKey) {
+		if len(key) > 0 {
+			oldKeys[fs.KeyId(key)] = key
+		}
+	}
+	if len(oldKeys) == 0 {
+		log.Fatalln("Media key rotation: current encryption key is not configured")
+	}
+
+	adapter := store.Store.GetAdapter()
+	var rotated, skipped int
+	var afterId string
+	for {
+		fds, err := adapter.FileGetEncrypted(afterId, rotateBatchSize)
+		if err != nil {
+			log.Fatalln("Media key rotation: failed to read file records:", err)
+		}
+
+		for i := range fds {
+			fd := &fds[i]
+			afterId = fd.Id
+
+			keyId := fs.WrappedKeyId(fd.EncKey)
+			if keyId == newKeyId {
+				// Rotated in an earlier interrupted run or uploaded with the new key.
+				skipped++
+				continue
+			}
+			oldKey := oldKeys[keyId]
+			if oldKey == nil {
+				log.Fatalf("Media key rotation: key '%s' of file '%s' is not configured", keyId, fd.Id)
+			}
+
+			wrapped, err := fs.RewrapDataKey(fd.Id, fd.EncKey, oldKey, newKey)
+			if err != nil {
+				log.Fatalf("Media key rotation: failed to decrypt key of file '%s': %s", fd.Id, err)
+			}
+
+			if err = adapter.FileUpdateEncKey(fd.Id, wrapped); err != nil {
+				log.Fatalf("Media key rotation: failed to update file '%s': %s", fd.Id, err)
+			}
+			rotated++
+		}
+
+		if len(fds) < rotateBatchSize {
+			break
+		}
+	}
+
+	log.Printf("Media key rotation: %d keys rotated, %d already rotated.", rotated, skipped)
+}